@@ -0,0 +1,27 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/pennsieve/pennsieve-upload-service-v2/storage"
+	"github.com/pennsieve/pennsieve-upload-service-v2/storage/localbackend"
+	"github.com/pennsieve/pennsieve-upload-service-v2/storage/s3backend"
+	"os"
+)
+
+// newStorageBackend returns the backend named by STORAGE_BACKEND: S3 by default, or directories below
+// LOCAL_STORAGE_ROOT for on-prem installs and local end-to-end tests.
+func newStorageBackend(cfg aws.Config) (storage.StorageBackend, error) {
+	backendType, err := storage.ParseBackendType(os.Getenv("STORAGE_BACKEND"))
+	if err != nil {
+		return nil, err
+	}
+	if backendType == storage.BackendLocal {
+		return localbackend.New(os.Getenv("LOCAL_STORAGE_ROOT"))
+	}
+	client := s3.NewFromConfig(cfg)
+	return s3backend.New(client, s3backend.Options{
+		Region:        s3backend.NewRegionCache(client).Region,
+		DefaultRegion: cfg.Region,
+	}), nil
+}
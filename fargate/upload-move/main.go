@@ -4,7 +4,6 @@ import (
 	"context"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/pennsieve/pennsieve-upload-service-v2/upload-move-files/pkg/pgmanager"
 	log "github.com/sirupsen/logrus"
 	"os"
@@ -51,17 +50,20 @@ func main() {
 
 	FileTableName = os.Getenv("FILES_TABLE")
 	TableName = os.Getenv("MANIFEST_TABLE")
+	uploadBucket = os.Getenv("UPLOAD_BUCKET")
+	defaultStorageBucket = os.Getenv("STORAGE_BUCKET")
 
 	pgManager, err := pgmanager.New(pgmanager.NewDBApi, false)
 	if err != nil {
 		log.Fatalf("error creating pgManager: %v", err)
 	}
-	store := NewUploadMoveStore(pgManager, dynamodb.NewFromConfig(cfg), s3.NewFromConfig(cfg))
+	backend, err := newStorageBackend(cfg)
+	if err != nil {
+		log.Fatalf("error creating storage backend: %v", err)
+	}
+	store := NewUploadMoveStore(pgManager, dynamodb.NewFromConfig(cfg), backend)
 	defer store.Close()
 
-	uploadBucket = os.Getenv("UPLOAD_BUCKET")
-	defaultStorageBucket = os.Getenv("STORAGE_BUCKET")
-
 	walker := make(fileWalk)
 
 	// Walk over all files in IMPORTED status and make available on channel for processors.
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/pennsieve/pennsieve-go-core/pkg/models/dydb"
+	"github.com/pennsieve/pennsieve-go-core/pkg/queries/pgdb"
+	"github.com/pennsieve/pennsieve-upload-service-v2/storage"
+)
+
+// storageSource implements storage.Source with the Fargate task's pennsieve-go-core queries.
+type storageSource struct {
+	dy *dynamodb.Client
+	db pgdb.DBTX
+}
+
+// Manifest returns storage.ErrManifestNotFound when the manifest table has no item for manifestId.
+func (s storageSource) Manifest(ctx context.Context, manifestId string) (storage.Manifest, error) {
+	out, err := s.dy.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(TableName),
+		Key: map[string]types.AttributeValue{
+			"ManifestId": &types.AttributeValueMemberS{Value: manifestId},
+		},
+	})
+	if err != nil {
+		return storage.Manifest{}, fmt.Errorf("get manifest %s: %w", manifestId, err)
+	}
+	if out.Item == nil {
+		return storage.Manifest{}, storage.ErrManifestNotFound
+	}
+	var manifest dydb.ManifestTable
+	if err := attributevalue.UnmarshalMap(out.Item, &manifest); err != nil {
+		return storage.Manifest{}, fmt.Errorf("unmarshal manifest %s: %w", manifestId, err)
+	}
+	return storage.Manifest{
+		ManifestId:     manifest.ManifestId,
+		OrganizationId: manifest.OrganizationId,
+		DatasetId:      manifest.DatasetId,
+		DateCreated:    manifest.DateCreated,
+	}, nil
+}
+
+func (s storageSource) DatasetBucket(ctx context.Context, organizationId int64, datasetId int64) (string, bool, error) {
+	return storage.QueryDatasetBucket(ctx, s.db, organizationId, datasetId)
+}
+
+func (s storageSource) OrganizationBucket(ctx context.Context, organizationId int64) (string, bool, error) {
+	org, err := pgdb.New(s.db).GetOrganization(ctx, organizationId)
+	if err != nil {
+		return "", false, err
+	}
+	return org.StorageBucket.String, org.StorageBucket.Valid, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/pennsieve/pennsieve-upload-service-v2/storage"
+	"io"
+)
+
+// errSHA256Mismatch is returned when the copied object does not hash to the
+// SHA256 S3 stored for the source object in the upload bucket.
+var errSHA256Mismatch = errors.New("sha256 mismatch after copy")
+
+// recordLegacySHA256 hashes a file that came through the legacy upload bucket
+// once it has been copied to storage, and records the value in
+// file_server_sha256. Nothing verifies the content of these uploads before
+// this point. When S3 stored a full-object SHA256 for the source, the copy is
+// compared against it and a difference returns errSHA256Mismatch.
+func (s *UploadMoveStore) recordLegacySHA256(stOrgItem *storageOrgItem, targetPath string, uploadId string, source storage.ObjectChecksum) error {
+	ctx := context.Background()
+
+	body, err := s.backend.Open(ctx, stOrgItem.storageBucket, targetPath)
+	if err != nil {
+		return fmt.Errorf("get object %s: %w", targetPath, err)
+	}
+	defer body.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, body); err != nil {
+		return fmt.Errorf("read object %s: %w", targetPath, err)
+	}
+	computed := base64.StdEncoding.EncodeToString(h.Sum(nil))
+
+	// A composite ("<base64>-<parts>") checksum can't be compared with a hash
+	// of the whole object.
+	var declared *string
+	var verified *bool
+	if source.Algorithm == "SHA256" && source.Type == "FULL_OBJECT" && source.Value != "" {
+		match := computed == source.Value
+		declared, verified = &source.Value, &match
+	}
+
+	db, err := s.pgManager.DB()
+	if err != nil {
+		return fmt.Errorf("error accessing DB for sha256 record: %w", err)
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer tx.Rollback()
+
+	if _, err = tx.ExecContext(ctx, fmt.Sprintf("SET LOCAL search_path = \"%d\";", stOrgItem.organizationId)); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO file_server_sha256 (file_id, sha256, declared_sha256, verified, computed_by) "+
+			"SELECT id, $2, $3, $4, 'upload-move' FROM files WHERE uuid = $1 "+
+			"ON CONFLICT (file_id) DO NOTHING;",
+		uploadId, computed, declared, verified)
+	if err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	if verified != nil && !*verified {
+		return fmt.Errorf("%w: expected %s, got %s", errSHA256Mismatch, *declared, computed)
+	}
+	return nil
+}
@@ -8,12 +8,11 @@ import (
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/pennsieve/pennsieve-go-core/pkg/models/manifest/manifestFile"
 	"github.com/pennsieve/pennsieve-go-core/pkg/models/pgdb"
 	dyQueries "github.com/pennsieve/pennsieve-go-core/pkg/queries/dydb"
 	pgQeuries "github.com/pennsieve/pennsieve-go-core/pkg/queries/pgdb"
-	"github.com/pennsieve/pennsieve-upload-service-v2/upload-move-files/pkg"
+	"github.com/pennsieve/pennsieve-upload-service-v2/storage"
 	"github.com/pennsieve/pennsieve-upload-service-v2/upload-move-files/pkg/pgmanager"
 	log "github.com/sirupsen/logrus"
 	"time"
@@ -21,21 +20,24 @@ import (
 
 // UploadMoveStore provides the Queries interface and a db instance.
 type UploadMoveStore struct {
-	pgManager           *pgmanager.PgManager
-	dy                  *dyQueries.Queries
-	dydb                *dynamodb.Client
-	s3                  *s3.Client
-	storageOrgItemCache *StorageOrgItemCache
+	pgManager *pgmanager.PgManager
+	dy        *dyQueries.Queries
+	dydb      *dynamodb.Client
+	backend   storage.StorageBackend
+	resolver  *storage.Resolver
 }
 
 // NewUploadMoveStore returns a NewUploadMoveStore object which implements the Queries
-func NewUploadMoveStore(pgManager *pgmanager.PgManager, dydb *dynamodb.Client, s3 *s3.Client) *UploadMoveStore {
+func NewUploadMoveStore(pgManager *pgmanager.PgManager, dydb *dynamodb.Client, backend storage.StorageBackend) *UploadMoveStore {
 	return &UploadMoveStore{
-		pgManager:           pgManager,
-		dydb:                dydb,
-		dy:                  dyQueries.New(dydb),
-		s3:                  s3,
-		storageOrgItemCache: NewStorageItemCache(DefaultStorageOrgItemQuery),
+		pgManager: pgManager,
+		dydb:      dydb,
+		dy:        dyQueries.New(dydb),
+		backend:   backend,
+		resolver: storage.NewResolver(storage.Config{
+			DefaultBucket: defaultStorageBucket,
+			Backend:       backend.Type(),
+		}),
 	}
 }
 
@@ -62,13 +64,21 @@ func (s *UploadMoveStore) execPgTx(ctx context.Context, fn func(*pgQeuries.Queri
 	return tx.Commit()
 }
 
-// GetManifestStorageBucket returns the storage bucket associated with organization for manifest.
+// GetManifestStorageBucket returns the storage bucket associated with the manifest's dataset or organization.
 func (s *UploadMoveStore) GetManifestStorageBucket(manifestId string) (*storageOrgItem, error) {
-	pg, err := s.pgManager.Queries()
+	db, err := s.pgManager.DB()
+	if err != nil {
+		return nil, fmt.Errorf("error getting pg db for storageOrgItem lookup: %w", err)
+	}
+	resolution, err := s.resolver.Resolve(context.Background(), storageSource{dy: s.dydb, db: db}, manifestId)
 	if err != nil {
-		return nil, fmt.Errorf("error getting pg queries for storageOrgItem lookup: %w", err)
+		return nil, fmt.Errorf("error loading item for manifestId %s: %w", manifestId, err)
 	}
-	return s.storageOrgItemCache.GetOrLoad(manifestId, s.dy, pg)
+	return &storageOrgItem{
+		organizationId: resolution.OrganizationId,
+		storageBucket:  resolution.StorageBucket,
+		datasetId:      resolution.DatasetId,
+	}, nil
 }
 
 // manifestFileWalk paginates results from dynamodb manifest files table and put items on channel.
@@ -186,12 +196,8 @@ func (s *UploadMoveStore) moveFile(workerId int, timeout time.Duration, items <-
 		sourcePath := fmt.Sprintf("%s/%s/%s", uploadBucket, item.ManifestId, item.UploadId)
 		targetPath := fmt.Sprintf("O%d/D%d/%s/%s", stOrgItem.organizationId, stOrgItem.datasetId, item.ManifestId, item.UploadId)
 
-		// Get File Size
-		headObj := s3.HeadObjectInput{
-			Bucket: aws.String(uploadBucket),
-			Key:    aws.String(sourceKey),
-		}
-		result, err := s.s3.HeadObject(context.Background(), &headObj)
+		// Check the upload exists, and get the SHA256 S3 stored for it if the client sent one.
+		source, err := s.backend.Stat(context.Background(), uploadBucket, sourceKey)
 		if err != nil {
 			log.WithFields(
 				log.Fields{
@@ -206,36 +212,21 @@ func (s *UploadMoveStore) moveFile(workerId int, timeout time.Duration, items <-
 			continue
 		}
 
-		// Copy File
-		fileSize := result.ContentLength           // size in bytes
-		const maxFileSize = 5 * 1000 * 1000 * 1000 // 5GiB (real limit is 5GB but want to be conservative)
-		if fileSize < maxFileSize {
-			err = s.simpleCopyFile(stOrgItem, sourcePath, targetPath)
-			if err != nil {
-				log.Error(fmt.Sprintf("Unable to copy item from  %s to %s, %v\n", sourcePath, targetPath, err))
-				err = s.dy.UpdateFileTableStatus(context.Background(), FileTableName, item.ManifestId, item.UploadId, manifestFile.Failed, err.Error())
-				if err != nil {
-					log.Error("Error updating Dynamodb status: ", err)
-					continue
-				}
-				continue
-			} else {
-				moveSuccess = true
-			}
-		} else {
-			err = pkg.MultiPartCopy(s.s3, timeout, fileSize, uploadBucket, sourceKey, stOrgItem.storageBucket, targetPath)
+		// Copy File. The backend switches to a multipart copy for objects over 5GB.
+		log.Debug("Copy: ", sourcePath, " to: ", stOrgItem.storageBucket, ":", targetPath)
+		copyCtx, cancel := context.WithTimeout(context.Background(), timeout)
+		err = s.backend.Copy(copyCtx, uploadBucket, sourceKey, stOrgItem.storageBucket, targetPath)
+		cancel()
+		if err != nil {
+			log.Error(fmt.Sprintf("Unable to copy item from  %s to %s, %v\n", sourcePath, targetPath, err))
+			err = s.dy.UpdateFileTableStatus(context.Background(), FileTableName, item.ManifestId, item.UploadId, manifestFile.Failed, err.Error())
 			if err != nil {
-				log.Error(fmt.Sprintf("Unable to copy item from  %s to %s, %v\n", sourcePath, targetPath, err))
-				err = s.dy.UpdateFileTableStatus(context.Background(), FileTableName, item.ManifestId, item.UploadId, manifestFile.Failed, err.Error())
-				if err != nil {
-					log.Error("Error updating Dynamodb status: ", err)
-					continue
-				}
+				log.Error("Error updating Dynamodb status: ", err)
 				continue
-			} else {
-				moveSuccess = true
 			}
+			continue
 		}
+		moveSuccess = true
 
 		log.WithFields(
 			log.Fields{
@@ -292,13 +283,32 @@ func (s *UploadMoveStore) moveFile(workerId int, timeout time.Duration, items <-
 			moveSuccess = false
 		}
 
+		// Hash the copy before the upload is deleted, so a mismatch leaves
+		// the source in place for the operator.
+		if moveSuccess && updatedStatus == manifestFile.Finalized {
+			err = s.recordLegacySHA256(stOrgItem, targetPath, item.UploadId, source.Checksum)
+			if errors.Is(err, errSHA256Mismatch) {
+				log.WithFields(
+					log.Fields{
+						"manifest_id": item.ManifestId,
+						"upload_id":   item.UploadId,
+					}).Error(err.Error())
+
+				updatedStatus = manifestFile.Failed
+				updatedMessage = err.Error()
+				moveSuccess = false
+			} else if err != nil {
+				log.WithFields(
+					log.Fields{
+						"manifest_id": item.ManifestId,
+						"upload_id":   item.UploadId,
+					}).Warn("unable to record sha256 for moved file: ", err)
+			}
+		}
+
 		// Deleting item in Uploads Folder if successfully moved to final location.
 		if moveSuccess == true {
-			deleteParams := s3.DeleteObjectInput{
-				Bucket: aws.String(uploadBucket),
-				Key:    aws.String(fmt.Sprintf("%s/%s", item.ManifestId, item.UploadId)),
-			}
-			_, err = s.s3.DeleteObject(context.Background(), &deleteParams)
+			err = s.backend.Delete(context.Background(), uploadBucket, sourceKey)
 			if err != nil {
 				log.WithFields(
 					log.Fields{
@@ -322,34 +332,6 @@ func (s *UploadMoveStore) moveFile(workerId int, timeout time.Duration, items <-
 	}
 }
 
-// simpleCopyFile copy files between buckets using simple file copy method.
-func (s *UploadMoveStore) simpleCopyFile(stOrgItem *storageOrgItem, sourcePath string, targetPath string) error {
-	// Copy the item
-
-	log.Debug("Simple copy: ", sourcePath, " to: ", stOrgItem.storageBucket, ":", targetPath)
-
-	params := s3.CopyObjectInput{
-		Bucket:     aws.String(stOrgItem.storageBucket),
-		CopySource: aws.String(sourcePath),
-		Key:        aws.String(targetPath),
-	}
-
-	region, exists := pkg.GetRegion(stOrgItem.storageBucket)
-	if !exists {
-		return errors.New(fmt.Sprintf("Could not determine region from bucket name %s", stOrgItem.storageBucket))
-	}
-	options := func(o *s3.Options) {
-		o.Region = region.RegionCode
-	}
-
-	_, err := s.s3.CopyObject(context.Background(), &params, options)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
 func (s *UploadMoveStore) Close() {
 	if err := s.pgManager.Close(); err != nil {
 		log.Warn("error closing pgManager: ", err)
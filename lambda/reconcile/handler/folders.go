@@ -0,0 +1,360 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pennsieve/pennsieve-go-core/pkg/changelog"
+	log "github.com/sirupsen/logrus"
+)
+
+// MergeFoldersJob asks for the duplicate folders of a dataset to be merged.
+// Concurrent upload lambdas used to create the same new folder side by side
+// (two "data" folders under one parent); the upload lambda now serializes
+// folder creation, and this job repairs the duplicates created before.
+// UserNodeID is the user the activity log events and package deletions are
+// attributed to; it is required unless the job is a dry run.
+type MergeFoldersJob struct {
+	OrganizationID int64  `json:"organizationId"`
+	DatasetID      int64  `json:"datasetId"`
+	UserNodeID     string `json:"userNodeId"`
+}
+
+// MergeFoldersResult is the outcome of a MergeFoldersJob.
+type MergeFoldersResult struct {
+	// Groups is the number of (parent, name) slots that held more than one
+	// folder, including slots that only became duplicated by an earlier merge.
+	Groups int `json:"groups"`
+	// Merged is the number of duplicate folders folded into the oldest folder
+	// of their slot and soft-deleted.
+	Merged int `json:"merged"`
+	// Renamed is the number of packages renamed because the surviving folder
+	// already had a package of the same name.
+	Renamed int `json:"renamed"`
+}
+
+// maxMergePasses bounds the merge loop. Merging two folders can duplicate
+// their same-named subfolders, so each pass repairs one more level.
+const maxMergePasses = 100
+
+// duplicateFolder is a folder sharing its (parent, name) slot with another.
+type duplicateFolder struct {
+	id       int64
+	nodeID   string
+	parentID sql.NullInt64
+	name     string
+	// parent is the folder above, nil at the dataset root.
+	parent *changelog.ParentPackage
+}
+
+// folderMergeEvent is the eventDetail of the DELETE_PACKAGE event for a
+// duplicate folder merged into the survivor of its slot. It follows the
+// upload lambda's delete event, with MergedInto in place of ReplacedBy.
+type folderMergeEvent struct {
+	Id         int64                    `json:"id"`
+	Name       string                   `json:"name"`
+	NodeId     string                   `json:"nodeId"`
+	Parent     *changelog.ParentPackage `json:"parent"`
+	MergedInto *changelog.ParentPackage `json:"mergedInto"`
+}
+
+// deletePackageJob is the upload lambda's DeletePackageJobParams, the payload
+// of its delete_package_jobs outbox entries; the fields are untagged there too.
+type deletePackageJob struct {
+	PackageId      int64
+	OrganizationId int
+	UserNodeId     string
+	TraceId        string
+}
+
+const (
+	// outboxChangelog and outboxDeletePackageJobs are the upload lambda's
+	// outbox kinds for a changelog.Message and for a batch of deletePackageJob.
+	outboxChangelog         = "changelog"
+	outboxDeletePackageJobs = "delete_package_jobs"
+	// deletePackageJobBatch is the most jobs one outbox entry holds, the SQS
+	// batch limit the relay sends them with.
+	deletePackageJobBatch = 10
+	// changelogEventBatch keeps each changelog message well below the SQS
+	// message size limit.
+	changelogEventBatch = 100
+)
+
+// mergeDuplicateFolders folds every duplicate folder of the dataset into the
+// oldest folder of its slot: children move to the survivor, the duplicate's
+// package storage is added to the survivor's, and the now-empty duplicate is
+// soft-deleted. Each slot is locked the way the upload lambda locks it before
+// creating a folder, so an import cannot add to a duplicate while it is
+// merged. The activity log events and the DeletePackageJobs of the merged
+// folders are recorded in pennsieve.upload_outbox, which the upload lambda
+// relays. Runs in one transaction; with dryRun the transaction is rolled back
+// and the result reports what would have changed.
+func mergeDuplicateFolders(ctx context.Context, db *sql.DB, job MergeFoldersJob, dryRun bool) (*MergeFoldersResult, error) {
+	if job.UserNodeID == "" && !dryRun {
+		return nil, errors.New("userNodeId is required")
+	}
+
+	contextLogger := log.WithFields(log.Fields{
+		"org_id":     job.OrganizationID,
+		"dataset_id": job.DatasetID,
+		"dry_run":    dryRun,
+	})
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("SET LOCAL search_path = \"%d\";", job.OrganizationID)); err != nil {
+		return nil, fmt.Errorf("set search path: %w", err)
+	}
+
+	res := &MergeFoldersResult{}
+	var merged []changelog.Event
+	for pass := 0; ; pass++ {
+		if pass == maxMergePasses {
+			return nil, fmt.Errorf("duplicate folders remain after %d passes", maxMergePasses)
+		}
+		groups, err := findDuplicateFolders(ctx, tx, job.DatasetID)
+		if err != nil {
+			return nil, err
+		}
+		if len(groups) == 0 {
+			break
+		}
+		for _, group := range groups {
+			res.Groups++
+			survivor := group[0]
+			if err := lockFolderSlot(ctx, tx, job.DatasetID, survivor); err != nil {
+				return nil, fmt.Errorf("lock folder %d: %w", survivor.id, err)
+			}
+			for _, duplicate := range group[1:] {
+				renamed, err := mergeFolder(ctx, tx, survivor.id, duplicate.id)
+				if err != nil {
+					return nil, fmt.Errorf("merge folder %d into %d: %w", duplicate.id, survivor.id, err)
+				}
+				res.Merged++
+				res.Renamed += renamed
+				merged = append(merged, changelog.Event{
+					EventType: changelog.DeletePackage,
+					EventDetail: folderMergeEvent{
+						Id:         duplicate.id,
+						Name:       duplicate.name,
+						NodeId:     duplicate.nodeID,
+						Parent:     duplicate.parent,
+						MergedInto: &changelog.ParentPackage{Id: survivor.id, Name: survivor.name, NodeId: survivor.nodeID},
+					},
+					Timestamp: time.Now(),
+				})
+				contextLogger.WithFields(log.Fields{
+					"folder":      survivor.name,
+					"survivor_id": survivor.id,
+					"merged_id":   duplicate.id,
+				}).Info("merged duplicate folder")
+			}
+		}
+	}
+
+	if err := recordMergeOutbox(ctx, tx, job, merged); err != nil {
+		return nil, fmt.Errorf("record outbox: %w", err)
+	}
+
+	if dryRun {
+		return res, nil
+	}
+	return res, tx.Commit()
+}
+
+// lockFolderSlot takes the transaction-scoped advisory lock the upload
+// lambda's lockFolder takes on the (dataset, parent, name) slot of folder.
+func lockFolderSlot(ctx context.Context, tx *sql.Tx, datasetID int64, folder duplicateFolder) error {
+	parentID := int64(-1)
+	if folder.parentID.Valid {
+		parentID = folder.parentID.Int64
+	}
+	_, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext($1));",
+		fmt.Sprintf("folder:%d:%d:%s", datasetID, parentID, folder.name))
+	return err
+}
+
+// recordMergeOutbox records, in the merge transaction, the changelog
+// messages of the merge events and a DeletePackageJob for every merged
+// folder, so the jobs service purges them like any deleted package.
+func recordMergeOutbox(ctx context.Context, tx *sql.Tx, job MergeFoldersJob, events []changelog.Event) error {
+	traceID := uuid.NewString()
+	record := func(kind string, payload any) error {
+		b, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx,
+			"INSERT INTO pennsieve.upload_outbox (organization_id, dataset_id, kind, payload) VALUES ($1, $2, $3, $4);",
+			job.OrganizationID, job.DatasetID, kind, b)
+		return err
+	}
+
+	for start := 0; start < len(events); start += changelogEventBatch {
+		msg := changelog.Message{DatasetChangelogEventJob: changelog.MessageParams{
+			OrganizationId: job.OrganizationID,
+			DatasetId:      job.DatasetID,
+			UserId:         job.UserNodeID,
+			Events:         events[start:min(start+changelogEventBatch, len(events))],
+			TraceId:        traceID,
+			Id:             uuid.NewString(),
+		}}
+		if err := record(outboxChangelog, msg); err != nil {
+			return err
+		}
+	}
+
+	var jobs []deletePackageJob
+	for _, e := range events {
+		jobs = append(jobs, deletePackageJob{
+			PackageId:      e.EventDetail.(folderMergeEvent).Id,
+			OrganizationId: int(job.OrganizationID),
+			UserNodeId:     job.UserNodeID,
+			TraceId:        traceID,
+		})
+	}
+	for start := 0; start < len(jobs); start += deletePackageJobBatch {
+		if err := record(outboxDeletePackageJobs, jobs[start:min(start+deletePackageJobBatch, len(jobs))]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findDuplicateFolders returns the dataset's non-deleted folders that share
+// their (parent, name) slot, grouped by slot with the oldest folder first.
+func findDuplicateFolders(ctx context.Context, tx *sql.Tx, datasetID int64) ([][]duplicateFolder, error) {
+	rows, err := tx.QueryContext(ctx,
+		"SELECT p.id, p.node_id, p.parent_id, p.name, pp.name, pp.node_id FROM packages p "+
+			"LEFT JOIN packages pp ON pp.id = p.parent_id "+
+			"WHERE p.dataset_id = $1 AND p.type = 'Collection' AND p.state != 'DELETING' AND EXISTS ("+
+			"SELECT 1 FROM packages d WHERE d.dataset_id = p.dataset_id AND d.type = 'Collection' "+
+			"AND d.state != 'DELETING' AND d.name = p.name AND d.parent_id IS NOT DISTINCT FROM p.parent_id "+
+			"AND d.id != p.id) "+
+			"ORDER BY p.parent_id NULLS FIRST, p.name, p.id;",
+		datasetID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var groups [][]duplicateFolder
+	for rows.Next() {
+		var f duplicateFolder
+		var parentName, parentNodeID sql.NullString
+		if err := rows.Scan(&f.id, &f.nodeID, &f.parentID, &f.name, &parentName, &parentNodeID); err != nil {
+			return nil, err
+		}
+		if f.parentID.Valid {
+			f.parent = &changelog.ParentPackage{Id: f.parentID.Int64, Name: parentName.String, NodeId: parentNodeID.String}
+		}
+		if n := len(groups); n > 0 && groups[n-1][0].parentID == f.parentID && groups[n-1][0].name == f.name {
+			groups[n-1] = append(groups[n-1], f)
+			continue
+		}
+		groups = append(groups, []duplicateFolder{f})
+	}
+	return groups, rows.Err()
+}
+
+// mergeFolder moves the children of duplicate into survivor, then
+// soft-deletes duplicate. Same-named subfolders are moved as they are and merged on the
+// next pass; other packages whose name is taken in survivor are renamed the
+// way the keepBoth strategy names them. Prior versions move with their folder
+// but neither take a name nor are renamed. Returns the number of renames.
+func mergeFolder(ctx context.Context, tx *sql.Tx, survivor int64, duplicate int64) (int, error) {
+	rows, err := tx.QueryContext(ctx,
+		"SELECT c.id, c.name FROM packages c WHERE c.parent_id = $2 AND c.type != 'Collection' "+
+			"AND c.state NOT IN ('DELETING', 'VERSIONED') AND EXISTS (SELECT 1 FROM packages s WHERE s.parent_id = $1 "+
+			"AND s.name = c.name AND s.state NOT IN ('DELETING', 'VERSIONED'));",
+		survivor, duplicate)
+	if err != nil {
+		return 0, err
+	}
+	taken := map[int64]string{}
+	for rows.Next() {
+		var id int64
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		taken[id] = name
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for id, name := range taken {
+		newName, err := availableName(ctx, tx, survivor, name)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE packages SET name = $2, updated_at = now() WHERE id = $1;",
+			id, newName); err != nil {
+			return 0, err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx,
+		"UPDATE packages SET parent_id = $1, updated_at = now() WHERE parent_id = $2;",
+		survivor, duplicate); err != nil {
+		return 0, err
+	}
+
+	// The survivor's ancestors already count the duplicate's bytes; only the
+	// two folders' own rows change.
+	if _, err := tx.ExecContext(ctx,
+		"INSERT INTO package_storage AS package_storage (package_id, size) "+
+			"SELECT $1, size FROM package_storage WHERE package_id = $2 "+
+			"ON CONFLICT (package_id) DO UPDATE SET size = COALESCE(package_storage.size, 0) + EXCLUDED.size;",
+		survivor, duplicate); err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM package_storage WHERE package_id = $1;", duplicate); err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE packages SET state = 'DELETING', updated_at = now() WHERE id = $1;",
+		duplicate); err != nil {
+		return 0, err
+	}
+	return len(taken), nil
+}
+
+var extensionRegex = regexp.MustCompile(`(?P<FileName>[^.]*)\.?(?P<Extension>.*)`)
+
+// availableName returns the first of "name (1).ext", "name (2).ext", ... not
+// taken in folder.
+func availableName(ctx context.Context, tx *sql.Tx, folder int64, name string) (string, error) {
+	parts := extensionRegex.FindStringSubmatch(name)
+	base, extension := parts[extensionRegex.SubexpIndex("FileName")], parts[extensionRegex.SubexpIndex("Extension")]
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s (%d)", base, i)
+		if extension != "" {
+			candidate = fmt.Sprintf("%s (%d).%s", base, i, extension)
+		}
+		var exists bool
+		err := tx.QueryRowContext(ctx,
+			"SELECT EXISTS (SELECT 1 FROM packages WHERE parent_id = $1 AND name = $2 "+
+				"AND state NOT IN ('DELETING', 'VERSIONED'));",
+			folder, candidate).Scan(&exists)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return candidate, nil
+		}
+	}
+}
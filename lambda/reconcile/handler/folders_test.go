@@ -0,0 +1,281 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/google/uuid"
+	pgQueries "github.com/pennsieve/pennsieve-go-core/pkg/queries/pgdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testOrgID     = 1
+	testDatasetID = 1
+	testUserID    = "N:user:99f02be5-009c-4ecd-9006-f016d48628bf"
+)
+
+func TestMergeFolders(t *testing.T) {
+	db, err := pgQueries.ConnectENV()
+	require.NoError(t, err)
+	defer db.Close()
+
+	for scenario, fn := range map[string]func(t *testing.T, db *sql.DB){
+		"merges duplicates into the oldest folder":   testMergeFolders,
+		"renames packages whose name is taken":       testMergeFoldersNameCollision,
+		"merges duplicates nested in duplicates":     testMergeFoldersNested,
+		"dry run changes nothing":                    testMergeFoldersDryRun,
+		"requires a user unless it is a dry run":     testMergeFoldersRequiresUser,
+		"logs the merge and purges merged folders":   testMergeFoldersOutbox,
+		"leaves folders with distinct names alone":   testMergeFoldersDistinct,
+		"merges duplicates at the root of a dataset": testMergeFoldersRoot,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			t.Cleanup(func() { truncateTestTables(t, db) })
+			fn(t, db)
+		})
+	}
+}
+
+func testMergeFolders(t *testing.T, db *sql.DB) {
+	parent := insertTestPackage(t, db, nil, "parent", "Collection")
+	survivor := insertTestPackage(t, db, &parent, "data", "Collection")
+	duplicate := insertTestPackage(t, db, &parent, "data", "Collection")
+	a := insertTestPackage(t, db, &survivor, "a.txt", "Text")
+	b := insertTestPackage(t, db, &duplicate, "b.txt", "Text")
+
+	res, err := mergeDuplicateFolders(context.Background(), db, testMergeFoldersJob(), false)
+	require.NoError(t, err)
+	assert.Equal(t, MergeFoldersResult{Groups: 1, Merged: 1}, *res)
+
+	assert.Equal(t, survivor, testParentID(t, db, a))
+	assert.Equal(t, survivor, testParentID(t, db, b))
+	assert.Equal(t, "DELETING", testPackageState(t, db, duplicate), "the duplicate is soft-deleted")
+	assert.Equal(t, "READY", testPackageState(t, db, survivor))
+}
+
+func testMergeFoldersNameCollision(t *testing.T, db *sql.DB) {
+	survivor := insertTestPackage(t, db, nil, "data", "Collection")
+	duplicate := insertTestPackage(t, db, nil, "data", "Collection")
+	kept := insertTestPackage(t, db, &survivor, "scan.nii.gz", "Text")
+	moved := insertTestPackage(t, db, &duplicate, "scan.nii.gz", "Text")
+	insertTestPackage(t, db, &survivor, "scan (1).nii.gz", "Text")
+	readme := insertTestPackage(t, db, &duplicate, "README", "Text")
+	insertTestPackage(t, db, &survivor, "README", "Text")
+
+	res, err := mergeDuplicateFolders(context.Background(), db, testMergeFoldersJob(), false)
+	require.NoError(t, err)
+	assert.Equal(t, 2, res.Renamed)
+
+	assert.Equal(t, "scan.nii.gz", testPackageName(t, db, kept))
+	assert.Equal(t, "scan (2).nii.gz", testPackageName(t, db, moved), "the next free name is used")
+	assert.Equal(t, "README (1)", testPackageName(t, db, readme))
+	assert.Equal(t, survivor, testParentID(t, db, moved))
+}
+
+func testMergeFoldersNested(t *testing.T, db *sql.DB) {
+	survivor := insertTestPackage(t, db, nil, "data", "Collection")
+	duplicate := insertTestPackage(t, db, nil, "data", "Collection")
+	survivorSub := insertTestPackage(t, db, &survivor, "sub", "Collection")
+	duplicateSub := insertTestPackage(t, db, &duplicate, "sub", "Collection")
+	x := insertTestPackage(t, db, &survivorSub, "x.txt", "Text")
+	y := insertTestPackage(t, db, &duplicateSub, "y.txt", "Text")
+
+	res, err := mergeDuplicateFolders(context.Background(), db, testMergeFoldersJob(), false)
+	require.NoError(t, err)
+	assert.Equal(t, MergeFoldersResult{Groups: 2, Merged: 2}, *res,
+		"the subfolders only become duplicates once their parents are merged")
+
+	assert.Equal(t, survivor, testParentID(t, db, survivorSub))
+	assert.Equal(t, survivorSub, testParentID(t, db, x))
+	assert.Equal(t, survivorSub, testParentID(t, db, y))
+	assert.Equal(t, "DELETING", testPackageState(t, db, duplicate))
+	assert.Equal(t, "DELETING", testPackageState(t, db, duplicateSub))
+}
+
+func testMergeFoldersDryRun(t *testing.T, db *sql.DB) {
+	survivor := insertTestPackage(t, db, nil, "data", "Collection")
+	duplicate := insertTestPackage(t, db, nil, "data", "Collection")
+	b := insertTestPackage(t, db, &duplicate, "b.txt", "Text")
+	insertTestPackage(t, db, &survivor, "b.txt", "Text")
+
+	job := testMergeFoldersJob()
+	job.UserNodeID = ""
+	res, err := mergeDuplicateFolders(context.Background(), db, job, true)
+	require.NoError(t, err)
+	assert.Equal(t, MergeFoldersResult{Groups: 1, Merged: 1, Renamed: 1}, *res, "reports what would change")
+
+	assert.Equal(t, duplicate, testParentID(t, db, b))
+	assert.Equal(t, "b.txt", testPackageName(t, db, b))
+	assert.Equal(t, "READY", testPackageState(t, db, duplicate))
+	assert.Empty(t, testOutboxKinds(t, db))
+}
+
+func testMergeFoldersRequiresUser(t *testing.T, db *sql.DB) {
+	insertTestPackage(t, db, nil, "data", "Collection")
+	duplicate := insertTestPackage(t, db, nil, "data", "Collection")
+
+	job := testMergeFoldersJob()
+	job.UserNodeID = ""
+	_, err := mergeDuplicateFolders(context.Background(), db, job, false)
+	assert.Error(t, err)
+	assert.Equal(t, "READY", testPackageState(t, db, duplicate))
+}
+
+func testMergeFoldersOutbox(t *testing.T, db *sql.DB) {
+	parent := insertTestPackage(t, db, nil, "parent", "Collection")
+	survivor := insertTestPackage(t, db, &parent, "data", "Collection")
+	duplicate := insertTestPackage(t, db, &parent, "data", "Collection")
+
+	_, err := mergeDuplicateFolders(context.Background(), db, testMergeFoldersJob(), false)
+	require.NoError(t, err)
+
+	payloads := testOutboxKinds(t, db)
+	require.Len(t, payloads[outboxChangelog], 1)
+	require.Len(t, payloads[outboxDeletePackageJobs], 1)
+
+	var msg struct {
+		DatasetChangelogEventJob struct {
+			OrganizationId int64  `json:"organizationId"`
+			DatasetId      int64  `json:"datasetId"`
+			UserId         string `json:"userId"`
+			Events         []struct {
+				EventType   string           `json:"eventType"`
+				EventDetail folderMergeEvent `json:"eventDetail"`
+			} `json:"events"`
+		}
+	}
+	require.NoError(t, json.Unmarshal(payloads[outboxChangelog][0], &msg))
+	job := msg.DatasetChangelogEventJob
+	assert.Equal(t, int64(testOrgID), job.OrganizationId)
+	assert.Equal(t, int64(testDatasetID), job.DatasetId)
+	assert.Equal(t, testUserID, job.UserId)
+	require.Len(t, job.Events, 1)
+	assert.Equal(t, "DELETE_PACKAGE", job.Events[0].EventType)
+	detail := job.Events[0].EventDetail
+	assert.Equal(t, duplicate, detail.Id)
+	assert.Equal(t, "data", detail.Name)
+	require.NotNil(t, detail.Parent)
+	assert.Equal(t, parent, detail.Parent.Id)
+	assert.Equal(t, "parent", detail.Parent.Name)
+	require.NotNil(t, detail.MergedInto)
+	assert.Equal(t, survivor, detail.MergedInto.Id)
+
+	var jobs []deletePackageJob
+	require.NoError(t, json.Unmarshal(payloads[outboxDeletePackageJobs][0], &jobs))
+	require.Len(t, jobs, 1)
+	assert.Equal(t, deletePackageJob{
+		PackageId:      duplicate,
+		OrganizationId: testOrgID,
+		UserNodeId:     testUserID,
+		TraceId:        jobs[0].TraceId,
+	}, jobs[0])
+}
+
+func testMergeFoldersDistinct(t *testing.T, db *sql.DB) {
+	data := insertTestPackage(t, db, nil, "data", "Collection")
+	other := insertTestPackage(t, db, nil, "Data", "Collection")
+	insertTestPackage(t, db, &data, "sub", "Collection")
+	insertTestPackage(t, db, &other, "sub", "Collection")
+	deleted := insertTestPackage(t, db, nil, "data", "Collection")
+	_, err := db.Exec(fmt.Sprintf(`UPDATE "%d".packages SET state = 'DELETING' WHERE id = $1`, testOrgID), deleted)
+	require.NoError(t, err)
+
+	res, err := mergeDuplicateFolders(context.Background(), db, testMergeFoldersJob(), false)
+	require.NoError(t, err)
+	assert.Equal(t, MergeFoldersResult{}, *res,
+		"names differ in case, subfolders have different parents and deleted folders do not count")
+	assert.Empty(t, testOutboxKinds(t, db))
+}
+
+func testMergeFoldersRoot(t *testing.T, db *sql.DB) {
+	survivor := insertTestPackage(t, db, nil, "data", "Collection")
+	first := insertTestPackage(t, db, nil, "data", "Collection")
+	second := insertTestPackage(t, db, nil, "data", "Collection")
+	a := insertTestPackage(t, db, &second, "a.txt", "Text")
+
+	res, err := mergeDuplicateFolders(context.Background(), db, testMergeFoldersJob(), false)
+	require.NoError(t, err)
+	assert.Equal(t, MergeFoldersResult{Groups: 1, Merged: 2}, *res)
+
+	assert.Equal(t, survivor, testParentID(t, db, a))
+	assert.Equal(t, "DELETING", testPackageState(t, db, first))
+	assert.Equal(t, "DELETING", testPackageState(t, db, second))
+
+	var jobs []deletePackageJob
+	require.NoError(t, json.Unmarshal(testOutboxKinds(t, db)[outboxDeletePackageJobs][0], &jobs))
+	assert.Len(t, jobs, 2)
+}
+
+func testMergeFoldersJob() MergeFoldersJob {
+	return MergeFoldersJob{OrganizationID: testOrgID, DatasetID: testDatasetID, UserNodeID: testUserID}
+}
+
+// insertTestPackage adds a READY package to the test dataset, below parent or
+// at the root, and returns its id. Packages are inserted directly: the
+// duplicates under test are what go-core's folder insert no longer creates.
+func insertTestPackage(t *testing.T, db *sql.DB, parent *int64, name string, packageType string) int64 {
+	var parentID sql.NullInt64
+	if parent != nil {
+		parentID = sql.NullInt64{Int64: *parent, Valid: true}
+	}
+	var id int64
+	err := db.QueryRow(fmt.Sprintf(`INSERT INTO "%d".packages (name, type, state, node_id, parent_id, dataset_id,
+		owner_id, created_at, updated_at) VALUES ($1, $2, 'READY', $3, $4, $5, 1, now(), now()) RETURNING id`, testOrgID),
+		name, packageType, fmt.Sprintf("N:package:%s", uuid.NewString()), parentID, testDatasetID).Scan(&id)
+	require.NoError(t, err)
+	return id
+}
+
+func testParentID(t *testing.T, db *sql.DB, id int64) int64 {
+	var parentID int64
+	require.NoError(t, db.QueryRow(fmt.Sprintf(`SELECT parent_id FROM "%d".packages WHERE id = $1`, testOrgID), id).
+		Scan(&parentID))
+	return parentID
+}
+
+func testPackageName(t *testing.T, db *sql.DB, id int64) string {
+	var name string
+	require.NoError(t, db.QueryRow(fmt.Sprintf(`SELECT name FROM "%d".packages WHERE id = $1`, testOrgID), id).
+		Scan(&name))
+	return name
+}
+
+func testPackageState(t *testing.T, db *sql.DB, id int64) string {
+	var state string
+	require.NoError(t, db.QueryRow(fmt.Sprintf(`SELECT state FROM "%d".packages WHERE id = $1`, testOrgID), id).
+		Scan(&state))
+	return state
+}
+
+// testOutboxKinds returns the payloads of the outbox entries, by kind.
+func testOutboxKinds(t *testing.T, db *sql.DB) map[string][]json.RawMessage {
+	rows, err := db.Query("SELECT kind, payload FROM pennsieve.upload_outbox ORDER BY id")
+	require.NoError(t, err)
+	defer rows.Close()
+
+	payloads := map[string][]json.RawMessage{}
+	for rows.Next() {
+		var kind string
+		var payload []byte
+		require.NoError(t, rows.Scan(&kind, &payload))
+		payloads[kind] = append(payloads[kind], payload)
+	}
+	require.NoError(t, rows.Err())
+	return payloads
+}
+
+func truncateTestTables(t *testing.T, db *sql.DB) {
+	for _, table := range []string{"packages", "files", "package_storage", "dataset_storage"} {
+		_, err := db.Exec(fmt.Sprintf(`TRUNCATE TABLE "%d".%s CASCADE`, testOrgID, table))
+		assert.NoError(t, err)
+	}
+	_, err := db.Exec("TRUNCATE TABLE pennsieve.organization_storage CASCADE")
+	assert.NoError(t, err)
+	_, err = db.Exec("DELETE FROM pennsieve.upload_outbox")
+	assert.NoError(t, err)
+}
@@ -13,8 +13,41 @@
 //     status whose manifest's DateCreated is older than gracePeriodHours,
 //     applies the same HEAD-then-enqueue recovery.
 //
-// Never deletes anything. Recovery means "HEAD succeeded, synthesized S3
-// event sent to upload_trigger_queue"; from that point the existing upload
+//  3. SHA256 verification (invoked asynchronously by finalize).
+//     Payload: {"verifySha256": {...}}.
+//     Hashes an imported object S3 stored no SHA256 checksum for and that
+//     finalize had no hash budget left for, and fails the file on a mismatch;
+//     see sha256.go. Jobs that keep failing go to a dead-letter queue.
+//
+//  4. Duplicate folder repair (operator-triggered).
+//     Payload: {"mergeFolders": {"organizationId": 1, "datasetId": 2,
+//     "userNodeId": "N:user:..."}}.
+//     Merges folders that concurrent imports created twice under the same
+//     parent into the oldest one and soft-deletes the others, logging the
+//     merge as that user; see folders.go. Honours dryRun.
+//
+//  5. Storage recompute (operator-triggered).
+//     Payload: {"recomputeStorage": {"organizationId": 1, "datasetId": 2}}.
+//     Rebuilds package, dataset and organization storage from the files
+//     table, reporting every drifted size before overwriting it; see
+//     recompute.go. Omit datasetId for the whole organization. Honours dryRun.
+//
+//  6. Outbox inspection (operator-triggered).
+//     Payload: {"inspectOutbox": {"minAttempts": 5, "requeue": false}}.
+//     Lists the import messages the upload lambda keeps failing to deliver
+//     or gave up on from pennsieve.upload_outbox, and optionally makes them
+//     due for an immediate retry; see outbox.go. Honours dryRun.
+//
+//  7. Migrations (invoked by terraform on every deploy).
+//     Payload: {"migrate": {}}.
+//     Applies the scripts of the migrations directory, which the deployment
+//     package carries, to the pennsieve schema and every organization
+//     schema; see migrations.go. Honours dryRun.
+//
+// Apart from soft-deleting the duplicate folders of mode 4, never deletes
+// anything.
+// Recovery means "HEAD succeeded, finalize message sent to
+// upload_trigger_queue"; from that point the existing upload
 // lambda consumer imports the file and transitions the DynamoDB row to
 // Finalized. Files whose S3 object is absent (case B in the orphan taxonomy)
 // are counted as "missing" and logged for operator follow-up.
@@ -33,18 +66,25 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/sqs"
 	pgQueries "github.com/pennsieve/pennsieve-go-core/pkg/queries/pgdb"
+	"github.com/pennsieve/pennsieve-upload-service-v2/storage"
+	"github.com/pennsieve/pennsieve-upload-service-v2/storage/localbackend"
+	"github.com/pennsieve/pennsieve-upload-service-v2/storage/migrate"
+	"github.com/pennsieve/pennsieve-upload-service-v2/storage/s3backend"
 	log "github.com/sirupsen/logrus"
 )
 
 var (
-	dyClient  *dynamodb.Client
-	s3Client  *s3.Client
-	sqsClient *sqs.Client
+	dyClient       *dynamodb.Client
+	storageBackend storage.StorageBackend
+	sqsClient      *sqs.Client
 
 	manifestTableName     string
 	manifestFileTableName string
 	uploadTriggerQueueURL string
-	defaultStorageBucket  string
+
+	// resolver outlives a single invocation, so warm starts reuse cached
+	// manifest resolutions, including manifests known to be gone.
+	resolver *storage.Resolver
 )
 
 func init() {
@@ -59,7 +99,6 @@ func init() {
 	manifestTableName = os.Getenv("MANIFEST_TABLE")
 	manifestFileTableName = os.Getenv("MANIFEST_FILE_TABLE")
 	uploadTriggerQueueURL = os.Getenv("UPLOAD_TRIGGER_QUEUE_URL")
-	defaultStorageBucket = os.Getenv("DEFAULT_STORAGE_BUCKET")
 }
 
 // InitializeClients constructs AWS SDK clients. Called from main.go's
@@ -70,19 +109,48 @@ func InitializeClients() {
 		log.Fatalf("LoadDefaultConfig: %v", err)
 	}
 	dyClient = dynamodb.NewFromConfig(cfg)
-	s3Client = s3.NewFromConfig(cfg)
 	sqsClient = sqs.NewFromConfig(cfg)
+
+	// STORAGE_BACKEND=local reads storage buckets from directories below
+	// LOCAL_STORAGE_ROOT, for on-prem installs and local end-to-end tests.
+	backendType, err := storage.ParseBackendType(os.Getenv("STORAGE_BACKEND"))
+	if err != nil {
+		log.Fatalf("STORAGE_BACKEND: %v", err)
+	}
+	if backendType == storage.BackendLocal {
+		storageBackend, err = localbackend.New(os.Getenv("LOCAL_STORAGE_ROOT"))
+		if err != nil {
+			log.Fatalf("localbackend: %v", err)
+		}
+	} else {
+		s3Client := s3.NewFromConfig(cfg)
+		storageBackend = s3backend.New(s3Client, s3backend.Options{
+			Region:        s3backend.NewRegionCache(s3Client).Region,
+			DefaultRegion: cfg.Region,
+		})
+	}
+	resolver = storage.NewResolver(storage.Config{
+		DefaultBucket: os.Getenv("DEFAULT_STORAGE_BUCKET"),
+		Backend:       storageBackend.Type(),
+	})
 }
 
 // Payload is the JSON body that invokes the lambda. Exactly one of
-// ManifestNodeID or GracePeriodHours should be set. Concurrency caps the
-// number of in-flight HEAD requests; default is 16, which suits a 512 MB
-// Lambda (HEAD is network-bound, not CPU-bound).
+// ManifestNodeID, GracePeriodHours, VerifySHA256, MergeFolders,
+// RecomputeStorage, InspectOutbox or Migrate should be set. Concurrency caps the number of in-flight
+// HEAD requests; default is 16, which suits a 512 MB Lambda (HEAD is
+// network-bound, not CPU-bound).
 type Payload struct {
 	ManifestNodeID   string `json:"manifestNodeId,omitempty"`
 	GracePeriodHours int    `json:"gracePeriodHours,omitempty"`
 	DryRun           bool   `json:"dryRun,omitempty"`
 	Concurrency      int    `json:"concurrency,omitempty"`
+
+	VerifySHA256     *SHA256Job           `json:"verifySha256,omitempty"`
+	MergeFolders     *MergeFoldersJob     `json:"mergeFolders,omitempty"`
+	RecomputeStorage *RecomputeStorageJob `json:"recomputeStorage,omitempty"`
+	InspectOutbox    *InspectOutboxJob    `json:"inspectOutbox,omitempty"`
+	Migrate          *MigrateJob          `json:"migrate,omitempty"`
 }
 
 const (
@@ -100,6 +168,11 @@ type Result struct {
 	Errors           []string                 `json:"errors,omitempty"`
 	PerManifest      map[string]ManifestStats `json:"perManifest,omitempty"`
 	DryRun           bool                     `json:"dryRun"`
+	SHA256           *SHA256Result            `json:"sha256,omitempty"`
+	Folders          *MergeFoldersResult      `json:"folders,omitempty"`
+	Storage          *RecomputeStorageResult  `json:"storage,omitempty"`
+	Outbox           *InspectOutboxResult     `json:"outbox,omitempty"`
+	Migrations       *migrate.Result          `json:"migrations,omitempty"`
 }
 
 type ManifestStats struct {
@@ -112,8 +185,14 @@ type ManifestStats struct {
 // via RDS Proxy (required for storage-bucket resolution), dispatches on
 // payload shape, and emits a summary record the scheduled alarm watches.
 func Handle(ctx context.Context, p Payload) (Result, error) {
-	if (p.ManifestNodeID == "") == (p.GracePeriodHours == 0) {
-		return Result{}, errors.New("exactly one of manifestNodeId or gracePeriodHours must be set")
+	modes := 0
+	for _, set := range []bool{p.ManifestNodeID != "", p.GracePeriodHours != 0, p.VerifySHA256 != nil, p.MergeFolders != nil, p.RecomputeStorage != nil, p.InspectOutbox != nil, p.Migrate != nil} {
+		if set {
+			modes++
+		}
+	}
+	if modes != 1 {
+		return Result{}, errors.New("exactly one of manifestNodeId, gracePeriodHours, verifySha256, mergeFolders, recomputeStorage, inspectOutbox or migrate must be set")
 	}
 
 	pgdb, err := pgQueries.ConnectRDS()
@@ -123,15 +202,70 @@ func Handle(ctx context.Context, p Payload) (Result, error) {
 	defer pgdb.Close()
 	pg := pgQueries.New(pgdb)
 
+	// A failed verification is returned as an error so Lambda retries the
+	// asynchronous invocation; the usual cause is an object whose import
+	// has not committed yet.
+	if p.VerifySHA256 != nil {
+		res, err := verifySHA256(ctx, storageBackend, pgdb, dyClient, manifestFileTableName, *p.VerifySHA256)
+		if err != nil {
+			return Result{}, err
+		}
+		emitMetrics(Result{SHA256: res})
+		return Result{SHA256: res}, nil
+	}
+
+	if p.MergeFolders != nil {
+		res, err := mergeDuplicateFolders(ctx, pgdb, *p.MergeFolders, p.DryRun)
+		if err != nil {
+			return Result{}, fmt.Errorf("merge folders: %w", err)
+		}
+		result := Result{DryRun: p.DryRun, Folders: res}
+		body, _ := json.Marshal(result)
+		log.WithField("result", string(body)).Info("folder merge complete")
+		return result, nil
+	}
+
+	if p.RecomputeStorage != nil {
+		res, err := recomputeStorage(ctx, pgdb, *p.RecomputeStorage, p.DryRun)
+		if err != nil {
+			return Result{}, fmt.Errorf("recompute storage: %w", err)
+		}
+		result := Result{DryRun: p.DryRun, Storage: res}
+		emitMetrics(result)
+		body, _ := json.Marshal(result)
+		log.WithField("result", string(body)).Info("storage recompute complete")
+		return result, nil
+	}
+
+	if p.InspectOutbox != nil {
+		res, err := inspectOutbox(ctx, pgdb, *p.InspectOutbox, p.DryRun)
+		if err != nil {
+			return Result{}, fmt.Errorf("inspect outbox: %w", err)
+		}
+		result := Result{DryRun: p.DryRun, Outbox: res}
+		body, _ := json.Marshal(result)
+		log.WithField("result", string(body)).Info("outbox inspection complete")
+		return result, nil
+	}
+
+	if p.Migrate != nil {
+		res, err := runMigrations(ctx, pgdb, p.DryRun)
+		if err != nil {
+			return Result{}, fmt.Errorf("migrate: %w", err)
+		}
+		return Result{DryRun: p.DryRun, Migrations: res}, nil
+	}
+
 	store := &store{
 		dy:                    dyClient,
-		s3:                    s3Client,
+		backend:               storageBackend,
 		sqs:                   sqsClient,
 		pg:                    pg,
+		db:                    pgdb,
 		manifestTable:         manifestTableName,
 		manifestFileTable:     manifestFileTableName,
 		uploadTriggerQueueURL: uploadTriggerQueueURL,
-		defaultStorageBucket:  defaultStorageBucket,
+		resolver:              resolver,
 	}
 
 	concurrency := p.Concurrency
@@ -209,6 +343,8 @@ func emitMetrics(r Result) {
 					{"Name": "OrphansMissing", "Unit": "Count"},
 					{"Name": "ReconciliationErrors", "Unit": "Count"},
 					{"Name": "EnqueueFailed", "Unit": "Count"},
+					{"Name": "ChecksumMismatches", "Unit": "Count"},
+					{"Name": "StorageDiscrepancies", "Unit": "Count"},
 				},
 			}},
 		},
@@ -216,6 +352,8 @@ func emitMetrics(r Result) {
 		"OrphansMissing":       r.Missing,
 		"ReconciliationErrors": len(r.Errors),
 		"EnqueueFailed":        r.EnqueueFailed,
+		"ChecksumMismatches":   r.checksumMismatches(),
+		"StorageDiscrepancies": r.storageDiscrepancies(),
 	}
 	line, _ := json.Marshal(emf)
 	// stdout so Lambda picks it up as a log line and parses the EMF block.
@@ -0,0 +1,42 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+
+	"github.com/pennsieve/pennsieve-upload-service-v2/storage/migrate"
+	log "github.com/sirupsen/logrus"
+)
+
+// MigrateJob asks for the upload service's Postgres migrations to be applied.
+// Terraform invokes it on every deploy, before the lambdas that use the new
+// tables are updated; it is idempotent, so an operator can run it again, for
+// example after an organization was created.
+type MigrateJob struct{}
+
+// migrationsDir is where the deployment package carries the migrations
+// directory. MIGRATIONS_DIR overrides it for local runs.
+func migrationsDir() string {
+	if dir := os.Getenv("MIGRATIONS_DIR"); dir != "" {
+		return dir
+	}
+	return filepath.Join(os.Getenv("LAMBDA_TASK_ROOT"), "migrations")
+}
+
+// runMigrations applies the migrations that have not been applied yet, or
+// only lists them on a dry run.
+func runMigrations(ctx context.Context, db *sql.DB, dryRun bool) (*migrate.Result, error) {
+	dir := migrationsDir()
+	res, err := migrate.Apply(ctx, db, os.DirFS(dir), dryRun)
+	if res != nil {
+		log.WithFields(log.Fields{
+			"dir":     dir,
+			"schemas": res.Schemas,
+			"applied": len(res.Applied),
+			"dry_run": dryRun,
+		}).Info("migrations run")
+	}
+	return res, err
+}
@@ -0,0 +1,52 @@
+package handler
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	pgQueries "github.com/pennsieve/pennsieve-go-core/pkg/queries/pgdb"
+	"github.com/pennsieve/pennsieve-upload-service-v2/storage/migrate"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testMigrationsDir is the repository's migrations directory.
+const testMigrationsDir = "../../../migrations"
+
+// TestMain adds the upload service's tables to the seed database, which has
+// the core schema only.
+func TestMain(m *testing.M) {
+	db, err := pgQueries.ConnectENV()
+	if err != nil {
+		log.Fatal("cannot connect to db:", err)
+	}
+	if _, err := migrate.Apply(context.Background(), db, os.DirFS(testMigrationsDir), false); err != nil {
+		log.Fatal("cannot apply migrations:", err)
+	}
+	_ = db.Close()
+
+	os.Exit(m.Run())
+}
+
+func TestMigrations(t *testing.T) {
+	db, err := pgQueries.ConnectENV()
+	require.NoError(t, err)
+	defer db.Close()
+	t.Setenv("MIGRATIONS_DIR", testMigrationsDir)
+
+	// TestMain applied every script, so there is nothing left to apply or list.
+	for _, dryRun := range []bool{true, false} {
+		res, err := runMigrations(context.Background(), db, dryRun)
+		require.NoError(t, err)
+		assert.Empty(t, res.Applied, "dry run %t", dryRun)
+		assert.Greater(t, res.Schemas, 1, "the pennsieve schema and the organization schemas")
+	}
+
+	var tables int
+	err = db.QueryRow("SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = '1' AND table_name IN " +
+		"('package_versions', 'file_checksums', 'file_server_sha256', 'file_type_detections');").Scan(&tables)
+	require.NoError(t, err)
+	assert.Equal(t, 4, tables)
+}
@@ -0,0 +1,157 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// InspectOutboxJob asks for the import messages the upload lambda has failed
+// to deliver, from pennsieve.upload_outbox. MinAttempts selects entries that
+// failed at least that many times; it defaults to the number at which the
+// upload lambda reports an entry as stuck, so dead entries, which the relay
+// gave up on, are selected too. Kind and OrganizationID narrow the selection
+// further. Requeue makes the selected entries due at once, so the next
+// heartbeat retries them, and brings dead ones back with their attempts reset;
+// it is ignored on a dry run.
+type InspectOutboxJob struct {
+	MinAttempts    int    `json:"minAttempts,omitempty"`
+	Kind           string `json:"kind,omitempty"`
+	OrganizationID int64  `json:"organizationId,omitempty"`
+	Limit          int    `json:"limit,omitempty"`
+	Requeue        bool   `json:"requeue,omitempty"`
+}
+
+// InspectOutboxResult is the outcome of an InspectOutboxJob. Pending and
+// Dead count the whole outbox. Entries lists the selected entries oldest
+// first, up to the job's limit; the counts are exact.
+type InspectOutboxResult struct {
+	Pending  int            `json:"pending"`
+	Dead     int            `json:"dead"`
+	Selected int            `json:"selected"`
+	ByKind   map[string]int `json:"byKind,omitempty"`
+	Entries  []OutboxEntry  `json:"entries,omitempty"`
+	Requeued int            `json:"requeued"`
+}
+
+// OutboxEntry is an undelivered import message, without its payload.
+type OutboxEntry struct {
+	ID             int64     `json:"id"`
+	OrganizationID int64     `json:"organizationId"`
+	DatasetID      int64     `json:"datasetId"`
+	Kind           string    `json:"kind"`
+	Attempts       int       `json:"attempts"`
+	LastError      string    `json:"lastError,omitempty"`
+	CreatedAt      time.Time `json:"createdAt"`
+	NextAttemptAt  time.Time `json:"nextAttemptAt"`
+	// DeadAt is when the upload lambda gave up on the entry; nil while it
+	// still retries it.
+	DeadAt *time.Time `json:"deadAt,omitempty"`
+}
+
+const (
+	// defaultOutboxMinAttempts matches outboxStuckAttempts in the upload lambda.
+	defaultOutboxMinAttempts = 5
+	defaultOutboxLimit       = 100
+)
+
+// inspectOutbox reports the outbox entries job selects and requeues them if
+// asked to.
+func inspectOutbox(ctx context.Context, db *sql.DB, job InspectOutboxJob, dryRun bool) (*InspectOutboxResult, error) {
+	minAttempts := job.MinAttempts
+	if minAttempts <= 0 {
+		minAttempts = defaultOutboxMinAttempts
+	}
+	limit := job.Limit
+	if limit <= 0 {
+		limit = defaultOutboxLimit
+	}
+
+	conditions := []string{"attempts >= $1"}
+	args := []any{minAttempts}
+	if job.Kind != "" {
+		args = append(args, job.Kind)
+		conditions = append(conditions, fmt.Sprintf("kind = $%d", len(args)))
+	}
+	if job.OrganizationID != 0 {
+		args = append(args, job.OrganizationID)
+		conditions = append(conditions, fmt.Sprintf("organization_id = $%d", len(args)))
+	}
+	where := strings.Join(conditions, " AND ")
+
+	res := &InspectOutboxResult{ByKind: map[string]int{}}
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FILTER (WHERE dead_at IS NULL), "+
+		"COUNT(*) FILTER (WHERE dead_at IS NOT NULL) FROM pennsieve.upload_outbox;").
+		Scan(&res.Pending, &res.Dead); err != nil {
+		return nil, fmt.Errorf("count outbox: %w", err)
+	}
+
+	rows, err := db.QueryContext(ctx,
+		"SELECT kind, COUNT(*) FROM pennsieve.upload_outbox WHERE "+where+" GROUP BY kind;", args...)
+	if err != nil {
+		return nil, fmt.Errorf("count selected entries: %w", err)
+	}
+	for rows.Next() {
+		var kind string
+		var n int
+		if err := rows.Scan(&kind, &n); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		res.ByKind[kind] = n
+		res.Selected += n
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.QueryContext(ctx,
+		"SELECT id, organization_id, dataset_id, kind, attempts, COALESCE(last_error, ''), created_at, next_attempt_at, "+
+			"dead_at "+
+			"FROM pennsieve.upload_outbox WHERE "+where+fmt.Sprintf(" ORDER BY created_at LIMIT %d;", limit), args...)
+	if err != nil {
+		return nil, fmt.Errorf("list selected entries: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e OutboxEntry
+		if err := rows.Scan(&e.ID, &e.OrganizationID, &e.DatasetID, &e.Kind, &e.Attempts, &e.LastError,
+			&e.CreatedAt, &e.NextAttemptAt, &e.DeadAt); err != nil {
+			return nil, err
+		}
+		res.Entries = append(res.Entries, e)
+		log.WithFields(log.Fields{
+			"outbox_id":  e.ID,
+			"org_id":     e.OrganizationID,
+			"dataset_id": e.DatasetID,
+			"kind":       e.Kind,
+			"attempts":   e.Attempts,
+			"last_error": e.LastError,
+			"created_at": e.CreatedAt,
+			"dead":       e.DeadAt != nil,
+		}).Warn("undelivered outbox entry")
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if job.Requeue && !dryRun {
+		r, err := db.ExecContext(ctx,
+			"UPDATE pennsieve.upload_outbox SET next_attempt_at = CURRENT_TIMESTAMP, "+
+				"attempts = CASE WHEN dead_at IS NULL THEN attempts ELSE 0 END, dead_at = NULL WHERE "+where+";", args...)
+		if err != nil {
+			return nil, fmt.Errorf("requeue entries: %w", err)
+		}
+		n, err := r.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+		res.Requeued = int(n)
+	}
+	return res, nil
+}
@@ -0,0 +1,319 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RecomputeStorageJob asks for the package, dataset and organization storage
+// of an organization to be rebuilt from its files table. DatasetID limits the
+// package and dataset recompute to one dataset; the organization total is
+// always the sum of its datasets.
+type RecomputeStorageJob struct {
+	OrganizationID int64 `json:"organizationId"`
+	DatasetID      int64 `json:"datasetId,omitempty"`
+}
+
+// RecomputeStorageResult is the outcome of a RecomputeStorageJob.
+type RecomputeStorageResult struct {
+	DatasetsScanned int `json:"datasetsScanned"`
+	PackagesScanned int `json:"packagesScanned"`
+	// Discrepancies lists every recorded size that differed from the
+	// recomputed one, up to maxReportedDiscrepancies; the counts are exact.
+	Discrepancies        []StorageDiscrepancy `json:"discrepancies,omitempty"`
+	PackageDiscrepancies int                  `json:"packageDiscrepancies"`
+	DatasetDiscrepancies int                  `json:"datasetDiscrepancies"`
+	OrganizationDrift    int64                `json:"organizationDrift"`
+	Fixed                bool                 `json:"fixed"`
+}
+
+// StorageDiscrepancy is a recorded storage size that does not match the
+// files it should account for.
+type StorageDiscrepancy struct {
+	Scope    string `json:"scope"` // package, dataset or organization
+	ID       int64  `json:"id"`
+	Recorded int64  `json:"recorded"`
+	Expected int64  `json:"expected"`
+}
+
+const (
+	maxReportedDiscrepancies = 500
+	// maxRecomputeAttempts bounds the retries of a recompute that a
+	// concurrent import changed storage under.
+	maxRecomputeAttempts = 5
+	// serializationFailure is the SQLSTATE of a REPEATABLE READ transaction
+	// that tried to write a row changed since its snapshot.
+	serializationFailure = "40001"
+)
+
+func (r Result) storageDiscrepancies() int {
+	if r.Storage == nil {
+		return 0
+	}
+	n := r.Storage.PackageDiscrepancies + r.Storage.DatasetDiscrepancies
+	if r.Storage.OrganizationDrift != 0 {
+		n++
+	}
+	return n
+}
+
+// storagePackage is a package with the bytes it occupies itself: its files.
+type storagePackage struct {
+	parentID sql.NullInt64
+	own      int64
+}
+
+// recomputeStorage rebuilds storage from the files table, reports every size
+// that drifted, and overwrites the recorded sizes unless dryRun. A folder
+// accounts for everything below it and a dataset for all its packages.
+// Packages in DELETING state are counted: their files occupy storage until
+// the delete path purges them. Prior versions kept by onConflict=version
+// (state VERSIONED) are counted as well: their objects stay in storage and
+// the import charges them again.
+//
+// Imports add to the same rows while this runs. The recompute reads one
+// REPEATABLE READ snapshot, so a row an import changed after it cannot be
+// overwritten with a stale size: the write fails and the recompute starts
+// over, up to maxRecomputeAttempts times.
+func recomputeStorage(ctx context.Context, db *sql.DB, job RecomputeStorageJob, dryRun bool) (*RecomputeStorageResult, error) {
+	contextLogger := log.WithFields(log.Fields{
+		"org_id":     job.OrganizationID,
+		"dataset_id": job.DatasetID,
+		"dry_run":    dryRun,
+	})
+
+	for attempt := 1; ; attempt++ {
+		res, err := recomputeStorageOnce(ctx, db, job, dryRun, contextLogger)
+		if !isSerializationFailure(err) || attempt == maxRecomputeAttempts {
+			return res, err
+		}
+		contextLogger.WithError(err).WithField("attempt", attempt).
+			Warn("storage changed during the recompute; starting over")
+	}
+}
+
+// isSerializationFailure returns true for the error of a REPEATABLE READ
+// write that lost to a concurrent transaction.
+func isSerializationFailure(err error) bool {
+	var pgErr interface{ SQLState() string }
+	return errors.As(err, &pgErr) && pgErr.SQLState() == serializationFailure
+}
+
+// recomputeStorageOnce is one attempt of recomputeStorage, in one
+// transaction. The discrepancies it reports are only final once it commits.
+func recomputeStorageOnce(ctx context.Context, db *sql.DB, job RecomputeStorageJob, dryRun bool,
+	contextLogger *log.Entry) (*RecomputeStorageResult, error) {
+
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead})
+	if err != nil {
+		return nil, err
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("SET LOCAL search_path = \"%d\";", job.OrganizationID)); err != nil {
+		return nil, fmt.Errorf("set search path: %w", err)
+	}
+
+	datasetIDs := []int64{job.DatasetID}
+	if job.DatasetID == 0 {
+		if datasetIDs, err = queryIDs(ctx, tx, "SELECT id FROM datasets ORDER BY id;"); err != nil {
+			return nil, fmt.Errorf("list datasets: %w", err)
+		}
+	}
+
+	res := &RecomputeStorageResult{}
+	report := func(d StorageDiscrepancy) {
+		contextLogger.WithFields(log.Fields{
+			"scope":    d.Scope,
+			"id":       d.ID,
+			"recorded": d.Recorded,
+			"expected": d.Expected,
+		}).Warn("storage discrepancy")
+		if len(res.Discrepancies) < maxReportedDiscrepancies {
+			res.Discrepancies = append(res.Discrepancies, d)
+		}
+	}
+
+	for _, datasetID := range datasetIDs {
+		expected, datasetTotal, err := expectedPackageStorage(ctx, tx, datasetID)
+		if err != nil {
+			return nil, fmt.Errorf("dataset %d: %w", datasetID, err)
+		}
+		recorded, err := recordedPackageStorage(ctx, tx, datasetID)
+		if err != nil {
+			return nil, fmt.Errorf("dataset %d: %w", datasetID, err)
+		}
+		res.DatasetsScanned++
+		res.PackagesScanned += len(expected)
+
+		for packageID, size := range expected {
+			if recorded[packageID] != size {
+				res.PackageDiscrepancies++
+				report(StorageDiscrepancy{Scope: "package", ID: packageID, Recorded: recorded[packageID], Expected: size})
+				if !dryRun {
+					if err := setPackageStorage(ctx, tx, packageID, size); err != nil {
+						return nil, err
+					}
+				}
+			}
+		}
+
+		var recordedTotal int64
+		err = tx.QueryRowContext(ctx, "SELECT COALESCE((SELECT size FROM dataset_storage WHERE dataset_id = $1), 0);",
+			datasetID).Scan(&recordedTotal)
+		if err != nil {
+			return nil, fmt.Errorf("dataset %d: %w", datasetID, err)
+		}
+		if recordedTotal != datasetTotal {
+			res.DatasetDiscrepancies++
+			report(StorageDiscrepancy{Scope: "dataset", ID: datasetID, Recorded: recordedTotal, Expected: datasetTotal})
+			if !dryRun {
+				_, err := tx.ExecContext(ctx,
+					"INSERT INTO dataset_storage AS dataset_storage (dataset_id, size) VALUES ($1, $2) "+
+						"ON CONFLICT (dataset_id) DO UPDATE SET size = EXCLUDED.size;",
+					datasetID, datasetTotal)
+				if err != nil {
+					return nil, fmt.Errorf("dataset %d: %w", datasetID, err)
+				}
+			}
+		}
+	}
+
+	// Read after the dataset fixes, so the organization total matches them.
+	var recordedOrg, expectedOrg int64
+	err = tx.QueryRowContext(ctx,
+		"SELECT COALESCE((SELECT size FROM pennsieve.organization_storage WHERE organization_id = $1), 0), "+
+			"COALESCE((SELECT SUM(size) FROM dataset_storage), 0);",
+		job.OrganizationID).Scan(&recordedOrg, &expectedOrg)
+	if err != nil {
+		return nil, fmt.Errorf("organization storage: %w", err)
+	}
+	if recordedOrg != expectedOrg {
+		res.OrganizationDrift = recordedOrg - expectedOrg
+		report(StorageDiscrepancy{Scope: "organization", ID: job.OrganizationID, Recorded: recordedOrg, Expected: expectedOrg})
+		if !dryRun {
+			_, err := tx.ExecContext(ctx,
+				"INSERT INTO pennsieve.organization_storage AS organization_storage (organization_id, size) "+
+					"VALUES ($1, $2) ON CONFLICT (organization_id) DO UPDATE SET size = EXCLUDED.size;",
+				job.OrganizationID, expectedOrg)
+			if err != nil {
+				return nil, fmt.Errorf("organization storage: %w", err)
+			}
+		}
+	}
+
+	if dryRun {
+		return res, nil
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	res.Fixed = true
+	return res, nil
+}
+
+// expectedPackageStorage returns the size each package of the dataset should
+// record, and the size of the dataset.
+func expectedPackageStorage(ctx context.Context, tx *sql.Tx, datasetID int64) (map[int64]int64, int64, error) {
+	packages := map[int64]*storagePackage{}
+	rows, err := tx.QueryContext(ctx,
+		"SELECT p.id, p.parent_id, COALESCE((SELECT SUM(f.size) FROM files f WHERE f.package_id = p.id), 0) "+
+			"FROM packages p WHERE p.dataset_id = $1;",
+		datasetID)
+	if err != nil {
+		return nil, 0, err
+	}
+	for rows.Next() {
+		var id int64
+		p := &storagePackage{}
+		if err := rows.Scan(&id, &p.parentID, &p.own); err != nil {
+			rows.Close()
+			return nil, 0, err
+		}
+		packages[id] = p
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	expected := make(map[int64]int64, len(packages))
+	var total int64
+	for id, p := range packages {
+		expected[id] += p.own
+		total += p.own
+		if p.own == 0 {
+			continue
+		}
+		// Walk up to the dataset root. The visited set guards against a
+		// corrupt parent cycle.
+		visited := map[int64]bool{id: true}
+		for parent := p.parentID; parent.Valid && !visited[parent.Int64]; {
+			visited[parent.Int64] = true
+			ancestor, ok := packages[parent.Int64]
+			if !ok {
+				break
+			}
+			expected[parent.Int64] += p.own
+			parent = ancestor.parentID
+		}
+	}
+	return expected, total, nil
+}
+
+// recordedPackageStorage returns the package_storage sizes of the packages
+// of the dataset. Packages without a row are absent.
+func recordedPackageStorage(ctx context.Context, tx *sql.Tx, datasetID int64) (map[int64]int64, error) {
+	rows, err := tx.QueryContext(ctx,
+		"SELECT ps.package_id, COALESCE(ps.size, 0) FROM package_storage ps "+
+			"JOIN packages p ON p.id = ps.package_id WHERE p.dataset_id = $1;",
+		datasetID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	recorded := map[int64]int64{}
+	for rows.Next() {
+		var id, size int64
+		if err := rows.Scan(&id, &size); err != nil {
+			return nil, err
+		}
+		recorded[id] = size
+	}
+	return recorded, rows.Err()
+}
+
+func setPackageStorage(ctx context.Context, tx *sql.Tx, packageID int64, size int64) error {
+	_, err := tx.ExecContext(ctx,
+		"INSERT INTO package_storage AS package_storage (package_id, size) VALUES ($1, $2) "+
+			"ON CONFLICT (package_id) DO UPDATE SET size = EXCLUDED.size;",
+		packageID, size)
+	if err != nil {
+		return fmt.Errorf("package %d: %w", packageID, err)
+	}
+	return nil
+}
+
+func queryIDs(ctx context.Context, tx *sql.Tx, query string, args ...any) ([]int64, error) {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
@@ -0,0 +1,209 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/google/uuid"
+	pgQueries "github.com/pennsieve/pennsieve-go-core/pkg/queries/pgdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecomputeStorage(t *testing.T) {
+	db, err := pgQueries.ConnectENV()
+	require.NoError(t, err)
+	defer db.Close()
+
+	for scenario, fn := range map[string]func(t *testing.T, db *sql.DB){
+		"computes package, dataset and organization totals": testRecomputeStorage,
+		"dry run reports without fixing":                    testRecomputeStorageDryRun,
+		"counts packages until they are purged":             testRecomputeStorageDeleting,
+		"counts prior versions":                             testRecomputeStorageVersioned,
+		"reports nothing when storage is correct":           testRecomputeStorageCorrect,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			truncateTestTables(t, db)
+			t.Cleanup(func() { truncateTestTables(t, db) })
+			fn(t, db)
+		})
+	}
+}
+
+func TestIsSerializationFailure(t *testing.T) {
+	assert.True(t, isSerializationFailure(fmt.Errorf("dataset 1: %w", sqlStateError("40001"))))
+	assert.False(t, isSerializationFailure(sqlStateError("23505")))
+	assert.False(t, isSerializationFailure(errors.New("could not serialize access")))
+	assert.False(t, isSerializationFailure(nil))
+}
+
+// testStorageTree is a folder holding a package and a subfolder, which holds
+// another package:
+//
+//	data/          30
+//	  a.txt        10
+//	  sub/         20
+//	    b.txt      20
+type testStorageTree struct {
+	data, a, sub, b int64
+}
+
+func insertTestStorageTree(t *testing.T, db *sql.DB) testStorageTree {
+	var tree testStorageTree
+	tree.data = insertTestPackage(t, db, nil, "data", "Collection")
+	tree.a = insertTestPackage(t, db, &tree.data, "a.txt", "Text")
+	tree.sub = insertTestPackage(t, db, &tree.data, "sub", "Collection")
+	tree.b = insertTestPackage(t, db, &tree.sub, "b.txt", "Text")
+	insertTestFile(t, db, tree.a, 10)
+	insertTestFile(t, db, tree.b, 15)
+	insertTestFile(t, db, tree.b, 5)
+	return tree
+}
+
+func testRecomputeStorage(t *testing.T, db *sql.DB) {
+	tree := insertTestStorageTree(t, db)
+	setTestStorage(t, db, map[int64]int64{tree.data: 5, tree.a: 10, tree.b: 99}, 7, 1000)
+
+	res, err := recomputeStorage(context.Background(), db, testRecomputeJob(), false)
+	require.NoError(t, err)
+	assert.True(t, res.Fixed)
+	assert.Equal(t, 1, res.DatasetsScanned)
+	assert.Equal(t, 4, res.PackagesScanned)
+	assert.Equal(t, 3, res.PackageDiscrepancies, "data and b drifted, sub had no row")
+	assert.Equal(t, 1, res.DatasetDiscrepancies)
+	assert.Equal(t, int64(1000-30), res.OrganizationDrift)
+	assert.Contains(t, res.Discrepancies, StorageDiscrepancy{Scope: "package", ID: tree.sub, Recorded: 0, Expected: 20})
+
+	assert.Equal(t, map[int64]int64{tree.data: 30, tree.a: 10, tree.sub: 20, tree.b: 20}, testPackageStorage(t, db))
+	datasetSize, orgSize := testDatasetAndOrgStorage(t, db)
+	assert.Equal(t, int64(30), datasetSize)
+	assert.Equal(t, int64(30), orgSize)
+}
+
+func testRecomputeStorageDryRun(t *testing.T, db *sql.DB) {
+	tree := insertTestStorageTree(t, db)
+	recorded := map[int64]int64{tree.data: 5, tree.a: 10, tree.sub: 20, tree.b: 99}
+	setTestStorage(t, db, recorded, 7, 1000)
+
+	res, err := recomputeStorage(context.Background(), db, testRecomputeJob(), true)
+	require.NoError(t, err)
+	assert.False(t, res.Fixed)
+	assert.Equal(t, 2, res.PackageDiscrepancies)
+	assert.Equal(t, 1, res.DatasetDiscrepancies)
+	assert.ElementsMatch(t, []StorageDiscrepancy{
+		{Scope: "package", ID: tree.data, Recorded: 5, Expected: 30},
+		{Scope: "package", ID: tree.b, Recorded: 99, Expected: 20},
+		{Scope: "dataset", ID: testDatasetID, Recorded: 7, Expected: 30},
+		{Scope: "organization", ID: testOrgID, Recorded: 1000, Expected: 7},
+	}, res.Discrepancies, "the organization is compared with the recorded dataset sizes, which a dry run keeps")
+
+	assert.Equal(t, recorded, testPackageStorage(t, db))
+	datasetSize, orgSize := testDatasetAndOrgStorage(t, db)
+	assert.Equal(t, int64(7), datasetSize)
+	assert.Equal(t, int64(1000), orgSize)
+}
+
+func testRecomputeStorageDeleting(t *testing.T, db *sql.DB) {
+	tree := insertTestStorageTree(t, db)
+	setTestPackageState(t, db, tree.b, "DELETING")
+
+	_, err := recomputeStorage(context.Background(), db, testRecomputeJob(), false)
+	require.NoError(t, err)
+
+	assert.Equal(t, map[int64]int64{tree.data: 30, tree.a: 10, tree.sub: 20, tree.b: 20}, testPackageStorage(t, db))
+	datasetSize, _ := testDatasetAndOrgStorage(t, db)
+	assert.Equal(t, int64(30), datasetSize)
+}
+
+func testRecomputeStorageVersioned(t *testing.T, db *sql.DB) {
+	tree := insertTestStorageTree(t, db)
+	prior := insertTestPackage(t, db, &tree.sub, "b.txt", "Text")
+	insertTestFile(t, db, prior, 50)
+	setTestPackageState(t, db, prior, "VERSIONED")
+
+	res, err := recomputeStorage(context.Background(), db, testRecomputeJob(), false)
+	require.NoError(t, err)
+	assert.Equal(t, 5, res.PackagesScanned)
+
+	storage := testPackageStorage(t, db)
+	assert.Equal(t, int64(70), storage[tree.sub])
+	assert.Equal(t, int64(50), storage[prior])
+	datasetSize, _ := testDatasetAndOrgStorage(t, db)
+	assert.Equal(t, int64(80), datasetSize)
+}
+
+func testRecomputeStorageCorrect(t *testing.T, db *sql.DB) {
+	tree := insertTestStorageTree(t, db)
+	setTestStorage(t, db, map[int64]int64{tree.data: 30, tree.a: 10, tree.sub: 20, tree.b: 20}, 30, 30)
+
+	res, err := recomputeStorage(context.Background(), db, testRecomputeJob(), false)
+	require.NoError(t, err)
+	assert.Equal(t, RecomputeStorageResult{DatasetsScanned: 1, PackagesScanned: 4, Fixed: true}, *res)
+}
+
+func testRecomputeJob() RecomputeStorageJob {
+	return RecomputeStorageJob{OrganizationID: testOrgID, DatasetID: testDatasetID}
+}
+
+// sqlStateError stands in for a driver error carrying a SQLSTATE.
+type sqlStateError string
+
+func (e sqlStateError) Error() string    { return "pq: " + string(e) }
+func (e sqlStateError) SQLState() string { return string(e) }
+
+func insertTestFile(t *testing.T, db *sql.DB, packageID int64, size int64) {
+	id := uuid.NewString()
+	_, err := db.Exec(fmt.Sprintf(`INSERT INTO "%d".files (package_id, name, file_type, s3_bucket, s3_key,
+		object_type, size, checksum, uuid, processing_state, uploaded_state, created_at, updated_at)
+		VALUES ($1, $2, 'Text', 'test-bucket', $2, 'source', $3, '{}', $4, 'unprocessed', 'uploaded', now(), now())`,
+		testOrgID), packageID, "file-"+id, size, id)
+	require.NoError(t, err)
+}
+
+func setTestPackageState(t *testing.T, db *sql.DB, packageID int64, state string) {
+	_, err := db.Exec(fmt.Sprintf(`UPDATE "%d".packages SET state = $2 WHERE id = $1`, testOrgID), packageID, state)
+	require.NoError(t, err)
+}
+
+// setTestStorage records package, dataset and organization sizes.
+func setTestStorage(t *testing.T, db *sql.DB, packages map[int64]int64, dataset int64, organization int64) {
+	for id, size := range packages {
+		_, err := db.Exec(fmt.Sprintf(`INSERT INTO "%d".package_storage (package_id, size) VALUES ($1, $2)`,
+			testOrgID), id, size)
+		require.NoError(t, err)
+	}
+	_, err := db.Exec(fmt.Sprintf(`INSERT INTO "%d".dataset_storage (dataset_id, size) VALUES ($1, $2)`,
+		testOrgID), testDatasetID, dataset)
+	require.NoError(t, err)
+	_, err = db.Exec(`INSERT INTO pennsieve.organization_storage (organization_id, size) VALUES ($1, $2)`,
+		testOrgID, organization)
+	require.NoError(t, err)
+}
+
+func testPackageStorage(t *testing.T, db *sql.DB) map[int64]int64 {
+	rows, err := db.Query(fmt.Sprintf(`SELECT package_id, size FROM "%d".package_storage`, testOrgID))
+	require.NoError(t, err)
+	defer rows.Close()
+
+	sizes := map[int64]int64{}
+	for rows.Next() {
+		var id, size int64
+		require.NoError(t, rows.Scan(&id, &size))
+		sizes[id] = size
+	}
+	require.NoError(t, rows.Err())
+	return sizes
+}
+
+func testDatasetAndOrgStorage(t *testing.T, db *sql.DB) (int64, int64) {
+	var datasetSize, orgSize int64
+	err := db.QueryRow(fmt.Sprintf(`SELECT
+		COALESCE((SELECT size FROM "%d".dataset_storage WHERE dataset_id = $1), 0),
+		COALESCE((SELECT size FROM pennsieve.organization_storage WHERE organization_id = $2), 0)`, testOrgID),
+		testDatasetID, testOrgID).Scan(&datasetSize, &orgSize)
+	require.NoError(t, err)
+	return datasetSize, orgSize
+}
@@ -0,0 +1,164 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dyTypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/pennsieve/pennsieve-go-core/pkg/models/manifest/manifestFile"
+	"github.com/pennsieve/pennsieve-upload-service-v2/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+// SHA256Job is a request to hash an imported object and compare it with the
+// SHA256 the client declared at finalize. Finalize sends one per file whose
+// object S3 stored no SHA256 checksum for and that did not fit the bytes it
+// hashes inline. Mirrors sha256VerificationJob in lambda/service/handler.
+type SHA256Job struct {
+	OrganizationID int64  `json:"organizationId"`
+	ManifestID     string `json:"manifestId,omitempty"`
+	UploadID       string `json:"uploadId"`
+	Bucket         string `json:"bucket"`
+	Key            string `json:"key"`
+	DeclaredSHA256 string `json:"declaredSha256"`
+}
+
+// SHA256Result is the outcome of a SHA256Job.
+type SHA256Result struct {
+	UploadID string `json:"uploadId"`
+	SHA256   string `json:"sha256"`
+	Verified bool   `json:"verified"`
+}
+
+func (r Result) checksumMismatches() int {
+	if r.SHA256 != nil && !r.SHA256.Verified {
+		return 1
+	}
+	return 0
+}
+
+// errFileNotImported is returned while the upload lambda has not created the
+// file row yet.
+var errFileNotImported = errors.New("file not imported yet")
+
+// verifySHA256 streams the object through SHA256 and records the result in
+// file_server_sha256. On a mismatch the file is failed: its package is set to
+// UPLOAD_FAILED in the same transaction, and its manifest file to Failed with
+// the mismatch as reason. A mismatch is not returned: retrying would compute
+// the same value.
+func verifySHA256(ctx context.Context, backend storage.StorageBackend, db *sql.DB, dy *dynamodb.Client,
+	manifestFileTable string, job SHA256Job) (*SHA256Result, error) {
+	contextLogger := log.WithFields(log.Fields{
+		"org_id":    job.OrganizationID,
+		"upload_id": job.UploadID,
+		"bucket":    job.Bucket,
+		"key":       job.Key,
+	})
+
+	body, err := backend.Open(ctx, job.Bucket, job.Key)
+	if err != nil {
+		return nil, fmt.Errorf("get object %s: %w", job.Key, err)
+	}
+	defer body.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, body); err != nil {
+		return nil, fmt.Errorf("read object %s: %w", job.Key, err)
+	}
+	res := &SHA256Result{
+		UploadID: job.UploadID,
+		SHA256:   base64.StdEncoding.EncodeToString(h.Sum(nil)),
+	}
+	res.Verified = res.SHA256 == job.DeclaredSHA256
+
+	if err := recordServerSHA256(ctx, db, job, res); err != nil {
+		return nil, err
+	}
+
+	if res.Verified {
+		contextLogger.Info("sha256 verified")
+		return res, nil
+	}
+
+	contextLogger.WithFields(log.Fields{
+		"declared_sha256": job.DeclaredSHA256,
+		"sha256":          res.SHA256,
+	}).Error("sha256 mismatch for imported file; failing it")
+	if job.ManifestID != "" {
+		// Jobs sent before the manifest id was added only fail the package.
+		if err := failManifestFile(ctx, dy, manifestFileTable, job, res); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// failManifestFile sets the manifest file of a file whose content does not
+// match its declared SHA256 to Failed, with the mismatch as reason.
+func failManifestFile(ctx context.Context, dy *dynamodb.Client, manifestFileTable string, job SHA256Job,
+	res *SHA256Result) error {
+	_, err := dy.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(manifestFileTable),
+		Key: map[string]dyTypes.AttributeValue{
+			"ManifestId": &dyTypes.AttributeValueMemberS{Value: job.ManifestID},
+			"UploadId":   &dyTypes.AttributeValueMemberS{Value: job.UploadID},
+		},
+		UpdateExpression:    aws.String("SET #s = :failed, StatusReason = :reason"),
+		ConditionExpression: aws.String("attribute_exists(UploadId)"),
+		ExpressionAttributeNames: map[string]string{
+			"#s": "Status",
+		},
+		ExpressionAttributeValues: map[string]dyTypes.AttributeValue{
+			":failed": &dyTypes.AttributeValueMemberS{Value: manifestFile.Failed.String()},
+			":reason": &dyTypes.AttributeValueMemberS{Value: fmt.Sprintf(
+				"checksum mismatch: declared sha256 %s, stored object has %s", job.DeclaredSHA256, res.SHA256)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("fail manifest file %s: %w", job.UploadID, err)
+	}
+	return nil
+}
+
+func recordServerSHA256(ctx context.Context, db *sql.DB, job SHA256Job, res *SHA256Result) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("SET LOCAL search_path = \"%d\";", job.OrganizationID)); err != nil {
+		return fmt.Errorf("set search path: %w", err)
+	}
+	r, err := tx.ExecContext(ctx,
+		"INSERT INTO file_server_sha256 (file_id, sha256, declared_sha256, verified, computed_by) "+
+			"SELECT id, $2, $3, $4, 'reconcile' FROM files WHERE uuid = $1 "+
+			"ON CONFLICT (file_id) DO UPDATE SET sha256 = EXCLUDED.sha256, "+
+			"declared_sha256 = EXCLUDED.declared_sha256, verified = EXCLUDED.verified, "+
+			"computed_by = EXCLUDED.computed_by;",
+		job.UploadID, res.SHA256, job.DeclaredSHA256, res.Verified)
+	if err != nil {
+		return fmt.Errorf("record sha256 for %s: %w", job.UploadID, err)
+	}
+	if n, _ := r.RowsAffected(); n == 0 {
+		return fmt.Errorf("record sha256 for %s: %w", job.UploadID, errFileNotImported)
+	}
+	if !res.Verified {
+		_, err = tx.ExecContext(ctx,
+			"UPDATE packages SET state = 'UPLOAD_FAILED' "+
+				"WHERE id = (SELECT package_id FROM files WHERE uuid = $1) AND state NOT IN ('DELETING', 'VERSIONED');",
+			job.UploadID)
+		if err != nil {
+			return fmt.Errorf("fail package of %s: %w", job.UploadID, err)
+		}
+	}
+	return tx.Commit()
+}
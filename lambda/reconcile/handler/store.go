@@ -2,38 +2,39 @@ package handler
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"strings"
 	"sync"
 	"time"
 
-	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	dyTypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/sqs"
 	sqsTypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
 	"github.com/pennsieve/pennsieve-go-core/pkg/models/dydb"
 	"github.com/pennsieve/pennsieve-go-core/pkg/models/manifest/manifestFile"
-	dyQueries "github.com/pennsieve/pennsieve-go-core/pkg/queries/dydb"
 	pgQueries "github.com/pennsieve/pennsieve-go-core/pkg/queries/pgdb"
+	"github.com/pennsieve/pennsieve-upload-service-v2/storage"
+	"github.com/pennsieve/pennsieve-upload-service-v2/storage/finalize"
 	log "github.com/sirupsen/logrus"
 )
 
 type store struct {
-	dy  *dynamodb.Client
-	s3  *s3.Client
-	sqs *sqs.Client
-	pg  *pgQueries.Queries
+	dy      *dynamodb.Client
+	backend storage.StorageBackend
+	sqs     *sqs.Client
+	pg      *pgQueries.Queries
+	db      *sql.DB
+
+	resolver *storage.Resolver
 
 	manifestTable         string
 	manifestFileTable     string
 	uploadTriggerQueueURL string
-	defaultStorageBucket  string
 
 	// mu serializes Result/PerManifest updates across the worker pool.
 	// Lives on the store so the Handle goroutine can safely snapshot
@@ -42,35 +43,71 @@ type store struct {
 }
 
 // resolvedManifest is what we need to reconstruct an S3 key and decide the
-// destination bucket. Cached per-manifest within a run so we hit Postgres
-// at most once per manifest.
+// destination bucket. Resolutions are cached by the shared storage resolver,
+// so Postgres is hit at most once per manifest per TTL.
 type resolvedManifest struct {
-	manifest      *dydb.ManifestTable
+	manifest      storage.Manifest
 	storageBucket string
 	keyPrefix     string // O{org}/D{ds}/{manifest}
 }
 
 func (s *store) resolveManifest(ctx context.Context, manifestID string) (*resolvedManifest, error) {
-	dy := dyQueries.New(s.dy)
-	m, err := dy.GetManifestById(ctx, s.manifestTable, manifestID)
+	r, err := s.resolver.Resolve(ctx, storageSource{s: s}, manifestID)
 	if err != nil {
-		return nil, fmt.Errorf("get manifest %s: %w", manifestID, err)
+		return nil, err
 	}
-	org, err := s.pg.GetOrganization(ctx, m.OrganizationId)
+	return &resolvedManifest{
+		manifest:      r.Manifest,
+		storageBucket: r.StorageBucket,
+		keyPrefix:     r.KeyPrefix(manifestID),
+	}, nil
+}
+
+// storageSource implements storage.Source with the reconcile lambda's
+// pennsieve-go-core queries.
+type storageSource struct {
+	s *store
+}
+
+// Manifest gets the item directly so that a missing manifest is reported as
+// storage.ErrManifestNotFound; GetManifestById only says so in its message.
+func (src storageSource) Manifest(ctx context.Context, manifestID string) (storage.Manifest, error) {
+	out, err := src.s.dy.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(src.s.manifestTable),
+		Key: map[string]dyTypes.AttributeValue{
+			"ManifestId": &dyTypes.AttributeValueMemberS{Value: manifestID},
+		},
+	})
 	if err != nil {
-		return nil, fmt.Errorf("get organization %d: %w", m.OrganizationId, err)
+		return storage.Manifest{}, fmt.Errorf("get manifest %s: %w", manifestID, err)
 	}
-	bucket := s.defaultStorageBucket
-	if org.StorageBucket.Valid {
-		bucket = org.StorageBucket.String
+	if out.Item == nil {
+		return storage.Manifest{}, storage.ErrManifestNotFound
 	}
-	return &resolvedManifest{
-		manifest:      m,
-		storageBucket: bucket,
-		keyPrefix:     fmt.Sprintf("O%d/D%d/%s", m.OrganizationId, m.DatasetId, manifestID),
+	var m dydb.ManifestTable
+	if err := attributevalue.UnmarshalMap(out.Item, &m); err != nil {
+		return storage.Manifest{}, fmt.Errorf("unmarshal manifest %s: %w", manifestID, err)
+	}
+	return storage.Manifest{
+		ManifestId:     m.ManifestId,
+		OrganizationId: m.OrganizationId,
+		DatasetId:      m.DatasetId,
+		DateCreated:    m.DateCreated,
 	}, nil
 }
 
+func (src storageSource) DatasetBucket(ctx context.Context, orgID int64, datasetID int64) (string, bool, error) {
+	return storage.QueryDatasetBucket(ctx, src.s.db, orgID, datasetID)
+}
+
+func (src storageSource) OrganizationBucket(ctx context.Context, orgID int64) (string, bool, error) {
+	org, err := src.s.pg.GetOrganization(ctx, orgID)
+	if err != nil {
+		return "", false, err
+	}
+	return org.StorageBucket.String, org.StorageBucket.Valid, nil
+}
+
 // reconcileManifest recovers all stuck-Registered files for a single
 // manifest (one-shot mode). HEAD calls are fanned out across `concurrency`
 // goroutines bounded by a semaphore — S3 HEAD is network-bound, so 16-way
@@ -156,7 +193,7 @@ func (s *store) reconcileByGracePeriod(ctx context.Context, gracePeriodHours int
 					// clean orphan. Any other resolve error (Postgres 5xx,
 					// throttling, missing org row, etc.) might be transient,
 					// so we skip-without-flipping and let a future run retry.
-					if isManifestNotFound(err) {
+					if errors.Is(err, storage.ErrManifestNotFound) {
 						missingManifests[manifestID] = true
 					}
 					if !missingManifests[manifestID] {
@@ -221,14 +258,6 @@ func (s *store) reconcileByGracePeriod(ctx context.Context, gracePeriodHours int
 	return nil
 }
 
-// isManifestNotFound matches the hardcoded error string from
-// pennsieve-go-core's GetManifestById (no sentinel error or typed error
-// exists in that package). Other resolve errors (Postgres failures,
-// throttles, bad org rows) must not trigger an orphan flip.
-func isManifestNotFound(err error) bool {
-	return err != nil && strings.Contains(err.Error(), "Manifest not found")
-}
-
 // markOrphanedRow flips a single manifest_files row whose parent manifest
 // is known-gone. Separate from reconcileFile because there's no bucket or
 // keyPrefix to resolve — all we have is manifestID + uploadID.
@@ -291,10 +320,7 @@ func (s *store) reconcileFile(
 	s.bumpScanned(result, manifestID)
 
 	key := fmt.Sprintf("%s/%s", resolved.keyPrefix, uploadID)
-	head, err := s.s3.HeadObject(ctx, &s3.HeadObjectInput{
-		Bucket: aws.String(resolved.storageBucket),
-		Key:    aws.String(key),
-	})
+	info, err := s.backend.Stat(ctx, resolved.storageBucket, key)
 	if err != nil {
 		// S3 is strongly consistent for read-after-write (since 2020), so a
 		// NotFound / 404 on HEAD means the object was never written or has
@@ -303,7 +329,7 @@ func (s *store) reconcileFile(
 		// Registered query doesn't match). Other errors (5xx, throttle,
 		// permission) are transient — leave Registered so the next
 		// scheduled run retries.
-		if isS3NotFound(err) {
+		if errors.Is(err, storage.ErrObjectNotFound) {
 			s.bumpMissing(result, manifestID)
 			if !dryRun {
 				if updErr := s.markFailedOrphan(ctx, manifestID, uploadID); updErr != nil {
@@ -331,12 +357,12 @@ func (s *store) reconcileFile(
 			"manifest_id": manifestID,
 			"upload_id":   uploadID,
 			"key":         key,
-			"size":        aws.ToInt64(head.ContentLength),
+			"size":        info.Size,
 		}).Info("dry-run: would enqueue recovery")
 		return
 	}
 
-	if err := s.enqueueRecovery(ctx, resolved.storageBucket, key, aws.ToInt64(head.ContentLength)); err != nil {
+	if err := s.enqueueRecovery(ctx, manifestID, uploadID, info); err != nil {
 		s.mu.Lock()
 		result.EnqueueFailed++
 		result.Errors = append(result.Errors, fmt.Sprintf("enqueue %s: %v", uploadID, err))
@@ -429,16 +455,27 @@ func (s *store) markFailedOrphan(ctx context.Context, manifestID, uploadID strin
 	return nil
 }
 
-func (s *store) enqueueRecovery(ctx context.Context, bucket, key string, size int64) error {
-	ev := events.S3Event{Records: []events.S3EventRecord{{
-		EventSource: "aws:s3",
-		EventName:   "ObjectCreated:Put",
-		S3: events.S3Entity{
-			Bucket: events.S3Bucket{Name: bucket},
-			Object: events.S3Object{Key: key, Size: size},
+// enqueueRecovery sends a finalize message for a recovered object to the
+// upload trigger queue. The original conflict strategy is not known here, so
+// the import uses the keepBoth default.
+func (s *store) enqueueRecovery(ctx context.Context, manifestID, uploadID string, info storage.ObjectInfo) error {
+	msg := finalize.Message{
+		Type:       finalize.MessageType,
+		Version:    finalize.MessageVersion,
+		Bucket:     info.Bucket,
+		Key:        info.Key,
+		ManifestID: manifestID,
+		UploadID:   uploadID,
+		Size:       info.Size,
+		ETag:       info.ETag,
+		Checksum: &finalize.Checksum{
+			Algorithm: info.Checksum.Algorithm,
+			Type:      info.Checksum.Type,
+			Value:     info.Checksum.Value,
 		},
-	}}}
-	body, err := json.Marshal(ev)
+		Source: finalize.SourceReconcile,
+	}
+	body, err := json.Marshal(msg)
 	if err != nil {
 		return err
 	}
@@ -449,27 +486,6 @@ func (s *store) enqueueRecovery(ctx context.Context, bucket, key string, size in
 	return err
 }
 
-func isS3NotFound(err error) bool {
-	var notFound *types404
-	if errors.As(err, &notFound) {
-		return true
-	}
-	// Fallback: the SDK exposes the code via the wrapped http response. Match
-	// the common string forms; StatusCode: 404 is what S3 returns for HEAD
-	// on a missing key.
-	msg := err.Error()
-	return strings.Contains(msg, "StatusCode: 404") ||
-		strings.Contains(msg, "NotFound") ||
-		strings.Contains(msg, "NoSuchKey")
-}
-
-// types404 is a placeholder for errors.As; aws-sdk-go-v2 v1.51.4 does expose
-// a typed NotFound but depending on the operation the concrete type differs.
-// The string-match fallback above catches the remaining cases.
-type types404 struct{}
-
-func (types404) Error() string { return "NotFound" }
-
 func timestampMillis() int64 {
 	return time.Now().UnixMilli()
 }
@@ -13,6 +13,7 @@ require (
 	github.com/aws/aws-sdk-go-v2/service/dynamodb v1.30.4
 	github.com/google/uuid v1.6.0
 	github.com/pennsieve/pennsieve-go-core v1.16.1
+	github.com/pennsieve/pennsieve-upload-service-v2/storage v0.0.0-00010101000000-000000000000
 	github.com/sirupsen/logrus v1.9.3
 	github.com/valyala/fastjson v1.6.4
 )
@@ -54,3 +55,5 @@ require (
 	gopkg.in/yaml.v2 v2.4.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
+
+replace github.com/pennsieve/pennsieve-upload-service-v2/storage => ../../storage
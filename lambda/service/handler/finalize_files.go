@@ -3,6 +3,7 @@ package handler
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"sync"
@@ -11,16 +12,14 @@ import (
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	dyTypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
-	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/aws/aws-sdk-go-v2/service/sqs"
 	sqsTypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
 	"github.com/pennsieve/pennsieve-go-core/pkg/authorizer"
 	"github.com/pennsieve/pennsieve-go-core/pkg/models/gateway"
 	"github.com/pennsieve/pennsieve-go-core/pkg/models/manifest/manifestFile"
 	pgQueries "github.com/pennsieve/pennsieve-go-core/pkg/queries/pgdb"
-	dyQueriesNs "github.com/pennsieve/pennsieve-go-core/pkg/queries/dydb"
-	"github.com/pennsieve/pennsieve-upload-service-v2/service/pkg/storage"
+	"github.com/pennsieve/pennsieve-upload-service-v2/service/pkg/checksum"
+	"github.com/pennsieve/pennsieve-upload-service-v2/storage"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -30,7 +29,8 @@ import (
 // is observed around 17 ms/file on the 10k-file test, so 250 = ~4.5s of
 // lambda time plus overhead. Keep in sync with the agent's dispatch batch
 // size in pkg/server/upload.go (finalizeBatcher.maxBatch) and the
-// maxItems constraint in terraform/upload-service.yml.
+// files description in terraform/upload-service.yml (maxItems there is the
+// async limit, maxAsyncFinalizeBatch).
 const maxFinalizeBatch = 250
 
 // headConcurrency caps how many HeadObject calls run in parallel per invocation.
@@ -40,6 +40,27 @@ type finalizeFileRequest struct {
 	UploadID string `json:"uploadId"`
 	Size     int64  `json:"size"`
 	SHA256   string `json:"sha256,omitempty"`
+	// ChecksumAlgorithm, ChecksumType and Checksum declare a checksum in any
+	// algorithm S3 supports. When Checksum is empty, SHA256 is used as a
+	// SHA256 checksum of undeclared type, which is what older clients send.
+	ChecksumAlgorithm string `json:"checksumAlgorithm,omitempty"`
+	ChecksumType      string `json:"checksumType,omitempty"`
+	Checksum          string `json:"checksum,omitempty"`
+	// OnConflict overrides finalizeRequest.OnConflict for this file. Empty
+	// inherits the request-level value.
+	OnConflict string `json:"onConflict,omitempty"`
+
+	// declared is the parsed checksum, set during validation.
+	declared checksum.Checksum
+	// serverSHA256 is the SHA256 the service computed for an object S3 has no
+	// SHA256 checksum for; sha256Pending marks an object that didn't fit the
+	// request's hash budget, which is verified after import instead.
+	serverSHA256  string
+	sha256Pending bool
+	// stored and etag describe the object as finalize read it; they are
+	// passed on to the upload lambda in the finalize message.
+	stored storage.ObjectChecksum
+	etag   string
 }
 
 type finalizeRequest struct {
@@ -47,30 +68,49 @@ type finalizeRequest struct {
 	Files          []finalizeFileRequest `json:"files"`
 	// OnConflict controls how the upload lambda resolves name collisions with
 	// existing non-deleted packages under the same (dataset, folder) tuple.
-	// Values: "keepBoth" (default, auto-rename to " (N)") or "replace"
-	// (soft-delete predecessor and record provenance). Empty string is
-	// treated as "keepBoth" for backward compatibility with older clients.
+	// Values: "keepBoth" (default, auto-rename to " (N)"), "replace"
+	// (soft-delete predecessor and record provenance), "version" (like
+	// replace, but the predecessor is kept as a prior version of the new
+	// package instead of being deleted), "skip" (keep the
+	// existing package, mark the file Skipped and delete the uploaded object)
+	// or "fail" (mark the file Failed with the conflict as reason). Empty
+	// string is treated as "keepBoth" for backward compatibility with older
+	// clients.
 	OnConflict string `json:"onConflict,omitempty"`
 }
 
 const (
 	onConflictKeepBoth = "keepBoth"
 	onConflictReplace  = "replace"
+	onConflictVersion  = "version"
+	onConflictSkip     = "skip"
+	onConflictFail     = "fail"
 )
 
+// onConflictValuesMsg is the 400 message for an unsupported onConflict value.
+const onConflictValuesMsg = "onConflict must be one of: keepBoth, replace, version, skip, fail"
+
 func validOnConflict(s string) bool {
 	switch s {
-	case "", onConflictKeepBoth, onConflictReplace:
+	case "", onConflictKeepBoth, onConflictReplace, onConflictVersion, onConflictSkip, onConflictFail:
 		return true
 	default:
 		return false
 	}
 }
 
+// manifestFileStatusSkipped is the manifest_files status the upload lambda
+// writes for files dropped by onConflict=skip. Not part of pennsieve-go-core's
+// manifestFile.Status enum; see the upload lambda's dyQueries.go.
+const manifestFileStatusSkipped = "Skipped"
+
 type finalizeResult struct {
 	UploadID string `json:"uploadId"`
-	Status   string `json:"status"` // "finalized" | "failed"
+	Status   string `json:"status"` // "finalized" | "skipped" | "failed"
 	Error    string `json:"error,omitempty"`
+	// ChecksumPending is set on a finalized file whose SHA256 is verified
+	// asynchronously after import (see server_checksum.go).
+	ChecksumPending bool `json:"checksumPending,omitempty"`
 }
 
 type finalizeResponse struct {
@@ -81,23 +121,32 @@ type finalizeResponse struct {
 // agent calls this after it has successfully PUT each file directly to the
 // storage bucket; we verify, import into Postgres, and mark the manifest file
 // Finalized. Idempotent per uploadId.
+//
+// With ?async=true the batch may hold up to maxAsyncFinalizeBatch files; it is
+// verified and enqueued by a background finalize job and the response is 202
+// with the job id (see finalize_jobs.go).
 func postFinalizeFilesRoute(request events.APIGatewayV2HTTPRequest, claims *authorizer.Claims) (*events.APIGatewayV2HTTPResponse, error) {
 	var req finalizeRequest
 	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
 		log.WithError(err).Warn("finalize: invalid request body")
 		return errResp(400, "invalid request body")
 	}
+	async := request.QueryStringParameters["async"] == "true"
+	maxBatch := maxFinalizeBatch
+	if async {
+		maxBatch = maxAsyncFinalizeBatch
+	}
 	if !isValidUUID(req.ManifestNodeID) {
 		return errResp(400, "manifestNodeId must be a UUID")
 	}
 	if len(req.Files) == 0 {
 		return errResp(400, "files is required and must be non-empty")
 	}
-	if len(req.Files) > maxFinalizeBatch {
-		return errResp(400, fmt.Sprintf("batch_too_large: max %d files per request", maxFinalizeBatch))
+	if len(req.Files) > maxBatch {
+		return errResp(400, fmt.Sprintf("batch_too_large: max %d files per request", maxBatch))
 	}
 	if !validOnConflict(req.OnConflict) {
-		return errResp(400, "onConflict must be one of: keepBoth, replace")
+		return errResp(400, onConflictValuesMsg)
 	}
 	resolvedOnConflict := req.OnConflict
 	if resolvedOnConflict == "" {
@@ -113,8 +162,16 @@ func postFinalizeFilesRoute(request events.APIGatewayV2HTTPRequest, claims *auth
 		if f.Size <= 0 {
 			return errResp(400, fmt.Sprintf("files[%d].size must be > 0", i))
 		}
-		if f.SHA256 == "" {
-			return errResp(400, fmt.Sprintf("files[%d].sha256 is required", i))
+		declared, err := declaredChecksum(f)
+		if err != nil {
+			return errResp(400, fmt.Sprintf("files[%d].%s", i, err.Error()))
+		}
+		req.Files[i].declared = declared
+		if !validOnConflict(f.OnConflict) {
+			return errResp(400, fmt.Sprintf("files[%d].%s", i, onConflictValuesMsg))
+		}
+		if f.OnConflict == "" {
+			req.Files[i].OnConflict = resolvedOnConflict
 		}
 	}
 
@@ -130,36 +187,52 @@ func postFinalizeFilesRoute(request events.APIGatewayV2HTTPRequest, claims *auth
 		return errResp(403, "Manifest does not belong to this dataset")
 	}
 
+	origin := finalizeOrigin{
+		requestID:      request.RequestContext.RequestID,
+		uploaderID:     claims.UserClaim.Id,
+		uploaderNodeID: claims.UserClaim.NodeId,
+	}
+	if async {
+		return startFinalizeJob(ctx, req, manifestRecord.DatasetNodeId, origin)
+	}
+
+	results, err := finalizeFiles(ctx, req, origin)
+	if err != nil {
+		return errResp(500, err.Error())
+	}
+
+	body, _ := json.Marshal(finalizeResponse{Results: results})
+	return &events.APIGatewayV2HTTPResponse{StatusCode: 200, Body: string(body)}, nil
+}
+
+// finalizeFiles verifies every file in a validated request against its object
+// in the storage bucket and enqueues the verified files for import. Results
+// are in request order. The returned error is fit for the client and means no
+// file was processed.
+func finalizeFiles(ctx context.Context, req finalizeRequest, origin finalizeOrigin) ([]finalizeResult, error) {
 	defaultStorageBucket := os.Getenv("DEFAULT_STORAGE_BUCKET")
 	if defaultStorageBucket == "" {
 		log.Error("DEFAULT_STORAGE_BUCKET not configured")
-		return errResp(500, "Storage not configured")
+		return nil, errors.New("Storage not configured")
 	}
 	uploadTriggerQueueURL := os.Getenv("UPLOAD_TRIGGER_QUEUE_URL")
 	if uploadTriggerQueueURL == "" {
 		log.Error("UPLOAD_TRIGGER_QUEUE_URL not configured")
-		return errResp(500, "Finalize dispatch not configured")
+		return nil, errors.New("Finalize dispatch not configured")
 	}
 
 	// Resolve destination bucket (same resolver the storage-credentials endpoint uses).
 	pgdb, err := pgQueries.ConnectRDS()
 	if err != nil {
 		log.WithError(err).Error("failed to connect to RDS")
-		return errResp(500, "Internal error")
+		return nil, errors.New("Internal error")
 	}
 	defer pgdb.Close()
 
-	resolution, err := storage.ResolveForManifest(
-		ctx,
-		req.ManifestNodeID,
-		store.tableName,
-		defaultStorageBucket,
-		dyQueriesNs.New(store.dynamodb),
-		pgQueries.New(pgdb),
-	)
+	resolution, err := storageResolver.Resolve(ctx, newStorageSource(pgdb), req.ManifestNodeID)
 	if err != nil {
 		log.WithError(err).WithField("manifestNodeId", req.ManifestNodeID).Error("failed to resolve storage bucket")
-		return errResp(500, "Failed to resolve storage bucket")
+		return nil, errors.New("Failed to resolve storage bucket")
 	}
 	keyPrefix := resolution.KeyPrefix(req.ManifestNodeID)
 
@@ -173,13 +246,14 @@ func postFinalizeFilesRoute(request events.APIGatewayV2HTTPRequest, claims *auth
 	manifestFileStatus, err := fetchManifestFileStatuses(ctx, store.dynamodb, store.fileTableName, req.ManifestNodeID, req.Files)
 	if err != nil {
 		log.WithError(err).WithField("manifestNodeId", req.ManifestNodeID).Error("finalize: failed to load manifest file statuses")
-		return errResp(500, "internal error")
+		return nil, errors.New("internal error")
 	}
 
 	// Parallel HEAD verification on the storage bucket.
 	resultsByUploadID := make(map[string]finalizeResult, len(req.Files))
 	toImport := make([]finalizeFileRequest, 0, len(req.Files))
 	var mu sync.Mutex
+	budget := newHashBudget()
 	sem := make(chan struct{}, headConcurrency)
 	var wg sync.WaitGroup
 
@@ -193,6 +267,12 @@ func postFinalizeFilesRoute(request events.APIGatewayV2HTTPRequest, claims *auth
 			resultsByUploadID[f.UploadID] = finalizeResult{UploadID: f.UploadID, Status: "finalized"}
 			continue
 		}
+		// A skipped file's object was deleted by the upload lambda; re-HEADing
+		// would report "object not found" for what was a deliberate outcome.
+		if status == manifestFileStatusSkipped {
+			resultsByUploadID[f.UploadID] = finalizeResult{UploadID: f.UploadID, Status: "skipped"}
+			continue
+		}
 
 		wg.Add(1)
 		f := f
@@ -202,14 +282,7 @@ func postFinalizeFilesRoute(request events.APIGatewayV2HTTPRequest, claims *auth
 			defer func() { <-sem }()
 
 			key := fmt.Sprintf("%s/%s", keyPrefix, f.UploadID)
-			// ChecksumMode: ENABLED is required for HeadObject to populate
-			// ChecksumSHA256; without it the field is nil even when S3 has
-			// stored the checksum, and the sha256 check below always fails.
-			head, err := store.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
-				Bucket:       aws.String(resolution.StorageBucket),
-				Key:          aws.String(key),
-				ChecksumMode: s3Types.ChecksumModeEnabled,
-			})
+			info, err := storageBackend.Stat(ctx, resolution.StorageBucket, key)
 			if err != nil {
 				log.WithError(err).WithFields(log.Fields{
 					"manifest_id": req.ManifestNodeID,
@@ -220,17 +293,45 @@ func postFinalizeFilesRoute(request events.APIGatewayV2HTTPRequest, claims *auth
 				mu.Unlock()
 				return
 			}
-			if head.ContentLength != nil && *head.ContentLength != f.Size {
+			if info.Size != f.Size {
 				mu.Lock()
 				resultsByUploadID[f.UploadID] = finalizeResult{UploadID: f.UploadID, Status: "failed", Error: "size mismatch"}
 				mu.Unlock()
 				return
 			}
-			// SHA256 is required (validated upstream). Enforce match against
-			// what S3 computed & stored during the multipart upload.
-			if head.ChecksumSHA256 == nil || *head.ChecksumSHA256 != f.SHA256 {
+			f.stored = info.Checksum
+			f.etag = info.ETag
+			// A checksum is required (validated upstream). Enforce match
+			// against what S3 computed & stored during the upload.
+			stored, _ := checksum.FromObject(info.Checksum, f.declared.Algorithm)
+			err = checksum.Verify(f.declared, stored)
+			// Clients that upload without checksums, or in parts with only a
+			// full-object SHA256 at hand, leave S3 with nothing to compare
+			// against; hash the object ourselves where we can.
+			if errors.Is(err, checksum.ErrMissing) && checksum.Computable(f.declared) {
+				if !budget.take(f.Size) {
+					f.sha256Pending = true
+					err = nil
+				} else {
+					var computed checksum.Checksum
+					computed, err = hashStoredObject(ctx, resolution.StorageBucket, key)
+					if err != nil {
+						log.WithError(err).WithFields(log.Fields{
+							"manifest_id": req.ManifestNodeID,
+							"upload_id":   f.UploadID,
+						}).Warn("finalize: server-side sha256 failed")
+						mu.Lock()
+						resultsByUploadID[f.UploadID] = finalizeResult{UploadID: f.UploadID, Status: "failed", Error: "checksum computation failed"}
+						mu.Unlock()
+						return
+					}
+					err = checksum.Verify(f.declared, computed)
+					f.serverSHA256 = computed.Value
+				}
+			}
+			if err != nil {
 				mu.Lock()
-				resultsByUploadID[f.UploadID] = finalizeResult{UploadID: f.UploadID, Status: "failed", Error: "sha256 mismatch"}
+				resultsByUploadID[f.UploadID] = finalizeResult{UploadID: f.UploadID, Status: "failed", Error: err.Error()}
 				mu.Unlock()
 				return
 			}
@@ -241,9 +342,9 @@ func postFinalizeFilesRoute(request events.APIGatewayV2HTTPRequest, claims *auth
 	}
 	wg.Wait()
 
-	// Enqueue synthesized S3 events to the upload_trigger_queue. The upload
+	// Enqueue FinalizeMessages to the upload_trigger_queue. The upload
 	// lambda's existing SQS event-source mapping consumes them and runs the
-	// same import flow as real S3 events. This path is async — we return
+	// same import flow as for real S3 events. This path is async — we return
 	// "finalized" on successful enqueue (SQS delivery guarantees + idempotent
 	// upload-lambda import + DLQ-backed retries make "enqueued" equivalent to
 	// "will be finalized"). Import failures that exhaust retries end up in
@@ -251,7 +352,7 @@ func postFinalizeFilesRoute(request events.APIGatewayV2HTTPRequest, claims *auth
 	// VerifyFinalizedStatus ticker is the belt-and-suspenders consistency
 	// check.
 	if len(toImport) > 0 {
-		failed, err := enqueueToUploadQueue(ctx, store.sqsClient, uploadTriggerQueueURL, resolution.StorageBucket, keyPrefix, toImport, resolvedOnConflict)
+		failed, err := enqueueToUploadQueue(ctx, store.sqsClient, uploadTriggerQueueURL, req.ManifestNodeID, resolution.StorageBucket, keyPrefix, toImport, origin)
 		if err != nil {
 			log.WithError(err).Error("failed to enqueue to upload queue")
 			for _, f := range toImport {
@@ -262,10 +363,31 @@ func postFinalizeFilesRoute(request events.APIGatewayV2HTTPRequest, claims *auth
 				if _, bad := failed[f.UploadID]; bad {
 					resultsByUploadID[f.UploadID] = finalizeResult{UploadID: f.UploadID, Status: "failed", Error: "enqueue failed"}
 				} else {
-					resultsByUploadID[f.UploadID] = finalizeResult{UploadID: f.UploadID, Status: "finalized"}
+					resultsByUploadID[f.UploadID] = finalizeResult{UploadID: f.UploadID, Status: "finalized", ChecksumPending: f.sha256Pending}
 				}
 			}
 		}
+		for _, f := range toImport {
+			if !resultsByUploadID[f.UploadID].ChecksumPending {
+				continue
+			}
+			job := sha256VerificationJob{
+				OrganizationID: resolution.OrganizationId,
+				ManifestID:     req.ManifestNodeID,
+				UploadID:       f.UploadID,
+				Bucket:         resolution.StorageBucket,
+				Key:            fmt.Sprintf("%s/%s", keyPrefix, f.UploadID),
+				DeclaredSHA256: f.declared.Value,
+			}
+			if err := startSHA256Verification(ctx, job); err != nil {
+				// The file is imported either way; without the job its
+				// checksum stays unverified until an operator re-runs it.
+				log.WithError(err).WithFields(log.Fields{
+					"manifest_id": req.ManifestNodeID,
+					"upload_id":   f.UploadID,
+				}).Error("finalize: failed to start sha256 verification")
+			}
+		}
 	}
 
 	// Preserve input order in the response.
@@ -277,9 +399,37 @@ func postFinalizeFilesRoute(request events.APIGatewayV2HTTPRequest, claims *auth
 			results = append(results, finalizeResult{UploadID: f.UploadID, Status: "failed", Error: "unknown"})
 		}
 	}
+	return results, nil
+}
 
-	body, _ := json.Marshal(finalizeResponse{Results: results})
-	return &events.APIGatewayV2HTTPResponse{StatusCode: 200, Body: string(body)}, nil
+// declaredChecksum parses the checksum declared for a file. The error message
+// names the offending field, for the caller to prefix with the file index.
+func declaredChecksum(f finalizeFileRequest) (checksum.Checksum, error) {
+	algorithm, err := checksum.ParseAlgorithm(f.ChecksumAlgorithm)
+	if err != nil {
+		return checksum.Checksum{}, fmt.Errorf("checksumAlgorithm: %w", err)
+	}
+	checksumType, err := checksum.ParseType(f.ChecksumType)
+	if err != nil {
+		return checksum.Checksum{}, fmt.Errorf("checksumType: %w", err)
+	}
+
+	value := f.Checksum
+	if value == "" && algorithm == checksum.SHA256 {
+		value = f.SHA256
+	}
+	if value == "" {
+		if f.ChecksumAlgorithm == "" {
+			return checksum.Checksum{}, fmt.Errorf("sha256 is required")
+		}
+		return checksum.Checksum{}, fmt.Errorf("checksum is required")
+	}
+
+	declared, err := checksum.New(algorithm, checksumType, value)
+	if err != nil {
+		return checksum.Checksum{}, fmt.Errorf("checksum: %w", err)
+	}
+	return declared, nil
 }
 
 func errResp(code int, msg string) (*events.APIGatewayV2HTTPResponse, error) {
@@ -345,35 +495,28 @@ func fetchManifestFileStatuses(
 	return statuses, nil
 }
 
-// enqueueToUploadQueue sends one synthesized S3 "Object Created" event per
-// file to the upload_trigger_queue. The upload lambda's existing SQS event
-// source drains the queue in small batches and runs the same ImportFiles
-// flow as for real S3 notifications. Failed sends (per-message) are returned
-// in the map so the caller can mark those files failed in the response; the
-// vast majority either succeed or hit the dead-letter queue on the
-// consumer side, giving SQS's at-least-once delivery guarantees.
+// enqueueToUploadQueue sends one finalize message per file to the
+// upload_trigger_queue. The upload lambda's existing SQS event source drains
+// the queue in small batches and runs the same ImportFiles flow as for real
+// S3 notifications. Failed sends (per-message) are returned in the map so the
+// caller can mark those files failed in the response; the vast majority
+// either succeed or hit the dead-letter queue on the consumer side, giving
+// SQS's at-least-once delivery guarantees.
 //
 // SQS SendMessageBatch limits: 10 messages, 256 KB per message, 256 KB total.
-// Each synthesized S3 event is ~500 B so 10 per batch is well under the
+// Each finalize message is under 1 KB so 10 per batch is well under the
 // 256 KB cap. 250 files -> 25 batches, which with minimal round-trip latency
 // totals well under 500 ms even sequentially; we fan out to keep it under
 // ~100 ms.
-// OnConflictAttrName is the SQS MessageAttribute key used to carry the
-// upload conflict strategy from the finalize endpoint to the upload
-// lambda. Exported so tests and the upload lambda can reference the same
-// constant. Missing attribute on the consumer side is treated as keepBoth
-// for backward compatibility with messages enqueued before this flag
-// existed.
-const OnConflictAttrName = "OnConflict"
-
 func enqueueToUploadQueue(
 	ctx context.Context,
 	sqsClient *sqs.Client,
 	queueURL string,
+	manifestNodeId string,
 	bucket string,
 	keyPrefix string,
 	files []finalizeFileRequest,
-	onConflict string,
+	origin finalizeOrigin,
 ) (map[string]struct{}, error) {
 	const sqsBatchLimit = 10
 	const sendConcurrency = 5
@@ -400,15 +543,14 @@ func enqueueToUploadQueue(
 			idToUpload := make(map[string]string, len(batch))
 			for i, f := range batch {
 				key := fmt.Sprintf("%s/%s", keyPrefix, f.UploadID)
-				s3Ev := events.S3Event{Records: []events.S3EventRecord{{
-					EventSource: "aws:s3",
-					EventName:   "ObjectCreated:Put",
-					S3: events.S3Entity{
-						Bucket: events.S3Bucket{Name: bucket},
-						Object: events.S3Object{Key: key, Size: f.Size},
-					},
-				}}}
-				body, _ := json.Marshal(s3Ev)
+				body, err := newFinalizeMessage(manifestNodeId, bucket, key, f, origin)
+				if err != nil {
+					log.WithError(err).Error("finalize: cannot build upload message")
+					mu.Lock()
+					failed[f.UploadID] = struct{}{}
+					mu.Unlock()
+					continue
+				}
 				// SQS batch entry Id must match ^[a-zA-Z0-9_-]{1,80}$; use
 				// position so we can map failures back to uploadIds below.
 				id := fmt.Sprintf("b%d", i)
@@ -416,15 +558,12 @@ func enqueueToUploadQueue(
 				entries = append(entries, sqsTypes.SendMessageBatchRequestEntry{
 					Id:          aws.String(id),
 					MessageBody: aws.String(string(body)),
-					MessageAttributes: map[string]sqsTypes.MessageAttributeValue{
-						OnConflictAttrName: {
-							DataType:    aws.String("String"),
-							StringValue: aws.String(onConflict),
-						},
-					},
 				})
 			}
 
+			if len(entries) == 0 {
+				return
+			}
 			out, err := sqsClient.SendMessageBatch(ctx, &sqs.SendMessageBatchInput{
 				QueueUrl: aws.String(queueURL),
 				Entries:  entries,
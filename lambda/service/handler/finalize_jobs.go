@@ -0,0 +1,364 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+	lambdaTypes "github.com/aws/aws-sdk-go-v2/service/lambda/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/google/uuid"
+	"github.com/pennsieve/pennsieve-go-core/pkg/authorizer"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxAsyncFinalizeBatch bounds an asynchronous finalize request. The worker
+// has the full Lambda timeout instead of API Gateway's 30s, so the limit is
+// set by the request body instead: 10k files stay well under API Gateway's
+// 10 MB payload cap. Keep in sync with terraform/upload-service.yml.
+const maxAsyncFinalizeBatch = 10000
+
+// finalizeJobChunk is how many files of a finalize job are verified and
+// enqueued at a time. The job's progress is saved after every chunk, so a job
+// that outlasts one invocation continues where it stopped. A chunk is the size
+// of a synchronous request, which is sized to finish within 30s.
+const finalizeJobChunk = maxFinalizeBatch
+
+// finalizeJobChunkTime is the time a chunk is given. A chunk is only started
+// with that much left before finalizeJobReserve; otherwise the job continues
+// in a new invocation.
+const finalizeJobChunkTime = 30 * time.Second
+
+// finalizeJobReserve is the part of an invocation kept for saving progress
+// and starting the next one. A chunk still running when only this much is
+// left is cut off and the job fails.
+const finalizeJobReserve = 30 * time.Second
+
+// finalizeJobStaleAfter is how long a pending or running job can go without
+// progress before it is reported as failed. It is longer than an invocation
+// (300s), so it only happens to a job whose invocation died without saving.
+const finalizeJobStaleAfter = 15 * time.Minute
+
+// Finalize job statuses.
+const (
+	finalizeJobPending   = "pending"
+	finalizeJobRunning   = "running"
+	finalizeJobCompleted = "completed"
+	finalizeJobFailed    = "failed"
+)
+
+// finalizeJob is the state of an asynchronous finalize request, stored as
+// JSON in the finalize jobs bucket next to the request it was created for.
+// Processed counts the files of the request, in order, that have a result.
+type finalizeJob struct {
+	JobID          string           `json:"jobId"`
+	ManifestNodeID string           `json:"manifestNodeId"`
+	DatasetNodeID  string           `json:"datasetNodeId"`
+	Status         string           `json:"status"`
+	FileCount      int              `json:"fileCount"`
+	Processed      int              `json:"processed"`
+	Error          string           `json:"error,omitempty"`
+	Results        []finalizeResult `json:"results,omitempty"`
+	CreatedAt      time.Time        `json:"createdAt"`
+	UpdatedAt      time.Time        `json:"updatedAt"`
+}
+
+// FinalizeJobEvent is the payload the service lambda invokes itself with to
+// run a finalize job in the background.
+type FinalizeJobEvent struct {
+	FinalizeJobID string `json:"finalizeJobId"`
+}
+
+// storedFinalizeRequest is the request a finalize job stores, with the
+// origin the worker passes on to the upload lambda. The request fields stay
+// at the top level, so requests stored before the origin was added still load.
+type storedFinalizeRequest struct {
+	finalizeRequest
+	RequestID      string `json:"requestId,omitempty"`
+	UploaderID     int64  `json:"uploaderId,omitempty"`
+	UploaderNodeID string `json:"uploaderNodeId,omitempty"`
+}
+
+func finalizeJobRequestKey(jobId string) string {
+	return fmt.Sprintf("finalize-jobs/%s/request.json", jobId)
+}
+
+func finalizeJobStatusKey(jobId string) string {
+	return fmt.Sprintf("finalize-jobs/%s/status.json", jobId)
+}
+
+// startFinalizeJob stores a validated finalize request, hands it to a
+// background invocation of this lambda and returns 202 with the job.
+func startFinalizeJob(ctx context.Context, req finalizeRequest, datasetNodeId string,
+	origin finalizeOrigin) (*events.APIGatewayV2HTTPResponse, error) {
+	bucket := os.Getenv("FINALIZE_JOBS_BUCKET")
+	if bucket == "" {
+		log.Error("FINALIZE_JOBS_BUCKET not configured")
+		return errResp(500, "Asynchronous finalize not configured")
+	}
+
+	now := time.Now().UTC()
+	job := finalizeJob{
+		JobID:          uuid.NewString(),
+		ManifestNodeID: req.ManifestNodeID,
+		DatasetNodeID:  datasetNodeId,
+		Status:         finalizeJobPending,
+		FileCount:      len(req.Files),
+		CreatedAt:      now,
+		UpdatedAt:      now,
+	}
+	contextLogger := log.WithFields(log.Fields{"manifest_id": req.ManifestNodeID, "finalize_job_id": job.JobID})
+
+	stored := storedFinalizeRequest{
+		finalizeRequest: req,
+		RequestID:       origin.requestID,
+		UploaderID:      origin.uploaderID,
+		UploaderNodeID:  origin.uploaderNodeID,
+	}
+	if err := putJSON(ctx, bucket, finalizeJobRequestKey(job.JobID), stored); err != nil {
+		contextLogger.WithError(err).Error("finalize job: failed to store request")
+		return errResp(500, "Failed to create finalize job")
+	}
+	if err := putJSON(ctx, bucket, finalizeJobStatusKey(job.JobID), job); err != nil {
+		contextLogger.WithError(err).Error("finalize job: failed to store status")
+		return errResp(500, "Failed to create finalize job")
+	}
+
+	payload, _ := json.Marshal(FinalizeJobEvent{FinalizeJobID: job.JobID})
+	_, err := store.lambdaClient.Invoke(ctx, &lambda.InvokeInput{
+		InvocationType: lambdaTypes.InvocationTypeEvent,
+		FunctionName:   aws.String(os.Getenv("AWS_LAMBDA_FUNCTION_NAME")),
+		Payload:        payload,
+	})
+	if err != nil {
+		contextLogger.WithError(err).Error("finalize job: failed to start worker")
+		return errResp(500, "Failed to start finalize job")
+	}
+
+	contextLogger.WithField("file_count", job.FileCount).Info("finalize job created")
+	body, _ := json.Marshal(job)
+	return &events.APIGatewayV2HTTPResponse{StatusCode: 202, Body: string(body)}, nil
+}
+
+// RunFinalizeJob runs the HEAD verification and upload-queue enqueue for a
+// stored finalize request and records the per-file results. The files are
+// processed in chunks of finalizeJobChunk from the job's saved position; when
+// the invocation runs short of time the rest is handed to a new invocation.
+// Failures are recorded on the job rather than returned: finalize is
+// idempotent per uploadId, but a Lambda retry of a job that already reported
+// failure would only confuse a client that is polling it.
+func RunFinalizeJob(ctx context.Context, event FinalizeJobEvent) error {
+	bucket := os.Getenv("FINALIZE_JOBS_BUCKET")
+	contextLogger := log.WithField("finalize_job_id", event.FinalizeJobID)
+
+	var job finalizeJob
+	if err := getJSON(ctx, bucket, finalizeJobStatusKey(event.FinalizeJobID), &job); err != nil {
+		contextLogger.WithError(err).Error("finalize job: failed to load status")
+		return err
+	}
+	if job.Status == finalizeJobCompleted || job.Status == finalizeJobFailed {
+		contextLogger.WithField("status", job.Status).Info("finalize job already done")
+		return nil
+	}
+
+	var stored storedFinalizeRequest
+	if err := getJSON(ctx, bucket, finalizeJobRequestKey(job.JobID), &stored); err != nil {
+		contextLogger.WithError(err).Error("finalize job: failed to load request")
+		return recordFinalizeJob(ctx, bucket, job, finalizeJobFailed, "failed to load request")
+	}
+
+	job.Status = finalizeJobRunning
+	job.UpdatedAt = time.Now().UTC()
+	if err := putJSON(ctx, bucket, finalizeJobStatusKey(job.JobID), job); err != nil {
+		contextLogger.WithError(err).Warn("finalize job: failed to mark running")
+	}
+
+	req := stored.finalizeRequest
+	// The parsed checksums don't survive the round trip through S3. The
+	// request was validated when the job was created.
+	for i := range req.Files {
+		declared, err := declaredChecksum(req.Files[i])
+		if err != nil {
+			return recordFinalizeJob(ctx, bucket, job, finalizeJobFailed, fmt.Sprintf("files[%d].%s", i, err))
+		}
+		req.Files[i].declared = declared
+	}
+	origin := finalizeOrigin{
+		requestID:      stored.RequestID,
+		jobID:          job.JobID,
+		uploaderID:     stored.UploaderID,
+		uploaderNodeID: stored.UploaderNodeID,
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(finalizeJobStaleAfter)
+	}
+	for job.Processed < len(req.Files) {
+		if time.Until(deadline) < finalizeJobReserve+finalizeJobChunkTime {
+			return continueFinalizeJob(ctx, bucket, job)
+		}
+
+		end := min(job.Processed+finalizeJobChunk, len(req.Files))
+		chunk := req
+		chunk.Files = req.Files[job.Processed:end]
+
+		chunkCtx, cancel := context.WithDeadline(ctx, deadline.Add(-finalizeJobReserve))
+		results, err := finalizeFiles(chunkCtx, chunk, origin)
+		timedOut := chunkCtx.Err() != nil
+		cancel()
+		if timedOut {
+			// Requests cut off by the deadline come back as failed files, so
+			// none of the chunk's results can be trusted.
+			return recordFinalizeJob(ctx, bucket, job, finalizeJobFailed,
+				fmt.Sprintf("timed out after %d of %d files", job.Processed, len(req.Files)))
+		}
+		if err != nil {
+			return recordFinalizeJob(ctx, bucket, job, finalizeJobFailed, err.Error())
+		}
+
+		job.Results = append(job.Results, results...)
+		job.Processed = end
+		job.UpdatedAt = time.Now().UTC()
+		if job.Processed < len(req.Files) {
+			if err := putJSON(ctx, bucket, finalizeJobStatusKey(job.JobID), job); err != nil {
+				contextLogger.WithError(err).Warn("finalize job: failed to save progress")
+			}
+		}
+	}
+	return recordFinalizeJob(ctx, bucket, job, finalizeJobCompleted, "")
+}
+
+// continueFinalizeJob saves the progress of a job and hands the rest of it to
+// a new asynchronous invocation of this lambda.
+func continueFinalizeJob(ctx context.Context, bucket string, job finalizeJob) error {
+	contextLogger := log.WithFields(log.Fields{
+		"finalize_job_id": job.JobID,
+		"processed":       job.Processed,
+		"file_count":      job.FileCount,
+	})
+
+	job.UpdatedAt = time.Now().UTC()
+	if err := putJSON(ctx, bucket, finalizeJobStatusKey(job.JobID), job); err != nil {
+		contextLogger.WithError(err).Error("finalize job: failed to save progress")
+		return err
+	}
+
+	payload, _ := json.Marshal(FinalizeJobEvent{FinalizeJobID: job.JobID})
+	_, err := store.lambdaClient.Invoke(ctx, &lambda.InvokeInput{
+		InvocationType: lambdaTypes.InvocationTypeEvent,
+		FunctionName:   aws.String(os.Getenv("AWS_LAMBDA_FUNCTION_NAME")),
+		Payload:        payload,
+	})
+	if err != nil {
+		contextLogger.WithError(err).Error("finalize job: failed to continue in a new invocation")
+		return recordFinalizeJob(ctx, bucket, job, finalizeJobFailed,
+			fmt.Sprintf("failed to continue after %d of %d files", job.Processed, job.FileCount))
+	}
+
+	contextLogger.Info("finalize job continues in a new invocation")
+	return nil
+}
+
+func recordFinalizeJob(ctx context.Context, bucket string, job finalizeJob, status string, message string) error {
+	job.Status = status
+	job.Error = message
+	job.UpdatedAt = time.Now().UTC()
+	if err := putJSON(ctx, bucket, finalizeJobStatusKey(job.JobID), job); err != nil {
+		log.WithError(err).WithField("finalize_job_id", job.JobID).Error("finalize job: failed to store result")
+		return err
+	}
+	log.WithFields(log.Fields{
+		"manifest_id":     job.ManifestNodeID,
+		"finalize_job_id": job.JobID,
+		"status":          status,
+		"processed":       job.Processed,
+	}).Info("finalize job done")
+	return nil
+}
+
+// finalizeJobStale returns true when a job that is not done has made no
+// progress for finalizeJobStaleAfter.
+func finalizeJobStale(job finalizeJob, now time.Time) bool {
+	if job.Status != finalizeJobPending && job.Status != finalizeJobRunning {
+		return false
+	}
+	return now.Sub(job.UpdatedAt) > finalizeJobStaleAfter
+}
+
+// getFinalizeJobRoute returns the status of a finalize job and the per-file
+// results of the files it has processed, in request order. A job that stopped
+// making progress is recorded as failed first.
+func getFinalizeJobRoute(request events.APIGatewayV2HTTPRequest, claims *authorizer.Claims) (*events.APIGatewayV2HTTPResponse, error) {
+	jobId := request.PathParameters["jobId"]
+	if !isValidUUID(jobId) {
+		return errResp(400, "jobId must be a UUID")
+	}
+
+	var job finalizeJob
+	err := getJSON(context.Background(), os.Getenv("FINALIZE_JOBS_BUCKET"), finalizeJobStatusKey(jobId), &job)
+	if err != nil {
+		var noSuchKey *s3Types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return errResp(404, "Finalize job not found")
+		}
+		log.WithError(err).WithField("finalize_job_id", jobId).Error("finalize job: failed to load status")
+		return errResp(500, "internal error")
+	}
+	if job.DatasetNodeID != claims.DatasetClaim.NodeId {
+		return errResp(404, "Finalize job not found")
+	}
+	if finalizeJobStale(job, time.Now()) {
+		// The invocation running the job died without recording an outcome.
+		message := fmt.Sprintf("stopped responding after %d of %d files", job.Processed, job.FileCount)
+		if err := recordFinalizeJob(context.Background(), os.Getenv("FINALIZE_JOBS_BUCKET"), job,
+			finalizeJobFailed, message); err != nil {
+			return errResp(500, "internal error")
+		}
+		job.Status = finalizeJobFailed
+		job.Error = message
+	}
+
+	body, _ := json.Marshal(job)
+	return &events.APIGatewayV2HTTPResponse{StatusCode: 200, Body: string(body)}, nil
+}
+
+func putJSON(ctx context.Context, bucket string, key string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = store.s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	})
+	return err
+}
+
+func getJSON(ctx context.Context, bucket string, key string, v interface{}) error {
+	out, err := store.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return err
+	}
+	defer out.Body.Close()
+
+	body, err := io.ReadAll(out.Body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
@@ -0,0 +1,53 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/pennsieve/pennsieve-upload-service-v2/service/pkg/checksum"
+	"github.com/pennsieve/pennsieve-upload-service-v2/storage/finalize"
+)
+
+// finalizeOrigin identifies the finalize request a file was verified by.
+type finalizeOrigin struct {
+	requestID      string
+	jobID          string
+	uploaderID     int64
+	uploaderNodeID string
+}
+
+// newFinalizeMessage returns the upload trigger queue body for a verified file
+// stored at bucket/key.
+func newFinalizeMessage(manifestNodeId string, bucket string, key string, f finalizeFileRequest,
+	origin finalizeOrigin) ([]byte, error) {
+	msg := finalize.Message{
+		Type:       finalize.MessageType,
+		Version:    finalize.MessageVersion,
+		Bucket:     bucket,
+		Key:        key,
+		ManifestID: manifestNodeId,
+		UploadID:   f.UploadID,
+		Size:       f.Size,
+		ETag:       f.etag,
+		// Finalize always reads the object; an empty checksum tells the upload
+		// lambda that storage holds none.
+		Checksum: &finalize.Checksum{
+			Algorithm: f.stored.Algorithm,
+			Type:      f.stored.Type,
+			Value:     f.stored.Value,
+		},
+		ServerSHA256:      f.serverSHA256,
+		OnConflict:        f.OnConflict,
+		Source:            finalize.SourceFinalize,
+		FinalizeRequestID: origin.requestID,
+		FinalizeJobID:     origin.jobID,
+	}
+	if checksum.Computable(f.declared) {
+		msg.ClientSHA256 = f.declared.Value
+	}
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return nil, fmt.Errorf("marshal finalize message for %s: %w", f.UploadID, err)
+	}
+	return body, nil
+}
@@ -2,6 +2,7 @@ package handler
 
 import (
 	"context"
+	"encoding/json"
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
@@ -10,6 +11,8 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/sqs"
 	"github.com/pennsieve/pennsieve-go-core/pkg/authorizer"
 	"github.com/pennsieve/pennsieve-go-core/pkg/models/permissions"
+	"github.com/pennsieve/pennsieve-upload-service-v2/storage"
+	"github.com/pennsieve/pennsieve-upload-service-v2/storage/s3backend"
 	log "github.com/sirupsen/logrus"
 	"os"
 	"regexp"
@@ -45,6 +48,32 @@ func init() {
 
 	store = NewUploadServiceStore(client, s3Client, lambdaClient, sqsClient, manifestFileTableName, manifestTableName)
 
+	bucketRegions = s3backend.NewRegionCache(s3Client)
+	storageBackend, err = newStorageBackend(cfg, s3Client)
+	if err != nil {
+		log.Fatalf("newStorageBackend: %v\n", err)
+	}
+	storageResolver = storage.NewResolver(storage.Config{
+		DefaultBucket: os.Getenv("DEFAULT_STORAGE_BUCKET"),
+		Backend:       storageBackend.Type(),
+	})
+
+}
+
+// Handler is the lambda entrypoint. The service lambda is invoked by API
+// Gateway and, asynchronously, by itself to run finalize jobs; the two
+// payloads are told apart by the finalizeJobId key.
+func Handler(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+	var job FinalizeJobEvent
+	if err := json.Unmarshal(payload, &job); err == nil && job.FinalizeJobID != "" {
+		return nil, RunFinalizeJob(ctx, job)
+	}
+
+	var request events.APIGatewayV2HTTPRequest
+	if err := json.Unmarshal(payload, &request); err != nil {
+		return nil, err
+	}
+	return ManifestHandler(request)
 }
 
 // ManifestHandler handles requests to the API V2 /manifest endpoints.
@@ -72,6 +101,21 @@ func ManifestHandler(request events.APIGatewayV2HTTPRequest) (*events.APIGateway
 				apiResponse, err = postManifestRoute(request, claims)
 			}
 		}
+	case "/manifest/preview":
+		switch request.RequestContext.HTTP.Method {
+		case "POST":
+			// Dry-run of the import; read-only, but gated like the import itself.
+			if authorized = authorizer.HasRole(*claims, permissions.CreateDeleteFiles); authorized {
+				apiResponse, err = postManifestPreviewRoute(request, claims)
+			}
+		}
+	case "/manifest/package/versions":
+		switch request.RequestContext.HTTP.Method {
+		case "GET":
+			if authorized = authorizer.HasRole(*claims, permissions.ViewFiles); authorized {
+				apiResponse, err = getPackageVersionsRoute(request, claims)
+			}
+		}
 	case "/manifest/files":
 		switch request.RequestContext.HTTP.Method {
 		case "GET":
@@ -107,6 +151,13 @@ func ManifestHandler(request events.APIGatewayV2HTTPRequest) (*events.APIGateway
 				apiResponse, err = postFinalizeFilesRoute(request, claims)
 			}
 		}
+	case "/manifest/files/finalize/{jobId}":
+		switch request.RequestContext.HTTP.Method {
+		case "GET":
+			if authorized = authorizer.HasRole(*claims, permissions.ViewFiles); authorized {
+				apiResponse, err = getFinalizeJobRoute(request, claims)
+			}
+		}
 	case "/manifest/archive":
 		switch request.RequestContext.HTTP.Method {
 		case "GET":
@@ -0,0 +1,242 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/pennsieve/pennsieve-go-core/pkg/authorizer"
+	"github.com/pennsieve/pennsieve-go-core/pkg/models/dydb"
+	"github.com/pennsieve/pennsieve-go-core/pkg/models/manifest"
+	"github.com/pennsieve/pennsieve-go-core/pkg/models/manifest/manifestFile"
+	"github.com/pennsieve/pennsieve-go-core/pkg/models/packageInfo/packageState"
+	"github.com/pennsieve/pennsieve-go-core/pkg/models/packageInfo/packageType"
+	"github.com/pennsieve/pennsieve-go-core/pkg/models/pgdb"
+	pgQueries "github.com/pennsieve/pennsieve-go-core/pkg/queries/pgdb"
+	"github.com/pennsieve/pennsieve-upload-service-v2/service/pkg/preview"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxPreviewFiles bounds how many Registered files a single preview will
+// plan. The response lists every package and conflict, so very large
+// manifests would exceed the 6 MB Lambda response limit; callers with
+// bigger manifests should preview a representative subset instead.
+const maxPreviewFiles = 10000
+
+// previewPageSize is the DynamoDB page size used when loading the manifest's
+// files for a preview.
+const previewPageSize = 1000
+
+type previewRequest struct {
+	ManifestNodeID string `json:"manifestNodeId"`
+	// OnConflict is the strategy the preview should assume; same values and
+	// default as finalizeRequest.OnConflict.
+	OnConflict string `json:"onConflict,omitempty"`
+	// Files overrides OnConflict per file, as finalizeFileRequest.OnConflict
+	// does at finalize.
+	Files []previewFileRequest `json:"files,omitempty"`
+}
+
+type previewFileRequest struct {
+	UploadID   string `json:"uploadId"`
+	OnConflict string `json:"onConflict,omitempty"`
+}
+
+type previewResponse struct {
+	ManifestNodeID string `json:"manifestNodeId"`
+	*preview.Plan
+}
+
+// postManifestPreviewRoute returns a dry-run of the import for every file in
+// the manifest that is still Registered: the folders that would be created,
+// the packages that would be created, how merged files group, and which names
+// would collide under the requested onConflict strategy. Nothing is written —
+// the Postgres reads run in a read-only transaction that is always rolled
+// back.
+func postManifestPreviewRoute(request events.APIGatewayV2HTTPRequest, claims *authorizer.Claims) (*events.APIGatewayV2HTTPResponse, error) {
+	var req previewRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		log.WithError(err).Warn("preview: invalid request body")
+		return errResp(400, "invalid request body")
+	}
+	if !isValidUUID(req.ManifestNodeID) {
+		return errResp(400, "manifestNodeId must be a UUID")
+	}
+	if !validOnConflict(req.OnConflict) {
+		return errResp(400, onConflictValuesMsg)
+	}
+	resolvedOnConflict := req.OnConflict
+	if resolvedOnConflict == "" {
+		resolvedOnConflict = onConflictKeepBoth
+	}
+	fileOnConflict := map[string]string{}
+	for _, f := range req.Files {
+		if !validOnConflict(f.OnConflict) {
+			return errResp(400, onConflictValuesMsg)
+		}
+		fileOnConflict[f.UploadID] = f.OnConflict
+	}
+
+	ctx := context.Background()
+
+	manifestRecord, err := store.dy.GetManifestById(ctx, store.tableName, req.ManifestNodeID)
+	if err != nil {
+		log.WithError(err).WithField("manifestNodeId", req.ManifestNodeID).Warn("manifest not found")
+		return errResp(404, "Manifest not found")
+	}
+	if manifestRecord.DatasetNodeId != claims.DatasetClaim.NodeId {
+		return errResp(403, "Manifest does not belong to this dataset")
+	}
+	if manifestRecord.Status == manifest.Archived.String() {
+		return errResp(400, "Cannot preview an 'archived' manifest.")
+	}
+
+	files, err := getRegisteredManifestFiles(ctx, req.ManifestNodeID)
+	if err != nil {
+		log.WithError(err).WithField("manifestNodeId", req.ManifestNodeID).Error("preview: failed to load manifest files")
+		return errResp(500, "internal error")
+	}
+	if len(files) > maxPreviewFiles {
+		return errResp(400, fmt.Sprintf("preview_too_large: max %d registered files per preview", maxPreviewFiles))
+	}
+
+	db, err := pgQueries.ConnectRDS()
+	if err != nil {
+		log.WithError(err).Error("failed to connect to RDS")
+		return errResp(500, "Internal error")
+	}
+	defer db.Close()
+
+	// The search path is set per connection; a transaction pins every read
+	// in the preview to the same connection and guarantees nothing commits.
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		log.WithError(err).Error("preview: failed to begin read-only transaction")
+		return errResp(500, "Internal error")
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer tx.Rollback()
+
+	if _, err := pgQueries.New(tx).WithOrg(int(manifestRecord.OrganizationId)); err != nil {
+		log.WithError(err).Error("preview: unable to set search path")
+		return errResp(500, "Internal error")
+	}
+
+	plan, err := preview.Build(ctx, previewLister{tx: tx}, int(manifestRecord.DatasetId), files, resolvedOnConflict, fileOnConflict)
+	if err != nil {
+		log.WithError(err).WithField("manifestNodeId", req.ManifestNodeID).Error("preview: failed to build plan")
+		return errResp(500, "Failed to build import preview")
+	}
+
+	body, _ := json.Marshal(previewResponse{ManifestNodeID: req.ManifestNodeID, Plan: plan})
+	return &events.APIGatewayV2HTTPResponse{StatusCode: 200, Body: string(body)}, nil
+}
+
+// packageStateVersioned is the state the upload lambda moves a package to
+// when onConflict=version keeps it as a prior version. It is hidden like a
+// deleted package.
+const packageStateVersioned = "VERSIONED"
+
+// previewLister reads existing packages for a preview on the read-only
+// transaction. pennsieve-go-core's GetPackageChildren only leaves out deleted
+// packages; this one also leaves out prior versions, as the import does.
+type previewLister struct {
+	tx *sql.Tx
+}
+
+// GetPackageChildren returns the packages directly under parent, or at the
+// dataset root when parent is nil or has no id.
+func (l previewLister) GetPackageChildren(ctx context.Context, parent *pgdb.Package, datasetId int, onlyFolders bool) ([]pgdb.Package, error) {
+	args := []interface{}{datasetId, packageState.Deleting.String(), packageStateVersioned}
+	filter := "parent_id IS NULL"
+	if parent != nil && parent.Id != 0 {
+		args = append(args, parent.Id)
+		filter = fmt.Sprintf("parent_id = $%d", len(args))
+	}
+	if onlyFolders {
+		args = append(args, packageType.Collection.String())
+		filter += fmt.Sprintf(" AND type = $%d", len(args))
+	}
+
+	rows, err := l.tx.QueryContext(ctx, fmt.Sprintf(
+		"SELECT id, name, type, state, node_id, parent_id FROM packages "+
+			"WHERE dataset_id = $1 AND state NOT IN ($2, $3) AND %s;", filter), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var children []pgdb.Package
+	for rows.Next() {
+		var p pgdb.Package
+		if err := rows.Scan(&p.Id, &p.Name, &p.PackageType, &p.PackageState, &p.NodeId, &p.ParentId); err != nil {
+			return nil, err
+		}
+		children = append(children, p)
+	}
+	return children, rows.Err()
+}
+
+// GetPackagesByNodeIds returns the packages of the dataset with the provided
+// node ids, keyed by node id. Unlike the upload lambda's lookup it takes no
+// locks: the preview only reads.
+func (l previewLister) GetPackagesByNodeIds(ctx context.Context, datasetId int, nodeIds []string) (map[string]pgdb.Package, error) {
+	packages := map[string]pgdb.Package{}
+	if len(nodeIds) == 0 {
+		return packages, nil
+	}
+
+	args := []interface{}{datasetId, packageState.Deleting.String(), packageStateVersioned}
+	placeholders := make([]string, len(nodeIds))
+	for i, nodeId := range nodeIds {
+		args = append(args, nodeId)
+		placeholders[i] = fmt.Sprintf("$%d", len(args))
+	}
+
+	rows, err := l.tx.QueryContext(ctx, fmt.Sprintf(
+		"SELECT id, name, type, state, node_id, parent_id FROM packages "+
+			"WHERE dataset_id = $1 AND state NOT IN ($2, $3) AND node_id IN (%s);",
+		strings.Join(placeholders, ",")), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p pgdb.Package
+		if err := rows.Scan(&p.Id, &p.Name, &p.PackageType, &p.PackageState, &p.NodeId, &p.ParentId); err != nil {
+			return nil, err
+		}
+		packages[p.NodeId] = p
+	}
+	return packages, rows.Err()
+}
+
+// getRegisteredManifestFiles returns every manifest_files row in Registered
+// status. The StatusIndex GSI does not project MergePackageId, which the
+// preview needs to group merged files, so this pages the base table and
+// filters client-side.
+func getRegisteredManifestFiles(ctx context.Context, manifestId string) ([]dydb.ManifestFileTable, error) {
+	var files []dydb.ManifestFileTable
+	var startKey map[string]types.AttributeValue
+	for {
+		page, lastKey, err := store.dy.GetFilesPaginated(ctx, store.fileTableName, manifestId,
+			sql.NullString{}, previewPageSize, startKey)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range page {
+			if f.Status == manifestFile.Registered.String() {
+				files = append(files, f)
+			}
+		}
+		if len(lastKey) == 0 || len(files) > maxPreviewFiles {
+			return files, nil
+		}
+		startKey = lastKey
+	}
+}
@@ -0,0 +1,114 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/pennsieve/pennsieve-go-core/pkg/authorizer"
+	pgQueries "github.com/pennsieve/pennsieve-go-core/pkg/queries/pgdb"
+	log "github.com/sirupsen/logrus"
+)
+
+// packageVersion is one entry in a package's version history. Version 1 is the
+// package that was first uploaded; every import with onConflict=version adds
+// the next number.
+type packageVersion struct {
+	PackageNodeID string    `json:"packageNodeId"`
+	PackageID     int64     `json:"packageId"`
+	Name          string    `json:"name"`
+	Version       int       `json:"version"`
+	Size          int64     `json:"size"`
+	CreatedAt     time.Time `json:"createdAt"`
+}
+
+type packageVersionsResponse struct {
+	PackageNodeID string           `json:"packageNodeId"`
+	Versions      []packageVersion `json:"versions"`
+}
+
+// packageVersionsQuery walks package_versions from the requested package back
+// to the first version. Prior versions are in state VERSIONED, so the lookup
+// is by id and does not filter on state; only the starting package is scoped
+// to the dataset in the claims. A version whose predecessor was purged ends
+// the chain: previous_package_id is set to NULL.
+const packageVersionsQuery = `
+WITH RECURSIVE chain AS (
+    SELECT p.id, p.node_id, p.name, p.created_at, pv.version, pv.previous_package_id
+    FROM packages p
+    LEFT JOIN package_versions pv ON pv.package_id = p.id
+    WHERE p.node_id = $1 AND p.dataset_id = $2
+  UNION ALL
+    SELECT p.id, p.node_id, p.name, p.created_at, pv.version, pv.previous_package_id
+    FROM chain c
+    JOIN packages p ON p.id = c.previous_package_id
+    LEFT JOIN package_versions pv ON pv.package_id = p.id
+)
+SELECT c.id, c.node_id, c.name, c.created_at, COALESCE(c.version, 1),
+       (SELECT COALESCE(SUM(f.size), 0) FROM files f WHERE f.package_id = c.id)
+FROM chain c
+ORDER BY COALESCE(c.version, 1) DESC;`
+
+// getPackageVersionsRoute returns the version history of a package, newest
+// first. A package that was never imported with onConflict=version has a
+// single entry.
+func getPackageVersionsRoute(request events.APIGatewayV2HTTPRequest, claims *authorizer.Claims) (*events.APIGatewayV2HTTPResponse, error) {
+	packageNodeID, found := request.QueryStringParameters["package_id"]
+	if !found || !strings.HasPrefix(packageNodeID, "N:package:") {
+		return errResp(400, "package_id must be a package node id")
+	}
+
+	ctx := context.Background()
+
+	db, err := pgQueries.ConnectRDS()
+	if err != nil {
+		log.WithError(err).Error("failed to connect to RDS")
+		return errResp(500, "Internal error")
+	}
+	defer db.Close()
+
+	// The search path is set per connection; the transaction keeps the query
+	// on the connection WithOrg configured.
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		log.WithError(err).Error("versions: failed to begin read-only transaction")
+		return errResp(500, "Internal error")
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer tx.Rollback()
+
+	if _, err = pgQueries.New(tx).WithOrg(int(claims.OrgClaim.IntId)); err != nil {
+		log.WithError(err).Error("versions: unable to set search path")
+		return errResp(500, "Internal error")
+	}
+
+	rows, err := tx.QueryContext(ctx, packageVersionsQuery, packageNodeID, claims.DatasetClaim.IntId)
+	if err != nil {
+		log.WithError(err).WithField("packageNodeId", packageNodeID).Error("versions: query failed")
+		return errResp(500, "Internal error")
+	}
+	defer rows.Close()
+
+	versions := []packageVersion{}
+	for rows.Next() {
+		var v packageVersion
+		if err := rows.Scan(&v.PackageID, &v.PackageNodeID, &v.Name, &v.CreatedAt, &v.Version, &v.Size); err != nil {
+			log.WithError(err).WithField("packageNodeId", packageNodeID).Error("versions: scan failed")
+			return errResp(500, "Internal error")
+		}
+		versions = append(versions, v)
+	}
+	if err := rows.Err(); err != nil {
+		log.WithError(err).WithField("packageNodeId", packageNodeID).Error("versions: query failed")
+		return errResp(500, "Internal error")
+	}
+	if len(versions) == 0 {
+		return errResp(404, "Package not found")
+	}
+
+	body, _ := json.Marshal(packageVersionsResponse{PackageNodeID: packageNodeID, Versions: versions})
+	return &events.APIGatewayV2HTTPResponse{StatusCode: 200, Body: string(body)}, nil
+}
@@ -0,0 +1,93 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+	lambdaTypes "github.com/aws/aws-sdk-go-v2/service/lambda/types"
+	"github.com/pennsieve/pennsieve-upload-service-v2/service/pkg/checksum"
+)
+
+// defaultServerHashBudgetBytes is how many bytes in total a finalize request
+// hashes inline for objects S3 has no SHA256 checksum for. The budget is per
+// request rather than per object: a request has API Gateway's 30s for every
+// HEAD and hash, so the bytes read have to stay small however many files it
+// carries. Objects that don't fit the rest of the budget are hashed by the
+// reconcile lambda after import. Override with SERVER_HASH_BUDGET_BYTES.
+const defaultServerHashBudgetBytes = 32 * 1024 * 1024
+
+// hashBudget hands out the bytes a request may hash inline to the concurrent
+// verifications of its files.
+type hashBudget struct {
+	mu        sync.Mutex
+	remaining int64
+}
+
+func newHashBudget() *hashBudget {
+	total := int64(defaultServerHashBudgetBytes)
+	if v, err := strconv.ParseInt(os.Getenv("SERVER_HASH_BUDGET_BYTES"), 10, 64); err == nil && v >= 0 {
+		total = v
+	}
+	return &hashBudget{remaining: total}
+}
+
+// take reserves size bytes and returns true if the budget has them left.
+func (b *hashBudget) take(size int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if size > b.remaining {
+		return false
+	}
+	b.remaining -= size
+	return true
+}
+
+// hashStoredObject streams an object from the storage bucket and returns its
+// full-object SHA256.
+func hashStoredObject(ctx context.Context, bucket string, key string) (checksum.Checksum, error) {
+	body, err := storageBackend.Open(ctx, bucket, key)
+	if err != nil {
+		return checksum.Checksum{}, err
+	}
+	defer body.Close()
+	return checksum.SHA256Of(body)
+}
+
+// sha256VerificationJob asks the reconcile lambda to hash an imported object
+// and compare it with the SHA256 the client declared at finalize; a mismatch
+// fails the file. Mirrors SHA256Job in lambda/reconcile/handler.
+type sha256VerificationJob struct {
+	OrganizationID int64  `json:"organizationId"`
+	ManifestID     string `json:"manifestId"`
+	UploadID       string `json:"uploadId"`
+	Bucket         string `json:"bucket"`
+	Key            string `json:"key"`
+	DeclaredSHA256 string `json:"declaredSha256"`
+}
+
+// startSHA256Verification invokes the reconcile lambda asynchronously for
+// one object. Lambda retries a failed asynchronous invocation twice, which
+// covers the window before the upload lambda has created the file row; a job
+// that still fails goes to the reconcile lambda's dead-letter queue.
+func startSHA256Verification(ctx context.Context, job sha256VerificationJob) error {
+	functionName := os.Getenv("RECONCILE_FUNCTION_NAME")
+	if functionName == "" {
+		return fmt.Errorf("RECONCILE_FUNCTION_NAME not configured")
+	}
+	payload, err := json.Marshal(map[string]sha256VerificationJob{"verifySha256": job})
+	if err != nil {
+		return err
+	}
+	_, err = store.lambdaClient.Invoke(ctx, &lambda.InvokeInput{
+		InvocationType: lambdaTypes.InvocationTypeEvent,
+		FunctionName:   aws.String(functionName),
+		Payload:        payload,
+	})
+	return err
+}
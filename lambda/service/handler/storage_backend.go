@@ -0,0 +1,39 @@
+package handler
+
+import (
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/pennsieve/pennsieve-upload-service-v2/storage"
+	"github.com/pennsieve/pennsieve-upload-service-v2/storage/localbackend"
+	"github.com/pennsieve/pennsieve-upload-service-v2/storage/s3backend"
+)
+
+// storageBackend performs the object operations of the finalize and
+// storage-credentials routes on storage buckets.
+var storageBackend storage.StorageBackend
+
+// bucketRegions discovers the region of the upload and storage buckets, which
+// is what the credential routes report to the agent.
+var bucketRegions *s3backend.RegionCache
+
+// newStorageBackend returns the backend named by STORAGE_BACKEND: S3 by
+// default, or directories below LOCAL_STORAGE_ROOT for on-prem installs and
+// local end-to-end tests.
+func newStorageBackend(cfg aws.Config, s3Client *s3.Client) (storage.StorageBackend, error) {
+	backendType, err := storage.ParseBackendType(os.Getenv("STORAGE_BACKEND"))
+	if err != nil {
+		return nil, err
+	}
+	if backendType == storage.BackendLocal {
+		return localbackend.New(os.Getenv("LOCAL_STORAGE_ROOT"))
+	}
+	return s3backend.New(s3Client, s3backend.Options{
+		Region:             bucketRegions.Region,
+		DefaultRegion:      os.Getenv("REGION"),
+		STS:                sts.NewFromConfig(cfg),
+		CredentialsRoleARN: os.Getenv("STORAGE_CREDENTIALS_ROLE_ARN"),
+	}), nil
+}
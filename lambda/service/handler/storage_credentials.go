@@ -3,19 +3,16 @@ package handler
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"time"
 
 	"github.com/aws/aws-lambda-go/events"
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/service/sts"
 	"github.com/pennsieve/pennsieve-go-core/pkg/authorizer"
 	"github.com/pennsieve/pennsieve-go-core/pkg/models/gateway"
-	dyQueries "github.com/pennsieve/pennsieve-go-core/pkg/queries/dydb"
 	pgQueries "github.com/pennsieve/pennsieve-go-core/pkg/queries/pgdb"
-	"github.com/pennsieve/pennsieve-upload-service-v2/service/pkg/storage"
+	"github.com/pennsieve/pennsieve-upload-service-v2/storage"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -72,14 +69,6 @@ func postStorageCredentialsRoute(request events.APIGatewayV2HTTPRequest, claims
 		}, nil
 	}
 
-	roleARN := os.Getenv("STORAGE_CREDENTIALS_ROLE_ARN")
-	if roleARN == "" {
-		log.Error("STORAGE_CREDENTIALS_ROLE_ARN not configured")
-		return &events.APIGatewayV2HTTPResponse{
-			StatusCode: 500,
-			Body:       gateway.CreateErrorMessage("Storage credentials not configured", 500),
-		}, nil
-	}
 	defaultStorageBucket := os.Getenv("DEFAULT_STORAGE_BUCKET")
 	if defaultStorageBucket == "" {
 		log.Error("DEFAULT_STORAGE_BUCKET not configured")
@@ -88,10 +77,9 @@ func postStorageCredentialsRoute(request events.APIGatewayV2HTTPRequest, claims
 			Body:       gateway.CreateErrorMessage("Storage not configured", 500),
 		}, nil
 	}
-	region := os.Getenv("REGION")
 
-	// Resolve destination bucket via shared resolver (workspace-scoped today,
-	// per-dataset in the future).
+	// Resolve destination bucket via shared resolver (dataset override,
+	// then workspace bucket, then the default).
 	pgdb, err := pgQueries.ConnectRDS()
 	if err != nil {
 		log.WithError(err).Error("failed to connect to RDS")
@@ -102,14 +90,7 @@ func postStorageCredentialsRoute(request events.APIGatewayV2HTTPRequest, claims
 	}
 	defer pgdb.Close()
 
-	resolution, err := storage.ResolveForManifest(
-		ctx,
-		req.ManifestNodeID,
-		store.tableName,
-		defaultStorageBucket,
-		dyQueries.New(store.dynamodb),
-		pgQueries.New(pgdb),
-	)
+	resolution, err := storageResolver.Resolve(ctx, newStorageSource(pgdb), req.ManifestNodeID)
 	if err != nil {
 		log.WithError(err).WithField("manifestNodeId", req.ManifestNodeID).Error("failed to resolve storage bucket")
 		return &events.APIGatewayV2HTTPResponse{
@@ -118,49 +99,34 @@ func postStorageCredentialsRoute(request events.APIGatewayV2HTTPRequest, claims
 		}, nil
 	}
 
-	// Future: if resolver returns a non-S3 backend (Azure, local), return 409 so
-	// the agent can fall back or use a backend-specific auth path. Today all
-	// backends are S3, so this is a no-op until the resolver learns about
-	// multiple backend types.
-	// if resolution.Backend != storage.BackendS3 { ... return 409 ... }
-
-	sessionPolicy := fmt.Sprintf(`{
-		"Version": "2012-10-17",
-		"Statement": [{
-			"Effect": "Allow",
-			"Action": [
-				"s3:PutObject",
-				"s3:ListBucketMultipartUploads",
-				"s3:AbortMultipartUpload",
-				"s3:ListMultipartUploadParts",
-				"s3:PutObjectTagging"
-			],
-			"Resource": [
-				"arn:aws:s3:::%s",
-				"arn:aws:s3:::%s/%s/*"
-			]
-		}]
-	}`, resolution.StorageBucket, resolution.StorageBucket, resolution.KeyPrefix(req.ManifestNodeID))
+	// The agent only knows how to upload to S3 with STS credentials. A 409
+	// tells it to fall back to the upload bucket flow.
+	if resolution.Backend != storage.BackendS3 {
+		log.WithFields(log.Fields{
+			"manifestNodeId": req.ManifestNodeID,
+			"backend":        resolution.Backend,
+		}).Info("storage backend does not support direct upload")
+		return &events.APIGatewayV2HTTPResponse{
+			StatusCode: 409,
+			Body:       gateway.CreateErrorMessage(fmt.Sprintf("Storage backend %s does not support direct upload", resolution.Backend), 409),
+		}, nil
+	}
 
 	sessionName := fmt.Sprintf("storage-%d-%d", claims.OrgClaim.IntId, claims.UserClaim.Id)
 
-	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
-	if err != nil {
-		log.WithError(err).Error("Failed to load AWS config")
+	credentials, err := storageBackend.Credentials(ctx, storage.CredentialsRequest{
+		Bucket:   resolution.StorageBucket,
+		Prefix:   resolution.KeyPrefix(req.ManifestNodeID),
+		Session:  sessionName,
+		Duration: time.Hour,
+	})
+	if errors.Is(err, storage.ErrNotSupported) {
+		log.WithError(err).Error("storage credentials not configured")
 		return &events.APIGatewayV2HTTPResponse{
 			StatusCode: 500,
-			Body:       gateway.CreateErrorMessage("Internal error", 500),
+			Body:       gateway.CreateErrorMessage("Storage credentials not configured", 500),
 		}, nil
 	}
-
-	stsClient := sts.NewFromConfig(cfg)
-	durationSeconds := int32(3600)
-	result, err := stsClient.AssumeRole(ctx, &sts.AssumeRoleInput{
-		RoleArn:         aws.String(roleARN),
-		RoleSessionName: aws.String(sessionName),
-		Policy:          aws.String(sessionPolicy),
-		DurationSeconds: &durationSeconds,
-	})
 	if err != nil {
 		log.WithError(err).Error("Failed to assume storage credentials role")
 		return &events.APIGatewayV2HTTPResponse{
@@ -170,13 +136,13 @@ func postStorageCredentialsRoute(request events.APIGatewayV2HTTPRequest, claims
 	}
 
 	resp := storageCredentialsResponse{
-		AccessKeyID:     *result.Credentials.AccessKeyId,
-		SecretAccessKey: *result.Credentials.SecretAccessKey,
-		SessionToken:    *result.Credentials.SessionToken,
-		Expiration:      result.Credentials.Expiration.Format(time.RFC3339),
+		AccessKeyID:     credentials.AccessKeyID,
+		SecretAccessKey: credentials.SecretAccessKey,
+		SessionToken:    credentials.SessionToken,
+		Expiration:      credentials.Expiration.Format(time.RFC3339),
 		Bucket:          resolution.StorageBucket,
 		KeyPrefix:       resolution.KeyPrefix(req.ManifestNodeID),
-		Region:          region,
+		Region:          credentials.Region,
 	}
 
 	jsonBody, _ := json.Marshal(resp)
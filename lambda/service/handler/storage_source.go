@@ -0,0 +1,70 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/pennsieve/pennsieve-go-core/pkg/models/dydb"
+	pgQueries "github.com/pennsieve/pennsieve-go-core/pkg/queries/pgdb"
+	"github.com/pennsieve/pennsieve-upload-service-v2/storage"
+)
+
+// storageResolver resolves manifests to storage buckets for the
+// storage-credentials and finalize routes. It lives for the lifetime of the
+// execution environment, so warm invocations reuse cached resolutions.
+var storageResolver *storage.Resolver
+
+// storageSource implements storage.Source with the service lambda's
+// pennsieve-go-core queries.
+type storageSource struct {
+	dy *dynamodb.Client
+	db pgQueries.DBTX
+}
+
+func newStorageSource(db pgQueries.DBTX) storageSource {
+	return storageSource{dy: store.dynamodb, db: db}
+}
+
+// Manifest reads the manifest item itself rather than through go-core's
+// GetManifestById, whose error for a missing item cannot be told apart from
+// other failures.
+func (s storageSource) Manifest(ctx context.Context, manifestId string) (storage.Manifest, error) {
+	out, err := s.dy.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(store.tableName),
+		Key: map[string]types.AttributeValue{
+			"ManifestId": &types.AttributeValueMemberS{Value: manifestId},
+		},
+	})
+	if err != nil {
+		return storage.Manifest{}, fmt.Errorf("get manifest %s: %w", manifestId, err)
+	}
+	if out.Item == nil {
+		return storage.Manifest{}, storage.ErrManifestNotFound
+	}
+	var m dydb.ManifestTable
+	if err := attributevalue.UnmarshalMap(out.Item, &m); err != nil {
+		return storage.Manifest{}, fmt.Errorf("unmarshal manifest %s: %w", manifestId, err)
+	}
+	return storage.Manifest{
+		ManifestId:     m.ManifestId,
+		OrganizationId: m.OrganizationId,
+		DatasetId:      m.DatasetId,
+		DateCreated:    m.DateCreated,
+	}, nil
+}
+
+func (s storageSource) DatasetBucket(ctx context.Context, organizationId int64, datasetId int64) (string, bool, error) {
+	return storage.QueryDatasetBucket(ctx, s.db, organizationId, datasetId)
+}
+
+func (s storageSource) OrganizationBucket(ctx context.Context, organizationId int64) (string, bool, error) {
+	org, err := pgQueries.New(s.db).GetOrganization(ctx, organizationId)
+	if err != nil {
+		return "", false, err
+	}
+	return org.StorageBucket.String, org.StorageBucket.Valid, nil
+}
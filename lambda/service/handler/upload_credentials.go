@@ -83,7 +83,15 @@ func postUploadCredentialsRoute(request events.APIGatewayV2HTTPRequest, claims *
 		}, nil
 	}
 
-	region := os.Getenv("REGION")
+	ctx := context.Background()
+
+	// The agent signs its requests for the returned region, so report the
+	// bucket's actual region rather than the one this lambda runs in.
+	region, err := bucketRegions.Region(ctx, uploadBucket)
+	if err != nil {
+		log.WithError(err).WithField("bucket", uploadBucket).Warn("could not determine upload bucket region")
+		region = os.Getenv("REGION")
+	}
 
 	// Scope credentials to only allow writes under this manifest's prefix
 	sessionPolicy := fmt.Sprintf(`{
@@ -106,8 +114,7 @@ func postUploadCredentialsRoute(request events.APIGatewayV2HTTPRequest, claims *
 
 	sessionName := fmt.Sprintf("upload-%d-%d", claims.OrgClaim.IntId, claims.UserClaim.Id)
 
-	ctx := context.Background()
-	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(os.Getenv("REGION")))
 	if err != nil {
 		log.WithError(err).Error("Failed to load AWS config")
 		return &events.APIGatewayV2HTTPResponse{
@@ -6,5 +6,5 @@ import (
 )
 
 func main() {
-	lambda.Start(handler.ManifestHandler)
+	lambda.Start(handler.Handler)
 }
@@ -0,0 +1,230 @@
+// Package checksum verifies a client-declared object checksum against the
+// checksum S3 stored for the object.
+//
+// S3 stores one checksum per object, in one of two forms:
+//
+//   - FULL_OBJECT: the checksum of the whole object. Always the form for single
+//     part uploads, and available for multipart uploads with the CRC
+//     algorithms (CRC64NVME is always full-object).
+//   - COMPOSITE: for multipart uploads, the checksum of the concatenated part
+//     checksums, reported as "<base64>-<parts>". Reproducing it requires the
+//     same part layout as the upload.
+//
+// The two forms of the same algorithm are not comparable, so Verify rejects a
+// declared type that differs from the stored one instead of reporting a
+// mismatch that no client could fix. The exception is a full-object SHA256
+// against a composite one: the object's bytes reproduce the former, so Verify
+// reports the checksum as missing and leaves the caller to hash the object.
+package checksum
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pennsieve/pennsieve-upload-service-v2/storage"
+)
+
+// Algorithm is an S3 checksum algorithm.
+type Algorithm string
+
+const (
+	SHA256    Algorithm = "SHA256"
+	SHA1      Algorithm = "SHA1"
+	CRC32     Algorithm = "CRC32"
+	CRC32C    Algorithm = "CRC32C"
+	CRC64NVME Algorithm = "CRC64NVME"
+)
+
+// digestLength is the decoded length in bytes of a single checksum.
+var digestLength = map[Algorithm]int{
+	SHA256:    32,
+	SHA1:      20,
+	CRC32:     4,
+	CRC32C:    4,
+	CRC64NVME: 8,
+}
+
+// Header returns the response header S3 uses for the algorithm's checksum.
+func (a Algorithm) Header() string {
+	return "x-amz-checksum-" + strings.ToLower(string(a))
+}
+
+// Type is the form of a stored checksum.
+type Type string
+
+const (
+	FullObject Type = "FULL_OBJECT"
+	Composite  Type = "COMPOSITE"
+)
+
+// typeHeader is the response header S3 uses to report the checksum Type.
+const typeHeader = "x-amz-checksum-type"
+
+var (
+	// ErrMissing is returned when the object has no checksum for the declared algorithm.
+	ErrMissing = errors.New("checksum missing")
+	// ErrTypeMismatch is returned when the declared and stored checksum types differ.
+	ErrTypeMismatch = errors.New("checksum type mismatch")
+	// ErrMismatch is returned when the checksum values differ. The message
+	// reads "<algorithm> mismatch", the wording finalize has always reported.
+	ErrMismatch = errors.New("mismatch")
+)
+
+// ParseAlgorithm returns the Algorithm for s, case-insensitively. Empty is
+// SHA256, the only algorithm older clients send.
+func ParseAlgorithm(s string) (Algorithm, error) {
+	if s == "" {
+		return SHA256, nil
+	}
+	a := Algorithm(strings.ToUpper(s))
+	if _, ok := digestLength[a]; !ok {
+		return "", fmt.Errorf("unsupported checksum algorithm %q", s)
+	}
+	return a, nil
+}
+
+// ParseType returns the Type for s, case-insensitively. Empty means the type
+// is not declared and Verify follows whatever S3 stored.
+func ParseType(s string) (Type, error) {
+	switch t := Type(strings.ToUpper(s)); t {
+	case "", FullObject, Composite:
+		return t, nil
+	default:
+		return "", fmt.Errorf("unsupported checksum type %q", s)
+	}
+}
+
+// Checksum is a checksum value of a known algorithm. Type is empty when the
+// form is not known; Parts is the part count of a composite value when given.
+type Checksum struct {
+	Algorithm Algorithm
+	Type      Type
+	Value     string
+	Parts     int
+}
+
+// New parses a base64 checksum value, with an optional "-<parts>" suffix, and
+// validates its length for the algorithm. A suffix implies Composite.
+func New(algorithm Algorithm, t Type, value string) (Checksum, error) {
+	c := Checksum{Algorithm: algorithm, Type: t}
+	c.Value, c.Parts = splitParts(value)
+
+	raw, err := base64.StdEncoding.DecodeString(c.Value)
+	if err != nil {
+		return Checksum{}, fmt.Errorf("checksum is not valid base64: %w", err)
+	}
+	if len(raw) != digestLength[algorithm] {
+		return Checksum{}, fmt.Errorf("%s checksum must be %d bytes, got %d",
+			strings.ToLower(string(algorithm)), digestLength[algorithm], len(raw))
+	}
+	if c.Parts > 0 {
+		if c.Type == FullObject {
+			return Checksum{}, fmt.Errorf("a FULL_OBJECT checksum has no part count")
+		}
+		c.Type = Composite
+	}
+	return c, nil
+}
+
+// FromHeader returns the checksum S3 reported for algorithm in a HeadObject
+// response, and false if there is none. The type comes from the
+// x-amz-checksum-type header; older endpoints omit it, in which case a part
+// count suffix marks the value as composite.
+func FromHeader(h http.Header, algorithm Algorithm) (Checksum, bool) {
+	return FromObject(storage.ObjectChecksum{
+		Algorithm: string(algorithm),
+		Type:      h.Get(typeHeader),
+		Value:     h.Get(algorithm.Header()),
+	}, algorithm)
+}
+
+// FromObject returns the checksum a storage backend reported with an object
+// if it is of the given algorithm, and false otherwise. An empty type is
+// inferred from the value as in FromHeader.
+func FromObject(stored storage.ObjectChecksum, algorithm Algorithm) (Checksum, bool) {
+	if stored.Value == "" || Algorithm(strings.ToUpper(stored.Algorithm)) != algorithm {
+		return Checksum{}, false
+	}
+	c := Checksum{Algorithm: algorithm, Type: Type(strings.ToUpper(stored.Type))}
+	c.Value, c.Parts = splitParts(stored.Value)
+	if c.Type == "" {
+		c.Type = FullObject
+		if c.Parts > 0 {
+			c.Type = Composite
+		}
+	}
+	return c, true
+}
+
+// String returns the checksum in S3's notation.
+func (c Checksum) String() string {
+	if c.Parts > 0 {
+		return fmt.Sprintf("%s-%d", c.Value, c.Parts)
+	}
+	return c.Value
+}
+
+// Verify checks the declared checksum against the stored one. stored is the
+// zero value when S3 has no checksum for the declared algorithm. A composite
+// stored checksum counts as missing when the declared one is Computable. The
+// returned error wraps ErrMissing, ErrTypeMismatch or ErrMismatch.
+func Verify(declared Checksum, stored Checksum) error {
+	name := strings.ToLower(string(declared.Algorithm))
+	if stored.Value == "" {
+		return fmt.Errorf("%w: object has no %s checksum", ErrMissing, name)
+	}
+	if stored.Type == Composite && Computable(declared) {
+		return fmt.Errorf("%w: object has only a %s %s checksum", ErrMissing, Composite, name)
+	}
+	if declared.Type != "" && declared.Type != stored.Type {
+		return fmt.Errorf("%w: object has a %s %s checksum", ErrTypeMismatch, stored.Type, name)
+	}
+	if declared.Value != stored.Value {
+		return fmt.Errorf("%s %w", name, ErrMismatch)
+	}
+	// A declared part count is optional, but must agree when given.
+	if declared.Parts > 0 && stored.Parts > 0 && declared.Parts != stored.Parts {
+		return fmt.Errorf("%s %w: part count %d, object has %d", name, ErrMismatch, declared.Parts, stored.Parts)
+	}
+	return nil
+}
+
+// Computable reports whether the declared checksum can be checked by hashing
+// the object: only a full-object SHA256 can be reproduced from the bytes
+// alone, a composite one needs the upload's part layout.
+func Computable(declared Checksum) bool {
+	return declared.Algorithm == SHA256 && declared.Type != Composite
+}
+
+// SHA256Of reads r to the end and returns its full-object SHA256 checksum.
+func SHA256Of(r io.Reader) (Checksum, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return Checksum{}, err
+	}
+	return Checksum{
+		Algorithm: SHA256,
+		Type:      FullObject,
+		Value:     base64.StdEncoding.EncodeToString(h.Sum(nil)),
+	}, nil
+}
+
+// splitParts splits "<base64>-<parts>" into its value and part count. Base64
+// never contains '-', so a trailing numeric suffix is unambiguous.
+func splitParts(value string) (string, int) {
+	i := strings.LastIndexByte(value, '-')
+	if i < 0 {
+		return value, 0
+	}
+	parts, err := strconv.Atoi(value[i+1:])
+	if err != nil || parts <= 0 {
+		return value, 0
+	}
+	return value[:i], parts
+}
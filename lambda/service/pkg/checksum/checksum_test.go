@@ -0,0 +1,210 @@
+package checksum
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/pennsieve/pennsieve-upload-service-v2/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func sha256B64(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func crc32cB64(s string) string {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, crc32.Checksum([]byte(s), crc32.MakeTable(crc32.Castagnoli)))
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+func header(kv ...string) http.Header {
+	h := http.Header{}
+	for i := 0; i < len(kv); i += 2 {
+		h.Set(kv[i], kv[i+1])
+	}
+	return h
+}
+
+func TestChecksum(t *testing.T) {
+	for scenario, fn := range map[string]func(tt *testing.T){
+		"parses algorithm and type":          testParse,
+		"rejects malformed values":           testNewInvalid,
+		"reads stored checksum from headers": testFromHeader,
+		"reads stored checksum from backend": testFromObject,
+		"verifies full-object checksums":     testVerifyFullObject,
+		"verifies composite checksums":       testVerifyComposite,
+		"rejects mismatched checksum types":  testVerifyTypeMismatch,
+		"reports missing checksums":          testVerifyMissing,
+		"hashes over composite sha256":       testVerifyCompositeComputable,
+		"computes full-object sha256":        testSHA256Of,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			fn(t)
+		})
+	}
+}
+
+func testParse(t *testing.T) {
+	a, err := ParseAlgorithm("")
+	assert.NoError(t, err)
+	assert.Equal(t, SHA256, a)
+
+	a, err = ParseAlgorithm("crc64nvme")
+	assert.NoError(t, err)
+	assert.Equal(t, CRC64NVME, a)
+
+	_, err = ParseAlgorithm("md5")
+	assert.Error(t, err)
+
+	ty, err := ParseType("composite")
+	assert.NoError(t, err)
+	assert.Equal(t, Composite, ty)
+
+	_, err = ParseType("partial")
+	assert.Error(t, err)
+}
+
+func testNewInvalid(t *testing.T) {
+	_, err := New(SHA256, "", "not base64!")
+	assert.Error(t, err)
+
+	// A CRC32C value is too short for SHA256.
+	_, err = New(SHA256, "", crc32cB64("x"))
+	assert.Error(t, err)
+
+	_, err = New(SHA256, FullObject, sha256B64("x")+"-3")
+	assert.Error(t, err)
+
+	c, err := New(SHA256, "", sha256B64("x")+"-3")
+	assert.NoError(t, err)
+	assert.Equal(t, Composite, c.Type)
+	assert.Equal(t, 3, c.Parts)
+	assert.Equal(t, sha256B64("x")+"-3", c.String())
+}
+
+func testFromHeader(t *testing.T) {
+	c, ok := FromHeader(header("x-amz-checksum-crc64nvme", "AAAAAAAAAAA=", "x-amz-checksum-type", "FULL_OBJECT"), CRC64NVME)
+	assert.True(t, ok)
+	assert.Equal(t, FullObject, c.Type)
+
+	// No type header: the part count suffix decides.
+	c, ok = FromHeader(header("x-amz-checksum-sha256", sha256B64("x")+"-2"), SHA256)
+	assert.True(t, ok)
+	assert.Equal(t, Composite, c.Type)
+	assert.Equal(t, 2, c.Parts)
+
+	_, ok = FromHeader(header("x-amz-checksum-sha256", sha256B64("x")), CRC32C)
+	assert.False(t, ok)
+}
+
+func testFromObject(t *testing.T) {
+	c, ok := FromObject(storage.ObjectChecksum{Algorithm: "CRC32C", Type: "FULL_OBJECT", Value: crc32cB64("hello")}, CRC32C)
+	assert.True(t, ok)
+	assert.Equal(t, FullObject, c.Type)
+
+	c, ok = FromObject(storage.ObjectChecksum{Algorithm: "SHA256", Value: sha256B64("x") + "-4"}, SHA256)
+	assert.True(t, ok)
+	assert.Equal(t, Composite, c.Type)
+	assert.Equal(t, 4, c.Parts)
+
+	_, ok = FromObject(storage.ObjectChecksum{Algorithm: "SHA256", Value: sha256B64("x")}, CRC32C)
+	assert.False(t, ok)
+	_, ok = FromObject(storage.ObjectChecksum{}, SHA256)
+	assert.False(t, ok)
+}
+
+func testVerifyFullObject(t *testing.T) {
+	stored, _ := FromHeader(header("x-amz-checksum-crc32c", crc32cB64("hello")), CRC32C)
+
+	declared, err := New(CRC32C, FullObject, crc32cB64("hello"))
+	assert.NoError(t, err)
+	assert.NoError(t, Verify(declared, stored))
+
+	declared, _ = New(CRC32C, "", crc32cB64("hello"))
+	assert.NoError(t, Verify(declared, stored))
+
+	declared, _ = New(CRC32C, FullObject, crc32cB64("world"))
+	err = Verify(declared, stored)
+	assert.True(t, errors.Is(err, ErrMismatch))
+	assert.EqualError(t, err, "crc32c mismatch")
+}
+
+func testVerifyComposite(t *testing.T) {
+	stored, _ := FromHeader(header(
+		"x-amz-checksum-sha256", sha256B64("parts")+"-4",
+		"x-amz-checksum-type", "COMPOSITE"), SHA256)
+
+	// The suffix is optional on the declared value.
+	declared, _ := New(SHA256, Composite, sha256B64("parts"))
+	assert.NoError(t, Verify(declared, stored))
+
+	// Older clients echo S3's value verbatim without a type.
+	declared, _ = New(SHA256, "", sha256B64("parts")+"-4")
+	assert.NoError(t, Verify(declared, stored))
+
+	declared, _ = New(SHA256, "", sha256B64("parts")+"-5")
+	assert.True(t, errors.Is(Verify(declared, stored), ErrMismatch))
+}
+
+func testVerifyTypeMismatch(t *testing.T) {
+	stored, _ := FromHeader(header("x-amz-checksum-crc32c", crc32cB64("parts")+"-4"), CRC32C)
+
+	// A full-object CRC32C can't be checked against a composite one, even if
+	// the bytes happen to be right.
+	declared, _ := New(CRC32C, FullObject, crc32cB64("parts"))
+	err := Verify(declared, stored)
+	assert.True(t, errors.Is(err, ErrTypeMismatch))
+	assert.Contains(t, err.Error(), "COMPOSITE crc32c")
+
+	stored, _ = FromHeader(header("x-amz-checksum-sha256", sha256B64("whole")), SHA256)
+	declared, _ = New(SHA256, Composite, sha256B64("whole"))
+	assert.True(t, errors.Is(Verify(declared, stored), ErrTypeMismatch))
+}
+
+func testVerifyCompositeComputable(t *testing.T) {
+	stored, _ := FromHeader(header("x-amz-checksum-sha256", sha256B64("parts")+"-4"), SHA256)
+
+	// A multipart upload stores only the composite SHA256; a full-object or
+	// untyped declaration is checked by hashing the object instead.
+	for _, typ := range []Type{FullObject, ""} {
+		declared, _ := New(SHA256, typ, sha256B64("hello"))
+		err := Verify(declared, stored)
+		assert.True(t, errors.Is(err, ErrMissing))
+		assert.Contains(t, err.Error(), "COMPOSITE sha256")
+
+		computed, _ := SHA256Of(strings.NewReader("hello"))
+		assert.NoError(t, Verify(declared, computed))
+	}
+}
+
+func testVerifyMissing(t *testing.T) {
+	declared, _ := New(CRC64NVME, "", "AAAAAAAAAAA=")
+	assert.True(t, errors.Is(Verify(declared, Checksum{}), ErrMissing))
+}
+
+func testSHA256Of(t *testing.T) {
+	computed, err := SHA256Of(strings.NewReader("hello"))
+	assert.NoError(t, err)
+	assert.Equal(t, sha256B64("hello"), computed.Value)
+
+	declared, _ := New(SHA256, "", sha256B64("hello"))
+	assert.True(t, Computable(declared))
+	assert.NoError(t, Verify(declared, computed))
+
+	declared, _ = New(SHA256, "", sha256B64("world"))
+	assert.True(t, errors.Is(Verify(declared, computed), ErrMismatch))
+
+	declared, _ = New(SHA256, "", sha256B64("hello")+"-2")
+	assert.False(t, Computable(declared))
+
+	declared, _ = New(CRC32C, "", crc32cB64("hello"))
+	assert.False(t, Computable(declared))
+}
@@ -0,0 +1,296 @@
+// Package preview computes what importing a manifest would do without
+// writing anything.
+//
+// The folders and packages come from storage/importplan, the same plan the
+// upload lambda's ImportFiles imports from; this package only adds the reads
+// that tell which folders exist and which names would collide.
+package preview
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	"github.com/pennsieve/pennsieve-go-core/pkg/models/dydb"
+	"github.com/pennsieve/pennsieve-go-core/pkg/models/fileInfo/fileType"
+	"github.com/pennsieve/pennsieve-go-core/pkg/models/packageInfo/packageType"
+	"github.com/pennsieve/pennsieve-go-core/pkg/models/pgdb"
+	"github.com/pennsieve/pennsieve-upload-service-v2/storage/importplan"
+)
+
+// PackageLister discovers existing folders and packages. Both lookups must
+// leave out packages the import does not see either: deleted packages and
+// prior versions kept by onConflict=version. GetPackagesByNodeIds keys the
+// packages it finds by node id.
+type PackageLister interface {
+	GetPackageChildren(ctx context.Context, parent *pgdb.Package, datasetId int, onlyFolders bool) ([]pgdb.Package, error)
+	GetPackagesByNodeIds(ctx context.Context, datasetId int, nodeIds []string) (map[string]pgdb.Package, error)
+}
+
+// Conflict resolution outcomes reported for a predicted name collision.
+const (
+	ActionRename  = "rename"
+	ActionReplace = "replace"
+	ActionVersion = "version"
+	ActionSkip    = "skip"
+	ActionFail    = "fail"
+)
+
+// Folder is a collection that the import would create.
+type Folder struct {
+	Path       string `json:"path"`
+	Name       string `json:"name"`
+	ParentPath string `json:"parentPath"`
+}
+
+// Package is a package that the import would create.
+type Package struct {
+	NodeId      string   `json:"nodeId"`
+	Name        string   `json:"name"`
+	ParentPath  string   `json:"parentPath"`
+	PackageType string   `json:"packageType"`
+	UploadIds   []string `json:"uploadIds"`
+}
+
+// MergedGroup is a set of files that share a MergePackageId and therefore
+// land in a single package. Existing is true when an earlier import already
+// created the package; the files are added to it and it is not listed in
+// Plan.Packages.
+type MergedGroup struct {
+	MergePackageId string   `json:"mergePackageId"`
+	PackageNodeId  string   `json:"packageNodeId"`
+	Name           string   `json:"name"`
+	UploadIds      []string `json:"uploadIds"`
+	Existing       bool     `json:"existing,omitempty"`
+}
+
+// Conflict is a predicted name collision between a package the import would
+// create and a package that already exists under the same parent (or another
+// package in the same manifest). ExistingNodeId is empty for the latter.
+type Conflict struct {
+	PackageNodeId  string `json:"packageNodeId"`
+	Name           string `json:"name"`
+	ParentPath     string `json:"parentPath"`
+	ExistingNodeId string `json:"existingNodeId,omitempty"`
+	Action         string `json:"action"`
+	PredictedName  string `json:"predictedName,omitempty"`
+}
+
+// Plan is the full dry-run result for a set of manifest files.
+type Plan struct {
+	OnConflict   string        `json:"onConflict"`
+	FileCount    int           `json:"fileCount"`
+	Folders      []Folder      `json:"folders"`
+	Packages     []Package     `json:"packages"`
+	MergedGroups []MergedGroup `json:"mergedGroups"`
+	Conflicts    []Conflict    `json:"conflicts"`
+}
+
+var fileNameRegex = regexp.MustCompile(`(?P<FileName>[^.]*)\.?(?P<Extension>.*)`)
+
+// Build computes the import Plan for the provided manifest files under the
+// provided onConflict strategy. fileOnConflict overrides the strategy per
+// upload id; as in the import, the members of a merged group all take the
+// strategy of the first one. It only issues reads against lister.
+func Build(ctx context.Context, lister PackageLister, datasetId int, files []dydb.ManifestFileTable,
+	onConflict string, fileOnConflict map[string]string) (*Plan, error) {
+
+	plan := &Plan{
+		OnConflict:   onConflict,
+		FileCount:    len(files),
+		Folders:      []Folder{},
+		Packages:     []Package{},
+		MergedGroups: []MergedGroup{},
+		Conflicts:    []Conflict{},
+	}
+
+	planned := make([]importplan.File, len(files))
+	for i, f := range files {
+		planned[i] = importplan.File{
+			UploadId:       f.UploadId,
+			Path:           f.FilePath,
+			Name:           f.FileName,
+			MergePackageId: f.MergePackageId,
+		}
+	}
+	importPlan := importplan.New(planned, "")
+
+	// 1. Resolve which folders already exist. The plan lists a folder's
+	// parent before the folder itself, the same invariant
+	// GetCreateUploadFolders relies on.
+	rootChildren, err := lister.GetPackageChildren(ctx, &pgdb.Package{}, datasetId, true)
+	if err != nil {
+		return nil, fmt.Errorf("error getting root folders: %w", err)
+	}
+	existingFolders := map[string]pgdb.Package{}
+	for _, k := range rootChildren {
+		existingFolders[k.Name] = k
+	}
+
+	for _, f := range importPlan.Folders {
+		existing, ok := existingFolders[f.Path]
+		if !ok {
+			plan.Folders = append(plan.Folders, Folder{Path: f.Path, Name: f.Name, ParentPath: f.ParentPath})
+			continue
+		}
+
+		children, err := lister.GetPackageChildren(ctx, &existing, datasetId, true)
+		if err != nil {
+			return nil, fmt.Errorf("error getting children for folder %s: %w", f.Path, err)
+		}
+		for _, k := range children {
+			existingFolders[fmt.Sprintf("%s/%s", f.Path, k.Name)] = k
+		}
+	}
+
+	// 2. Packages — one per uploadId, or per MergePackageId for merged files.
+	// A merged package an earlier import created is reused rather than
+	// created again, so it is neither a new package nor a name collision.
+	var mergedNodeIds []string
+	for _, pkg := range importPlan.Packages {
+		if files[pkg.Files[0]].MergePackageId != "" {
+			mergedNodeIds = append(mergedNodeIds, pkg.NodeId)
+		}
+	}
+	mergedPackages, err := lister.GetPackagesByNodeIds(ctx, datasetId, mergedNodeIds)
+	if err != nil {
+		return nil, fmt.Errorf("error getting existing merged packages: %w", err)
+	}
+
+	strategies := map[string]string{}
+	for _, pkg := range importPlan.Packages {
+		first := files[pkg.Files[0]]
+		uploadIds := make([]string, len(pkg.Files))
+		for i, k := range pkg.Files {
+			uploadIds[i] = files[k].UploadId
+		}
+		_, existing := mergedPackages[pkg.NodeId]
+
+		if !existing {
+			plan.Packages = append(plan.Packages, Package{
+				NodeId:      pkg.NodeId,
+				Name:        pkg.Name,
+				ParentPath:  pkg.ParentPath,
+				PackageType: packageTypeFor(first.FileType).String(),
+				UploadIds:   uploadIds,
+			})
+		}
+		if first.MergePackageId != "" {
+			plan.MergedGroups = append(plan.MergedGroups, MergedGroup{
+				MergePackageId: first.MergePackageId,
+				PackageNodeId:  pkg.NodeId,
+				Name:           pkg.Name,
+				UploadIds:      uploadIds,
+				Existing:       existing,
+			})
+		}
+
+		strategies[pkg.NodeId] = onConflict
+		if s := fileOnConflict[first.UploadId]; s != "" {
+			strategies[pkg.NodeId] = s
+		}
+	}
+
+	// 3. Predicted conflicts. Packages under a folder the import would create
+	// cannot collide with anything that exists today, so only parents that
+	// already exist (or the dataset root) are queried.
+	taken := map[string]map[string]pgdb.Package{}
+	for _, pkg := range plan.Packages {
+		names, ok := taken[pkg.ParentPath]
+		if !ok {
+			names = map[string]pgdb.Package{}
+			var parent *pgdb.Package
+			if pkg.ParentPath == "" {
+				parent = &pgdb.Package{}
+			} else if existing, ok := existingFolders[pkg.ParentPath]; ok {
+				parent = &existing
+			}
+			if parent != nil {
+				children, err := lister.GetPackageChildren(ctx, parent, datasetId, false)
+				if err != nil {
+					return nil, fmt.Errorf("error getting packages under %q: %w", pkg.ParentPath, err)
+				}
+				for _, c := range children {
+					names[c.Name] = c
+				}
+			}
+			taken[pkg.ParentPath] = names
+		}
+
+		existing, collides := names[pkg.Name]
+		if !collides {
+			names[pkg.Name] = pgdb.Package{Name: pkg.Name}
+			continue
+		}
+
+		c := Conflict{
+			PackageNodeId:  pkg.NodeId,
+			Name:           pkg.Name,
+			ParentPath:     pkg.ParentPath,
+			ExistingNodeId: existing.NodeId,
+			Action:         conflictAction(strategies[pkg.NodeId], existing),
+		}
+		if c.Action == ActionRename {
+			c.PredictedName = nextFreeName(pkg.Name, names)
+			names[c.PredictedName] = pgdb.Package{Name: c.PredictedName}
+		}
+		plan.Conflicts = append(plan.Conflicts, c)
+	}
+
+	return plan, nil
+}
+
+// conflictAction returns the outcome the import would apply to a collision
+// with existing. Collisions with another package in the same manifest
+// (existing.NodeId == "") are always renamed: there is no committed
+// predecessor to replace, skip or fail against. Folders can't be replaced by
+// a file, so replace and version fall back to a rename for them; skip and
+// fail check names regardless of package type.
+func conflictAction(onConflict string, existing pgdb.Package) string {
+	if existing.NodeId == "" {
+		return ActionRename
+	}
+	switch onConflict {
+	case "replace", "version":
+		if existing.PackageType == packageType.Collection {
+			return ActionRename
+		}
+		if onConflict == "version" {
+			return ActionVersion
+		}
+		return ActionReplace
+	case "skip":
+		return ActionSkip
+	case "fail":
+		return ActionFail
+	default:
+		return ActionRename
+	}
+}
+
+// nextFreeName mirrors pennsieve-go-core's expandName: "name (N).ext" with
+// the lowest N that is not already taken under the same parent.
+func nextFreeName(name string, taken map[string]pgdb.Package) string {
+	parts := fileNameRegex.FindStringSubmatch(name)
+	base := parts[fileNameRegex.SubexpIndex("FileName")]
+	ext := parts[fileNameRegex.SubexpIndex("Extension")]
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s (%d)", base, i)
+		if ext != "" {
+			candidate = fmt.Sprintf("%s (%d).%s", base, i, ext)
+		}
+		if _, ok := taken[candidate]; !ok {
+			return candidate
+		}
+	}
+}
+
+// packageTypeFor mirrors the upload lambda's getFileInfo fallback to
+// GenericData for unmapped file types.
+func packageTypeFor(fileTypeStr string) packageType.Type {
+	info, ok := packageType.FileTypeToInfoDict[fileType.Dict[fileTypeStr]]
+	if !ok {
+		info = packageType.FileTypeToInfoDict[fileType.GenericData]
+	}
+	return info.PackageType
+}
@@ -0,0 +1,266 @@
+package preview
+
+import (
+	"context"
+	"database/sql"
+	"slices"
+	"testing"
+
+	"github.com/pennsieve/pennsieve-go-core/pkg/models/dydb"
+	"github.com/pennsieve/pennsieve-go-core/pkg/models/packageInfo/packageType"
+	"github.com/pennsieve/pennsieve-go-core/pkg/models/pgdb"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeLister serves GetPackageChildren and GetPackagesByNodeIds from an
+// in-memory tree keyed by parent id (0 = dataset root) and counts
+// GetPackageChildren calls so tests can assert the preview never walks into
+// folders that do not exist yet.
+type fakeLister struct {
+	children map[int64][]pgdb.Package
+	calls    int
+}
+
+func (f *fakeLister) GetPackageChildren(_ context.Context, parent *pgdb.Package, _ int, onlyFolders bool) ([]pgdb.Package, error) {
+	f.calls++
+	var out []pgdb.Package
+	for _, p := range f.children[parent.Id] {
+		if onlyFolders && p.PackageType != packageType.Collection {
+			continue
+		}
+		out = append(out, p)
+	}
+	return out, nil
+}
+
+func (f *fakeLister) GetPackagesByNodeIds(_ context.Context, _ int, nodeIds []string) (map[string]pgdb.Package, error) {
+	out := map[string]pgdb.Package{}
+	for _, children := range f.children {
+		for _, p := range children {
+			if slices.Contains(nodeIds, p.NodeId) {
+				out[p.NodeId] = p
+			}
+		}
+	}
+	return out, nil
+}
+
+func folderPkg(id int64, parentId int64, name string) pgdb.Package {
+	return pgdb.Package{
+		Id:          id,
+		Name:        name,
+		NodeId:      "N:collection:" + name,
+		PackageType: packageType.Collection,
+		ParentId:    sql.NullInt64{Int64: parentId, Valid: parentId != 0},
+	}
+}
+
+func filePkg(id int64, parentId int64, name string) pgdb.Package {
+	return pgdb.Package{
+		Id:          id,
+		Name:        name,
+		NodeId:      "N:package:existing-" + name,
+		PackageType: packageType.Text,
+		ParentId:    sql.NullInt64{Int64: parentId, Valid: parentId != 0},
+	}
+}
+
+func TestBuild(t *testing.T) {
+	for scenario, fn := range map[string]func(tt *testing.T){
+		"folders only created when missing":   testFoldersToCreate,
+		"merged files share one package":      testMergedGroups,
+		"conflicts under keepBoth":            testConflictsKeepBoth,
+		"conflicts under replace/version":     testConflictsReplace,
+		"conflicts under skip and fail":       testConflictsSkipFail,
+		"new folders are not queried":         testNewFolderNotQueried,
+		"existing merged packages are reused": testExistingMergedPackage,
+		"per-file onConflict overrides":       testFileOnConflict,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			fn(t)
+		})
+	}
+}
+
+func testFoldersToCreate(t *testing.T) {
+	lister := &fakeLister{children: map[int64][]pgdb.Package{
+		0: {folderPkg(1, 0, "a")},
+		1: {folderPkg(2, 1, "b")},
+	}}
+	files := []dydb.ManifestFileTable{
+		{UploadId: "u1", FilePath: "/a/b/c/", FileName: "x.txt", FileType: "Text"},
+		{UploadId: "u2", FilePath: "a/d", FileName: "y.txt", FileType: "Text"},
+	}
+
+	plan, err := Build(context.Background(), lister, 1, files, "keepBoth", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, plan.FileCount)
+
+	var paths []string
+	for _, f := range plan.Folders {
+		paths = append(paths, f.Path)
+	}
+	assert.ElementsMatch(t, []string{"a/b/c", "a/d"}, paths)
+	assert.Len(t, plan.Packages, 2)
+	assert.Empty(t, plan.Conflicts)
+}
+
+func testMergedGroups(t *testing.T) {
+	lister := &fakeLister{children: map[int64][]pgdb.Package{}}
+	files := []dydb.ManifestFileTable{
+		{UploadId: "u1", FileName: "scan.hdr", FileType: "Analyze", MergePackageId: "m1"},
+		{UploadId: "u2", FileName: "scan.img", FileType: "Analyze", MergePackageId: "m1"},
+		{UploadId: "u3", FileName: "notes.txt", FileType: "Text"},
+	}
+
+	plan, err := Build(context.Background(), lister, 1, files, "keepBoth", nil)
+	assert.NoError(t, err)
+	assert.Len(t, plan.Packages, 2)
+	assert.Len(t, plan.MergedGroups, 1)
+
+	group := plan.MergedGroups[0]
+	assert.Equal(t, "N:package:m1", group.PackageNodeId)
+	assert.Equal(t, "scan", group.Name)
+	assert.ElementsMatch(t, []string{"u1", "u2"}, group.UploadIds)
+}
+
+func testConflictsKeepBoth(t *testing.T) {
+	lister := &fakeLister{children: map[int64][]pgdb.Package{
+		0: {filePkg(10, 0, "x.txt"), filePkg(11, 0, "x (1).txt")},
+	}}
+	files := []dydb.ManifestFileTable{
+		{UploadId: "u1", FileName: "x.txt", FileType: "Text"},
+		{UploadId: "u2", FileName: "y.txt", FileType: "Text"},
+		{UploadId: "u3", FileName: "y.txt", FileType: "Text"},
+	}
+
+	plan, err := Build(context.Background(), lister, 1, files, "keepBoth", nil)
+	assert.NoError(t, err)
+	assert.Len(t, plan.Conflicts, 2)
+
+	byPackage := map[string]Conflict{}
+	for _, c := range plan.Conflicts {
+		byPackage[c.PackageNodeId] = c
+	}
+
+	existing := byPackage["N:package:u1"]
+	assert.Equal(t, ActionRename, existing.Action)
+	assert.Equal(t, "N:package:existing-x.txt", existing.ExistingNodeId)
+	assert.Equal(t, "x (2).txt", existing.PredictedName)
+
+	inManifest := byPackage["N:package:u3"]
+	assert.Equal(t, ActionRename, inManifest.Action)
+	assert.Empty(t, inManifest.ExistingNodeId)
+	assert.Equal(t, "y (1).txt", inManifest.PredictedName)
+}
+
+func testConflictsReplace(t *testing.T) {
+	lister := &fakeLister{children: map[int64][]pgdb.Package{
+		0: {filePkg(10, 0, "x.txt"), folderPkg(12, 0, "data")},
+	}}
+	files := []dydb.ManifestFileTable{
+		{UploadId: "u1", FileName: "x.txt", FileType: "Text"},
+		{UploadId: "u2", FileName: "data", FileType: "Text"},
+	}
+
+	for onConflict, action := range map[string]string{"replace": ActionReplace, "version": ActionVersion} {
+		plan, err := Build(context.Background(), lister, 1, files, onConflict, nil)
+		assert.NoError(t, err)
+		assert.Len(t, plan.Conflicts, 2)
+
+		for _, c := range plan.Conflicts {
+			switch c.PackageNodeId {
+			case "N:package:u1":
+				assert.Equal(t, action, c.Action)
+				assert.Empty(t, c.PredictedName)
+			case "N:package:u2":
+				// A folder can't be replaced by a file; the import renames.
+				assert.Equal(t, ActionRename, c.Action)
+				assert.Equal(t, "data (1)", c.PredictedName)
+			}
+		}
+	}
+}
+
+func testNewFolderNotQueried(t *testing.T) {
+	lister := &fakeLister{children: map[int64][]pgdb.Package{}}
+	files := []dydb.ManifestFileTable{
+		{UploadId: "u1", FilePath: "new/deep", FileName: "x.txt", FileType: "Text"},
+	}
+
+	_, err := Build(context.Background(), lister, 1, files, "keepBoth", nil)
+	assert.NoError(t, err)
+	// Only the root-folder lookup; nothing under the folders to be created.
+	assert.Equal(t, 1, lister.calls)
+}
+
+func testConflictsSkipFail(t *testing.T) {
+	lister := &fakeLister{children: map[int64][]pgdb.Package{
+		0: {filePkg(10, 0, "x.txt"), folderPkg(12, 0, "data")},
+	}}
+	files := []dydb.ManifestFileTable{
+		{UploadId: "u1", FileName: "x.txt", FileType: "Text"},
+		{UploadId: "u2", FileName: "data", FileType: "Text"},
+	}
+
+	for onConflict, action := range map[string]string{"skip": ActionSkip, "fail": ActionFail} {
+		plan, err := Build(context.Background(), lister, 1, files, onConflict, nil)
+		assert.NoError(t, err)
+		if assert.Len(t, plan.Conflicts, 2) {
+			for _, c := range plan.Conflicts {
+				assert.Equal(t, action, c.Action)
+				assert.Empty(t, c.PredictedName)
+			}
+		}
+	}
+}
+
+func testExistingMergedPackage(t *testing.T) {
+	merged := filePkg(20, 0, "scan")
+	merged.NodeId = "N:package:m1"
+	lister := &fakeLister{children: map[int64][]pgdb.Package{
+		0: {merged},
+	}}
+	files := []dydb.ManifestFileTable{
+		{UploadId: "u1", FileName: "scan.img", FileType: "Analyze", MergePackageId: "m1"},
+	}
+
+	plan, err := Build(context.Background(), lister, 1, files, "fail", nil)
+	assert.NoError(t, err)
+	// The member joins the package an earlier import created: nothing new,
+	// and no collision with the package's own name.
+	assert.Empty(t, plan.Packages)
+	assert.Empty(t, plan.Conflicts)
+	if assert.Len(t, plan.MergedGroups, 1) {
+		assert.True(t, plan.MergedGroups[0].Existing)
+		assert.Equal(t, []string{"u1"}, plan.MergedGroups[0].UploadIds)
+	}
+}
+
+func testFileOnConflict(t *testing.T) {
+	lister := &fakeLister{children: map[int64][]pgdb.Package{
+		0: {filePkg(10, 0, "x.txt"), filePkg(11, 0, "y.txt"), filePkg(12, 0, "scan")},
+	}}
+	files := []dydb.ManifestFileTable{
+		{UploadId: "u1", FileName: "x.txt", FileType: "Text"},
+		{UploadId: "u2", FileName: "y.txt", FileType: "Text"},
+		{UploadId: "u3", FileName: "scan.hdr", FileType: "Analyze", MergePackageId: "m1"},
+		{UploadId: "u4", FileName: "scan.img", FileType: "Analyze", MergePackageId: "m1"},
+	}
+	overrides := map[string]string{"u2": "skip", "u3": "replace", "u4": "fail"}
+
+	plan, err := Build(context.Background(), lister, 1, files, "keepBoth", overrides)
+	assert.NoError(t, err)
+	assert.Equal(t, "keepBoth", plan.OnConflict)
+
+	actions := map[string]string{}
+	for _, c := range plan.Conflicts {
+		actions[c.PackageNodeId] = c.Action
+	}
+	assert.Equal(t, map[string]string{
+		"N:package:u1": ActionRename,
+		"N:package:u2": ActionSkip,
+		// A merged group takes the strategy of its first member.
+		"N:package:m1": ActionReplace,
+	}, actions)
+}
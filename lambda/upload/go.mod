@@ -21,6 +21,7 @@ require (
 	github.com/aws/smithy-go v1.20.1
 	github.com/google/uuid v1.6.0
 	github.com/pennsieve/pennsieve-go-core v1.16.1
+	github.com/pennsieve/pennsieve-upload-service-v2/storage v0.0.0-00010101000000-000000000000
 	github.com/pusher/pusher-http-go/v5 v5.1.1
 	github.com/sirupsen/logrus v1.9.3
 	github.com/stretchr/testify v1.8.1
@@ -53,3 +54,5 @@ require (
 	golang.org/x/sys v0.21.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
+
+replace github.com/pennsieve/pennsieve-upload-service-v2/storage => ../../storage
@@ -2,9 +2,131 @@ package handler
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
 	"github.com/pennsieve/pennsieve-go-core/pkg/changelog"
+	"github.com/pennsieve/pennsieve-go-core/pkg/models/pgdb"
 )
 
 type Changelogger interface {
 	EmitEvents(ctx context.Context, params changelog.Message) error
 }
+
+// maxChangelogMessageBytes keeps a DatasetChangelogEventJob message below the 256 KiB SQS limit.
+const maxChangelogMessageBytes = 240 * 1024
+
+// packageDeleteEvent is the eventDetail of the DELETE_PACKAGE event for a package an import with onConflict replace
+// or version soft-deleted. pennsieve-go-core has no detail type for deletes; the fields follow
+// changelog.PackageCreateEvent, and ReplacedBy is the package that took its place.
+type packageDeleteEvent struct {
+	Id         int64                    `json:"id"`
+	Name       string                   `json:"name"`
+	NodeId     string                   `json:"nodeId"`
+	Parent     *changelog.ParentPackage `json:"parent"`
+	ReplacedBy *changelog.ParentPackage `json:"replacedBy,omitempty"`
+}
+
+// importChangelogEvents returns the activity log events of an import: a CREATE_PACKAGE event for each folder it
+// created, then one for each package it created, then a DELETE_PACKAGE event for each predecessor it replaced.
+// folders resolves parent ids to the folders of the dataset; predecessors maps the id of a replaced package to its
+// row.
+func importChangelogEvents(createdFolders []pgdb.Package, packages []pgdb.Package, predecessors map[int64]pgdb.Package,
+	folders pgdb.PackageMap, timestamp time.Time) []changelog.Event {
+
+	folderById := make(map[int64]pgdb.Package, len(folders))
+	for _, f := range folders {
+		folderById[f.Id] = f
+	}
+	parent := func(p pgdb.Package) *changelog.ParentPackage {
+		if !p.ParentId.Valid {
+			return nil
+		}
+		f, ok := folderById[p.ParentId.Int64]
+		if !ok {
+			return &changelog.ParentPackage{Id: p.ParentId.Int64}
+		}
+		return &changelog.ParentPackage{Id: f.Id, Name: f.Name, NodeId: f.NodeId}
+	}
+	createEvent := func(p pgdb.Package) changelog.Event {
+		return changelog.Event{
+			EventType: changelog.CreatePackage,
+			EventDetail: changelog.PackageCreateEvent{
+				Id:     p.Id,
+				Name:   p.Name,
+				NodeId: p.NodeId,
+				Parent: parent(p),
+			},
+			Timestamp: timestamp,
+		}
+	}
+
+	events := make([]changelog.Event, 0, len(createdFolders)+len(packages))
+	for _, f := range createdFolders {
+		events = append(events, createEvent(f))
+	}
+	for _, p := range packages {
+		events = append(events, createEvent(p))
+	}
+	for _, p := range packages {
+		if !p.ReplacesPackageId.Valid {
+			continue
+		}
+		detail := packageDeleteEvent{
+			Id: p.ReplacesPackageId.Int64,
+			// The replacement took over the name; the predecessor may have been renamed when it was soft-deleted.
+			Name:       p.Name,
+			Parent:     parent(p),
+			ReplacedBy: &changelog.ParentPackage{Id: p.Id, Name: p.Name, NodeId: p.NodeId},
+		}
+		if predecessor, ok := predecessors[p.ReplacesPackageId.Int64]; ok {
+			detail.NodeId = predecessor.NodeId
+		}
+		events = append(events, changelog.Event{
+			EventType:   changelog.DeletePackage,
+			EventDetail: detail,
+			Timestamp:   timestamp,
+		})
+	}
+	return events
+}
+
+// changelogMessages splits events into DatasetChangelogEventJob messages of at most maxBytes, in order. Each message
+// shares the dataset, user and trace of params and gets its own id. An event too large for a message of its own is
+// sent alone; the queue rejects it without affecting the others.
+func changelogMessages(params changelog.MessageParams, events []changelog.Event, maxBytes int) ([]changelog.Message, error) {
+	newMessage := func() changelog.Message {
+		p := params
+		p.Id = uuid.NewString()
+		p.Events = nil
+		return changelog.Message{DatasetChangelogEventJob: p}
+	}
+	empty, err := json.Marshal(newMessage())
+	if err != nil {
+		return nil, err
+	}
+
+	var messages []changelog.Message
+	current := newMessage()
+	size := len(empty)
+	for i, event := range events {
+		b, err := json.Marshal(event)
+		if err != nil {
+			return nil, fmt.Errorf("marshal changelog event %d: %w", i, err)
+		}
+		// Replacing "events":null with the array costs at most one byte per event.
+		if len(current.DatasetChangelogEventJob.Events) > 0 && size+len(b)+1 > maxBytes {
+			messages = append(messages, current)
+			current = newMessage()
+			size = len(empty)
+		}
+		current.DatasetChangelogEventJob.Events = append(current.DatasetChangelogEventJob.Events, event)
+		size += len(b) + 1
+	}
+	if len(current.DatasetChangelogEventJob.Events) > 0 {
+		messages = append(messages, current)
+	}
+	return messages, nil
+}
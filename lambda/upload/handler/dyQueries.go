@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	dynamoTypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
@@ -16,6 +17,8 @@ import (
 	log "github.com/sirupsen/logrus"
 	"math/rand"
 	"regexp"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -293,6 +296,248 @@ func (q *UploadDyQueries) updateManifestFileStatusTo(uploadFilesForManifest []up
 
 }
 
+// manifestFileStatusSkipped marks a manifest file that was not imported because onConflict=skip found an existing
+// package with the same name. pennsieve-go-core's manifestFile.Status enum has no such value, so it is written as a
+// plain string by updateManifestFileConflictStatus.
+const manifestFileStatusSkipped = "Skipped"
+
+// updateManifestFileConflictStatus sets status and a StatusReason on manifest files that the skip or fail conflict
+// strategies kept out of the import, or whose merge group did not complete in time. reasons is keyed by uploadId.
+//
+// Skipped is terminal, so the row is dropped from the sparse InProgressIndex GSI that decides manifest completion.
+// Failed rows stay in the index, matching pennsieve-go-core's Status.IsInProgress: a failed file is expected to be
+// retried.
+func (q *UploadDyQueries) updateManifestFileConflictStatus(ctx context.Context, manifestId string,
+	files []uploadFile.UploadFile, status string, reasons map[string]string) error {
+
+	updateExpression := "SET #s = :new, StatusReason = :reason"
+	if status == manifestFileStatusSkipped {
+		updateExpression += " REMOVE InProgress"
+	}
+
+	for _, f := range files {
+		_, err := q.db.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName: aws.String(ManifestFileTableName),
+			Key: map[string]dynamoTypes.AttributeValue{
+				"ManifestId": &dynamoTypes.AttributeValueMemberS{Value: manifestId},
+				"UploadId":   &dynamoTypes.AttributeValueMemberS{Value: f.UploadId},
+			},
+			UpdateExpression:    aws.String(updateExpression),
+			ConditionExpression: aws.String("attribute_exists(UploadId)"),
+			ExpressionAttributeNames: map[string]string{
+				"#s": "Status",
+			},
+			ExpressionAttributeValues: map[string]dynamoTypes.AttributeValue{
+				":new":    &dynamoTypes.AttributeValueMemberS{Value: status},
+				":reason": &dynamoTypes.AttributeValueMemberS{Value: reasons[f.UploadId]},
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("could not update status for manifest file %s to %s: %w", f.UploadId, status, err)
+		}
+	}
+
+	return nil
+}
+
+// manifestFileStatusStaged marks a member of a merge group that arrived before the rest of its group and is held
+// until they do. Like Skipped it is not part of pennsieve-go-core's manifestFile.Status enum. Staged rows stay in the
+// InProgressIndex: the file has not been imported yet.
+const manifestFileStatusStaged = "Staged"
+
+// mergeGroupMember is the manifest file row of a member of a merge group. StagedMessage is the upload trigger queue
+// message of a staged member, as JSON, and StagedAt the time it was staged; both are empty for other members and go
+// away when the member is imported and its row replaced.
+type mergeGroupMember struct {
+	ManifestId     string `dynamodbav:"ManifestId"`
+	UploadId       string `dynamodbav:"UploadId"`
+	MergePackageId string `dynamodbav:"MergePackageId,omitempty"`
+	Status         string `dynamodbav:"Status"`
+	StagedMessage  string `dynamodbav:"StagedMessage,omitempty"`
+	StagedAt       int64  `dynamodbav:"StagedAt,omitempty"`
+}
+
+// getMergeGroupMembers returns every manifest file registered with mergePackageId in the manifest.
+func (q *UploadDyQueries) getMergeGroupMembers(ctx context.Context, manifestId string, mergePackageId string) ([]mergeGroupMember, error) {
+	return q.queryManifestFiles(ctx, manifestId, "MergePackageId = :filter", mergePackageId)
+}
+
+// getStagedManifestFiles returns the staged manifest files of the manifest.
+func (q *UploadDyQueries) getStagedManifestFiles(ctx context.Context, manifestId string) ([]mergeGroupMember, error) {
+	return q.queryManifestFiles(ctx, manifestId, "#s = :filter", manifestFileStatusStaged)
+}
+
+// queryManifestFiles returns the manifest files of the manifest that match filterExpression, which compares against
+// :filter and may refer to Status as #s. The read is strongly consistent, so it sees every member staged before it.
+func (q *UploadDyQueries) queryManifestFiles(ctx context.Context, manifestId string, filterExpression string,
+	filter string) ([]mergeGroupMember, error) {
+
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(ManifestFileTableName),
+		ConsistentRead:         aws.Bool(true),
+		KeyConditionExpression: aws.String("ManifestId = :manifestId"),
+		FilterExpression:       aws.String(filterExpression),
+		ExpressionAttributeValues: map[string]dynamoTypes.AttributeValue{
+			":manifestId": &dynamoTypes.AttributeValueMemberS{Value: manifestId},
+			":filter":     &dynamoTypes.AttributeValueMemberS{Value: filter},
+		},
+	}
+	if strings.Contains(filterExpression, "#s") {
+		input.ExpressionAttributeNames = map[string]string{"#s": "Status"}
+	}
+
+	var members []mergeGroupMember
+	for {
+		out, err := q.db.Query(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("could not query files of manifest %s: %w", manifestId, err)
+		}
+		var page []mergeGroupMember
+		if err := attributevalue.UnmarshalListOfMaps(out.Items, &page); err != nil {
+			return nil, err
+		}
+		members = append(members, page...)
+		if len(out.LastEvaluatedKey) == 0 {
+			return members, nil
+		}
+		input.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+}
+
+// getStagedManifestIds returns the ids of the manifests with staged files, read from the StatusIndex GSI.
+func (q *UploadDyQueries) getStagedManifestIds(ctx context.Context) ([]string, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(ManifestFileTableName),
+		IndexName:              aws.String("StatusIndex"),
+		KeyConditionExpression: aws.String("#s = :status"),
+		ProjectionExpression:   aws.String("ManifestId"),
+		ExpressionAttributeNames: map[string]string{
+			"#s": "Status",
+		},
+		ExpressionAttributeValues: map[string]dynamoTypes.AttributeValue{
+			":status": &dynamoTypes.AttributeValueMemberS{Value: manifestFileStatusStaged},
+		},
+	}
+
+	var manifestIds []string
+	seen := map[string]bool{}
+	for {
+		out, err := q.db.Query(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("could not list manifests with staged files: %w", err)
+		}
+		var page []mergeGroupMember
+		if err := attributevalue.UnmarshalListOfMaps(out.Items, &page); err != nil {
+			return nil, err
+		}
+		for _, m := range page {
+			if !seen[m.ManifestId] {
+				seen[m.ManifestId] = true
+				manifestIds = append(manifestIds, m.ManifestId)
+			}
+		}
+		if len(out.LastEvaluatedKey) == 0 {
+			return manifestIds, nil
+		}
+		input.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+}
+
+// stageManifestFiles sets manifest files to Staged and stores the queue message each arrived with, keyed by uploadId,
+// so the file can be imported once the rest of its merge group arrives.
+func (q *UploadDyQueries) stageManifestFiles(ctx context.Context, manifestId string, files []uploadFile.UploadFile,
+	messages map[string]string) error {
+
+	at := strconv.FormatInt(time.Now().Unix(), 10)
+	for _, f := range files {
+		_, err := q.db.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName: aws.String(ManifestFileTableName),
+			Key: map[string]dynamoTypes.AttributeValue{
+				"ManifestId": &dynamoTypes.AttributeValueMemberS{Value: manifestId},
+				"UploadId":   &dynamoTypes.AttributeValueMemberS{Value: f.UploadId},
+			},
+			UpdateExpression:    aws.String("SET #s = :staged, StagedMessage = :message, StagedAt = :at"),
+			ConditionExpression: aws.String("attribute_exists(UploadId)"),
+			ExpressionAttributeNames: map[string]string{
+				"#s": "Status",
+			},
+			ExpressionAttributeValues: map[string]dynamoTypes.AttributeValue{
+				":staged":  &dynamoTypes.AttributeValueMemberS{Value: manifestFileStatusStaged},
+				":message": &dynamoTypes.AttributeValueMemberS{Value: messages[f.UploadId]},
+				":at":      &dynamoTypes.AttributeValueMemberN{Value: at},
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("could not stage manifest file %s: %w", f.UploadId, err)
+		}
+	}
+
+	return nil
+}
+
+// updateManifestFileImportError records why the import of manifest files failed, keyed by uploadId. The status is
+// left alone: the SQS message goes back to the queue and the import is retried. A later successful import replaces
+// the row and drops the error.
+func (q *UploadDyQueries) updateManifestFileImportError(ctx context.Context, manifestId string,
+	files []uploadFile.UploadFile, reasons map[string]string) error {
+
+	for _, f := range files {
+		_, err := q.db.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName: aws.String(ManifestFileTableName),
+			Key: map[string]dynamoTypes.AttributeValue{
+				"ManifestId": &dynamoTypes.AttributeValueMemberS{Value: manifestId},
+				"UploadId":   &dynamoTypes.AttributeValueMemberS{Value: f.UploadId},
+			},
+			UpdateExpression:    aws.String("SET ImportError = :reason, ImportErrorAt = :at"),
+			ConditionExpression: aws.String("attribute_exists(UploadId)"),
+			ExpressionAttributeValues: map[string]dynamoTypes.AttributeValue{
+				":reason": &dynamoTypes.AttributeValueMemberS{Value: reasons[f.UploadId]},
+				":at":     &dynamoTypes.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Unix(), 10)},
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("could not record import error for manifest file %s: %w", f.UploadId, err)
+		}
+	}
+
+	return nil
+}
+
+// countManifestFileStatuses returns the number of files of the manifest in each of statuses, read from the
+// StatusIndex GSI.
+func (q *UploadDyQueries) countManifestFileStatuses(ctx context.Context, manifestId string,
+	statuses []string) (map[string]int, error) {
+
+	counts := make(map[string]int, len(statuses))
+	for _, status := range statuses {
+		input := &dynamodb.QueryInput{
+			TableName:              aws.String(ManifestFileTableName),
+			IndexName:              aws.String("StatusIndex"),
+			KeyConditionExpression: aws.String("#s = :status AND ManifestId = :manifestId"),
+			ExpressionAttributeNames: map[string]string{
+				"#s": "Status",
+			},
+			ExpressionAttributeValues: map[string]dynamoTypes.AttributeValue{
+				":status":     &dynamoTypes.AttributeValueMemberS{Value: status},
+				":manifestId": &dynamoTypes.AttributeValueMemberS{Value: manifestId},
+			},
+			Select: dynamoTypes.SelectCount,
+		}
+		for {
+			out, err := q.db.Query(ctx, input)
+			if err != nil {
+				return nil, fmt.Errorf("could not count %s files of manifest %s: %w", status, manifestId, err)
+			}
+			counts[status] += int(out.Count)
+			if len(out.LastEvaluatedKey) == 0 {
+				break
+			}
+			input.ExclusiveStartKey = out.LastEvaluatedKey
+		}
+	}
+	return counts, nil
+}
+
 // getFileInfo returns a FileType and PackageType.Info object based on filetype string.
 func getFileInfo(fileTypeStr string) (fileType.Type, packageType.Info) {
 
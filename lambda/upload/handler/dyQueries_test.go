@@ -3,18 +3,23 @@ package handler
 import (
 	"context"
 	"database/sql"
+	"fmt"
+	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/google/uuid"
 	"github.com/pennsieve/pennsieve-go-core/pkg/models/dydb"
+	"github.com/pennsieve/pennsieve-go-core/pkg/models/fileInfo/fileType"
 	manifestModels "github.com/pennsieve/pennsieve-go-core/pkg/models/manifest"
+	"github.com/pennsieve/pennsieve-go-core/pkg/models/manifest/manifestFile"
 	"github.com/pennsieve/pennsieve-go-core/pkg/models/uploadFile"
 	"github.com/pennsieve/pennsieve-go-core/pkg/queries/pgdb"
 	"github.com/pennsieve/pennsieve-upload-service-v2/upload/test"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"sync"
 	"testing"
 )
 
@@ -25,6 +30,9 @@ func TestDyQueries(t *testing.T) {
 	){
 		"correctly creating uploadFiles from upload entries": testGetUploadFiles,
 		"check manifest status workflow":                     testCheckUpdateManifest,
+		"count manifest files by status":                     testCountManifestFileStatuses,
+		"stages merge group members until complete":          testGateMergeGroups,
+		"concurrent last members complete a merge group":     testGateMergeGroupsConcurrent,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			client := getDynamoDBClient()
@@ -35,10 +43,10 @@ func TestDyQueries(t *testing.T) {
 			}
 
 			mSNS := test.MockSNS{}
-			mS3 := test.MockS3{}
+			mStorage := test.MockStorage{}
 			mPusher := test.NewMockPusherClient()
 			mChangelogger := &test.MockChangelogger{}
-			store := NewUploadHandlerStore(pgdbClient, client, mSNS, mS3, ManifestFileTableName, ManifestTableName, SNSTopic, "", mPusher, mChangelogger, nil, "")
+			store := NewUploadHandlerStore(pgdbClient, client, mSNS, mStorage, ManifestFileTableName, ManifestTableName, SNSTopic, "", NewPusherNotifier(mPusher), mChangelogger, nil, "")
 
 			fn(t, store)
 		})
@@ -186,3 +194,182 @@ func TestGetUploadFilesUnprocessedKeys(t *testing.T) {
 	mockDy.AssertBatchGetItemCallCount(len(expectedOutputs))
 
 }
+
+func testCountManifestFileStatuses(t *testing.T, store *UploadHandlerStore) {
+	ctx := context.Background()
+	manifestId := "00000000-0000-0000-0000-000000000003"
+	err := populateManifest(store, manifestId, 4)
+	assert.NoError(t, err)
+
+	manifestFiles, _, err := store.dy.GetFilesPaginated(ctx, ManifestFileTableName, manifestId, sql.NullString{Valid: false}, 100, nil)
+	assert.NoError(t, err)
+	var imported []uploadFile.UploadFile
+	for _, f := range manifestFiles[:2] {
+		imported = append(imported, uploadFile.UploadFile{ManifestId: f.ManifestId, UploadId: f.UploadId})
+	}
+	err = store.dy.updateManifestFileStatus(imported, manifestId)
+	assert.NoError(t, err)
+
+	counts, err := store.dy.countManifestFileStatuses(ctx, manifestId, progressStatuses)
+	assert.NoError(t, err)
+	assert.Len(t, counts, len(progressStatuses), "every status is reported, including those without files")
+	assert.Equal(t, 3, counts[manifestFile.Registered.String()])
+	assert.Equal(t, 2, counts[manifestFile.Imported.String()])
+	assert.Equal(t, 0, counts[manifestFileStatusSkipped])
+}
+
+func testGateMergeGroups(t *testing.T, store *UploadHandlerStore) {
+	ctx := context.Background()
+	manifestId := uuid.NewString()
+	err := store.dy.CreateManifest(ctx, ManifestTableName, dydb.ManifestTable{
+		ManifestId:     manifestId,
+		DatasetId:      1,
+		DatasetNodeId:  "N:Dataset:1",
+		OrganizationId: 2,
+		UserId:         1,
+		Status:         manifestModels.Initiated.String(),
+	})
+	require.NoError(t, err)
+
+	mergeId := uuid.NewString()
+	dtos, messages, err := generateManifestFilesAndEvents([]tesManifestFileParams{
+		{name: "rec.edf", fType: fileType.EDF},
+		{name: "rec.edf.1", fType: fileType.EDF},
+		{name: "rec.edf.2", fType: fileType.EDF},
+	}, manifestId)
+	require.NoError(t, err)
+	for i := range dtos {
+		dtos[i].MergePackageId = mergeId
+	}
+	_, err = store.dy.SyncFiles(manifestId, dtos, nil, ManifestTableName, ManifestFileTableName)
+	require.NoError(t, err)
+
+	files := make([]uploadFile.UploadFile, len(dtos))
+	s3KeySQSMessageMap := map[string]events.SQSMessage{}
+	for i, d := range dtos {
+		files[i] = uploadFile.UploadFile{
+			ManifestId:     manifestId,
+			UploadId:       d.UploadID,
+			S3Key:          fmt.Sprintf("%s/%s", manifestId, d.UploadID),
+			Name:           d.TargetName,
+			FileType:       fileType.EDF,
+			MergePackageId: mergeId,
+		}
+		s3KeySQSMessageMap[files[i].S3Key] = messages[i]
+	}
+	s3KeyToOnConflict := map[string]string{}
+	checksums := map[string]FileChecksum{}
+
+	// The first two members are held while the third is outstanding.
+	for _, f := range files[:2] {
+		ready, failed := store.gateMergeGroups(ctx, []uploadFile.UploadFile{f}, s3KeySQSMessageMap, s3KeyToOnConflict, checksums)
+		assert.Empty(t, ready)
+		assert.Empty(t, failed)
+	}
+	staged, err := store.dy.getStagedManifestFiles(ctx, manifestId)
+	require.NoError(t, err)
+	assert.Len(t, staged, 2)
+	for _, m := range staged {
+		assert.NotEmpty(t, m.StagedMessage)
+		assert.NotZero(t, m.StagedAt)
+	}
+	manifestIds, err := store.dy.getStagedManifestIds(ctx)
+	require.NoError(t, err)
+	assert.Contains(t, manifestIds, manifestId)
+
+	// Files outside a merge group, or of a type without a workflow, are not held.
+	text := uploadFile.UploadFile{ManifestId: manifestId, UploadId: uuid.NewString(), FileType: fileType.Text,
+		MergePackageId: mergeId}
+	ready, failed := store.gateMergeGroups(ctx, []uploadFile.UploadFile{text}, s3KeySQSMessageMap, s3KeyToOnConflict, checksums)
+	assert.Equal(t, []uploadFile.UploadFile{text}, ready)
+	assert.Empty(t, failed)
+
+	// The last member releases the staged ones.
+	ready, failed = store.gateMergeGroups(ctx, files[2:], s3KeySQSMessageMap, s3KeyToOnConflict, checksums)
+	assert.Empty(t, failed)
+	require.Len(t, ready, 3)
+	var readyIds []string
+	for _, f := range ready {
+		readyIds = append(readyIds, f.UploadId)
+		assert.Equal(t, mergeId, f.MergePackageId)
+	}
+	for _, f := range files {
+		assert.Contains(t, readyIds, f.UploadId)
+	}
+	for _, f := range files[:2] {
+		assert.Equal(t, onConflictKeepBoth, s3KeyToOnConflict[f.S3Key])
+	}
+}
+
+func testGateMergeGroupsConcurrent(t *testing.T, store *UploadHandlerStore) {
+	ctx := context.Background()
+	manifestId := uuid.NewString()
+	err := store.dy.CreateManifest(ctx, ManifestTableName, dydb.ManifestTable{
+		ManifestId:     manifestId,
+		DatasetId:      1,
+		DatasetNodeId:  "N:Dataset:1",
+		OrganizationId: 2,
+		UserId:         1,
+		Status:         manifestModels.Initiated.String(),
+	})
+	require.NoError(t, err)
+
+	// The race is timing dependent, so it is run on a few groups.
+	for round := 0; round < 5; round++ {
+		mergeId := uuid.NewString()
+		dtos, messages, err := generateManifestFilesAndEvents([]tesManifestFileParams{
+			{name: fmt.Sprintf("rec%d.edf", round), fType: fileType.EDF},
+			{name: fmt.Sprintf("rec%d.edf.1", round), fType: fileType.EDF},
+			{name: fmt.Sprintf("rec%d.edf.2", round), fType: fileType.EDF},
+		}, manifestId)
+		require.NoError(t, err)
+		for i := range dtos {
+			dtos[i].MergePackageId = mergeId
+		}
+		_, err = store.dy.SyncFiles(manifestId, dtos, nil, ManifestTableName, ManifestFileTableName)
+		require.NoError(t, err)
+
+		files := make([]uploadFile.UploadFile, len(dtos))
+		s3KeySQSMessageMap := map[string]events.SQSMessage{}
+		for i, d := range dtos {
+			files[i] = uploadFile.UploadFile{
+				ManifestId:     manifestId,
+				UploadId:       d.UploadID,
+				S3Key:          fmt.Sprintf("%s/%s", manifestId, d.UploadID),
+				Name:           d.TargetName,
+				FileType:       fileType.EDF,
+				MergePackageId: mergeId,
+			}
+			s3KeySQSMessageMap[files[i].S3Key] = messages[i]
+		}
+
+		ready, failed := store.gateMergeGroups(ctx, files[:1], s3KeySQSMessageMap, map[string]string{}, map[string]FileChecksum{})
+		require.Empty(t, ready)
+		require.Empty(t, failed)
+
+		// The last two members arrive at once, in batches of their own, like two upload lambdas.
+		var wg sync.WaitGroup
+		readies := make([][]uploadFile.UploadFile, 2)
+		failures := make([][]uploadFile.UploadFile, 2)
+		for i := range readies {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				readies[i], failures[i] = store.gateMergeGroups(ctx, files[i+1:i+2], s3KeySQSMessageMap,
+					map[string]string{}, map[string]FileChecksum{})
+			}(i)
+		}
+		wg.Wait()
+
+		readyIds := map[string]bool{}
+		for i := range readies {
+			assert.Empty(t, failures[i])
+			for _, f := range readies[i] {
+				readyIds[f.UploadId] = true
+			}
+		}
+		for _, f := range files {
+			assert.True(t, readyIds[f.UploadId], "round %d: %s is never imported", round, f.UploadId)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -15,6 +16,8 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/sns/types"
 	"github.com/pennsieve/pennsieve-go-core/pkg/models/dydb"
 	"github.com/pennsieve/pennsieve-go-core/pkg/models/pgdb"
+	"github.com/pennsieve/pennsieve-go-core/pkg/models/uploadFile"
+	"github.com/pennsieve/pennsieve-upload-service-v2/storage"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -41,6 +44,107 @@ type FileFinalizedEvent struct {
 	TraceID        string `json:"traceId"`
 }
 
+// FileFinalizedEventV2 is version 2 of the FileFinalized payload. It adds
+// the package, folder path, uploader and content hashes that version 1
+// consumers had to read from Postgres, and Checksum is the checksum
+// storage holds for the object rather than its ETag. Keep the JSON tags
+// in sync with the consumers, like FileFinalizedEvent.
+type FileFinalizedEventV2 struct {
+	EventType    string `json:"eventType"`
+	EventVersion int    `json:"eventVersion"`
+	FileID       int64  `json:"fileId"`
+	FileUUID     string `json:"fileUUID"`
+	S3Bucket     string `json:"s3Bucket"`
+	S3Key        string `json:"s3Key"`
+	Size         int64  `json:"size"`
+	FileType     string `json:"fileType"`
+	Extension    string `json:"extension"`
+	ETag         string `json:"etag,omitempty"`
+	// Checksum is nil when storage reported none for the object.
+	Checksum *FileFinalizedChecksum `json:"checksum,omitempty"`
+	// SHA256 is the full-object SHA256 the client declared, which the
+	// import checked against the object. For files that arrived without a
+	// declared one, it is the full-object SHA256 storage holds, or else the
+	// one finalize computed; empty when none is known.
+	SHA256 string `json:"sha256,omitempty"`
+
+	PackageID     int64  `json:"packageId"`
+	PackageNodeID string `json:"packageNodeId,omitempty"`
+	// ReplacedPackageID is the package the file's package replaced under
+	// onConflict replace or version.
+	ReplacedPackageID *int64 `json:"replacedPackageId,omitempty"`
+	// DatasetPath is the folder path of the package in the dataset, empty
+	// at the dataset root.
+	DatasetPath string `json:"datasetPath"`
+
+	OrganizationID int    `json:"organizationId"`
+	DatasetID      int    `json:"datasetId"`
+	DatasetNodeID  string `json:"datasetNodeId"`
+	ManifestID     string `json:"manifestId"`
+	UploaderID     int64  `json:"uploaderId"`
+	UploaderNodeID string `json:"uploaderNodeId,omitempty"`
+	ComplianceTier string `json:"complianceTier"`
+	Timestamp      string `json:"timestamp"`
+	TraceID        string `json:"traceId"`
+}
+
+// FileFinalizedChecksum is a storage checksum carried by
+// FileFinalizedEventV2.
+type FileFinalizedChecksum struct {
+	Algorithm string `json:"algorithm"`
+	Type      string `json:"type,omitempty"`
+	Value     string `json:"value"`
+}
+
+// FileFinalizedVersions selects the FileFinalized payload versions the
+// upload lambda publishes. Consumers move from version 1 to 2 while both
+// are published, filtering on the eventVersion message attribute.
+type FileFinalizedVersions string
+
+const (
+	FileFinalizedV1   FileFinalizedVersions = "1"
+	FileFinalizedV2   FileFinalizedVersions = "2"
+	FileFinalizedDual FileFinalizedVersions = "dual"
+)
+
+// ParseFileFinalizedVersions returns the FileFinalizedVersions named by
+// s; empty means version 1.
+func ParseFileFinalizedVersions(s string) (FileFinalizedVersions, error) {
+	switch v := FileFinalizedVersions(s); v {
+	case "":
+		return FileFinalizedV1, nil
+	case FileFinalizedV1, FileFinalizedV2, FileFinalizedDual:
+		return v, nil
+	default:
+		return "", fmt.Errorf("unknown FileFinalized versions %q: expected 1, 2 or dual", s)
+	}
+}
+
+// versions returns the payload versions to publish for each file.
+func (v FileFinalizedVersions) versions() []int {
+	switch v {
+	case FileFinalizedV2:
+		return []int{2}
+	case FileFinalizedDual:
+		return []int{1, 2}
+	default:
+		return []int{1}
+	}
+}
+
+// finalizedFileDetails is what an import knows about its files beyond
+// their rows, for FileFinalized version 2.
+type finalizedFileDetails struct {
+	uploader pgdb.User
+	// uploads and checksums are keyed by uploadId, the file UUID.
+	uploads   map[string]uploadFile.UploadFile
+	checksums map[string]FileChecksum
+	// packages are the packages the import created, by id. Packages of
+	// files an earlier delivery imported are read from Postgres, in the
+	// import transaction.
+	packages map[int64]pgdb.Package
+}
+
 // complianceTierCache is a process-wide cache of per-org compliance
 // tier. Entries expire after complianceTierTTL so that if an ops change
 // flips a workspace from standard → hipaa, warm Lambda sandboxes pick
@@ -91,18 +195,49 @@ func (s *UploadHandlerStore) getComplianceTier(ctx context.Context, orgID int) s
 }
 
 // PublishFileFinalized emits one FileFinalized event per committed file
-// to the FileFinalized SNS topic. Publishes are batched (PublishBatch,
-// 10 entries/request) mirroring the existing PublishToSNS pattern.
+// and payload version in FileFinalizedEventVersions to the FileFinalized
+// SNS topic. Publishes are batched (PublishBatch, 10 entries/request)
+// mirroring the existing PublishToSNS pattern.
 //
 // Errors are logged and returned but ImportFiles callers should not
 // fail the request on a publish error — the file is already durable
 // and the scanner can be re-driven via the reconcile lambda if needed.
-func (s *UploadHandlerStore) PublishFileFinalized(ctx context.Context, files []pgdb.File, manifest *dydb.ManifestTable) error {
+func (s *UploadHandlerStore) PublishFileFinalized(ctx context.Context, files []pgdb.File, manifest *dydb.ManifestTable,
+	details finalizedFileDetails) error {
 	if s.FileFinalizedTopic == "" {
 		// Topic not configured (local/unit-test env). Skip.
 		return nil
 	}
 
+	const batchSize = 10
+	entries, err := s.fileFinalizedEntries(ctx, s.pg, files, manifest, details)
+	if err != nil {
+		return err
+	}
+	for start := 0; start < len(entries); start += batchSize {
+		if err := s.publishFileFinalizedBatch(ctx, entries[start:min(start+batchSize, len(entries))]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fileFinalizedEntries returns the FileFinalized messages PublishFileFinalized
+// sends for files, one per file and payload version. Packages version 2
+// needs and details does not hold are read with q, which is the import
+// transaction when the messages are recorded in the outbox.
+func (s *UploadHandlerStore) fileFinalizedEntries(ctx context.Context, q *UploadPgQueries, files []pgdb.File,
+	manifest *dydb.ManifestTable, details finalizedFileDetails) ([]types.PublishBatchRequestEntry, error) {
+	versions := FileFinalizedEventVersions.versions()
+	packages := details.packages
+	if slices.Contains(versions, 2) {
+		var err error
+		packages, err = finalizedFilePackages(ctx, q, files, details.packages)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	tier := s.getComplianceTier(ctx, int(manifest.OrganizationId))
 	now := time.Now().UTC().Format(time.RFC3339Nano)
 	traceID := ""
@@ -110,8 +245,7 @@ func (s *UploadHandlerStore) PublishFileFinalized(ctx context.Context, files []p
 		traceID = lc.AwsRequestID
 	}
 
-	const batchSize = 10
-	entries := make([]types.PublishBatchRequestEntry, 0, batchSize)
+	entries := make([]types.PublishBatchRequestEntry, 0, len(files)*len(versions))
 
 	for i := range files {
 		f := files[i]
@@ -122,60 +256,139 @@ func (s *UploadHandlerStore) PublishFileFinalized(ctx context.Context, files []p
 			continue
 		}
 
-		evt := FileFinalizedEvent{
-			EventType:      "FileFinalized",
-			EventVersion:   1,
-			FileID:         fileID,
-			FileUUID:       f.UUID.String(),
-			S3Bucket:       f.S3Bucket,
-			S3Key:          f.S3Key,
-			Size:           f.Size,
-			FileType:       f.FileType.String(),
-			Extension:      extractExtension(f.Name),
-			Checksum:       f.CheckSum,
-			OrganizationID: int(manifest.OrganizationId),
-			DatasetID:      int(manifest.DatasetId),
-			ManifestID:     manifest.ManifestId,
-			ComplianceTier: tier,
-			Timestamp:      now,
-			TraceID:        traceID,
-		}
+		for _, version := range versions {
+			var evt any
+			switch version {
+			case 1:
+				evt = FileFinalizedEvent{
+					EventType:      "FileFinalized",
+					EventVersion:   1,
+					FileID:         fileID,
+					FileUUID:       f.UUID.String(),
+					S3Bucket:       f.S3Bucket,
+					S3Key:          f.S3Key,
+					Size:           f.Size,
+					FileType:       f.FileType.String(),
+					Extension:      extractExtension(f.Name),
+					Checksum:       f.CheckSum,
+					OrganizationID: int(manifest.OrganizationId),
+					DatasetID:      int(manifest.DatasetId),
+					ManifestID:     manifest.ManifestId,
+					ComplianceTier: tier,
+					Timestamp:      now,
+					TraceID:        traceID,
+				}
+			case 2:
+				evt = newFileFinalizedEventV2(f, fileID, manifest, details, packages, tier, now, traceID)
+			}
 
-		body, err := json.Marshal(evt)
-		if err != nil {
-			log.WithError(err).Warnf("file_finalized: marshal failed for file %d; skipping", fileID)
-			continue
-		}
+			body, err := json.Marshal(evt)
+			if err != nil {
+				log.WithError(err).Warnf("file_finalized: marshal failed for file %d; skipping", fileID)
+				continue
+			}
 
-		entries = append(entries, types.PublishBatchRequestEntry{
-			Id:      aws.String(f.UUID.String()),
-			Message: aws.String(string(body)),
-			MessageAttributes: map[string]types.MessageAttributeValue{
-				"complianceTier": {
-					DataType:    aws.String("String"),
-					StringValue: aws.String(tier),
+			entries = append(entries, types.PublishBatchRequestEntry{
+				Id:      aws.String(fmt.Sprintf("%s-v%d", f.UUID.String(), version)),
+				Message: aws.String(string(body)),
+				MessageAttributes: map[string]types.MessageAttributeValue{
+					"complianceTier": {
+						DataType:    aws.String("String"),
+						StringValue: aws.String(tier),
+					},
+					"eventType": {
+						DataType:    aws.String("String"),
+						StringValue: aws.String("FileFinalized"),
+					},
+					"eventVersion": {
+						DataType:    aws.String("Number"),
+						StringValue: aws.String(strconv.Itoa(version)),
+					},
 				},
-				"eventType": {
-					DataType:    aws.String("String"),
-					StringValue: aws.String("FileFinalized"),
-				},
-			},
-		})
+			})
+		}
+	}
+	return entries, nil
+}
 
-		if len(entries) == batchSize {
-			if err := s.publishFileFinalizedBatch(ctx, entries); err != nil {
-				return err
-			}
-			entries = entries[:0]
+// newFileFinalizedEventV2 returns the version 2 payload for file f of the
+// manifest. packages holds the package of every file, by id.
+func newFileFinalizedEventV2(f pgdb.File, fileID int64, manifest *dydb.ManifestTable, details finalizedFileDetails,
+	packages map[int64]pgdb.Package, tier string, timestamp string, traceID string) FileFinalizedEventV2 {
+	evt := FileFinalizedEventV2{
+		EventType:      "FileFinalized",
+		EventVersion:   2,
+		FileID:         fileID,
+		FileUUID:       f.UUID.String(),
+		S3Bucket:       f.S3Bucket,
+		S3Key:          f.S3Key,
+		Size:           f.Size,
+		FileType:       f.FileType.String(),
+		Extension:      extractExtension(f.Name),
+		ETag:           f.CheckSum,
+		PackageID:      int64(f.PackageId),
+		OrganizationID: int(manifest.OrganizationId),
+		DatasetID:      int(manifest.DatasetId),
+		DatasetNodeID:  manifest.DatasetNodeId,
+		ManifestID:     manifest.ManifestId,
+		UploaderID:     details.uploader.Id,
+		UploaderNodeID: details.uploader.NodeId,
+		ComplianceTier: tier,
+		Timestamp:      timestamp,
+		TraceID:        traceID,
+	}
+
+	uploadId := f.UUID.String()
+	if c, ok := details.checksums[uploadId]; ok {
+		if c.Value != "" {
+			evt.Checksum = &FileFinalizedChecksum{Algorithm: c.Algorithm, Type: c.Type, Value: c.Value}
+		}
+		evt.SHA256 = c.ClientSHA256
+		if evt.SHA256 == "" {
+			evt.SHA256 = fullObjectSHA256(storage.ObjectChecksum{Algorithm: c.Algorithm, Type: c.Type, Value: c.Value},
+				c.ServerSHA256)
 		}
 	}
+	if u, ok := details.uploads[uploadId]; ok {
+		evt.DatasetPath = u.Path
+	}
+	if p, ok := packages[evt.PackageID]; ok {
+		evt.PackageNodeID = p.NodeId
+		if p.ReplacesPackageId.Valid {
+			replaced := p.ReplacesPackageId.Int64
+			evt.ReplacedPackageID = &replaced
+		}
+	}
+	return evt
+}
 
-	if len(entries) > 0 {
-		if err := s.publishFileFinalizedBatch(ctx, entries); err != nil {
-			return err
+// finalizedFilePackages returns known with the packages of the other files
+// added from Postgres, read with q.
+func finalizedFilePackages(ctx context.Context, q *UploadPgQueries, files []pgdb.File,
+	known map[int64]pgdb.Package) (map[int64]pgdb.Package, error) {
+	packages := make(map[int64]pgdb.Package, len(files))
+	var missing []int64
+	for _, f := range files {
+		id := int64(f.PackageId)
+		if p, ok := known[id]; ok {
+			packages[id] = p
+		} else if _, listed := packages[id]; !listed {
+			packages[id] = pgdb.Package{Id: id}
+			missing = append(missing, id)
 		}
 	}
-	return nil
+	if len(missing) == 0 {
+		return packages, nil
+	}
+
+	found, err := q.GetPackagesByIds(ctx, missing)
+	if err != nil {
+		return nil, fmt.Errorf("file_finalized: unable to read packages: %w", err)
+	}
+	for id, p := range found {
+		packages[id] = p
+	}
+	return packages, nil
 }
 
 func (s *UploadHandlerStore) publishFileFinalizedBatch(ctx context.Context, entries []types.PublishBatchRequestEntry) error {
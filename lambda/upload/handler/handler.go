@@ -3,6 +3,7 @@ package handler
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
@@ -14,6 +15,9 @@ import (
 	"github.com/pennsieve/pennsieve-go-core/pkg/changelog"
 	ps "github.com/pennsieve/pennsieve-go-core/pkg/models/pusher"
 	pgQueries "github.com/pennsieve/pennsieve-go-core/pkg/queries/pgdb"
+	"github.com/pennsieve/pennsieve-upload-service-v2/storage"
+	"github.com/pennsieve/pennsieve-upload-service-v2/storage/localbackend"
+	"github.com/pennsieve/pennsieve-upload-service-v2/storage/s3backend"
 	"github.com/pusher/pusher-http-go/v5"
 	log "github.com/sirupsen/logrus"
 	"os"
@@ -24,7 +28,7 @@ var (
 	SNSClient             *sns.Client
 	SNSTopic              string
 	FileFinalizedTopic    string
-	S3Client              *s3.Client
+	StorageBackend        storage.StorageBackend
 	DynamoClient          *dynamodb.Client
 	SQSClient             *sqs.Client
 	ManifestTableName     string
@@ -32,6 +36,10 @@ var (
 	JobSQSQueueId         string
 	PusherConfig          *ps.Config
 	PusherClient          *pusher.Client
+	UploadNotifier        Notifier
+	// FileFinalizedEventVersions selects the FileFinalized payload versions published, from
+	// FILE_FINALIZED_EVENT_VERSIONS.
+	FileFinalizedEventVersions = FileFinalizedV1
 )
 
 // init runs on cold start of lambda and configures logging and looks up env vars.
@@ -85,9 +93,20 @@ func InitializeClients() {
 	}
 
 	SNSClient = sns.NewFromConfig(cfg)
-	S3Client = s3.NewFromConfig(cfg)
+	UploadNotifier, err = newNotifier()
+	if err != nil {
+		log.Fatalf("newNotifier: %v\n", err)
+	}
+	StorageBackend, err = newStorageBackend(cfg)
+	if err != nil {
+		log.Fatalf("newStorageBackend: %v\n", err)
+	}
 	SNSTopic = os.Getenv("IMPORTED_SNS_TOPIC")
 	FileFinalizedTopic = os.Getenv("FILE_FINALIZED_TOPIC")
+	FileFinalizedEventVersions, err = ParseFileFinalizedVersions(os.Getenv("FILE_FINALIZED_EVENT_VERSIONS"))
+	if err != nil {
+		log.Fatalf("ParseFileFinalizedVersions: %v\n", err)
+	}
 	DynamoClient = dynamodb.NewFromConfig(cfg)
 	SQSClient = sqs.NewFromConfig(cfg)
 	ChangelogClient = changelog.NewClient(*SQSClient, JobSQSQueueId)
@@ -111,12 +130,12 @@ func Handler(ctx context.Context, sqsEvent events.SQSEvent) (events.SQSEventResp
 		db,
 		DynamoClient,
 		SNSClient,
-		S3Client,
+		StorageBackend,
 		ManifestFileTableName,
 		ManifestTableName,
 		SNSTopic,
 		FileFinalizedTopic,
-		PusherClient,
+		UploadNotifier,
 		ChangelogClient,
 		SQSClient,
 		JobSQSQueueId)
@@ -127,3 +146,45 @@ func Handler(ctx context.Context, sqsEvent events.SQSEvent) (events.SQSEventResp
 	}
 	return eventResponse, nil
 }
+
+// newNotifier returns the Notifier named by NOTIFIER: Pusher by default, SNS to publish events to
+// NOTIFIER_SNS_TOPIC, or none. Falls back to no notifications when the Pusher config could not be loaded.
+func newNotifier() (Notifier, error) {
+	notifierType, err := ParseNotifierType(os.Getenv("NOTIFIER"))
+	if err != nil {
+		return nil, err
+	}
+	switch notifierType {
+	case NotifierSNS:
+		topic := os.Getenv("NOTIFIER_SNS_TOPIC")
+		if topic == "" {
+			return nil, errors.New("NOTIFIER_SNS_TOPIC is required for the sns notifier")
+		}
+		return NewSNSNotifier(SNSClient, topic), nil
+	case NotifierNone:
+		return NewNoopNotifier(), nil
+	default:
+		if PusherClient == nil {
+			log.Warn("Pusher is not configured; clients will not be notified of imports.")
+			return NewNoopNotifier(), nil
+		}
+		return NewPusherNotifier(PusherClient), nil
+	}
+}
+
+// newStorageBackend returns the backend named by STORAGE_BACKEND: S3 by default, or directories below
+// LOCAL_STORAGE_ROOT for on-prem installs and local end-to-end tests.
+func newStorageBackend(cfg aws.Config) (storage.StorageBackend, error) {
+	backendType, err := storage.ParseBackendType(os.Getenv("STORAGE_BACKEND"))
+	if err != nil {
+		return nil, err
+	}
+	if backendType == storage.BackendLocal {
+		return localbackend.New(os.Getenv("LOCAL_STORAGE_ROOT"))
+	}
+	client := s3.NewFromConfig(cfg)
+	return s3backend.New(client, s3backend.Options{
+		Region:        s3backend.NewRegionCache(client).Region,
+		DefaultRegion: cfg.Region,
+	}), nil
+}
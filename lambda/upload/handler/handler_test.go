@@ -21,6 +21,8 @@ import (
 	pgdb2 "github.com/pennsieve/pennsieve-go-core/pkg/models/pgdb"
 	"github.com/pennsieve/pennsieve-go-core/pkg/queries/pgdb"
 	testHelpers "github.com/pennsieve/pennsieve-go-core/test"
+	"github.com/pennsieve/pennsieve-upload-service-v2/storage/migrate"
+	"github.com/pennsieve/pennsieve-upload-service-v2/storage/s3backend"
 	"github.com/pennsieve/pennsieve-upload-service-v2/upload/test"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
@@ -219,6 +221,11 @@ func TestMain(m *testing.M) {
 		log.Fatal("cannot connect to db:", err)
 	}
 
+	// The seed database has the core schema only; add the upload service's tables.
+	if _, err := migrate.Apply(context.Background(), pgdbClient, os.DirFS("../../../migrations"), false); err != nil {
+		log.Fatal("cannot apply migrations:", err)
+	}
+
 	mSNS := test.MockSNS{}
 
 	s3Client := getS3Client()
@@ -259,7 +266,7 @@ func TestMain(m *testing.M) {
 
 	mChangelogger := &test.MockChangelogger{}
 	mPusher := test.NewMockPusherClient()
-	store := NewUploadHandlerStore(pgdbClient, client, mSNS, s3Client, ManifestFileTableName, ManifestTableName, SNSTopic, "", mPusher, mChangelogger, nil, "")
+	store := NewUploadHandlerStore(pgdbClient, client, mSNS, s3backend.New(s3Client, s3backend.Options{}), ManifestFileTableName, ManifestTableName, SNSTopic, "", NewPusherNotifier(mPusher), mChangelogger, nil, "")
 
 	manifestId := "00000000-0000-0000-0000-000000000000"
 	err = populateManifest(store, manifestId, 1)
@@ -296,11 +303,11 @@ func TestUploadService(t *testing.T) {
 			}
 
 			mSNS := test.MockSNS{}
-			s3Client := test.MockS3{}
+			s3Client := test.MockStorage{}
 			mPusher := test.NewMockPusherClient()
 			mChangelogger := &test.MockChangelogger{}
 
-			store := NewUploadHandlerStore(pgdbClient, client, mSNS, s3Client, ManifestFileTableName, ManifestTableName, SNSTopic, "", mPusher, mChangelogger, nil, "")
+			store := NewUploadHandlerStore(pgdbClient, client, mSNS, s3Client, ManifestFileTableName, ManifestTableName, SNSTopic, "", NewPusherNotifier(mPusher), mChangelogger, nil, "")
 
 			fn(t, store)
 		})
@@ -0,0 +1,303 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/pennsieve/pennsieve-go-core/pkg/models/manifest/manifestFile"
+	"github.com/pennsieve/pennsieve-go-core/pkg/models/packageInfo/packageType"
+	"github.com/pennsieve/pennsieve-go-core/pkg/models/uploadFile"
+	log "github.com/sirupsen/logrus"
+)
+
+// Files registered with the same MergePackageId become one package. When that package type is processed, a package
+// imported with some of its members missing starts processing without them, so the members of such a merge group are
+// held back until the whole group has arrived: a member that arrives early is set to Staged, with the queue message
+// it arrived with, and is imported together with the member that completes the group. A group still incomplete
+// after mergeGroupTimeout is reported, on a heartbeat, by failing its staged members.
+
+// mergeGroupTimeout is how long the oldest staged member of a merge group waits for the rest before the group is
+// reported as incomplete.
+const mergeGroupTimeout = 24 * time.Hour
+
+// needsCompleteGroup returns true for files of a merge group whose package type has a processing workflow.
+func needsCompleteGroup(f uploadFile.UploadFile) bool {
+	return f.MergePackageId != "" && packageType.FileTypeToInfoDict[f.FileType].HasWorkflow
+}
+
+// mergeGroupKey identifies a merge group; a MergePackageId is only shared within a manifest.
+type mergeGroupKey struct {
+	manifestId     string
+	mergePackageId string
+}
+
+// gateMergeGroups holds back the members of merge groups that have not fully arrived. It returns the files to import
+// now, which include the staged members of groups this batch completes, and the files whose group could not be
+// checked or staged, which go back to the queue.
+//   - messages maps S3 key to the queue message of each file in the batch. The onConflict values and checksums of
+//     released members are added to s3KeyToOnConflict and checksums.
+func (s *UploadHandlerStore) gateMergeGroups(ctx context.Context, files []uploadFile.UploadFile,
+	messages map[string]events.SQSMessage, s3KeyToOnConflict map[string]string,
+	checksums map[string]FileChecksum) (ready []uploadFile.UploadFile, failed []uploadFile.UploadFile) {
+
+	groups := map[mergeGroupKey][]uploadFile.UploadFile{}
+	var keys []mergeGroupKey
+	for _, f := range files {
+		if !needsCompleteGroup(f) {
+			ready = append(ready, f)
+			continue
+		}
+		key := mergeGroupKey{manifestId: f.ManifestId, mergePackageId: f.MergePackageId}
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], f)
+	}
+
+	for _, key := range keys {
+		group := groups[key]
+		contextLogger := log.WithFields(log.Fields{
+			"manifest_id":      key.manifestId,
+			"merge_package_id": key.mergePackageId,
+		})
+
+		members, err := s.dy.getMergeGroupMembers(ctx, key.manifestId, key.mergePackageId)
+		if err != nil {
+			contextLogger.WithError(err).Error("Unable to read merge group members.")
+			failed = append(failed, group...)
+			continue
+		}
+
+		inBatch := map[string]bool{}
+		for _, f := range group {
+			inBatch[f.UploadId] = true
+		}
+		staged, missing := waitingMergeGroupMembers(members, inBatch)
+
+		if missing > 0 {
+			stagedMessages := map[string]string{}
+			for _, f := range group {
+				body, _ := json.Marshal(messages[f.S3Key])
+				stagedMessages[f.UploadId] = string(body)
+			}
+			if err := s.dy.stageManifestFiles(ctx, key.manifestId, group, stagedMessages); err != nil {
+				contextLogger.WithError(err).Error("Unable to stage merge group members.")
+				failed = append(failed, group...)
+				continue
+			}
+
+			// The last members of a group can arrive in concurrent batches that each saw the others still
+			// Registered. Reading the group again after staging ensures the batch that stages last sees the whole
+			// group and releases it; when several do, the import of the members is idempotent.
+			members, err = s.dy.getMergeGroupMembers(ctx, key.manifestId, key.mergePackageId)
+			if err != nil {
+				// The batch is retried and, with its members already staged, completes the group if this one did.
+				contextLogger.WithError(err).Error("Unable to read merge group members after staging.")
+				failed = append(failed, group...)
+				continue
+			}
+			staged, missing = waitingMergeGroupMembers(members, inBatch)
+			if missing > 0 {
+				contextLogger.WithFields(log.Fields{
+					"staged":  len(group) + len(staged),
+					"missing": missing,
+					"members": len(members),
+				}).Info("Staged merge group members until the group is complete")
+				continue
+			}
+		}
+
+		released, err := s.stagedUploadFiles(ctx, staged, s3KeyToOnConflict, checksums)
+		if err != nil {
+			// The staged members stay staged and are released again when this batch is retried.
+			contextLogger.WithError(err).Error("Unable to release staged merge group members.")
+			failed = append(failed, group...)
+			continue
+		}
+		if len(released) > 0 {
+			contextLogger.WithField("released", len(released)).Info("Merge group is complete; importing staged members")
+		}
+		ready = append(ready, group...)
+		ready = append(ready, released...)
+	}
+
+	return ready, failed
+}
+
+// waitingMergeGroupMembers returns the members of a merge group that are staged and waiting to be imported, and the
+// number of members that have not arrived yet. Members in the current batch, keyed by uploadId in inBatch, are
+// neither.
+func waitingMergeGroupMembers(members []mergeGroupMember, inBatch map[string]bool) (staged []mergeGroupMember, missing int) {
+	for _, m := range members {
+		switch {
+		case inBatch[m.UploadId]:
+		case m.StagedMessage != "" && (m.Status == manifestFileStatusStaged || m.Status == manifestFile.Failed.String()):
+			// Staged, or staged and then reported incomplete; either way it is still waiting to be imported.
+			staged = append(staged, m)
+		case m.Status == manifestFile.Registered.String():
+			missing++
+		}
+	}
+	return staged, missing
+}
+
+// stagedUploadFiles turns the stored queue messages of staged members back into upload files, as if they had arrived
+// in this batch.
+func (s *UploadHandlerStore) stagedUploadFiles(ctx context.Context, members []mergeGroupMember,
+	s3KeyToOnConflict map[string]string, checksums map[string]FileChecksum) ([]uploadFile.UploadFile, error) {
+	if len(members) == 0 {
+		return nil, nil
+	}
+
+	s3KeyToServerSHA256 := map[string]string{}
+	var records []events.SQSMessage
+	for _, m := range members {
+		var record events.SQSMessage
+		if err := json.Unmarshal([]byte(m.StagedMessage), &record); err != nil {
+			return nil, fmt.Errorf("unable to read staged message of %s: %w", m.UploadId, err)
+		}
+		msg, err := parseQueueMessage(record)
+		if err != nil || msg == nil {
+			return nil, fmt.Errorf("staged message of %s is not an upload: %v", m.UploadId, err)
+		}
+		s3KeyToOnConflict[msg.key] = msg.onConflict
+		if msg.serverSHA256 != "" {
+			s3KeyToServerSHA256[msg.key] = msg.serverSHA256
+		}
+		records = append(records, record)
+	}
+
+	entries, orphans, err := s.GetUploadEntries(records)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) != len(members) || len(orphans) > 0 {
+		return nil, fmt.Errorf("%d of %d staged objects could not be read", len(members)-len(entries), len(members))
+	}
+	addEntryChecksums(entries, s3KeyToServerSHA256, checksums)
+
+	files, orphans, err := s.dy.GetUploadFiles(entries)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) != len(entries) || len(orphans) > 0 {
+		return nil, fmt.Errorf("%d of %d staged files are no longer in their manifest", len(entries)-len(files), len(entries))
+	}
+	return files, nil
+}
+
+// ExpireMergeGroups reports the merge groups whose oldest staged member has waited longer than mergeGroupTimeout:
+// their staged members are set to Failed, with the number of members that arrived as the reason. They keep their
+// queue message, so a member that still arrives releases them.
+func (s *UploadHandlerStore) ExpireMergeGroups(ctx context.Context) {
+	manifestIds, err := s.dy.getStagedManifestIds(ctx)
+	if err != nil {
+		log.WithError(err).Error("Unable to list manifests with staged files.")
+		return
+	}
+
+	expired := 0
+	for _, manifestId := range manifestIds {
+		staged, err := s.dy.getStagedManifestFiles(ctx, manifestId)
+		if err != nil {
+			log.WithError(err).WithField("manifest_id", manifestId).Error("Unable to read staged files.")
+			continue
+		}
+
+		groups := map[string][]mergeGroupMember{}
+		for _, m := range staged {
+			groups[m.MergePackageId] = append(groups[m.MergePackageId], m)
+		}
+		for mergePackageId, group := range groups {
+			if !mergeGroupExpired(group, time.Now()) {
+				continue
+			}
+			if err := s.expireMergeGroup(ctx, manifestId, mergePackageId, group); err != nil {
+				log.WithError(err).WithFields(log.Fields{
+					"manifest_id":      manifestId,
+					"merge_package_id": mergePackageId,
+				}).Error("Unable to report incomplete merge group.")
+				continue
+			}
+			expired++
+		}
+	}
+	emitMergeGroupMetrics(expired)
+}
+
+// mergeGroupExpired returns true when the oldest of the staged members of a group was staged more than
+// mergeGroupTimeout before now.
+func mergeGroupExpired(staged []mergeGroupMember, now time.Time) bool {
+	for _, m := range staged {
+		if m.StagedAt > 0 && now.Sub(time.Unix(m.StagedAt, 0)) > mergeGroupTimeout {
+			return true
+		}
+	}
+	return false
+}
+
+// expireMergeGroup fails the staged members of an incomplete merge group and tells clients of the manifest.
+func (s *UploadHandlerStore) expireMergeGroup(ctx context.Context, manifestId string, mergePackageId string,
+	staged []mergeGroupMember) error {
+
+	members, err := s.dy.getMergeGroupMembers(ctx, manifestId, mergePackageId)
+	if err != nil {
+		return err
+	}
+	missing := 0
+	for _, m := range members {
+		if m.Status == manifestFile.Registered.String() {
+			missing++
+		}
+	}
+
+	reason := fmt.Sprintf("merge group incomplete: %d of %d files arrived within %s", len(members)-missing,
+		len(members), mergeGroupTimeout)
+	files := make([]uploadFile.UploadFile, len(staged))
+	reasons := map[string]string{}
+	for i, m := range staged {
+		files[i] = uploadFile.UploadFile{ManifestId: manifestId, UploadId: m.UploadId}
+		reasons[m.UploadId] = reason
+	}
+	if err := s.dy.updateManifestFileConflictStatus(ctx, manifestId, files, manifestFile.Failed.String(), reasons); err != nil {
+		return err
+	}
+
+	contextLogger := log.WithFields(log.Fields{
+		"manifest_id":      manifestId,
+		"merge_package_id": mergePackageId,
+		"members":          len(members),
+		"missing":          missing,
+	})
+	contextLogger.Warn("Merge group did not complete in time; staged members failed")
+
+	manifest, err := s.dy.GetManifestById(ctx, s.tableName, manifestId)
+	if err != nil {
+		contextLogger.WithError(err).Error("Unable to get manifest.")
+		return nil
+	}
+	s.notifyManifestProgress(ctx, manifest, contextLogger)
+	return nil
+}
+
+// emitMergeGroupMetrics writes a CloudWatch EMF record of the merge groups reported as incomplete on a heartbeat.
+func emitMergeGroupMetrics(expired int) {
+	emf := map[string]any{
+		"_aws": map[string]any{
+			"Timestamp": time.Now().UnixMilli(),
+			"CloudWatchMetrics": []map[string]any{{
+				"Namespace":  "UploadService/MergeGroups",
+				"Dimensions": [][]string{{}},
+				"Metrics": []map[string]string{
+					{"Name": "IncompleteMergeGroups", "Unit": "Count"},
+				},
+			}},
+		},
+		"IncompleteMergeGroups": expired,
+	}
+	line, _ := json.Marshal(emf)
+	fmt.Println(string(line))
+}
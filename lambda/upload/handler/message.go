@@ -0,0 +1,138 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/pennsieve/pennsieve-upload-service-v2/storage/finalize"
+)
+
+// objectCreatedDetailType and s3EventSource identify the EventBridge events S3
+// emits for new objects in a bucket with EventBridge notifications enabled.
+const (
+	objectCreatedDetailType = "Object Created"
+	s3EventSource           = "aws.s3"
+)
+
+// objectCreatedEvent is the part of an EventBridge "Object Created" event the
+// import needs. EventBridge does not URL-encode the key, unlike S3
+// notifications; upload keys contain no characters that would differ.
+type objectCreatedEvent struct {
+	Source     string `json:"source"`
+	DetailType string `json:"detail-type"`
+	Detail     struct {
+		Bucket struct {
+			Name string `json:"name"`
+		} `json:"bucket"`
+		Object struct {
+			Key  string `json:"key"`
+			Size int64  `json:"size"`
+			ETag string `json:"etag"`
+		} `json:"object"`
+	} `json:"detail"`
+}
+
+// queueMessage is an upload trigger queue message reduced to the object it
+// announces.
+type queueMessage struct {
+	bucket       string
+	key          string
+	etag         string
+	size         int64
+	onConflict   string
+	serverSHA256 string
+
+	// finalize is the message body for finalize messages, nil for S3
+	// notifications and EventBridge events.
+	finalize *finalize.Message
+}
+
+// s3TestEvent is the Event of the message S3 sends to a queue when a bucket
+// notification to it is configured.
+const s3TestEvent = "s3:TestEvent"
+
+// parseQueueMessage reads an upload trigger queue message. The queue carries
+// finalize messages, S3 notifications (sent by S3 for legacy uploads, and
+// synthesized by finalize and reconcile before finalize messages existed, with
+// the strategy and server SHA256 in message attributes), EventBridge "Object
+// Created" events for storage buckets routed through EventBridge, and
+// heartbeats.
+// Returns nil for heartbeats, S3 test events and other S3 events, which
+// announce no object, and an error for any other body, including finalize
+// messages this lambda cannot read; those go back to the queue and, once
+// retried out, to its dead-letter queue.
+func parseQueueMessage(m events.SQSMessage) (*queueMessage, error) {
+	var envelope struct {
+		Heartbeat  bool   `json:"heartbeat"`
+		Event      string `json:"Event"`
+		Source     string `json:"source"`
+		DetailType string `json:"detail-type"`
+	}
+	if err := json.Unmarshal([]byte(m.Body), &envelope); err != nil {
+		return nil, fmt.Errorf("unreadable upload trigger message: %w", err)
+	}
+
+	if finalize.IsMessage([]byte(m.Body)) {
+		fm, err := finalize.Decode([]byte(m.Body))
+		if err != nil {
+			return nil, err
+		}
+		onConflict := fm.OnConflict
+		if onConflict == "" {
+			onConflict = onConflictKeepBoth
+		}
+		return &queueMessage{
+			bucket:       fm.Bucket,
+			key:          fm.Key,
+			etag:         fm.ETag,
+			size:         fm.Size,
+			onConflict:   onConflict,
+			serverSHA256: fm.ServerSHA256,
+			finalize:     fm,
+		}, nil
+	}
+
+	if envelope.Heartbeat || envelope.Event == s3TestEvent {
+		return nil, nil
+	}
+
+	if envelope.Source == s3EventSource {
+		if envelope.DetailType != objectCreatedDetailType {
+			return nil, nil
+		}
+		var event objectCreatedEvent
+		if err := json.Unmarshal([]byte(m.Body), &event); err != nil {
+			return nil, fmt.Errorf("malformed %s event: %w", objectCreatedDetailType, err)
+		}
+		if event.Detail.Bucket.Name == "" || event.Detail.Object.Key == "" {
+			return nil, fmt.Errorf("%s event has no bucket or key", objectCreatedDetailType)
+		}
+		// EventBridge events carry no message attributes; files routed this way
+		// use the default strategy, like legacy S3-triggered uploads.
+		return &queueMessage{
+			bucket:     event.Detail.Bucket.Name,
+			key:        event.Detail.Object.Key,
+			etag:       event.Detail.Object.ETag,
+			size:       event.Detail.Object.Size,
+			onConflict: onConflictKeepBoth,
+		}, nil
+	}
+
+	var s3Event events.S3Event
+	if err := json.Unmarshal([]byte(m.Body), &s3Event); err != nil || len(s3Event.Records) == 0 {
+		return nil, fmt.Errorf("unrecognized upload trigger message")
+	}
+	record := s3Event.Records[0]
+	msg := &queueMessage{
+		bucket:     record.S3.Bucket.Name,
+		key:        record.S3.Object.Key,
+		etag:       record.S3.Object.ETag,
+		size:       record.S3.Object.Size,
+		onConflict: extractOnConflictAttr(m),
+	}
+	if attr, ok := m.MessageAttributes[serverSHA256AttrName]; ok && attr.StringValue != nil {
+		msg.serverSHA256 = *attr.StringValue
+	}
+	return msg, nil
+}
@@ -22,6 +22,31 @@ func (e *S3FileMalFormedError) Error() string {
 	return fmt.Sprintf("S3 File is not structured as expected: %s / %s ", e.S3Bucket, e.S3Key)
 }
 
+// ChecksumMismatchError is returned for an object whose full-object SHA256 differs from the one its client declared.
+type ChecksumMismatchError struct {
+	ManifestId string
+	UploadId   string
+	Declared   string
+	Stored     string
+}
+
+func (e *ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("SHA256 of %s / %s is %s, client declared %s", e.ManifestId, e.UploadId, e.Stored, e.Declared)
+}
+
+// FileChecksum is the checksum S3 stored for an uploaded object.
+type FileChecksum struct {
+	Algorithm string // SHA256, SHA1, CRC32, CRC32C or CRC64NVME
+	Type      string // FULL_OBJECT or COMPOSITE
+	Value     string // base64, with a "-<parts>" suffix for composite checksums
+	// ServerSHA256 is the SHA256 the finalize endpoint computed and verified
+	// for an object S3 stored no SHA256 checksum for. Empty otherwise.
+	ServerSHA256 string
+	// ClientSHA256 is the full-object SHA256 the client declared in a finalize
+	// message, which the import checked against the object. Empty otherwise.
+	ClientSHA256 string
+}
+
 // UploadEntry representation of file from SQS queue on Upload Trigger
 type UploadEntry struct {
 	ManifestId     string
@@ -36,6 +61,7 @@ type UploadEntry struct {
 	MergePackageId string
 	FileType       string
 	Sha256         string
+	Checksum       FileChecksum
 	// DirectToStorage indicates the file already landed at its final storage
 	// location (agent uploaded directly, no Fargate move required). Detected
 	// from the S3 key prefix (starts with "O{orgId}/D{datasetId}/...").
@@ -0,0 +1,214 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/aws-sdk-go-v2/service/sns/types"
+	"github.com/pennsieve/pennsieve-go-core/pkg/domain"
+	"github.com/pusher/pusher-http-go/v5"
+)
+
+// Notifier delivers upload events to the clients watching a dataset channel.
+type Notifier interface {
+	// Notify sends data as a single event.
+	Notify(ctx context.Context, channel string, event string, data any) error
+	// NotifyItems sends items as one or more events, each carrying a JSON array of consecutive items that fits the
+	// payload limit of the transport. An item that does not fit on its own is dropped and reported in the error;
+	// the other items are still sent.
+	NotifyItems(ctx context.Context, channel string, event string, items []any) error
+}
+
+const (
+	// pusherMaxPayloadBytes is the default Pusher limit on the data of one event.
+	pusherMaxPayloadBytes = 10 * 1024
+	// pusherMaxBatchEvents is the number of events Pusher accepts in one batch trigger.
+	pusherMaxBatchEvents = 10
+
+	// snsMaxPayloadBytes leaves room below the 256 KiB SNS message limit for the message attributes.
+	snsMaxPayloadBytes = 250 * 1024
+	// snsMaxBatchBytes and snsMaxBatchEntries bound one PublishBatch request.
+	snsMaxBatchBytes   = 256 * 1024
+	snsMaxBatchEntries = 10
+)
+
+// NotifierType names a Notifier implementation, as set in the NOTIFIER environment variable.
+type NotifierType string
+
+const (
+	NotifierPusher NotifierType = "pusher"
+	NotifierSNS    NotifierType = "sns"
+	NotifierNone   NotifierType = "none"
+)
+
+// ParseNotifierType returns the NotifierType named by s; empty means Pusher.
+func ParseNotifierType(s string) (NotifierType, error) {
+	switch t := NotifierType(s); t {
+	case "":
+		return NotifierPusher, nil
+	case NotifierPusher, NotifierSNS, NotifierNone:
+		return t, nil
+	default:
+		return "", fmt.Errorf("unknown notifier %q", s)
+	}
+}
+
+// pusherNotifier sends events to Pusher channels.
+type pusherNotifier struct {
+	client          domain.PusherAPI
+	maxPayloadBytes int
+}
+
+// NewPusherNotifier returns a Notifier that triggers events on Pusher.
+func NewPusherNotifier(client domain.PusherAPI) Notifier {
+	return &pusherNotifier{client: client, maxPayloadBytes: pusherMaxPayloadBytes}
+}
+
+func (n *pusherNotifier) Notify(_ context.Context, channel string, event string, data any) error {
+	return n.client.Trigger(channel, event, data)
+}
+
+func (n *pusherNotifier) NotifyItems(_ context.Context, channel string, event string, items []any) error {
+	chunks, err := chunkItems(items, n.maxPayloadBytes)
+	errs := []error{err}
+	for start := 0; start < len(chunks); start += pusherMaxBatchEvents {
+		end := min(start+pusherMaxBatchEvents, len(chunks))
+		batch := make([]pusher.Event, 0, end-start)
+		for _, chunk := range chunks[start:end] {
+			batch = append(batch, pusher.Event{Channel: channel, Name: event, Data: chunk})
+		}
+		if _, err := n.client.TriggerBatch(batch); err != nil {
+			errs = append(errs, fmt.Errorf("trigger %s events %d-%d of %d: %w", event, start+1, end, len(chunks), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// snsNotifier publishes events to an SNS topic for a relay to deliver. The event data is the message body; the
+// channel and event name are message attributes, so subscribers can filter on them.
+type snsNotifier struct {
+	client          domain.SnsAPI
+	topicArn        string
+	maxPayloadBytes int
+}
+
+// NewSNSNotifier returns a Notifier that publishes events to topicArn.
+func NewSNSNotifier(client domain.SnsAPI, topicArn string) Notifier {
+	return &snsNotifier{client: client, topicArn: topicArn, maxPayloadBytes: snsMaxPayloadBytes}
+}
+
+func (n *snsNotifier) Notify(ctx context.Context, channel string, event string, data any) error {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("marshal %s event: %w", event, err)
+	}
+	return n.publish(ctx, channel, event, []json.RawMessage{body})
+}
+
+func (n *snsNotifier) NotifyItems(ctx context.Context, channel string, event string, items []any) error {
+	chunks, err := chunkItems(items, n.maxPayloadBytes)
+	return errors.Join(err, n.publish(ctx, channel, event, chunks))
+}
+
+// publish sends each body as one SNS message, in as few PublishBatch requests as the batch limits allow.
+func (n *snsNotifier) publish(ctx context.Context, channel string, event string, bodies []json.RawMessage) error {
+	attributes := map[string]types.MessageAttributeValue{
+		"channel": {DataType: aws.String("String"), StringValue: aws.String(channel)},
+		"event":   {DataType: aws.String("String"), StringValue: aws.String(event)},
+	}
+
+	var errs []error
+	var entries []types.PublishBatchRequestEntry
+	batchBytes := 0
+	send := func() {
+		if len(entries) == 0 {
+			return
+		}
+		out, err := n.client.PublishBatch(ctx, &sns.PublishBatchInput{
+			TopicArn:                   aws.String(n.topicArn),
+			PublishBatchRequestEntries: entries,
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("publish %s events: %w", event, err))
+		} else if len(out.Failed) > 0 {
+			errs = append(errs, fmt.Errorf("publish %s events: %d of %d failed", event, len(out.Failed), len(entries)))
+		}
+		entries = nil
+		batchBytes = 0
+	}
+
+	for i, body := range bodies {
+		if len(entries) == snsMaxBatchEntries || batchBytes+len(body) > snsMaxBatchBytes {
+			send()
+		}
+		entries = append(entries, types.PublishBatchRequestEntry{
+			Id:                aws.String(strconv.Itoa(i)),
+			Message:           aws.String(string(body)),
+			MessageAttributes: attributes,
+		})
+		batchBytes += len(body)
+	}
+	send()
+	return errors.Join(errs...)
+}
+
+// noopNotifier drops every event, for installs without a client-facing notification channel.
+type noopNotifier struct{}
+
+// NewNoopNotifier returns a Notifier that sends nothing.
+func NewNoopNotifier() Notifier {
+	return noopNotifier{}
+}
+
+func (noopNotifier) Notify(context.Context, string, string, any) error {
+	return nil
+}
+
+func (noopNotifier) NotifyItems(context.Context, string, string, []any) error {
+	return nil
+}
+
+// chunkItems marshals items into JSON arrays of at most limit bytes, keeping their order. Items that do not fit into
+// an array of their own are left out and reported in the error.
+func chunkItems(items []any, limit int) ([]json.RawMessage, error) {
+	var chunks []json.RawMessage
+	var errs []error
+	chunk := []byte{'['}
+	for i, item := range items {
+		b, err := json.Marshal(item)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("marshal item %d: %w", i, err))
+			continue
+		}
+		if len(b)+2 > limit {
+			errs = append(errs, fmt.Errorf("item %d is %d bytes, over the %d byte payload limit", i, len(b), limit))
+			continue
+		}
+		if len(chunk) > 1 && len(chunk)+len(b)+2 > limit {
+			chunks = append(chunks, append(chunk, ']'))
+			chunk = []byte{'['}
+		}
+		if len(chunk) > 1 {
+			chunk = append(chunk, ',')
+		}
+		chunk = append(chunk, b...)
+	}
+	if len(chunk) > 1 {
+		chunks = append(chunks, append(chunk, ']'))
+	}
+	return chunks, errors.Join(errs...)
+}
+
+// anySlice converts items for Notifier.NotifyItems.
+func anySlice[T any](items []T) []any {
+	res := make([]any, len(items))
+	for i, item := range items {
+		res[i] = item
+	}
+	return res
+}
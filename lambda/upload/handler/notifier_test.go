@@ -0,0 +1,143 @@
+// External test package — avoids the in-package TestMain that requires live
+// DynamoDB/Postgres for the integration tests.
+package handler_test
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/pennsieve/pennsieve-upload-service-v2/upload/handler"
+	"github.com/pennsieve/pennsieve-upload-service-v2/upload/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type notifierItem struct {
+	Index int    `json:"index"`
+	Name  string `json:"name"`
+}
+
+// notifierItems returns n items of roughly 500 bytes each.
+func notifierItems(n int) []any {
+	items := make([]any, n)
+	for i := range items {
+		items[i] = notifierItem{Index: i, Name: strings.Repeat("x", 480)}
+	}
+	return items
+}
+
+// decodeChunks returns the items carried by the events, in order, and fails if an event is over limit bytes.
+func decodeChunks(t *testing.T, payloads [][]byte, limit int) []notifierItem {
+	var items []notifierItem
+	for _, p := range payloads {
+		assert.LessOrEqual(t, len(p), limit)
+		var chunk []notifierItem
+		require.NoError(t, json.Unmarshal(p, &chunk))
+		items = append(items, chunk...)
+	}
+	return items
+}
+
+func TestPusherNotifier(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, mPusher *test.MockPusherClient, notifier handler.Notifier){
+		"chunks items under the payload limit": func(t *testing.T, mPusher *test.MockPusherClient, notifier handler.Notifier) {
+			require.NoError(t, notifier.NotifyItems(context.Background(), "dataset-1", "upload-event", notifierItems(100)))
+
+			var payloads [][]byte
+			for _, data := range mPusher.Triggered["dataset-1"]["upload-event"] {
+				payloads = append(payloads, data.(json.RawMessage))
+			}
+			assert.Greater(t, len(payloads), 1, "100 items of 500 bytes do not fit one event")
+			items := decodeChunks(t, payloads, 10*1024)
+			if assert.Len(t, items, 100) {
+				for i, item := range items {
+					assert.Equal(t, i, item.Index)
+				}
+			}
+		},
+		"drops and reports an oversized item": func(t *testing.T, mPusher *test.MockPusherClient, notifier handler.Notifier) {
+			items := notifierItems(3)
+			items[1] = notifierItem{Index: 1, Name: strings.Repeat("x", 11*1024)}
+
+			err := notifier.NotifyItems(context.Background(), "dataset-1", "upload-event", items)
+			assert.ErrorContains(t, err, "item 1")
+
+			var payloads [][]byte
+			for _, data := range mPusher.Triggered["dataset-1"]["upload-event"] {
+				payloads = append(payloads, data.(json.RawMessage))
+			}
+			sent := decodeChunks(t, payloads, 10*1024)
+			if assert.Len(t, sent, 2) {
+				assert.Equal(t, 0, sent[0].Index)
+				assert.Equal(t, 2, sent[1].Index)
+			}
+		},
+		"sends single events unwrapped": func(t *testing.T, mPusher *test.MockPusherClient, notifier handler.Notifier) {
+			progress := map[string]int{"Imported": 2}
+			require.NoError(t, notifier.Notify(context.Background(), "dataset-1", "manifest-progress", progress))
+			assert.Equal(t, []any{progress}, mPusher.Triggered["dataset-1"]["manifest-progress"])
+		},
+		"sends nothing for no items": func(t *testing.T, mPusher *test.MockPusherClient, notifier handler.Notifier) {
+			require.NoError(t, notifier.NotifyItems(context.Background(), "dataset-1", "upload-event", nil))
+			assert.Empty(t, mPusher.Triggered)
+		},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			mPusher := test.NewMockPusherClient()
+			fn(t, mPusher, handler.NewPusherNotifier(mPusher))
+		})
+	}
+}
+
+// capturingSNS records the PublishBatch requests it receives.
+type capturingSNS struct {
+	batches []*sns.PublishBatchInput
+}
+
+func (c *capturingSNS) PublishBatch(ctx context.Context, params *sns.PublishBatchInput, optFns ...func(*sns.Options)) (*sns.PublishBatchOutput, error) {
+	c.batches = append(c.batches, params)
+	return &sns.PublishBatchOutput{}, nil
+}
+
+func TestSNSNotifier(t *testing.T) {
+	mSNS := &capturingSNS{}
+	notifier := handler.NewSNSNotifier(mSNS, "arn:aws:sns:us-east-1:123456789012:notifications")
+
+	// 2000 items of 500 bytes need four messages of up to 250 KiB, which do not fit one 256 KiB batch.
+	require.NoError(t, notifier.NotifyItems(context.Background(), "dataset-1", "upload-event", notifierItems(2000)))
+
+	var payloads [][]byte
+	for _, batch := range mSNS.batches {
+		assert.LessOrEqual(t, len(batch.PublishBatchRequestEntries), 10)
+		batchBytes := 0
+		for _, e := range batch.PublishBatchRequestEntries {
+			assert.Equal(t, "dataset-1", *e.MessageAttributes["channel"].StringValue)
+			assert.Equal(t, "upload-event", *e.MessageAttributes["event"].StringValue)
+			batchBytes += len(*e.Message)
+			payloads = append(payloads, []byte(*e.Message))
+		}
+		assert.LessOrEqual(t, batchBytes, 256*1024)
+	}
+	assert.Greater(t, len(mSNS.batches), 1)
+	assert.Len(t, decodeChunks(t, payloads, 250*1024), 2000)
+}
+
+func TestParseNotifierType(t *testing.T) {
+	for value, expected := range map[string]handler.NotifierType{
+		"":       handler.NotifierPusher,
+		"pusher": handler.NotifierPusher,
+		"sns":    handler.NotifierSNS,
+		"none":   handler.NotifierNone,
+	} {
+		actual, err := handler.ParseNotifierType(value)
+		assert.NoError(t, err, value)
+		assert.Equal(t, expected, actual, value)
+	}
+	_, err := handler.ParseNotifierType("carrier-pigeon")
+	assert.Error(t, err)
+
+	assert.NoError(t, handler.NewNoopNotifier().NotifyItems(context.Background(), "dataset-1", "upload-event", notifierItems(1)))
+}
@@ -0,0 +1,391 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/aws-sdk-go-v2/service/sns/types"
+	"github.com/pennsieve/pennsieve-go-core/pkg/changelog"
+	log "github.com/sirupsen/logrus"
+)
+
+// An import records the messages it sends once it commits in pennsieve.upload_outbox, in the transaction that
+// commits it, and delivers them right after the commit. Entries it could not deliver stay in the outbox with a retry
+// time; the relay, run on every upload lambda heartbeat, delivers them until they succeed or fail outboxMaxAttempts
+// times, after which they are dead: they stay in the outbox, but only the reconcile lambda's inspectOutbox mode
+// brings them back. Delivery is at least once: a message whose entry could not be removed is sent again.
+
+// outboxKind names how an outbox entry is delivered.
+type outboxKind string
+
+const (
+	// outboxSNS entries are one PublishBatch request, an outboxSNSPayload.
+	outboxSNS outboxKind = "sns"
+	// outboxChangelog entries are one changelog.Message.
+	outboxChangelog outboxKind = "changelog"
+	// outboxDeletePackageJobs entries are one SendMessageBatch request of DeletePackageJobParams.
+	outboxDeletePackageJobs outboxKind = "delete_package_jobs"
+	// outboxNotification entries are one Notifier.NotifyItems call, an outboxNotificationPayload.
+	outboxNotification outboxKind = "notification"
+)
+
+const (
+	// outboxLease keeps the relay off entries an import is still delivering, and off entries another relay
+	// claimed. It outlasts the 300 second lambda timeout.
+	outboxLease = 10 * time.Minute
+	// outboxMinBackoff and outboxMaxBackoff bound the wait before an entry is retried; it doubles with every
+	// failed attempt.
+	outboxMinBackoff = 30 * time.Second
+	outboxMaxBackoff = time.Hour
+	// outboxStuckAttempts is the number of failed attempts after which an entry is reported as stuck.
+	outboxStuckAttempts = 5
+	// outboxMaxAttempts is the number of failed attempts after which an entry is dead, about 14 hours after it was
+	// recorded.
+	outboxMaxAttempts = 20
+	// outboxRelayBatchSize is the number of entries the relay claims at a time. A batch is delivered in a few
+	// seconds, well within outboxRelayBudget.
+	outboxRelayBatchSize = 25
+	// outboxRelayBudget is how long the relay claims entries on a heartbeat; a larger backlog is left to the
+	// following ones.
+	outboxRelayBudget = 20 * time.Second
+	// outboxRelayReserve is the time the relay leaves before the invocation deadline.
+	outboxRelayReserve = 30 * time.Second
+)
+
+// outboxMessage is a message an import sends once it commits. payload holds the value to deliver, or its JSON when
+// the message was read back from the outbox.
+type outboxMessage struct {
+	kind    outboxKind
+	payload any
+}
+
+// outboxEntry is an outboxMessage recorded in the outbox.
+type outboxEntry struct {
+	outboxMessage
+	id        int64
+	attempts  int
+	createdAt time.Time
+}
+
+// outboxSNSPayload is a PublishBatch request.
+type outboxSNSPayload struct {
+	TopicArn string           `json:"topicArn"`
+	Entries  []outboxSNSEntry `json:"entries"`
+}
+
+type outboxSNSEntry struct {
+	Id         string                        `json:"id"`
+	Message    string                        `json:"message"`
+	Attributes map[string]outboxSNSAttribute `json:"attributes,omitempty"`
+}
+
+type outboxSNSAttribute struct {
+	DataType string `json:"dataType"`
+	Value    string `json:"value"`
+}
+
+// outboxNotificationPayload is a Notifier.NotifyItems call.
+type outboxNotificationPayload struct {
+	Channel string            `json:"channel"`
+	Event   string            `json:"event"`
+	Items   []json.RawMessage `json:"items"`
+}
+
+// outboxSNSMessages returns the messages that publish entries to topicArn, one per PublishBatch request.
+func outboxSNSMessages(topicArn string, entries []types.PublishBatchRequestEntry) []outboxMessage {
+	var messages []outboxMessage
+	for start := 0; start < len(entries); start += snsMaxBatchEntries {
+		payload := outboxSNSPayload{TopicArn: topicArn}
+		for _, e := range entries[start:min(start+snsMaxBatchEntries, len(entries))] {
+			entry := outboxSNSEntry{Id: aws.ToString(e.Id), Message: aws.ToString(e.Message)}
+			for name, a := range e.MessageAttributes {
+				if entry.Attributes == nil {
+					entry.Attributes = map[string]outboxSNSAttribute{}
+				}
+				entry.Attributes[name] = outboxSNSAttribute{DataType: aws.ToString(a.DataType), Value: aws.ToString(a.StringValue)}
+			}
+			payload.Entries = append(payload.Entries, entry)
+		}
+		messages = append(messages, outboxMessage{kind: outboxSNS, payload: payload})
+	}
+	return messages
+}
+
+// batchEntries returns the PublishBatch entries of p.
+func (p outboxSNSPayload) batchEntries() []types.PublishBatchRequestEntry {
+	entries := make([]types.PublishBatchRequestEntry, 0, len(p.Entries))
+	for _, e := range p.Entries {
+		entry := types.PublishBatchRequestEntry{Id: aws.String(e.Id), Message: aws.String(e.Message)}
+		for name, a := range e.Attributes {
+			if entry.MessageAttributes == nil {
+				entry.MessageAttributes = map[string]types.MessageAttributeValue{}
+			}
+			entry.MessageAttributes[name] = types.MessageAttributeValue{
+				DataType:    aws.String(a.DataType),
+				StringValue: aws.String(a.Value),
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// changelogOutboxMessages returns the messages that send events to the dataset activity log.
+func changelogOutboxMessages(params changelog.MessageParams, events []changelog.Event) ([]outboxMessage, error) {
+	if len(events) == 0 {
+		return nil, nil
+	}
+	changelogMsgs, err := changelogMessages(params, events, maxChangelogMessageBytes)
+	if err != nil {
+		return nil, err
+	}
+	messages := make([]outboxMessage, 0, len(changelogMsgs))
+	for _, m := range changelogMsgs {
+		messages = append(messages, outboxMessage{kind: outboxChangelog, payload: m})
+	}
+	return messages, nil
+}
+
+// deletePackageJobOutboxMessages returns the messages that enqueue jobs, one per SendMessageBatch request.
+func deletePackageJobOutboxMessages(jobs []DeletePackageJobParams) []outboxMessage {
+	var messages []outboxMessage
+	for start := 0; start < len(jobs); start += sqsSendMessageBatchLimit {
+		batch := jobs[start:min(start+sqsSendMessageBatchLimit, len(jobs))]
+		messages = append(messages, outboxMessage{kind: outboxDeletePackageJobs, payload: batch})
+	}
+	return messages
+}
+
+// notificationOutboxMessage returns the message that notifies channel of items, or false if there are none.
+func notificationOutboxMessage(channel string, event string, items []any) (outboxMessage, bool, error) {
+	if len(items) == 0 {
+		return outboxMessage{}, false, nil
+	}
+	payload := outboxNotificationPayload{Channel: channel, Event: event, Items: make([]json.RawMessage, len(items))}
+	for i, item := range items {
+		b, err := json.Marshal(item)
+		if err != nil {
+			return outboxMessage{}, false, fmt.Errorf("marshal %s item %d: %w", event, i, err)
+		}
+		payload.Items[i] = b
+	}
+	return outboxMessage{kind: outboxNotification, payload: payload}, true, nil
+}
+
+// outboxPayload returns the payload of m as a T, decoding it if m was read back from the outbox.
+func outboxPayload[T any](m outboxMessage) (T, error) {
+	var payload T
+	switch p := m.payload.(type) {
+	case T:
+		return p, nil
+	case json.RawMessage:
+		err := json.Unmarshal(p, &payload)
+		return payload, err
+	}
+	return payload, fmt.Errorf("unexpected %s payload %T", m.kind, m.payload)
+}
+
+// deliverOutboxMessage sends m once.
+func (s *UploadHandlerStore) deliverOutboxMessage(ctx context.Context, m outboxMessage) error {
+	switch m.kind {
+	case outboxSNS:
+		p, err := outboxPayload[outboxSNSPayload](m)
+		if err != nil {
+			return err
+		}
+		out, err := s.SNSClient.PublishBatch(ctx, &sns.PublishBatchInput{
+			TopicArn:                   aws.String(p.TopicArn),
+			PublishBatchRequestEntries: p.batchEntries(),
+		})
+		if err != nil {
+			return fmt.Errorf("PublishBatch: %w", err)
+		}
+		if len(out.Failed) > 0 {
+			return fmt.Errorf("PublishBatch: %d of %d entries failed (first: %s/%s)", len(out.Failed), len(p.Entries),
+				aws.ToString(out.Failed[0].Code), aws.ToString(out.Failed[0].Message))
+		}
+		return nil
+	case outboxChangelog:
+		msg, err := outboxPayload[changelog.Message](m)
+		if err != nil {
+			return err
+		}
+		return s.changelogClient.EmitEvents(ctx, msg)
+	case outboxDeletePackageJobs:
+		jobs, err := outboxPayload[[]DeletePackageJobParams](m)
+		if err != nil {
+			return err
+		}
+		return PublishDeletePackageJobs(ctx, s.sqsClient, s.jobsQueueURL, jobs)
+	case outboxNotification:
+		p, err := outboxPayload[outboxNotificationPayload](m)
+		if err != nil {
+			return err
+		}
+		return s.notifier.NotifyItems(ctx, p.Channel, p.Event, anySlice(p.Items))
+	}
+	return fmt.Errorf("unknown outbox kind %q", m.kind)
+}
+
+// outboxDelivery counts the entries deliverOutbox delivered, and those that failed by kind.
+type outboxDelivery struct {
+	delivered int
+	failed    map[outboxKind]int
+}
+
+// deliverOutbox delivers entries and removes them from the outbox. An entry that fails is scheduled for the relay to
+// retry after outboxBackoff.
+func (s *UploadHandlerStore) deliverOutbox(ctx context.Context, entries []outboxEntry) outboxDelivery {
+	res := outboxDelivery{failed: map[outboxKind]int{}}
+	if len(entries) == 0 {
+		return res
+	}
+
+	var delivered []int64
+	for _, e := range entries {
+		contextLogger := log.WithFields(log.Fields{"outbox_id": e.id, "kind": e.kind})
+		err := s.deliverOutboxMessage(ctx, e.outboxMessage)
+		if err == nil {
+			delivered = append(delivered, e.id)
+			continue
+		}
+
+		res.failed[e.kind]++
+		attempts := e.attempts + 1
+		contextLogger = contextLogger.WithError(err).WithField("attempts", attempts)
+		if attempts >= outboxMaxAttempts {
+			contextLogger.Error("outbox entry is dead; requeue it with the reconcile lambda's inspectOutbox mode")
+			if err := s.pg.KillOutboxEntry(ctx, e.id, err.Error()); err != nil {
+				// The lease still expires, so the entry is retried, and killed, again.
+				contextLogger.WithError(err).Error("Unable to mark outbox entry dead.")
+			}
+			continue
+		}
+		if attempts == outboxStuckAttempts {
+			contextLogger.Warn("outbox entry is stuck; inspect it with the reconcile lambda's inspectOutbox mode")
+		} else {
+			contextLogger.Info("outbox delivery failed; will retry")
+		}
+		if err := s.pg.RetryOutboxEntry(ctx, e.id, err.Error(), outboxBackoff(attempts)); err != nil {
+			// The lease still expires, so the entry is retried all the same.
+			contextLogger.WithError(err).Error("Unable to reschedule outbox entry.")
+		}
+	}
+
+	res.delivered = len(delivered)
+	if err := s.pg.DeleteOutboxEntries(ctx, delivered); err != nil {
+		log.WithError(err).WithField("outbox_ids", delivered).
+			Error("Unable to remove delivered outbox entries; they will be delivered again.")
+	}
+
+	failed := 0
+	for _, n := range res.failed {
+		failed += n
+	}
+	emitOutboxDeliveryMetrics(res.delivered, failed)
+	return res
+}
+
+// outboxBackoff returns the wait before the next delivery of an entry that failed attempts times.
+func outboxBackoff(attempts int) time.Duration {
+	backoff := outboxMinBackoff
+	for i := 1; i < attempts && backoff < outboxMaxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, outboxMaxBackoff)
+}
+
+// RelayOutbox delivers the outbox entries that are due, a batch at a time, until none are left, outboxRelayBudget has
+// passed or the invocation is about to time out, and reports the size of the outbox.
+func (s *UploadHandlerStore) RelayOutbox(ctx context.Context) {
+	stop := time.Now().Add(outboxRelayBudget)
+	if deadline, ok := ctx.Deadline(); ok && deadline.Add(-outboxRelayReserve).Before(stop) {
+		stop = deadline.Add(-outboxRelayReserve)
+	}
+	for time.Now().Before(stop) {
+		entries, err := s.pg.ClaimOutboxEntries(ctx, outboxRelayBatchSize, outboxLease)
+		if err != nil {
+			log.WithError(err).Error("Unable to claim outbox entries.")
+			break
+		}
+		if len(entries) == 0 {
+			break
+		}
+		s.deliverOutbox(ctx, entries)
+		if len(entries) < outboxRelayBatchSize {
+			break
+		}
+	}
+
+	backlog, err := s.pg.GetOutboxBacklog(ctx, outboxStuckAttempts)
+	if err != nil {
+		log.WithError(err).Error("Unable to measure the outbox backlog.")
+		return
+	}
+	if backlog.stuck > 0 || backlog.dead > 0 {
+		log.WithFields(log.Fields{"pending": backlog.pending, "stuck": backlog.stuck, "dead": backlog.dead}).
+			Warn("outbox has stuck or dead entries; inspect them with the reconcile lambda's inspectOutbox mode")
+	}
+	emitOutboxBacklogMetrics(backlog)
+}
+
+// outboxBacklog describes the entries in the outbox.
+type outboxBacklog struct {
+	// pending counts the entries the relay still delivers.
+	pending int
+	// stuck counts the pending entries that failed at least outboxStuckAttempts times.
+	stuck int
+	// dead counts the entries that failed outboxMaxAttempts times.
+	dead int
+	// oldest is the age of the oldest pending entry.
+	oldest time.Duration
+}
+
+// emitOutboxDeliveryMetrics writes a CloudWatch EMF record of the outcome of one round of outbox deliveries.
+func emitOutboxDeliveryMetrics(delivered, failed int) {
+	emitOutboxMetrics(map[string]any{
+		"OutboxDelivered":        delivered,
+		"OutboxDeliveryFailures": failed,
+	})
+}
+
+// emitOutboxBacklogMetrics writes a CloudWatch EMF record of the outbox backlog. Alarm on OutboxOldestAgeSeconds
+// to catch a message that keeps failing, and on OutboxDead for one the relay gave up on.
+func emitOutboxBacklogMetrics(b outboxBacklog) {
+	emitOutboxMetrics(map[string]any{
+		"OutboxPending":          b.pending,
+		"OutboxStuck":            b.stuck,
+		"OutboxDead":             b.dead,
+		"OutboxOldestAgeSeconds": int64(b.oldest.Seconds()),
+	})
+}
+
+func emitOutboxMetrics(values map[string]any) {
+	var metrics []map[string]string
+	for name := range values {
+		unit := "Count"
+		if name == "OutboxOldestAgeSeconds" {
+			unit = "Seconds"
+		}
+		metrics = append(metrics, map[string]string{"Name": name, "Unit": unit})
+	}
+	emf := map[string]any{
+		"_aws": map[string]any{
+			"Timestamp": time.Now().UnixMilli(),
+			"CloudWatchMetrics": []map[string]any{{
+				"Namespace":  "UploadService/Outbox",
+				"Dimensions": [][]string{{}},
+				"Metrics":    metrics,
+			}},
+		},
+	}
+	for name, value := range values {
+		emf[name] = value
+	}
+	line, _ := json.Marshal(emf)
+	fmt.Println(string(line))
+}
@@ -2,7 +2,12 @@ package handler
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/google/uuid"
+	"github.com/pennsieve/pennsieve-go-core/pkg/models/fileInfo/fileType"
 	"github.com/pennsieve/pennsieve-go-core/pkg/models/packageInfo/packageState"
 	"github.com/pennsieve/pennsieve-go-core/pkg/models/packageInfo/packageType"
 	"github.com/pennsieve/pennsieve-go-core/pkg/models/pgdb"
@@ -10,8 +15,16 @@ import (
 	pgQueries "github.com/pennsieve/pennsieve-go-core/pkg/queries/pgdb"
 	log "github.com/sirupsen/logrus"
 	"sort"
+	"strings"
+	"time"
 )
 
+// packageStateVersioned is the state of a package kept as a prior version of the package that replaced it under
+// onConflict=version. It is not a pennsieve-go-core state: DELETING would have the jobs that purge deleted packages
+// remove the version's files and objects. A prior version is hidden like a deleted package, so every query that
+// lists packages or looks for a name conflict excludes both states, but its files are still charged to storage.
+const packageStateVersioned = "VERSIONED"
+
 // UploadPgQueries is the UploadHandler Queries Struct embedding the shared Queries struct
 type UploadPgQueries struct {
 	*pgQueries.Queries
@@ -27,10 +40,57 @@ func NewUploadPgQueries(db pgQueries.DBTX) *UploadPgQueries {
 	}
 }
 
+// GetPackageChildren returns the packages directly under parent, or at the dataset root when parent is nil or has no
+// id. It replaces pennsieve-go-core's version, which only leaves out deleted packages and would list prior versions.
+func (q *UploadPgQueries) GetPackageChildren(ctx context.Context, parent *pgdb.Package, datasetId int, onlyFolders bool) ([]pgdb.Package, error) {
+	args := []interface{}{datasetId, packageState.Deleting.String(), packageStateVersioned}
+	parentFilter := "parent_id IS NULL"
+	if parent != nil && parent.Id != 0 {
+		args = append(args, parent.Id)
+		parentFilter = fmt.Sprintf("parent_id = $%d", len(args))
+	}
+	if onlyFolders {
+		args = append(args, packageType.Collection.String())
+		parentFilter += fmt.Sprintf(" AND type = $%d", len(args))
+	}
+
+	rows, err := q.db.QueryContext(ctx, fmt.Sprintf("SELECT id, name, type, state, node_id, parent_id, dataset_id, "+
+		"owner_id, size, created_at, updated_at FROM packages WHERE dataset_id = $1 AND state NOT IN ($2, $3) AND %s;",
+		parentFilter), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var children []pgdb.Package
+	for rows.Next() {
+		var p pgdb.Package
+		err = rows.Scan(
+			&p.Id,
+			&p.Name,
+			&p.PackageType,
+			&p.PackageState,
+			&p.NodeId,
+			&p.ParentId,
+			&p.DatasetId,
+			&p.OwnerId,
+			&p.Size,
+			&p.CreatedAt,
+			&p.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, p)
+	}
+	return children, rows.Err()
+}
+
 // GetCreateUploadFolders creates new folders in the organization.
 // It updates UploadFolders with real folder ID for folders that already exist.
 // Assumes map keys are absolute paths in the dataset
-func (q *UploadPgQueries) GetCreateUploadFolders(datasetId int, ownerId int, folders uploadFolder.UploadFolderMap) (pgdb.PackageMap, error) {
+// Also returns the folders it created, parents before their children.
+func (q *UploadPgQueries) GetCreateUploadFolders(datasetId int, ownerId int, folders uploadFolder.UploadFolderMap) (pgdb.PackageMap, []pgdb.Package, error) {
 
 	contextLogger := log.WithFields(log.Fields{
 		"service": "Upload-service",
@@ -44,7 +104,7 @@ func (q *UploadPgQueries) GetCreateUploadFolders(datasetId int, ownerId int, fol
 			log.Fields{
 				"dataset_id": datasetId,
 			}).Error("Error getting root folders:  ", err)
-		return nil, err
+		return nil, nil, err
 	}
 
 	// Map NodeId to Packages for folders that exist in DB
@@ -60,38 +120,67 @@ func (q *UploadPgQueries) GetCreateUploadFolders(datasetId int, ownerId int, fol
 	}
 	sort.Strings(pathKeys)
 
+	// useFolder points the upload folder at path, and its children, at an existing folder and adds the folder's
+	// children to existingFolders.
+	useFolder := func(path string, folder pgdb.Package) error {
+		folders[path].NodeId = folder.NodeId
+		folders[path].Id = folder.Id
+
+		// Iterate over map and update values that have identified current folder as parent.
+		for _, childFolder := range folders[path].Children {
+			childFolder.ParentId = folder.Id
+			childFolder.ParentNodeId = folder.NodeId
+		}
+
+		// Add children of current folder to existing folders
+		children, err := q.GetPackageChildren(context.Background(), &folder, datasetId, true)
+		if err != nil {
+			contextLogger.WithFields(
+				log.Fields{
+					"dataset_id":       datasetId,
+					"folder":           folder.Name,
+					"folder_parent_id": folder.ParentId,
+				}).Error("Error getting children for folder:  ", err)
+			return err
+		}
+		for _, k := range children {
+			p := fmt.Sprintf("%s/%s", path, k.Name)
+			existingFolders[p] = k
+		}
+		return nil
+	}
+
 	// Iterate over the sorted map
+	var created []pgdb.Package
 	for _, path := range pathKeys {
 
 		if folder, ok := existingFolders[path]; ok {
 
 			// Use existing folder
-			folders[path].NodeId = folder.NodeId
-			folders[path].Id = folder.Id
-
-			// Iterate over map and update values that have identified current folder as parent.
-			for _, childFolder := range folders[path].Children {
-				childFolder.ParentId = folder.Id
-				childFolder.ParentNodeId = folder.NodeId
+			if err := useFolder(path, folder); err != nil {
+				return nil, nil, err
 			}
 
-			// Add children of current folder to existing folders
-			children, _ := q.GetPackageChildren(context.Background(), &folder, datasetId, true)
+		} else {
+			// Another upload lambda may be creating the same folder. Serialize on (dataset, parent, name) and look
+			// again: once the lock is granted, a folder the other transaction committed is visible.
+			folder, err := q.lockFolder(context.Background(), datasetId, folders[path].ParentId, folders[path].Name)
 			if err != nil {
 				contextLogger.WithFields(
 					log.Fields{
-						"dataset_id":       datasetId,
-						"folder":           folder.Name,
-						"folder_parent_id": folder.ParentId,
-					}).Error("Error getting children for folder:  ", err)
-				return nil, err
+						"dataset_id": datasetId,
+						"folder":     folders[path].Name,
+					}).Error("Error locking folder:  ", err)
+				return nil, nil, err
 			}
-			for _, k := range children {
-				p := fmt.Sprintf("%s/%s", path, k.Name)
-				existingFolders[p] = k
+			if folder != nil {
+				existingFolders[path] = *folder
+				if err := useFolder(path, *folder); err != nil {
+					return nil, nil, err
+				}
+				continue
 			}
 
-		} else {
 			// Create folder
 			pkgParams := pgdb.PackageParams{
 				Name:         folders[path].Name,
@@ -112,11 +201,12 @@ func (q *UploadPgQueries) GetCreateUploadFolders(datasetId int, ownerId int, fol
 						"dataset_id": datasetId,
 						"folder":     folders[path].Name,
 					}).Error("Error adding folder to package:  ", err)
-				return nil, err
+				return nil, nil, err
 			}
 
 			folders[path].Id = result.Id
 			existingFolders[path] = *result
+			created = append(created, *result)
 
 			for _, childFolder := range folders[path].Children {
 				childFolder.ParentId = result.Id
@@ -125,7 +215,443 @@ func (q *UploadPgQueries) GetCreateUploadFolders(datasetId int, ownerId int, fol
 		}
 	}
 
-	return existingFolders, nil
+	return existingFolders, created, nil
+}
+
+// lockFolder takes a transaction-scoped advisory lock on the (dataset, parent, name) slot of a folder and returns the
+// non-deleted folder occupying the slot, or nil if there is none. The lock is held until the transaction ends, so
+// a concurrent creator of the same folder waits and then finds the folder this transaction created.
+//   - parentId is -1 for the dataset root.
+//   - Must be called on a transaction.
+func (q *UploadPgQueries) lockFolder(ctx context.Context, datasetId int, parentId int64, name string) (*pgdb.Package, error) {
+	_, err := q.db.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext($1));",
+		fmt.Sprintf("folder:%d:%d:%s", datasetId, parentId, name))
+	if err != nil {
+		return nil, err
+	}
+
+	parentFilter := "parent_id IS NULL"
+	args := []interface{}{datasetId, name, packageType.Collection.String(), packageState.Deleting.String(),
+		packageStateVersioned}
+	if parentId >= 0 {
+		args = append(args, parentId)
+		parentFilter = "parent_id = $6"
+	}
+
+	var folder pgdb.Package
+	err = q.db.QueryRowContext(ctx, fmt.Sprintf("SELECT id, name, type, state, node_id, parent_id, dataset_id, "+
+		"owner_id, size, import_id, created_at, updated_at FROM packages "+
+		"WHERE dataset_id = $1 AND name = $2 AND type = $3 AND state NOT IN ($4, $5) AND %s ORDER BY id LIMIT 1;",
+		parentFilter),
+		args...).Scan(
+		&folder.Id,
+		&folder.Name,
+		&folder.PackageType,
+		&folder.PackageState,
+		&folder.NodeId,
+		&folder.ParentId,
+		&folder.DatasetId,
+		&folder.OwnerId,
+		&folder.Size,
+		&folder.ImportId,
+		&folder.CreatedAt,
+		&folder.UpdatedAt,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &folder, nil
+}
+
+// GetConflictingPackages returns the existing, non-deleted packages that occupy the same (dataset, parent, name)
+// slot as the provided package params, keyed by the NodeId of the incoming params.
+//
+// Used by the skip and fail conflict strategies, which pennsieve-go-core's AddPackagesWithConflict does not know
+// about: the caller removes the conflicting params before inserting. A package whose NodeId matches the incoming
+// params is not a conflict — that is the same package being re-delivered (or a merged package gaining members).
+//   - Should be called on the same transaction as the package insert so the check and insert see the same rows.
+func (q *UploadPgQueries) GetConflictingPackages(ctx context.Context, datasetId int, params []pgdb.PackageParams) (map[string]pgdb.Package, error) {
+
+	// Group by parent, so we can issue one query per folder.
+	parentIdMap := map[int64][]pgdb.PackageParams{}
+	for _, p := range params {
+		parentIdMap[p.ParentId] = append(parentIdMap[p.ParentId], p)
+	}
+
+	conflicts := map[string]pgdb.Package{}
+	for parentId, group := range parentIdMap {
+
+		args := []interface{}{datasetId, packageState.Deleting.String(), packageStateVersioned}
+		var placeholders []string
+		nameToNodeIds := map[string][]string{}
+		for _, p := range group {
+			if _, ok := nameToNodeIds[p.Name]; !ok {
+				args = append(args, p.Name)
+				placeholders = append(placeholders, fmt.Sprintf("$%d", len(args)))
+			}
+			nameToNodeIds[p.Name] = append(nameToNodeIds[p.Name], p.NodeId)
+		}
+
+		// Root folder is -1 in params, but NULL in the table.
+		parentFilter := "parent_id IS NULL"
+		if parentId >= 0 {
+			args = append(args, parentId)
+			parentFilter = fmt.Sprintf("parent_id = $%d", len(args))
+		}
+
+		queryStr := fmt.Sprintf("SELECT id, name, type, state, node_id, parent_id FROM packages "+
+			"WHERE dataset_id = $1 AND state NOT IN ($2, $3) AND %s AND name IN (%s);",
+			parentFilter, strings.Join(placeholders, ","))
+
+		rows, err := q.db.QueryContext(ctx, queryStr, args...)
+		if err != nil {
+			return nil, err
+		}
+
+		for rows.Next() {
+			var existing pgdb.Package
+			err = rows.Scan(
+				&existing.Id,
+				&existing.Name,
+				&existing.PackageType,
+				&existing.PackageState,
+				&existing.NodeId,
+				&existing.ParentId,
+			)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+
+			for _, nodeId := range nameToNodeIds[existing.Name] {
+				if nodeId != existing.NodeId {
+					conflicts[nodeId] = existing
+				}
+			}
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	return conflicts, nil
+}
+
+// GetPackagesByNodeIds returns the existing, non-deleted packages of a dataset with the provided node ids, keyed by
+// node id.
+//
+// Used to find the merged package an earlier batch created for files sharing a MergePackageId, so members arriving
+// later are attached to it instead of inserted as a package of their own.
+//   - Must be called on the import transaction. A transaction-scoped advisory lock is taken on every node id before
+//     the lookup, so a concurrent import of the same merge group waits until this one commits and then finds the
+//     package it created, even when no package existed yet to lock.
+func (q *UploadPgQueries) GetPackagesByNodeIds(ctx context.Context, datasetId int, nodeIds []string) (map[string]pgdb.Package, error) {
+	packages := map[string]pgdb.Package{}
+	if len(nodeIds) == 0 {
+		return packages, nil
+	}
+
+	lockArgs := make([]interface{}, len(nodeIds))
+	lockPlaceholders := make([]string, len(nodeIds))
+	for i, nodeId := range nodeIds {
+		lockArgs[i] = fmt.Sprintf("merge:%d:%s", datasetId, nodeId)
+		lockPlaceholders[i] = fmt.Sprintf("$%d", i+1)
+	}
+	_, err := q.db.ExecContext(ctx, fmt.Sprintf(
+		"SELECT pg_advisory_xact_lock(hashtext(k)) FROM unnest(ARRAY[%s]::text[]) AS k ORDER BY k;",
+		strings.Join(lockPlaceholders, ",")), lockArgs...)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []interface{}{datasetId, packageState.Deleting.String(), packageStateVersioned}
+	placeholders := make([]string, len(nodeIds))
+	for i, nodeId := range nodeIds {
+		args = append(args, nodeId)
+		placeholders[i] = fmt.Sprintf("$%d", len(args))
+	}
+
+	rows, err := q.db.QueryContext(ctx, fmt.Sprintf(
+		"SELECT id, name, type, state, node_id, parent_id FROM packages "+
+			"WHERE dataset_id = $1 AND state NOT IN ($2, $3) AND node_id IN (%s) ORDER BY id FOR UPDATE;",
+		strings.Join(placeholders, ",")), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p pgdb.Package
+		if err := rows.Scan(&p.Id, &p.Name, &p.PackageType, &p.PackageState, &p.NodeId, &p.ParentId); err != nil {
+			return nil, err
+		}
+		packages[p.NodeId] = p
+	}
+	return packages, rows.Err()
+}
+
+// AddPackageVersions records every package that replaced a predecessor as the next version in the predecessor's
+// chain, and moves the predecessor from DELETING, where the replace left it, to packageStateVersioned. The bytes of a
+// prior version stay in storage, so the storage the replace released is charged again to the predecessor, its
+// ancestors, the dataset and the organization. Returns the ids of the new packages that have a prior version.
+//   - Packages without a ReplacesPackageId are ignored.
+//   - Re-delivery of the same package is a no-op.
+//   - Should be called on the import transaction so the version row commits together with the replacement.
+func (q *UploadPgQueries) AddPackageVersions(ctx context.Context, userId int, datasetId int64, orgId int64,
+	packages []pgdb.Package) (map[int64]bool, error) {
+
+	versions := map[int64]bool{}
+	for _, p := range packages {
+		if !p.ReplacesPackageId.Valid {
+			continue
+		}
+
+		_, err := q.db.ExecContext(ctx,
+			"INSERT INTO package_versions (package_id, previous_package_id, version, user_id) "+
+				"SELECT $1, $2, COALESCE((SELECT version FROM package_versions WHERE package_id = $2), 1) + 1, $3 "+
+				"ON CONFLICT (package_id) DO NOTHING;",
+			p.Id, p.ReplacesPackageId.Int64, userId)
+		if err != nil {
+			return nil, err
+		}
+
+		// Only the first delivery finds the predecessor in DELETING, so its storage is charged once.
+		var parentId sql.NullInt64
+		var size int64
+		err = q.db.QueryRowContext(ctx,
+			"UPDATE packages SET state = $2 WHERE id = $1 AND state = $3 "+
+				"RETURNING parent_id, (SELECT COALESCE(SUM(size), 0) FROM files WHERE package_id = $1);",
+			p.ReplacesPackageId.Int64, packageStateVersioned, packageState.Deleting.String()).Scan(&parentId, &size)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+		case err != nil:
+			return nil, err
+		default:
+			if err := q.chargePriorVersion(ctx, p.ReplacesPackageId.Int64, parentId, size, datasetId, orgId); err != nil {
+				return nil, err
+			}
+		}
+		versions[p.Id] = true
+	}
+
+	return versions, nil
+}
+
+// chargePriorVersion charges the size of a package kept as a prior version back to storage. The package's own row is
+// set rather than incremented, as the replace may or may not have released it.
+func (q *UploadPgQueries) chargePriorVersion(ctx context.Context, packageId int64, parentId sql.NullInt64, size int64,
+	datasetId int64, orgId int64) error {
+	_, err := q.db.ExecContext(ctx,
+		"INSERT INTO package_storage AS package_storage (package_id, size) VALUES ($1, $2) "+
+			"ON CONFLICT (package_id) DO UPDATE SET size = EXCLUDED.size;",
+		packageId, size)
+	if err != nil {
+		return err
+	}
+	if size == 0 {
+		return nil
+	}
+	if parentId.Valid {
+		if err := q.IncrementPackageStorageAncestors(ctx, parentId.Int64, size); err != nil {
+			return err
+		}
+	}
+	if err := q.IncrementDatasetStorage(ctx, datasetId, size); err != nil {
+		return err
+	}
+	return q.IncrementOrganizationStorage(ctx, orgId, size)
+}
+
+// AddFileChecksums records the checksum S3 stored for each of the provided files, looked up in checksums by file
+// UUID (the uploadId). Files without a checksum are skipped and re-delivery of a file is a no-op.
+//   - Should be called on the import transaction so the checksum commits together with the file row.
+func (q *UploadPgQueries) AddFileChecksums(ctx context.Context, files []pgdb.File, checksums map[string]FileChecksum) error {
+	for _, f := range files {
+		c, ok := checksums[f.UUID.String()]
+		if !ok || c.Value == "" {
+			continue
+		}
+
+		_, err := q.db.ExecContext(ctx,
+			"INSERT INTO file_checksums (file_id, algorithm, checksum_type, checksum) "+
+				"SELECT id, $2, $3, $4 FROM files WHERE uuid = $1 "+
+				"ON CONFLICT (file_id) DO NOTHING;",
+			f.UUID, c.Algorithm, c.Type, c.Value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddServerSHA256s records the SHA256 the finalize endpoint computed for files whose object S3 stored no SHA256
+// checksum for. Finalize only enqueues a file once the computed value matched the one the client declared, so the
+// rows are recorded as verified.
+//   - Should be called on the import transaction so the value commits together with the file row.
+func (q *UploadPgQueries) AddServerSHA256s(ctx context.Context, files []pgdb.File, checksums map[string]FileChecksum) error {
+	for _, f := range files {
+		c, ok := checksums[f.UUID.String()]
+		if !ok || c.ServerSHA256 == "" {
+			continue
+		}
+
+		_, err := q.db.ExecContext(ctx,
+			"INSERT INTO file_server_sha256 (file_id, sha256, declared_sha256, verified, computed_by) "+
+				"SELECT id, $2, $2, TRUE, 'finalize' FROM files WHERE uuid = $1 "+
+				"ON CONFLICT (file_id) DO NOTHING;",
+			f.UUID, c.ServerSHA256)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddFileTypeDetections records the declared and detected type of files whose type was sniffed from their content.
+//   - Should be called on the import transaction so the record commits together with the file row.
+func (q *UploadPgQueries) AddFileTypeDetections(ctx context.Context, files []pgdb.File, detections map[string]fileTypeDetection) error {
+	for _, f := range files {
+		d, ok := detections[f.UUID.String()]
+		if !ok {
+			continue
+		}
+
+		var detected sql.NullString
+		if d.Matched {
+			detected = sql.NullString{String: d.Detected.String(), Valid: true}
+		}
+		_, err := q.db.ExecContext(ctx,
+			"INSERT INTO file_type_detections (file_id, declared_type, detected_type) "+
+				"SELECT id, $2, $3 FROM files WHERE uuid = $1 "+
+				"ON CONFLICT (file_id) DO NOTHING;",
+			f.UUID, d.Declared.String(), detected)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetImportedFiles returns the files rows that already exist for the provided file UUIDs (the uploadIds), keyed by
+// UUID.
+//   - Takes a transaction-scoped advisory lock per UUID first, in one statement and in UUID order, so a concurrent
+//     import of the same file waits for this transaction and then finds its row, and two imports sharing files cannot
+//     deadlock.
+//   - Must be called on the import transaction.
+func (q *UploadPgQueries) GetImportedFiles(ctx context.Context, uuids []uuid.UUID) (map[uuid.UUID]pgdb.File, error) {
+	imported := map[uuid.UUID]pgdb.File{}
+	if len(uuids) == 0 {
+		return imported, nil
+	}
+
+	args := make([]interface{}, len(uuids))
+	placeholders := make([]string, len(uuids))
+	for i, u := range uuids {
+		args[i] = u.String()
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+	}
+	inList := strings.Join(placeholders, ",")
+
+	_, err := q.db.ExecContext(ctx, fmt.Sprintf(
+		"SELECT pg_advisory_xact_lock(hashtext(u)) FROM unnest(ARRAY[%s]::text[]) AS u ORDER BY u;", inList), args...)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := q.db.QueryContext(ctx, fmt.Sprintf(
+		"SELECT id, package_id, name, file_type, s3_bucket, s3_key, size, checksum, uuid FROM files WHERE uuid IN (%s);",
+		inList), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var f pgdb.File
+		var fType string
+		err = rows.Scan(&f.Id, &f.PackageId, &f.Name, &fType, &f.S3Bucket, &f.S3Key, &f.Size, &f.CheckSum, &f.UUID)
+		if err != nil {
+			return nil, err
+		}
+		f.FileType = fileType.Dict[fType]
+		imported[f.UUID] = f
+	}
+	return imported, rows.Err()
+}
+
+// GetPackagesAncestorIds returns, for each of the provided packages, the ids of the package itself and of all the
+// folders above it, in a single recursive query.
+func (q *UploadPgQueries) GetPackagesAncestorIds(ctx context.Context, packageIds []int64) (map[int64][]int64, error) {
+	ancestors := map[int64][]int64{}
+	if len(packageIds) == 0 {
+		return ancestors, nil
+	}
+
+	args := make([]interface{}, len(packageIds))
+	placeholders := make([]string, len(packageIds))
+	for i, id := range packageIds {
+		args[i] = id
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+	}
+
+	rows, err := q.db.QueryContext(ctx, fmt.Sprintf(
+		"WITH RECURSIVE ancestors(package_id, id, parent_id) AS ("+
+			"SELECT packages.id, packages.id, packages.parent_id FROM packages packages WHERE packages.id IN (%s) "+
+			"UNION "+
+			"SELECT ancestors.package_id, parents.id, parents.parent_id FROM packages parents "+
+			"JOIN ancestors ON ancestors.parent_id = parents.id"+
+			") SELECT package_id, id FROM ancestors;",
+		strings.Join(placeholders, ",")), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var packageId, ancestorId int64
+		if err := rows.Scan(&packageId, &ancestorId); err != nil {
+			return nil, err
+		}
+		ancestors[packageId] = append(ancestors[packageId], ancestorId)
+	}
+	return ancestors, rows.Err()
+}
+
+// GetPackagesByIds returns the packages with the provided ids, in any state, keyed by id. Only the id, name,
+// node id and parent id are read.
+func (q *UploadPgQueries) GetPackagesByIds(ctx context.Context, packageIds []int64) (map[int64]pgdb.Package, error) {
+	packages := map[int64]pgdb.Package{}
+	if len(packageIds) == 0 {
+		return packages, nil
+	}
+
+	args := make([]interface{}, len(packageIds))
+	placeholders := make([]string, len(packageIds))
+	for i, id := range packageIds {
+		args[i] = id
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+	}
+
+	rows, err := q.db.QueryContext(ctx, fmt.Sprintf(
+		"SELECT id, name, node_id, parent_id FROM packages WHERE id IN (%s);",
+		strings.Join(placeholders, ",")), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p pgdb.Package
+		if err := rows.Scan(&p.Id, &p.Name, &p.NodeId, &p.ParentId); err != nil {
+			return nil, err
+		}
+		packages[p.Id] = p
+	}
+	return packages, rows.Err()
 }
 
 // UpdateStorage updates storage in packages, dataset and organization for uploaded package
@@ -175,3 +701,107 @@ func (q *UploadPgQueries) UpdateStorage(files []pgdb.FileParams, packages []pgdb
 
 	return nil
 }
+
+// AddOutboxMessages records messages in the outbox and returns their entries. The entries are leased for lease, so
+// the relay leaves them to the caller to deliver first.
+func (q *UploadPgQueries) AddOutboxMessages(ctx context.Context, orgId int, datasetId int, messages []outboxMessage,
+	lease time.Duration) ([]outboxEntry, error) {
+	entries := make([]outboxEntry, 0, len(messages))
+	for _, m := range messages {
+		payload, err := json.Marshal(m.payload)
+		if err != nil {
+			return nil, fmt.Errorf("marshal %s outbox payload: %w", m.kind, err)
+		}
+		e := outboxEntry{outboxMessage: m}
+		err = q.db.QueryRowContext(ctx,
+			"INSERT INTO pennsieve.upload_outbox (organization_id, dataset_id, kind, payload, next_attempt_at) "+
+				"VALUES ($1, $2, $3, $4, CURRENT_TIMESTAMP + $5 * INTERVAL '1 second') RETURNING id, created_at;",
+			orgId, datasetId, m.kind, payload, lease.Seconds()).Scan(&e.id, &e.createdAt)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// ClaimOutboxEntries leases up to limit outbox entries that are due for delivery, oldest retry first. Entries another
+// relay holds and dead entries are skipped.
+func (q *UploadPgQueries) ClaimOutboxEntries(ctx context.Context, limit int, lease time.Duration) ([]outboxEntry, error) {
+	rows, err := q.db.QueryContext(ctx,
+		"UPDATE pennsieve.upload_outbox SET next_attempt_at = CURRENT_TIMESTAMP + $2 * INTERVAL '1 second' "+
+			"WHERE id IN (SELECT id FROM pennsieve.upload_outbox "+
+			"WHERE dead_at IS NULL AND next_attempt_at <= CURRENT_TIMESTAMP "+
+			"ORDER BY next_attempt_at LIMIT $1 FOR UPDATE SKIP LOCKED) "+
+			"RETURNING id, kind, payload, attempts, created_at;",
+		limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []outboxEntry
+	for rows.Next() {
+		var e outboxEntry
+		var payload []byte
+		if err := rows.Scan(&e.id, &e.kind, &payload, &e.attempts, &e.createdAt); err != nil {
+			return nil, err
+		}
+		e.payload = json.RawMessage(payload)
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// RetryOutboxEntry records a failed delivery of an outbox entry and schedules the next one after backoff.
+func (q *UploadPgQueries) RetryOutboxEntry(ctx context.Context, id int64, lastError string, backoff time.Duration) error {
+	_, err := q.db.ExecContext(ctx,
+		"UPDATE pennsieve.upload_outbox SET attempts = attempts + 1, last_error = $2, "+
+			"next_attempt_at = CURRENT_TIMESTAMP + $3 * INTERVAL '1 second' WHERE id = $1;",
+		id, lastError, backoff.Seconds())
+	return err
+}
+
+// KillOutboxEntry records the last failed delivery of an outbox entry and marks it dead, so the relay no longer claims
+// it.
+func (q *UploadPgQueries) KillOutboxEntry(ctx context.Context, id int64, lastError string) error {
+	_, err := q.db.ExecContext(ctx,
+		"UPDATE pennsieve.upload_outbox SET attempts = attempts + 1, last_error = $2, dead_at = CURRENT_TIMESTAMP "+
+			"WHERE id = $1;",
+		id, lastError)
+	return err
+}
+
+// DeleteOutboxEntries removes delivered entries from the outbox.
+func (q *UploadPgQueries) DeleteOutboxEntries(ctx context.Context, ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	args := make([]interface{}, len(ids))
+	placeholders := make([]string, len(ids))
+	for i, id := range ids {
+		args[i] = id
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+	}
+	_, err := q.db.ExecContext(ctx, fmt.Sprintf(
+		"DELETE FROM pennsieve.upload_outbox WHERE id IN (%s);",
+		strings.Join(placeholders, ",")), args...)
+	return err
+}
+
+// GetOutboxBacklog counts the pending entries in the outbox, those that failed at least stuckAttempts times, and the
+// dead ones.
+func (q *UploadPgQueries) GetOutboxBacklog(ctx context.Context, stuckAttempts int) (outboxBacklog, error) {
+	var b outboxBacklog
+	var oldestSeconds float64
+	err := q.db.QueryRowContext(ctx,
+		"SELECT COUNT(*) FILTER (WHERE dead_at IS NULL), "+
+			"COUNT(*) FILTER (WHERE dead_at IS NULL AND attempts >= $1), "+
+			"COUNT(*) FILTER (WHERE dead_at IS NOT NULL), "+
+			"COALESCE(EXTRACT(EPOCH FROM CURRENT_TIMESTAMP - MIN(created_at) FILTER (WHERE dead_at IS NULL)), 0) "+
+			"FROM pennsieve.upload_outbox;",
+		stuckAttempts).Scan(&b.pending, &b.stuck, &b.dead, &oldestSeconds)
+	b.oldest = time.Duration(oldestSeconds * float64(time.Second))
+	return b, err
+}
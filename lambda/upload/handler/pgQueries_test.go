@@ -33,11 +33,11 @@ func TestPgQueries(t *testing.T) {
 			}
 
 			mSNS := test.MockSNS{}
-			mS3 := test.MockS3{}
+			mStorage := test.MockStorage{}
 			mPusher := test.NewMockPusherClient()
 			mChangelogger := &test.MockChangelogger{}
 
-			store := NewUploadHandlerStore(pgdbClient, client, mSNS, mS3, ManifestFileTableName, ManifestTableName, SNSTopic, "", mPusher, mChangelogger, nil, "")
+			store := NewUploadHandlerStore(pgdbClient, client, mSNS, mStorage, ManifestFileTableName, ManifestTableName, SNSTopic, "", NewPusherNotifier(mPusher), mChangelogger, nil, "")
 
 			fn(t, store)
 		})
@@ -2,18 +2,18 @@ package handler
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"github.com/aws/aws-lambda-go/events"
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
-	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/pennsieve/pennsieve-go-core/pkg/models/manifest/manifestFile"
+	"github.com/pennsieve/pennsieve-go-core/pkg/models/uploadFile"
+	"github.com/pennsieve/pennsieve-upload-service-v2/storage"
 	log "github.com/sirupsen/logrus"
 	"regexp"
 	"strings"
 )
 
-// GetUploadEntries parses the events from SQS into meaningful objects
+// GetUploadEntries parses the events from SQS into meaningful objects. Heartbeats and messages parseQueueMessage
+// rejects are skipped; the Handler acknowledges or returns those on its own.
 func (s *UploadHandlerStore) GetUploadEntries(fileEvents []events.SQSMessage) ([]UploadEntry, []OrphanS3File, error) {
 
 	var entries []UploadEntry
@@ -22,13 +22,12 @@ func (s *UploadHandlerStore) GetUploadEntries(fileEvents []events.SQSMessage) ([
 	var uploadIdMap = map[string]struct{}{}
 
 	for _, message := range fileEvents {
-		parsedS3Event := events.S3Event{}
-		if err := json.Unmarshal([]byte(message.Body), &parsedS3Event); err != nil {
-			log.Error("unexpected error, could not parse event send by S3")
-			return nil, nil, fmt.Errorf("failed to unmarshal message, %v", err)
+		msg, err := parseQueueMessage(message)
+		if err != nil || msg == nil {
+			continue
 		}
 
-		entry, err := s.uploadEntryFromS3Event(&parsedS3Event)
+		entry, err := s.uploadEntryFromMessage(msg)
 		if err != nil {
 			switch err.(type) {
 			case *S3FileNotExistError:
@@ -43,11 +42,16 @@ func (s *UploadHandlerStore) GetUploadEntries(fileEvents []events.SQSMessage) ([
 
 				// Ignore sqs event as the file does not exist (for some reason)
 				continue
+			case *ChecksumMismatchError:
+				// The object is not what the client uploaded; importing it would record the wrong content.
+				parsedErr := err.(*ChecksumMismatchError)
+				s.failMismatchedFile(parsedErr)
+				continue
 			case *S3FileMalFormedError:
 				orphanFile := OrphanS3File{
-					S3Bucket: parsedS3Event.Records[0].S3.Bucket.Name,
-					S3Key:    parsedS3Event.Records[0].S3.Object.Key,
-					ETag:     parsedS3Event.Records[0].S3.Object.ETag,
+					S3Bucket: msg.bucket,
+					S3Key:    msg.key,
+					ETag:     msg.etag,
 				}
 
 				orphanFiles = append(orphanFiles, orphanFile)
@@ -72,7 +76,7 @@ func (s *UploadHandlerStore) GetUploadEntries(fileEvents []events.SQSMessage) ([
 	return entries, orphanFiles, nil
 }
 
-// uploadEntryFromS3Event returns an object representing an uploaded file from an S3 Event.
+// uploadEntryFromMessage returns an object representing an uploaded file from an upload trigger queue message.
 //
 // Accepts two key shapes:
 //   - Legacy (upload bucket): {manifestId}/{uploadId}
@@ -81,18 +85,21 @@ func (s *UploadHandlerStore) GetUploadEntries(fileEvents []events.SQSMessage) ([
 // Only the trailing manifest/upload pair is extracted — the leading O/D segments
 // carry the same org+dataset already stored on the manifest record, so they're
 // informational here.
-func (s *UploadHandlerStore) uploadEntryFromS3Event(event *events.S3Event) (*UploadEntry, error) {
+//
+// The object is read for its checksum unless a finalize message already carries it. The SHA256 the client declared
+// in a finalize message is checked against the object's full-object SHA256, when the object has one.
+func (s *UploadHandlerStore) uploadEntryFromMessage(msg *queueMessage) (*UploadEntry, error) {
 	// No end anchor: legacy cross-account clients (data-target-pennsieve) may
 	// use nested keys like {manifestId}/{uploadId}/subpath/file, which the
 	// upload-credentials session policy permits. FindStringSubmatch returns
 	// the first match, so we still extract manifest/upload reliably.
 	r := regexp.MustCompile(`(?P<Manifest>[a-z0-9]{8}-[a-z0-9]{4}-[a-z0-9]{4}-[a-z0-9]{4}-[a-z0-9]{12})\/(?P<UploadId>[a-z0-9]{8}-[a-z0-9]{4}-[a-z0-9]{4}-[a-z0-9]{4}-[a-z0-9]{12})`)
-	res := r.FindStringSubmatch(event.Records[0].S3.Object.Key)
+	res := r.FindStringSubmatch(msg.key)
 
 	if res == nil {
 		return nil, &S3FileMalFormedError{
-			S3Bucket: event.Records[0].S3.Bucket.Name,
-			S3Key:    event.Records[0].S3.Object.Key,
+			S3Bucket: msg.bucket,
+			S3Key:    msg.key,
 		}
 	}
 
@@ -100,23 +107,41 @@ func (s *UploadHandlerStore) uploadEntryFromS3Event(event *events.S3Event) (*Upl
 	manifestId := res[r.SubexpIndex("Manifest")]
 	uploadId := res[r.SubexpIndex("UploadId")]
 
-	s3Bucket := event.Records[0].S3.Bucket.Name
-	s3Key := event.Records[0].S3.Object.Key
+	s3Bucket := msg.bucket
+	s3Key := msg.key
+
+	var checksum storage.ObjectChecksum
+	if msg.finalize != nil && msg.finalize.Checksum != nil {
+		checksum = storage.ObjectChecksum{
+			Algorithm: msg.finalize.Checksum.Algorithm,
+			Type:      msg.finalize.Checksum.Type,
+			Value:     msg.finalize.Checksum.Value,
+		}
+	} else {
+		// Confirm the object exists and read the checksum S3 stored for it.
+		info, err := s.Storage.Stat(context.Background(), s3Bucket, s3Key)
+		if err != nil {
 
-	// Get File Size
-	headObj := s3.HeadObjectInput{
-		Bucket:       aws.String(s3Bucket),
-		Key:          aws.String(s3Key),
-		ChecksumMode: s3Types.ChecksumModeEnabled,
+			return nil, &S3FileNotExistError{
+				S3Bucket:   s3Bucket,
+				S3Key:      s3Key,
+				ManifestId: manifestId,
+				UploadId:   uploadId,
+			}
+		}
+		checksum = info.Checksum
 	}
-	result, err := s.S3Client.HeadObject(context.Background(), &headObj)
-	if err != nil {
-
-		return nil, &S3FileNotExistError{
-			S3Bucket:   s3Bucket,
-			S3Key:      s3Key,
-			ManifestId: manifestId,
-			UploadId:   uploadId,
+
+	fileChecksum := FileChecksum{Algorithm: checksum.Algorithm, Type: checksum.Type, Value: checksum.Value}
+	if msg.finalize != nil && msg.finalize.ClientSHA256 != "" {
+		fileChecksum.ClientSHA256 = msg.finalize.ClientSHA256
+		if stored := fullObjectSHA256(checksum, msg.serverSHA256); stored != "" && stored != msg.finalize.ClientSHA256 {
+			return nil, &ChecksumMismatchError{
+				ManifestId: manifestId,
+				UploadId:   uploadId,
+				Declared:   msg.finalize.ClientSHA256,
+				Stored:     stored,
+			}
 		}
 	}
 
@@ -129,24 +154,61 @@ func (s *UploadHandlerStore) uploadEntryFromS3Event(event *events.S3Event) (*Upl
 		S3Key:           s3Key,
 		ManifestId:      manifestId,
 		UploadId:        uploadId,
-		ETag:            event.Records[0].S3.Object.ETag,
-		Size:            event.Records[0].S3.Object.Size,
-		Sha256:          checkSumOrEmpty(result.ChecksumSHA256),
+		ETag:            msg.etag,
+		Size:            msg.size,
+		Sha256:          sha256OrEmpty(checksum),
+		Checksum:        fileChecksum,
 		DirectToStorage: directToStorage,
 	}
 
-	log.WithFields(
+	contextLogger := log.WithFields(
 		log.Fields{
 			"manifest_id": response.ManifestId,
 			"upload_id":   response.UploadId,
 		},
-	).Debugf("UploadEntry created in %s / %s", response.S3Bucket, response.S3Key)
+	)
+	if msg.finalize != nil {
+		contextLogger = contextLogger.WithFields(log.Fields{
+			"source":              msg.finalize.Source,
+			"finalize_request_id": msg.finalize.FinalizeRequestID,
+			"finalize_job_id":     msg.finalize.FinalizeJobID,
+		})
+	}
+	contextLogger.Debugf("UploadEntry created in %s / %s", response.S3Bucket, response.S3Key)
 	return &response, nil
 }
 
-func checkSumOrEmpty(checkSum *string) string {
-	if checkSum != nil {
-		return *checkSum
+// fullObjectSHA256 returns the full-object SHA256 of an object: the one storage holds, or else the one the sender
+// computed. Empty when neither is known.
+func fullObjectSHA256(c storage.ObjectChecksum, serverSHA256 string) string {
+	if c.Algorithm == "SHA256" && c.Type != "COMPOSITE" {
+		return c.Value
+	}
+	return serverSHA256
+}
+
+// sha256OrEmpty returns the full-object SHA256 storage holds for an object. Empty for other algorithms and for the
+// composite SHA256 of a multipart upload, which is not the SHA256 of the file.
+func sha256OrEmpty(c storage.ObjectChecksum) string {
+	if c.Algorithm == "SHA256" && c.Type != "COMPOSITE" {
+		return c.Value
 	}
 	return ""
 }
+
+// failMismatchedFile sets the manifest file of an object whose SHA256 differs from the one the client declared to
+// Failed, so the client sees why it was not imported.
+func (s *UploadHandlerStore) failMismatchedFile(mismatch *ChecksumMismatchError) {
+	contextLogger := log.WithFields(log.Fields{
+		"manifest_id": mismatch.ManifestId,
+		"upload_id":   mismatch.UploadId,
+	})
+	contextLogger.Error(mismatch.Error())
+
+	files := []uploadFile.UploadFile{{ManifestId: mismatch.ManifestId, UploadId: mismatch.UploadId}}
+	reasons := map[string]string{mismatch.UploadId: "sha256 mismatch: the stored object differs from the declared checksum"}
+	if err := s.dy.updateManifestFileConflictStatus(context.Background(), mismatch.ManifestId, files,
+		manifestFile.Failed.String(), reasons); err != nil {
+		contextLogger.WithError(err).Error("Unable to fail manifest file.")
+	}
+}
@@ -9,7 +9,7 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
-// TestKeyRegex confirms the regex used in uploadEntryFromS3Event accepts both
+// TestKeyRegex confirms the regex used in uploadEntryFromMessage accepts both
 // the legacy upload-bucket key shape, the direct-to-storage shape, and nested
 // sub-paths permitted by the upload-credentials session policy. Kept in sync
 // with the literal in handler/s3.go by copy; integration tests (s3_test.go)
@@ -1,13 +1,21 @@
 package handler
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"github.com/aws/aws-lambda-go/events"
+	"github.com/google/uuid"
+	"github.com/pennsieve/pennsieve-go-core/pkg/models/manifest/manifestFile"
 	"github.com/pennsieve/pennsieve-go-core/pkg/queries/pgdb"
+	"github.com/pennsieve/pennsieve-upload-service-v2/storage/finalize"
 	"github.com/pennsieve/pennsieve-upload-service-v2/upload/test"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -19,6 +27,11 @@ func TestS3(t *testing.T) {
 		"test correctly formed SQS message and S3Key":   testCorrectSQSMessage,
 		"test incorrectly formed SQS message and S3Key": testInCorrectSQSMessage,
 		"test duplicate keys in SQS events":             testDuplicateKey,
+		"test finalize message":                         testFinalizeMessage,
+		"test notification fixtures":                    testNotificationFixtures,
+		"test finalize message checksum mismatch":       testFinalizeMessageChecksumMismatch,
+		"test finalize message composite checksum":      testFinalizeMessageCompositeChecksum,
+		"test unrecognized messages":                    testUnrecognizedMessages,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			client := getDynamoDBClient()
@@ -29,11 +42,11 @@ func TestS3(t *testing.T) {
 			}
 
 			mSNS := test.MockSNS{}
-			mS3 := test.MockS3{}
+			mStorage := test.MockStorage{}
 			mPusher := test.NewMockPusherClient()
 			mChangelogger := &test.MockChangelogger{}
 
-			store := NewUploadHandlerStore(pgdbClient, client, mSNS, mS3, ManifestFileTableName, ManifestTableName, SNSTopic, "", mPusher, mChangelogger, nil, "")
+			store := NewUploadHandlerStore(pgdbClient, client, mSNS, mStorage, ManifestFileTableName, ManifestTableName, SNSTopic, "", NewPusherNotifier(mPusher), mChangelogger, nil, "")
 
 			fn(t, store)
 		})
@@ -143,3 +156,175 @@ func testInCorrectSQSMessage(t *testing.T, store *UploadHandlerStore) {
 	assert.Equal(t, orphanEntries[0].S3Key, fmt.Sprintf("%s/%s", manifestId, uploadId))
 
 }
+
+func testFinalizeMessage(t *testing.T, store *UploadHandlerStore) {
+	manifestId := "00000000-0000-0000-0000-000000000000"
+	uploadId := "00000000-1111-1111-1111-000000000000"
+
+	message := finalize.Message{
+		Type:       finalize.MessageType,
+		Version:    finalize.MessageVersion,
+		Bucket:     "storageBucket",
+		Key:        fmt.Sprintf("O1/D1/%s/%s", manifestId, uploadId),
+		ManifestID: manifestId,
+		UploadID:   uploadId,
+		Size:       42,
+		ETag:       "etag",
+		Checksum:   &finalize.Checksum{Algorithm: "SHA256", Type: "FULL_OBJECT", Value: "declaredSHA"},
+		OnConflict: onConflictReplace,
+		Source:     finalize.SourceFinalize,
+	}
+	body, _ := json.Marshal(message)
+	newer := message
+	newer.Version = finalize.MessageVersion + 1
+	newerBody, _ := json.Marshal(newer)
+
+	parsed, err := parseQueueMessage(events.SQSMessage{Body: string(body)})
+	if assert.NoError(t, err) && assert.NotNil(t, parsed) {
+		assert.Equal(t, onConflictReplace, parsed.onConflict)
+		assert.Equal(t, message.Key, parsed.key)
+	}
+	_, err = parseQueueMessage(events.SQSMessage{Body: string(newerBody)})
+	assert.Error(t, err, "a newer version must not be dropped as a heartbeat")
+
+	entries, orphanEntries, err := store.GetUploadEntries([]events.SQSMessage{{Body: string(body)}, {Body: string(newerBody)}})
+	assert.NoError(t, err)
+	assert.Nil(t, orphanEntries)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, uploadId, entries[0].UploadId)
+		assert.Equal(t, int64(42), entries[0].Size)
+		assert.True(t, entries[0].DirectToStorage)
+		// Taken from the message: the storage mock would report fakeSHA.
+		assert.Equal(t, "declaredSHA", entries[0].Sha256)
+	}
+}
+
+// testFinalizeMessageCompositeChecksum checks that the composite SHA256 of a multipart upload is kept as the
+// file's checksum but not taken for its SHA256.
+func testFinalizeMessageCompositeChecksum(t *testing.T, store *UploadHandlerStore) {
+	manifestId := "00000000-0000-0000-0000-000000000000"
+	uploadId := "00000000-1111-1111-1111-000000000000"
+
+	message := finalize.Message{
+		Type:       finalize.MessageType,
+		Version:    finalize.MessageVersion,
+		Bucket:     "storageBucket",
+		Key:        fmt.Sprintf("O1/D1/%s/%s", manifestId, uploadId),
+		ManifestID: manifestId,
+		UploadID:   uploadId,
+		Size:       42,
+		ETag:       "etag",
+		Checksum:   &finalize.Checksum{Algorithm: "SHA256", Type: "COMPOSITE", Value: "compositeSHA-3"},
+		Source:     finalize.SourceFinalize,
+	}
+	body, _ := json.Marshal(message)
+
+	entries, orphanEntries, err := store.GetUploadEntries([]events.SQSMessage{{Body: string(body)}})
+	assert.NoError(t, err)
+	assert.Nil(t, orphanEntries)
+	if assert.Len(t, entries, 1) {
+		assert.Empty(t, entries[0].Sha256)
+		assert.Equal(t, "COMPOSITE", entries[0].Checksum.Type)
+		assert.Equal(t, "compositeSHA-3", entries[0].Checksum.Value)
+	}
+}
+
+// testFinalizeMessageChecksumMismatch checks that a file whose stored SHA256 differs from the one its client
+// declared is failed instead of imported.
+func testFinalizeMessageChecksumMismatch(t *testing.T, store *UploadHandlerStore) {
+	ctx := context.Background()
+	manifestId := uuid.NewString()
+	require.NoError(t, populateManifest(store, manifestId, 1))
+	files, _, err := store.dy.GetFilesPaginated(ctx, ManifestFileTableName, manifestId, sql.NullString{Valid: false}, 100, nil)
+	require.NoError(t, err)
+	require.NotEmpty(t, files)
+	uploadId := files[0].UploadId
+
+	message := finalize.Message{
+		Type:         finalize.MessageType,
+		Version:      finalize.MessageVersion,
+		Bucket:       "storageBucket",
+		Key:          fmt.Sprintf("O1/D1/%s/%s", manifestId, uploadId),
+		ManifestID:   manifestId,
+		UploadID:     uploadId,
+		Size:         42,
+		Checksum:     &finalize.Checksum{Algorithm: "SHA256", Type: "FULL_OBJECT", Value: "storedSHA"},
+		ClientSHA256: "declaredSHA",
+		Source:       finalize.SourceReconcile,
+	}
+	body, _ := json.Marshal(message)
+	matching := message
+	matching.ClientSHA256 = "storedSHA"
+	matchingBody, _ := json.Marshal(matching)
+
+	entries, orphanEntries, err := store.GetUploadEntries([]events.SQSMessage{{Body: string(body)}})
+	assert.NoError(t, err)
+	assert.Nil(t, orphanEntries)
+	assert.Empty(t, entries)
+
+	counts, err := store.dy.countManifestFileStatuses(ctx, manifestId, []string{manifestFile.Failed.String()})
+	require.NoError(t, err)
+	assert.Equal(t, 1, counts[manifestFile.Failed.String()])
+
+	entries, _, err = store.GetUploadEntries([]events.SQSMessage{{Body: string(matchingBody)}})
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+// testUnrecognizedMessages checks that heartbeats are dropped and bodies the lambda does not know are not.
+func testUnrecognizedMessages(t *testing.T, _ *UploadHandlerStore) {
+	for _, body := range []string{
+		`{"heartbeat":true}`,
+		`{"Service":"Amazon S3","Event":"s3:TestEvent","Bucket":"storageBucket"}`,
+	} {
+		parsed, err := parseQueueMessage(events.SQSMessage{Body: body})
+		assert.NoError(t, err, body)
+		assert.Nil(t, parsed, body)
+	}
+	for _, body := range []string{
+		`not json`,
+		`{}`,
+		`{"type":"pennsieve.upload.other","version":1}`,
+		`{"Records":[]}`,
+	} {
+		_, err := parseQueueMessage(events.SQSMessage{Body: body})
+		assert.Error(t, err, body)
+	}
+}
+
+// testNotificationFixtures checks that an S3 notification and an EventBridge
+// "Object Created" event for the same object yield the same UploadEntry.
+func testNotificationFixtures(t *testing.T, store *UploadHandlerStore) {
+	for _, fixture := range []string{"s3_object_created.json", "eventbridge_object_created.json"} {
+		body, err := os.ReadFile(filepath.Join("testdata", fixture))
+		if !assert.NoError(t, err) {
+			continue
+		}
+		message := events.SQSMessage{MessageId: fixture, Body: string(body)}
+
+		parsed, err := parseQueueMessage(message)
+		if assert.NoError(t, err, fixture) && assert.NotNil(t, parsed, fixture) {
+			assert.Equal(t, "storageBucket", parsed.bucket, fixture)
+			assert.Equal(t, int64(42), parsed.size, fixture)
+			assert.Equal(t, "d41d8cd98f00b204e9800998ecf8427e-1", parsed.etag, fixture)
+			assert.Equal(t, onConflictKeepBoth, parsed.onConflict, fixture)
+			assert.Nil(t, parsed.finalize, fixture)
+		}
+
+		entries, orphanEntries, err := store.GetUploadEntries([]events.SQSMessage{message})
+		assert.NoError(t, err, fixture)
+		assert.Nil(t, orphanEntries, fixture)
+		if assert.Len(t, entries, 1, fixture) {
+			assert.Equal(t, "00000000-0000-0000-0000-000000000000", entries[0].ManifestId, fixture)
+			assert.Equal(t, "00000000-1111-1111-1111-000000000000", entries[0].UploadId, fixture)
+			assert.Equal(t, int64(42), entries[0].Size, fixture)
+			assert.True(t, entries[0].DirectToStorage, fixture)
+		}
+	}
+
+	// Other S3 events routed to the queue announce no object to import.
+	deleted := `{"source":"aws.s3","detail-type":"Object Deleted","detail":{"bucket":{"name":"storageBucket"},"object":{"key":"k"}}}`
+	parsed, err := parseQueueMessage(events.SQSMessage{Body: deleted})
+	assert.NoError(t, err)
+	assert.Nil(t, parsed)
+}
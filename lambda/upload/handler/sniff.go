@@ -0,0 +1,168 @@
+package handler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"sync"
+
+	"github.com/pennsieve/pennsieve-go-core/pkg/models/fileInfo/fileType"
+	"github.com/pennsieve/pennsieve-go-core/pkg/models/packageInfo/packageType"
+	"github.com/pennsieve/pennsieve-go-core/pkg/models/uploadFile"
+	log "github.com/sirupsen/logrus"
+)
+
+// sniffBytes is how much of an object is read to detect its type. Every signature below sits well inside it.
+const sniffBytes = 4096
+
+// fileSignature is a magic number at a fixed offset that identifies a file type.
+type fileSignature struct {
+	fileType fileType.Type
+	offsets  []int
+	magic    []byte
+}
+
+var fileSignatures = []fileSignature{
+	// DICOM Part 10 files have a 128-byte preamble followed by "DICM".
+	{fileType: fileType.DICOM, offsets: []int{128}, magic: []byte("DICM")},
+	// NIfTI-1 stores its magic at the end of the 348-byte header: "n+1" for single files, "ni1" for .hdr/.img pairs.
+	{fileType: fileType.NIFTI, offsets: []int{344}, magic: []byte("n+1\x00")},
+	{fileType: fileType.NIFTI, offsets: []int{344}, magic: []byte("ni1\x00")},
+	// NIfTI-2 moved the magic to just after the header size.
+	{fileType: fileType.NIFTI, offsets: []int{4}, magic: []byte("n+2\x00\r\n\x1a\n")},
+	{fileType: fileType.NIFTI, offsets: []int{4}, magic: []byte("ni2\x00\r\n\x1a\n")},
+	// HDF5 places its superblock at 0, or at the next power of two past a user block.
+	{fileType: fileType.HDF5, offsets: []int{0, 512, 1024, 2048}, magic: []byte("\x89HDF\r\n\x1a\n")},
+}
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// fileTypeDetection records what sniffing found for a file whose declared type was not recognised.
+//   - Matched is false when no signature matched and the file keeps its declared type.
+type fileTypeDetection struct {
+	Declared fileType.Type
+	Detected fileType.Type
+	Matched  bool
+}
+
+// sniffFileType matches the leading bytes of an object against the known signatures. Gzip streams are inflated
+// first, so a compressed NIfTI volume is recognised as well.
+func sniffFileType(header []byte) (fileType.Type, bool) {
+	for _, sig := range fileSignatures {
+		for _, off := range sig.offsets {
+			if len(header) >= off+len(sig.magic) && bytes.Equal(header[off:off+len(sig.magic)], sig.magic) {
+				return sig.fileType, true
+			}
+		}
+	}
+
+	if bytes.HasPrefix(header, gzipMagic) {
+		zr, err := gzip.NewReader(bytes.NewReader(header))
+		if err != nil {
+			return fileType.GenericData, false
+		}
+		// The header is a truncated stream, so the read ends in an error; whatever inflated before it is enough.
+		inflated, _ := io.ReadAll(io.LimitReader(zr, sniffBytes))
+		if len(inflated) > 0 && !bytes.HasPrefix(inflated, gzipMagic) {
+			return sniffFileType(inflated)
+		}
+	}
+	return fileType.GenericData, false
+}
+
+// needsSniffing returns true when the declared type of a file did not map to a specific package type, which is what
+// getFileInfo falls back to for unknown extensions.
+func needsSniffing(f uploadFile.UploadFile) bool {
+	if f.FileType == fileType.GenericData {
+		return true
+	}
+	_, exists := packageType.FileTypeToInfoDict[f.FileType]
+	return !exists
+}
+
+// sniffConcurrency bounds the objects detectFileTypes reads at once.
+const sniffConcurrency = 16
+
+// detectFileTypes reads the start of every file with an unrecognised declared type, sniffConcurrency at a time, and
+// matches it against the known signatures. It returns the outcome per uploadId; applyFileTypeDetections updates the
+// files. The handler detects the types of a batch once, before it is imported, so retried sub-batches of a failing
+// import do not read the objects again.
+//   - Failing to read an object is not fatal; the file is imported as declared.
+func (s *UploadHandlerStore) detectFileTypes(ctx context.Context, files []uploadFile.UploadFile) map[string]fileTypeDetection {
+	detections := map[string]fileTypeDetection{}
+	if s.Storage == nil {
+		return detections
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, sniffConcurrency)
+	for _, f := range files {
+		if !needsSniffing(f) {
+			continue
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(f uploadFile.UploadFile) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			header, err := s.readHeader(ctx, f.S3Bucket, f.S3Key)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"manifest_id": f.ManifestId,
+					"upload_id":   f.UploadId,
+					"s3_key":      f.S3Key,
+				}).Warn("Unable to read object header for file type detection: ", err)
+				return
+			}
+			if len(header) == 0 {
+				// Empty objects have nothing to match.
+				return
+			}
+
+			d := fileTypeDetection{Declared: f.FileType}
+			d.Detected, d.Matched = sniffFileType(header)
+			mu.Lock()
+			detections[f.UploadId] = d
+			mu.Unlock()
+		}(f)
+	}
+	wg.Wait()
+	return detections
+}
+
+// applyFileTypeDetections sets the type, package type and icon of every file whose type detections matched.
+func applyFileTypeDetections(files []uploadFile.UploadFile, detections map[string]fileTypeDetection,
+	contextLogger *log.Entry) {
+	for i, f := range files {
+		d, ok := detections[f.UploadId]
+		if !ok || !d.Matched || f.FileType == d.Detected {
+			continue
+		}
+
+		pInfo := packageType.FileTypeToInfoDict[d.Detected]
+		files[i].FileType = d.Detected
+		files[i].Type = pInfo.PackageType
+		files[i].SubType = pInfo.PackageSubType
+		files[i].Icon = pInfo.Icon
+
+		contextLogger.WithFields(log.Fields{
+			"upload_id":     f.UploadId,
+			"declared_type": d.Declared.String(),
+			"detected_type": d.Detected.String(),
+		}).Info("Detected file type from content")
+	}
+}
+
+// readHeader returns up to sniffBytes from the start of an object.
+func (s *UploadHandlerStore) readHeader(ctx context.Context, bucket string, key string) ([]byte, error) {
+	r, err := s.Storage.OpenRange(ctx, bucket, key, 0, sniffBytes)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(io.LimitReader(r, sniffBytes))
+}
@@ -14,28 +14,27 @@ import (
 func (s *UploadHandlerStore) PublishToSNS(files []pgdb.File) error {
 
 	const batchSize = 10
-	var snsEntries []types.PublishBatchRequestEntry
-	for _, f := range files {
-		e := types.PublishBatchRequestEntry{
-			Id:      aws.String(f.UUID.String()),
-			Message: aws.String(fmt.Sprintf("%d", f.PackageId)),
-		}
-		snsEntries = append(snsEntries, e)
-
+	entries := importedFileEntries(files)
+	for start := 0; start < len(entries); start += batchSize {
 		// Send SNS messages in blocks of batchSize
-		if len(snsEntries) == batchSize {
-			err := s.sendSNSMessages(snsEntries)
-			if err != nil {
-				return err
-			}
-			snsEntries = nil
+		err := s.sendSNSMessages(entries[start:min(start+batchSize, len(entries))])
+		if err != nil {
+			return err
 		}
 	}
+	return nil
+}
 
-	// send remaining entries
-	err := s.sendSNSMessages(snsEntries)
-
-	return err
+// importedFileEntries returns the message for each imported file: the id of its package, keyed by the file UUID.
+func importedFileEntries(files []pgdb.File) []types.PublishBatchRequestEntry {
+	entries := make([]types.PublishBatchRequestEntry, 0, len(files))
+	for _, f := range files {
+		entries = append(entries, types.PublishBatchRequestEntry{
+			Id:      aws.String(f.UUID.String()),
+			Message: aws.String(fmt.Sprintf("%d", f.PackageId)),
+		})
+	}
+	return entries
 }
 
 // sendSNSMessages actually sends messages to topic -- Internally used by PublishToSNS
@@ -3,14 +3,11 @@ package handler
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
+	"database/sql/driver"
 	"errors"
 	"fmt"
 	"github.com/aws/aws-lambda-go/events"
-	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
-	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/aws/aws-sdk-go-v2/service/sqs"
 	"github.com/google/uuid"
 	"github.com/pennsieve/pennsieve-go-core/pkg/changelog"
@@ -26,18 +23,17 @@ import (
 	ps "github.com/pennsieve/pennsieve-go-core/pkg/models/pusher"
 	"github.com/pennsieve/pennsieve-go-core/pkg/models/uploadFile"
 	"github.com/pennsieve/pennsieve-go-core/pkg/models/uploadFolder"
+	"github.com/pennsieve/pennsieve-upload-service-v2/storage"
+	"github.com/pennsieve/pennsieve-upload-service-v2/storage/importplan"
 	log "github.com/sirupsen/logrus"
-	"regexp"
+	"io"
+	"net"
+	"slices"
 	"strings"
+	"syscall"
 	"time"
 )
 
-// seenFileUUIDs allows this Lambda to avoid trying to create the same file in Postgres more than once.
-// Can happen if AWS sends out the same S3 create object event more than once.
-// This could be a local variable to ImportFiles(). Just here in case the Lambda gets used more than once
-// we get a little more de-duplication.
-var seenFileUUIDs = map[uuid.UUID]int{}
-
 // UploadHandlerStore provides the Queries interface and a db instance.
 type UploadHandlerStore struct {
 	pg                 *UploadPgQueries
@@ -45,8 +41,8 @@ type UploadHandlerStore struct {
 	pgdb               *sql.DB
 	dynamodb           *dynamodb.Client
 	SNSClient          domain.SnsAPI
-	S3Client           domain.S3API
-	pusherClient       domain.PusherAPI
+	Storage            storage.StorageBackend
+	notifier           Notifier
 	changelogClient    Changelogger
 	sqsClient          *sqs.Client
 	jobsQueueURL       string
@@ -56,9 +52,54 @@ type UploadHandlerStore struct {
 	tableName          string
 }
 
+// uploadFolders are the folders of an import: every folder the files are in, keyed by path, and those the import
+// created.
+type uploadFolders struct {
+	packages pgdb.PackageMap
+	created  []pgdb.Package
+}
+
 type PackagesAndFiles struct {
-	packages []pgdb.Package
-	files    []pgdb.File
+	packages  []pgdb.Package
+	files     []pgdb.File
+	conflicts map[string]pgdb.Package
+
+	// predecessors maps the id of each package an imported package replaced to its row.
+	predecessors map[int64]pgdb.Package
+
+	// existing are files whose row an earlier delivery of the same S3 event already committed, and moved those of
+	// them the Fargate task has since moved to the storage bucket.
+	existing []pgdb.File
+	moved    []uploadFile.UploadFile
+
+	// versions holds the ids of the packages imported with onConflict=version that have a prior version.
+	versions map[int64]bool
+
+	// storage is what the import added to package, dataset and organization storage.
+	storage *storageUpdateParams
+
+	// outbox are the messages the import recorded for delivery once it commits.
+	outbox []outboxEntry
+}
+
+// ImportResult reports the files of an ImportFiles batch that were deliberately not imported because their package
+// name collides with an existing package and the batch used the skip or fail conflict strategy. Every other file in
+// the batch was imported.
+type ImportResult struct {
+	Skipped []uploadFile.UploadFile
+	Failed  []uploadFile.UploadFile
+
+	// Moved are redelivered files that were imported and moved to the storage bucket before; they are finalized.
+	Moved []uploadFile.UploadFile
+
+	// Reasons maps uploadId to a human-readable explanation for every skipped or failed file.
+	Reasons map[string]string
+}
+
+// notImported returns true if the file with the provided uploadId was skipped or failed in this import.
+func (r *ImportResult) notImported(uploadId string) bool {
+	_, ok := r.Reasons[uploadId]
+	return ok
 }
 
 type storageUpdateParams struct {
@@ -68,18 +109,18 @@ type storageUpdateParams struct {
 
 // NewUploadHandlerStore returns a UploadHandlerStore object which implements the Queries
 func NewUploadHandlerStore(db *sql.DB, dy *dynamodb.Client, sns domain.SnsAPI,
-	s3 domain.S3API, fileTableName string, tableName string, snsTopic string,
+	backend storage.StorageBackend, fileTableName string, tableName string, snsTopic string,
 	fileFinalizedTopic string,
-	pc domain.PusherAPI, changelogger Changelogger,
+	notifier Notifier, changelogger Changelogger,
 	sqsClient *sqs.Client, jobsQueueURL string) *UploadHandlerStore {
 	return &UploadHandlerStore{
 		pgdb:               db,
 		dynamodb:           dy,
-		pusherClient:       pc,
+		notifier:           notifier,
 		SNSClient:          sns,
 		SNSTopic:           snsTopic,
 		FileFinalizedTopic: fileFinalizedTopic,
-		S3Client:           s3,
+		Storage:            backend,
 		changelogClient:    changelogger,
 		sqsClient:          sqsClient,
 		jobsQueueURL:       jobsQueueURL,
@@ -140,8 +181,30 @@ func (s *UploadHandlerStore) execTx(ctx context.Context, fn func(queries *Upload
 // When directToStorage is true, the files already landed at final storage (the
 // agent uploaded straight to the storage bucket), so SNS publish is skipped —
 // there's nothing for the Fargate move task to do.
+//
+// Under the skip and fail conflict strategies, files whose package name is
+// already taken are left out of the import and reported in the returned
+// ImportResult; the caller owns the manifest-file status update for them.
+// Skipped files have their now-redundant object deleted here.
+//
+// Files with a MergePackageId whose package an earlier batch already created
+// are added to that package; its storage grows by their size.
+//
+// Files whose row already exists (a redelivered S3 event) are not inserted
+// again. Their SNS and FileFinalized notifications are re-sent, unless the
+// move task has already moved them, in which case they are reported in
+// ImportResult.Moved.
+//
+// checksums maps uploadId to the checksum S3 stored for the file, and to the
+// SHA256 finalize computed when S3 stored none; entries are recorded next to
+// the file rows. Files without an entry get no checksum row.
+//
+// detections maps uploadId to what detectFileTypes found for files whose
+// declared type is not recognised; a match replaces the declared type, and
+// both are recorded in file_type_detections.
 func (s *UploadHandlerStore) ImportFiles(ctx context.Context, datasetId int, orgId int, user pgdb.User,
-	files []uploadFile.UploadFile, manifest *dydb.ManifestTable, directToStorage bool, onConflict string) error {
+	files []uploadFile.UploadFile, manifest *dydb.ManifestTable, directToStorage bool, onConflict string,
+	checksums map[string]FileChecksum, detections map[string]fileTypeDetection) (*ImportResult, error) {
 
 	contextLogger := log.WithFields(log.Fields{
 		"service":     "Upload-service",
@@ -154,12 +217,18 @@ func (s *UploadHandlerStore) ImportFiles(ctx context.Context, datasetId int, org
 	// Verify assumptions
 	for i, f := range files {
 		// avoiding for-loop variable gotcha
-		files[i].Path = trimSlashes(f.Path)
+		files[i].Path = importplan.TrimPath(f.Path)
 		if f.ManifestId != manifest.ManifestId {
-			return errors.New("not all files belong to the same manifest (required for ImportFiles method)")
+			return nil, errors.New("not all files belong to the same manifest (required for ImportFiles method)")
 		}
 	}
 
+	// S3 may send a create object event for a given file more than once, and both copies can land in one batch.
+	files = uniqueUploadFiles(files, contextLogger)
+
+	// Types detected from content replace unrecognised declared types before package types are derived.
+	applyFileTypeDetections(files, detections, contextLogger)
+
 	var f uploadFile.UploadFile
 	f.Sort(files)
 
@@ -172,28 +241,31 @@ func (s *UploadHandlerStore) ImportFiles(ctx context.Context, datasetId int, org
 	// 2. Iterate over folders and create them if they do not exist in organization
 	// This will lock rows in db for concurrent Lambda handlers so wrapping in its own TX to minimize time.
 	res, err := s.execTx(ctx, func(qtx *UploadPgQueries) (interface{}, error) {
-		folderPackageMap, err := qtx.GetCreateUploadFolders(datasetId, int(user.Id), folderMap)
+		folderPackageMap, createdFolders, err := qtx.GetCreateUploadFolders(datasetId, int(user.Id), folderMap)
 		if err != nil {
 			contextLogger.Error("Unable to create folders in ImportFiles function: ", err)
 			return nil, err
 		}
-		return folderPackageMap, nil
+		return uploadFolders{packages: folderPackageMap, created: createdFolders}, nil
 	})
 	if err != nil {
 		contextLogger.Error("Unable to create folders. ", err)
-		return err
+		return nil, err
 	}
 
-	folderPackageMap := res.(pgdb.PackageMap)
+	folders := res.(uploadFolders)
+	folderPackageMap := folders.packages
+	changelogParams := changelog.MessageParams{
+		OrganizationId: int64(orgId),
+		DatasetId:      int64(datasetId),
+		UserId:         user.NodeId,
+		TraceId:        manifest.ManifestId,
+	}
 	if contextLogger.Logger.IsLevelEnabled(log.DebugLevel) {
 		contextLogger.WithFields(log.Fields{"folderPackageMap": folderPackageMap}).Debug("calculated folder package map")
 	}
 
-	pkgParams, err := getPackageParams(datasetId, int(user.Id), files, folderPackageMap)
-	if err != nil {
-		contextLogger.Error("Unable to parse package parameters: ", err)
-		return err
-	}
+	pkgParams := getPackageParams(datasetId, int(user.Id), files, folderPackageMap)
 	if contextLogger.Logger.IsLevelEnabled(log.DebugLevel) {
 		contextLogger.WithFields(log.Fields{"pkgParams": pkgParams}).Debug("calculated package parameters")
 	}
@@ -201,9 +273,112 @@ func (s *UploadHandlerStore) ImportFiles(ctx context.Context, datasetId int, org
 	// 3. Create packages and Files in Transaction
 	strategy := conflictStrategyFromAttr(onConflict)
 	res, err = s.execTx(ctx, func(qtx *UploadPgQueries) (interface{}, error) {
-		packages, err := qtx.AddPackagesWithConflict(context.Background(), pkgParams, strategy)
+
+		// Idempotency is keyed on the file UUID (the uploadId). A redelivered event, whether handled by this
+		// sandbox or another one, or retried after an earlier attempt committed but failed before the manifest
+		// status update, finds its file row and is completed rather than inserted again.
+		fileUUIDs := make([]uuid.UUID, len(files))
+		for i, f := range files {
+			fileUUIDs[i] = uuid.MustParse(f.UploadId)
+		}
+		imported, err := qtx.GetImportedFiles(ctx, fileUUIDs)
+		if err != nil {
+			contextLogger.Error("Error checking for imported files: ", err)
+			return nil, err
+		}
+		pendingPackages := map[string]bool{}
+		var existing []pgdb.File
+		var moved []uploadFile.UploadFile
+		for _, f := range files {
+			if existingFile, ok := imported[uuid.MustParse(f.UploadId)]; ok {
+				// The move task points the row at the storage bucket once it has copied the object.
+				if existingFile.S3Key != f.S3Key {
+					moved = append(moved, f)
+				} else {
+					existing = append(existing, existingFile)
+				}
+				continue
+			}
+			pendingPackages[uploadPackageNodeId(f)] = true
+		}
+
+		// Members of a merged package can arrive in a later batch than the one that created the package. Those
+		// are attached to the existing package rather than inserted again, which would collide on its name. The
+		// lookup locks the merge group, so concurrent batches of one group take turns creating and joining it.
+		var mergedNodeIds []string
+		for _, f := range files {
+			nodeId := uploadPackageNodeId(f)
+			if f.MergePackageId != "" && pendingPackages[nodeId] && !slices.Contains(mergedNodeIds, nodeId) {
+				mergedNodeIds = append(mergedNodeIds, nodeId)
+			}
+		}
+		mergedPackages, err := qtx.GetPackagesByNodeIds(ctx, datasetId, mergedNodeIds)
+		if err != nil {
+			contextLogger.Error("Error checking for existing merged packages: ", err)
+			return nil, err
+		}
+
+		var pendingParams []pgdb.PackageParams
+		for _, p := range pkgParams {
+			if _, ok := mergedPackages[p.NodeId]; ok {
+				continue
+			}
+			if pendingPackages[p.NodeId] {
+				pendingParams = append(pendingParams, p)
+			}
+		}
+
+		// Skip and fail are resolved here rather than in pennsieve-go-core:
+		// conflicting packages are dropped from the insert and the remainder
+		// goes through the KeepBoth path. The check runs on the insert
+		// transaction; a concurrent writer claiming a name in between gets the
+		// KeepBoth rename rather than an error.
+		var conflicts map[string]pgdb.Package
+		importParams := pendingParams
+		if onConflict == onConflictSkip || onConflict == onConflictFail {
+			conflicts, err = qtx.GetConflictingPackages(ctx, datasetId, pendingParams)
+			if err != nil {
+				contextLogger.Error("Error checking for conflicting packages: ", err)
+				return nil, err
+			}
+			importParams = nil
+			for _, p := range pendingParams {
+				if _, conflict := conflicts[p.NodeId]; !conflict {
+					importParams = append(importParams, p)
+				}
+			}
+		}
+
+		var packages []pgdb.Package
+		if len(importParams) > 0 {
+			packages, err = qtx.AddPackagesWithConflict(context.Background(), importParams, strategy)
+			if err != nil {
+				contextLogger.Error("Error creating packages: ", err)
+				return nil, err
+			}
+		}
+
+		// Version keeps the predecessor around as a prior version of the new
+		// package. Recording it here means the chain exists if and only if the
+		// replacement committed.
+		var versions map[int64]bool
+		if onConflict == onConflictVersion {
+			versions, err = qtx.AddPackageVersions(ctx, int(user.Id), int64(datasetId), int64(orgId), packages)
+			if err != nil {
+				contextLogger.Error("Error recording package versions: ", err)
+				return nil, err
+			}
+		}
+
+		var replacedIds []int64
+		for _, p := range packages {
+			if p.ReplacesPackageId.Valid {
+				replacedIds = append(replacedIds, p.ReplacesPackageId.Int64)
+			}
+		}
+		predecessors, err := qtx.GetPackagesByIds(ctx, replacedIds)
 		if err != nil {
-			contextLogger.Error("Error creating packages: ", err)
+			contextLogger.Error("Error reading replaced packages: ", err)
 			return nil, err
 		}
 
@@ -212,15 +387,22 @@ func (s *UploadHandlerStore) ImportFiles(ctx context.Context, datasetId int, org
 			packageMap[p.NodeId] = p
 			contextLogger.Info(fmt.Sprintf("Package created: %s", p.NodeId))
 		}
+		for nodeId, p := range mergedPackages {
+			packageMap[nodeId] = p
+			contextLogger.Info(fmt.Sprintf("Attaching files to existing package: %s", nodeId))
+		}
 
 		var allFileParams []pgdb.FileParams
 		for i, f := range files {
-			packageNodeId := fmt.Sprintf("N:package:%s", f.UploadId)
-			if len(files[i].MergePackageId) > 0 {
-				contextLogger.Debug("USING MERGED PACKAGE")
-				packageNodeId = fmt.Sprintf("N:package:%s", files[i].MergePackageId)
+			fileUUID := uuid.MustParse(f.UploadId)
+			if _, ok := imported[fileUUID]; ok {
+				contextLogger.WithField("upload_id", f.UploadId).Info("file already imported")
+				continue
+			}
+			packageNodeId := uploadPackageNodeId(f)
+			if _, conflict := conflicts[packageNodeId]; conflict {
+				continue
 			}
-			fileUUID := uuid.MustParse(files[i].UploadId)
 			file := pgdb.FileParams{
 				PackageId:  int(packageMap[packageNodeId].Id),
 				Name:       files[i].Name,
@@ -233,36 +415,95 @@ func (s *UploadHandlerStore) ImportFiles(ctx context.Context, datasetId int, org
 				UUID:       fileUUID,
 				Sha256:     files[i].Sha256,
 			}
-			// S3 may send a create object event
-			// for a given file more than once. If more than one instance
-			// ended up in this batch, here we ensure only one is sent
-			// to AddFiles() below.
-			if seen, ok := seenFileUUIDs[fileUUID]; !ok {
-				seenFileUUIDs[fileUUID] = 1
-				allFileParams = append(allFileParams, file)
-			} else {
-				seenCount := seen + 1
-				seenFileUUIDs[fileUUID] = seenCount
-				contextLogger.WithFields(log.Fields{"duplicate_file_uuid": fileUUID, "seen_count": seenCount}).Warn("duplicate uuid")
+			allFileParams = append(allFileParams, file)
+		}
+
+		var returnedFiles []pgdb.File
+		if len(allFileParams) > 0 {
+			returnedFiles, err = qtx.AddFiles(context.Background(), allFileParams)
+			if err != nil {
+				contextLogger.Error("Unable to add files to postgres.", err)
+				return nil, err
+			}
+
+			err = qtx.AddFileChecksums(ctx, returnedFiles, checksums)
+			if err != nil {
+				contextLogger.Error("Unable to add file checksums to postgres.", err)
+				return nil, err
+			}
+
+			err = qtx.AddServerSHA256s(ctx, returnedFiles, checksums)
+			if err != nil {
+				contextLogger.Error("Unable to add server-computed sha256 values to postgres.", err)
+				return nil, err
+			}
+
+			err = qtx.AddFileTypeDetections(ctx, returnedFiles, detections)
+			if err != nil {
+				contextLogger.Error("Unable to add file type detections to postgres.", err)
+				return nil, err
+			}
+		}
+
+		response := PackagesAndFiles{
+			packages:     packages,
+			predecessors: predecessors,
+			files:        returnedFiles,
+			conflicts:    conflicts,
+			existing:     existing,
+			moved:        moved,
+			versions:     versions,
+		}
+
+		// 4. Update storage for Packages, Dataset and Organization. Counting on the insert transaction means a
+		// committed import is counted exactly once.
+		if len(returnedFiles) > 0 {
+			response.storage, err = createStorageUpdateMap(ctx, qtx, response)
+			if err != nil {
+				contextLogger.WithError(err).Error("Unable to compute storage update map.")
+				return nil, err
+			}
+			if err = qtx.IncrementOrganizationStorage(ctx, int64(orgId), response.storage.total); err != nil {
+				return nil, err
+			}
+			if err = qtx.IncrementDatasetStorage(ctx, int64(datasetId), response.storage.total); err != nil {
+				return nil, err
+			}
+			for p, value := range response.storage.packages {
+				if err = qtx.IncrementPackageStorage(ctx, p, value); err != nil {
+					return nil, err
+				}
 			}
 		}
 
-		returnedFiles, err := qtx.AddFiles(context.Background(), allFileParams)
+		// 5. Record the messages the import sends: recorded in this transaction, they go out if and only if the
+		// import commits.
+		messages, err := s.importOutboxMessages(ctx, qtx, orgId, user, manifest, directToStorage, changelogParams,
+			folders, response, files, checksums)
 		if err != nil {
-			contextLogger.Error("Unable to add files to postgres.", err)
+			contextLogger.WithError(err).Error("Unable to prepare import messages.")
 			return nil, err
 		}
-
-		response := PackagesAndFiles{
-			packages: packages,
-			files:    returnedFiles,
+		response.outbox, err = qtx.AddOutboxMessages(ctx, orgId, datasetId, messages, outboxLease)
+		if err != nil {
+			contextLogger.WithError(err).Error("Unable to record import messages in the outbox.")
+			return nil, err
 		}
 
 		return response, nil
 	})
 	if err != nil {
 		contextLogger.Error("Unable to create Packages and/or Files. ", err)
-		return err
+		// The folders are committed and a retry finds them, so this is the only chance to log their creation.
+		messages, logErr := changelogOutboxMessages(changelogParams, importChangelogEvents(folders.created, nil, nil,
+			folderPackageMap, time.Now()))
+		if logErr == nil {
+			logErr = s.sendThroughOutbox(ctx, orgId, datasetId, messages)
+		}
+		if logErr != nil {
+			contextLogger.WithError(logErr).Error("Unable to log the creation of folders.")
+		}
+		return nil, err
 	}
 
 	result := res.(PackagesAndFiles)
@@ -270,135 +511,150 @@ func (s *UploadHandlerStore) ImportFiles(ctx context.Context, datasetId int, org
 		contextLogger.Info(fmt.Sprintf("Package and File created: %s", f.UUID))
 	}
 
-	// 4. Update storage for Packages, Dataset and Organization.
-	storageMap, err := s.createStorageUpdateMap(ctx, result)
-	if err != nil {
-		contextLogger.WithError(err).Error("Unable to compute storage update map.")
-		return err
-	}
-	_, err = s.execTx(ctx, func(qtx *UploadPgQueries) (interface{}, error) {
+	importResult := s.resolveConflictedFiles(files, result.conflicts, onConflict, contextLogger)
+	importResult.Moved = result.moved
 
-		err = qtx.IncrementOrganizationStorage(ctx, int64(orgId), storageMap.total)
-		if err != nil {
-			return nil, err
-		}
-
-		err = qtx.IncrementDatasetStorage(ctx, int64(datasetId), storageMap.total)
-		if err != nil {
-			return nil, err
-		}
-
-		for p, value := range storageMap.packages {
-			err = qtx.IncrementPackageStorage(ctx, p, value)
-			if err != nil {
-				return nil, err
-			}
-		}
+	// 6. Deliver the messages the import recorded. The outbox relay retries those that fail; the import does not
+	// fail, as the files are already committed in Postgres.
+	delivery := s.deliverOutbox(ctx, result.outbox)
+	if len(delivery.failed) > 0 {
+		contextLogger.WithField("failed", delivery.failed).
+			Warn("Unable to deliver some import messages; the outbox relay will retry them.")
+	}
 
-		return nil, nil
-	})
-	if err != nil {
-		log.Error("Unable to update storage for Packages, Dataset and Organization.")
+	if len(result.files) == 0 {
+		// Everything was imported by an earlier delivery, which may have stopped before its side effects. Its
+		// transaction counted the storage and recorded its messages.
+		return importResult, nil
 	}
 
-	log.Debug("Total storage added to dataset: ", storageMap.total)
-	for p, v := range storageMap.packages {
+	log.Debug("Total storage added to dataset: ", result.storage.total)
+	for p, v := range result.storage.packages {
 		log.Debug(fmt.Sprintf("Package %d storage incremented by %d", p, v))
 	}
 
-	// 5. Notify SNS that files were imported — triggers the Fargate move task.
-	// Skip for direct-to-storage: files are already at final location.
-	if !directToStorage {
-		err = s.PublishToSNS(result.files)
-		if err != nil {
-			contextLogger.Error("Error with notifying SNS that records are imported.", err)
+	if jobs := replacementJobs(orgId, user, manifest, result); len(jobs) > 0 {
+		var replacementPublishFailures int
+		if s.jobsQueueURL == "" {
+			replacementPublishFailures = 1
+			contextLogger.WithField("replacement_count", len(jobs)).
+				Error("jobs queue URL is not configured; no DeletePackageJob was enqueued for replaced predecessors")
+		} else if delivery.failed[outboxDeletePackageJobs] > 0 {
+			replacementPublishFailures = 1
+			contextLogger.WithField("replacement_count", len(jobs)).
+				Error("failed to enqueue one or more DeletePackageJob messages for replaced predecessors")
 		}
+		// Warn when a single ImportFiles batch generates a lot of replacements.
+		// 100 is a soft threshold — no throttling, just signal so ops can watch
+		// jobs_queue depth if this fires frequently. Pair with a CloudWatch
+		// alarm on jobs_queue ApproximateAgeOfOldestMessage.
+		if len(jobs) > 100 {
+			contextLogger.WithField("replacement_count", len(jobs)).
+				Warn("large replacement batch — monitor jobs_queue depth")
+		}
+		emitReplacementMetrics(len(jobs), replacementPublishFailures)
 	}
 
-	// 5b. Fan-out FileFinalized events to downstream consumers (scan-service, etc.).
-	// Runs for both direct-to-storage and Fargate-moved files. Failure here is logged
-	// but does not fail ImportFiles — the file is already committed in Postgres.
-	if err := s.PublishFileFinalized(ctx, result.files, manifest); err != nil {
-		contextLogger.Error("Error publishing FileFinalized events.", err)
-	}
+	return importResult, nil
+}
 
-	// 6. Update activity Log
-	var evnts []changelog.Event
-	for _, pkg := range result.packages {
-		event := changelog.Event{
-			EventType: changelog.CreatePackage,
-			EventDetail: changelog.PackageCreateEvent{
-				Id:     pkg.Id,
-				Name:   pkg.Name,
-				NodeId: pkg.NodeId,
-			},
-			Timestamp: time.Now(),
+// importOutboxMessages returns the messages an import sends once it commits, in order:
+//
+//   - the SNS message that triggers the Fargate move task, except for direct-to-storage files, which are already at
+//     their final location, and the FileFinalized events for downstream consumers (scan-service, etc.), both
+//     including files an earlier delivery imported;
+//   - the activity log events of the folders and packages the import created and the packages it replaced;
+//   - a DeletePackageJob for every replaced predecessor;
+//   - the client notification of the new packages.
+//
+// An import of nothing but redelivered files created no packages, so their changelog and Pusher updates, which are
+// not idempotent, are not repeated. qtx is the import transaction, which reads what the messages need beyond result.
+func (s *UploadHandlerStore) importOutboxMessages(ctx context.Context, qtx *UploadPgQueries, orgId int, user pgdb.User,
+	manifest *dydb.ManifestTable, directToStorage bool, changelogParams changelog.MessageParams, folders uploadFolders,
+	result PackagesAndFiles, files []uploadFile.UploadFile, checksums map[string]FileChecksum) ([]outboxMessage, error) {
+	var messages []outboxMessage
+
+	publishFiles := make([]pgdb.File, 0, len(result.files)+len(result.existing))
+	publishFiles = append(publishFiles, result.files...)
+	publishFiles = append(publishFiles, result.existing...)
+	if len(publishFiles) > 0 {
+		if !directToStorage {
+			messages = append(messages, outboxSNSMessages(s.SNSTopic, importedFileEntries(publishFiles))...)
+		}
+		if s.FileFinalizedTopic != "" {
+			details := finalizedFileDetails{
+				uploader:  user,
+				uploads:   make(map[string]uploadFile.UploadFile, len(files)),
+				checksums: checksums,
+				packages:  make(map[int64]pgdb.Package, len(result.packages)),
+			}
+			for _, f := range files {
+				details.uploads[f.UploadId] = f
+			}
+			for _, p := range result.packages {
+				details.packages[p.Id] = p
+			}
+			entries, err := s.fileFinalizedEntries(ctx, qtx, publishFiles, manifest, details)
+			if err != nil {
+				return nil, err
+			}
+			messages = append(messages, outboxSNSMessages(s.FileFinalizedTopic, entries)...)
 		}
-		evnts = append(evnts, event)
 	}
 
-	params := changelog.MessageParams{
-		OrganizationId: int64(orgId),
-		DatasetId:      int64(datasetId),
-		UserId:         user.NodeId,
-		Events:         evnts,
-		TraceId:        manifest.ManifestId,
-		Id:             uuid.NewString(),
+	changelogMsgs, err := changelogOutboxMessages(changelogParams, importChangelogEvents(folders.created,
+		result.packages, result.predecessors, folders.packages, time.Now()))
+	if err != nil {
+		return nil, err
 	}
+	messages = append(messages, changelogMsgs...)
 
-	mes := changelog.Message{
-		DatasetChangelogEventJob: params,
+	// Without a queue the jobs could never be delivered; ImportFiles reports them instead.
+	if s.jobsQueueURL != "" {
+		messages = append(messages, deletePackageJobOutboxMessages(replacementJobs(orgId, user, manifest, result))...)
 	}
 
-	err = s.changelogClient.EmitEvents(context.Background(), mes)
+	notification, ok, err := notificationOutboxMessage(datasetChannel(manifest), uploadEventName,
+		anySlice(uploadPusherItems(result.packages)))
 	if err != nil {
-		contextLogger.Error("Error with notifying Changelog about imported records: ", err)
-	}
-
-	// 7. Publish a DeletePackageJob for every replaced predecessor so the
-	// Scala jobs service can run the async S3 asset cleanup. The DB-level
-	// soft-delete (state=DELETING, name prefix) + storage decrement is
-	// already done by pennsieve-go-core's AddPackagesWithConflict inside the
-	// import transaction; the queue publish is the side effect the library
-	// leaves to us. Batched via SendMessageBatch — at 100k-file replace
-	// scale this drops the SQS round-trip count ~10x vs per-message
-	// SendMessage.
-	var replacementJobs []DeletePackageJobParams
+		return nil, err
+	}
+	if ok {
+		messages = append(messages, notification)
+	}
+	return messages, nil
+}
+
+// replacementJobs returns a DeletePackageJob for every predecessor the import replaced, so the Scala jobs service
+// can run the async S3 asset cleanup. The DB-level soft-delete (state=DELETING, name prefix) + storage decrement is
+// already done by pennsieve-go-core's AddPackagesWithConflict inside the import transaction; the queue publish is
+// the side effect the library leaves to us. Predecessors kept as prior versions are not deleted.
+func replacementJobs(orgId int, user pgdb.User, manifest *dydb.ManifestTable,
+	result PackagesAndFiles) []DeletePackageJobParams {
+	var jobs []DeletePackageJobParams
 	for _, pkg := range result.packages {
 		if !pkg.ReplacesPackageId.Valid {
 			continue
 		}
-		replacementJobs = append(replacementJobs, DeletePackageJobParams{
+		if _, versioned := result.versions[pkg.Id]; versioned {
+			continue
+		}
+		jobs = append(jobs, DeletePackageJobParams{
 			PackageId:      pkg.ReplacesPackageId.Int64,
 			OrganizationId: orgId,
 			UserNodeId:     user.NodeId,
 			TraceId:        manifest.ManifestId,
 		})
 	}
-	var replacementPublishFailures int
-	if len(replacementJobs) > 0 {
-		if err := PublishDeletePackageJobs(ctx, s.sqsClient, s.jobsQueueURL, replacementJobs); err != nil {
-			replacementPublishFailures = 1
-			contextLogger.WithError(err).WithField("replacement_count", len(replacementJobs)).
-				Error("failed to enqueue one or more DeletePackageJob messages for replaced predecessors")
-		}
-		// Warn when a single ImportFiles batch generates a lot of replacements.
-		// 100 is a soft threshold — no throttling, just signal so ops can watch
-		// jobs_queue depth if this fires frequently. Pair with a CloudWatch
-		// alarm on jobs_queue ApproximateAgeOfOldestMessage.
-		if len(replacementJobs) > 100 {
-			contextLogger.WithField("replacement_count", len(replacementJobs)).
-				Warn("large replacement batch — monitor jobs_queue depth")
-		}
-		emitReplacementMetrics(len(replacementJobs), replacementPublishFailures)
-	}
+	return jobs
+}
 
-	// 8. Notify Pusher. Include replaced_package_id so the frontend can
-	// remove the replaced row from the files table instead of rendering both
-	// the old (now trashed) and new packages side by side.
-	chName := strings.ReplaceAll(manifest.DatasetNodeId, "N:dataset:", "dataset-")
-	var pusherData []uploadPusherItem
-	for _, pkg := range result.packages {
+// uploadPusherItems returns the client notification items of packages. They include replaced_package_id so the
+// frontend can remove the replaced row from the files table instead of rendering both the old (now trashed) and new
+// packages side by side.
+func uploadPusherItems(packages []pgdb.Package) []uploadPusherItem {
+	var items []uploadPusherItem
+	for _, pkg := range packages {
 		item := uploadPusherItem{
 			UploadMessageItem: ps.UploadMessageItem{
 				Name:     pkg.Name,
@@ -410,16 +666,96 @@ func (s *UploadHandlerStore) ImportFiles(ctx context.Context, datasetId int, org
 		if pkg.ReplacesPackageId.Valid {
 			item.ReplacedPackageId = &pkg.ReplacesPackageId.Int64
 		}
-		pusherData = append(pusherData, item)
+		items = append(items, item)
+	}
+	return items
+}
+
+// sendThroughOutbox records messages in the outbox outside any import transaction and delivers them.
+func (s *UploadHandlerStore) sendThroughOutbox(ctx context.Context, orgId int, datasetId int,
+	messages []outboxMessage) error {
+	if len(messages) == 0 {
+		return nil
 	}
-	err = s.pusherClient.Trigger(chName, "upload-event", pusherData)
+	entries, err := s.pg.AddOutboxMessages(ctx, orgId, datasetId, messages, outboxLease)
 	if err != nil {
-		log.Warnf(err.Error())
+		return err
 	}
-
+	s.deliverOutbox(ctx, entries)
 	return nil
 }
 
+// uniqueUploadFiles drops all but the first of the files sharing an uploadId.
+func uniqueUploadFiles(files []uploadFile.UploadFile, contextLogger *log.Entry) []uploadFile.UploadFile {
+	seen := map[string]bool{}
+	unique := make([]uploadFile.UploadFile, 0, len(files))
+	for _, f := range files {
+		if seen[f.UploadId] {
+			contextLogger.WithField("duplicate_upload_id", f.UploadId).Warn("duplicate uuid")
+			continue
+		}
+		seen[f.UploadId] = true
+		unique = append(unique, f)
+	}
+	return unique
+}
+
+// uploadPackageNodeId returns the node id of the package a file is imported into: its merge package if it has one,
+// its own otherwise.
+func uploadPackageNodeId(f uploadFile.UploadFile) string {
+	return importplan.PackageNodeId(planFiles([]uploadFile.UploadFile{f})[0])
+}
+
+// resolveConflictedFiles sorts the files whose package collided under the skip or fail strategy into an
+// ImportResult. Skipped files are redundant — the existing package stays — so their uploaded object is deleted;
+// failed files keep their object so the upload can be retried with a different strategy.
+func (s *UploadHandlerStore) resolveConflictedFiles(files []uploadFile.UploadFile, conflicts map[string]pgdb.Package,
+	onConflict string, contextLogger *log.Entry) *ImportResult {
+
+	importResult := &ImportResult{Reasons: map[string]string{}}
+	if len(conflicts) == 0 {
+		return importResult
+	}
+
+	var redundant []OrphanS3File
+	for _, f := range files {
+		packageNodeId := uploadPackageNodeId(f)
+		existing, conflict := conflicts[packageNodeId]
+		if !conflict {
+			continue
+		}
+
+		importResult.Reasons[f.UploadId] = fmt.Sprintf("name conflict: package '%s' already exists (%s)",
+			existing.Name, existing.NodeId)
+
+		fileLogger := contextLogger.WithFields(log.Fields{
+			"upload_id":           f.UploadId,
+			"existing_package_id": existing.NodeId,
+			"on_conflict":         onConflict,
+		})
+
+		switch onConflict {
+		case onConflictSkip:
+			fileLogger.Info("Skipping import of file that conflicts with existing package.")
+			importResult.Skipped = append(importResult.Skipped, f)
+			redundant = append(redundant, OrphanS3File{S3Bucket: f.S3Bucket, S3Key: f.S3Key, ETag: f.ETag})
+		default:
+			fileLogger.Warn("Failing import of file that conflicts with existing package.")
+			importResult.Failed = append(importResult.Failed, f)
+		}
+	}
+
+	if len(redundant) > 0 {
+		if err := s.deleteOrphanFiles(redundant); err != nil {
+			// The existing package is untouched either way; a leftover object
+			// only costs storage, so don't fail the import over it.
+			contextLogger.WithError(err).Error("Unable to delete objects for skipped files.")
+		}
+	}
+
+	return importResult
+}
+
 // uploadPusherItem extends the shared UploadMessageItem with the
 // replaced_package_id field that only the replace-on-conflict flow
 // populates. Kept local to upload-service-v2 to avoid churning the
@@ -430,6 +766,55 @@ type uploadPusherItem struct {
 	ReplacedPackageId *int64 `json:"replaced_package_id,omitempty"`
 }
 
+const (
+	uploadEventName           = "upload-event"
+	manifestProgressEventName = "manifest-progress"
+)
+
+// datasetChannel returns the channel clients watching the dataset of the manifest subscribe to.
+func datasetChannel(manifest *dydb.ManifestTable) string {
+	return strings.ReplaceAll(manifest.DatasetNodeId, "N:dataset:", "dataset-")
+}
+
+// progressStatuses are the manifest file statuses a manifest-progress event counts.
+var progressStatuses = []string{
+	manifestFile.Registered.String(),
+	manifestFile.Uploaded.String(),
+	manifestFile.Imported.String(),
+	manifestFile.Finalized.String(),
+	manifestFile.Failed.String(),
+	manifestFileStatusSkipped,
+	manifestFileStatusStaged,
+}
+
+// manifestProgress is the manifest-progress event, sent after each batch of a manifest is imported so the frontend
+// can show aggregate progress without counting upload-events.
+type manifestProgress struct {
+	ManifestId string `json:"manifest_id"`
+	DatasetId  string `json:"dataset_id"`
+	// Counts maps each of progressStatuses to the number of manifest files in it.
+	Counts map[string]int `json:"counts"`
+}
+
+// notifyManifestProgress sends a manifest-progress event for the manifest. The counts come from a GSI and may not
+// yet include the status updates of the batch that was just imported; the next event catches up.
+func (s *UploadHandlerStore) notifyManifestProgress(ctx context.Context, manifest *dydb.ManifestTable,
+	contextLogger *log.Entry) {
+	counts, err := s.dy.countManifestFileStatuses(ctx, manifest.ManifestId, progressStatuses)
+	if err != nil {
+		contextLogger.WithError(err).Error("Unable to count manifest file statuses.")
+		return
+	}
+	progress := manifestProgress{
+		ManifestId: manifest.ManifestId,
+		DatasetId:  manifest.DatasetNodeId,
+		Counts:     counts,
+	}
+	if err := s.notifier.Notify(ctx, datasetChannel(manifest), manifestProgressEventName, progress); err != nil {
+		contextLogger.WithError(err).Error("Unable to notify clients of manifest progress.")
+	}
+}
+
 // Handler is the primary entrypoint that handles importing files and is called by the Lambda
 func (s *UploadHandlerStore) Handler(ctx context.Context, sqsEvent events.SQSEvent) (events.SQSEventResponse, error) {
 	/*
@@ -451,43 +836,58 @@ func (s *UploadHandlerStore) Handler(ctx context.Context, sqsEvent events.SQSEve
 	// Drop heartbeat + malformed records up front. Heartbeats are emitted
 	// by the upload_lambda_heartbeat EventBridge rule (see terraform/
 	// cloudwatch.tf) to keep SQS pollers and the lambda execution
-	// environment warm during idle periods — they have no S3 Records
-	// payload and must be ack'd without processing. The same guard also
-	// hardens the Records[0] access below against any other non-S3
-	// message that might reach this queue.
+	// environment warm during idle periods — they announce no object and
+	// must be ack'd without processing, like S3 test events and S3 events
+	// other than Object Created. Bodies parseQueueMessage does not recognize,
+	// including finalize messages of a newer version, are returned to the
+	// queue instead, so they end in its dead-letter queue rather than being
+	// dropped.
+	//
+	// The maps below are keyed by s3Key and used in case of failed imports.
+	// s3KeyToOnConflict carries the per-file OnConflict value (set by the
+	// service lambda's finalize handler) from the SQS message to the
+	// ImportFiles call for that file's strategy group. Missing value =
+	// "keepBoth" for backward compatibility with legacy S3-triggered uploads
+	// that predate this flag.
+	s3KeySQSMessageMap := map[string]events.SQSMessage{}
+	s3KeyToOnConflict := map[string]string{}
+	s3KeyToServerSHA256 := map[string]string{}
 	liveRecords := sqsEvent.Records[:0]
 	heartbeatCount := 0
 	for _, m := range sqsEvent.Records {
-		parsedS3Event := events.S3Event{}
-		if err := json.Unmarshal([]byte(m.Body), &parsedS3Event); err != nil || len(parsedS3Event.Records) == 0 {
+		msg, err := parseQueueMessage(m)
+		if err != nil {
+			log.WithField("message_id", m.MessageId).Error("Unable to read upload trigger message: ", err)
+			batchItemFailures = append(batchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: m.MessageId})
+			continue
+		}
+		if msg == nil {
 			heartbeatCount++
 			continue
 		}
 		liveRecords = append(liveRecords, m)
+		s3KeySQSMessageMap[msg.key] = m
+		s3KeyToOnConflict[msg.key] = msg.onConflict
+		if msg.serverSHA256 != "" {
+			s3KeyToServerSHA256[msg.key] = msg.serverSHA256
+		}
 	}
 	if heartbeatCount > 0 {
-		log.Debugf("Dropped %d heartbeat/non-S3 message(s) from batch", heartbeatCount)
+		log.Debugf("Dropped %d heartbeat or non-object message(s) from batch", heartbeatCount)
+		// The heartbeat also paces the outbox relay, which retries the import messages that could not be delivered,
+		// and the report of merge groups that did not complete in time. Both run once the live records of the batch
+		// are imported, so a backlog never delays an import, and the relay stops after outboxRelayBudget.
+		defer func() {
+			s.RelayOutbox(ctx)
+			s.ExpireMergeGroups(ctx)
+		}()
 	}
 	if len(liveRecords) == 0 {
+		response.BatchItemFailures = batchItemFailures
 		return response, nil
 	}
 	sqsEvent.Records = liveRecords
 
-	// Map SQS Events by s3Key - This is used in case of failed imports.
-	s3KeySQSMessageMap := map[string]events.SQSMessage{}
-	// s3KeyToOnConflict carries the OnConflict MessageAttribute (set by the
-	// service lambda's finalize handler) from the SQS message to the per-
-	// manifest ImportFiles call. Missing attribute = "keepBoth" for backward
-	// compatibility with legacy S3-triggered uploads that predate this flag.
-	s3KeyToOnConflict := map[string]string{}
-	for _, m := range sqsEvent.Records {
-		parsedS3Event := events.S3Event{}
-		_ = json.Unmarshal([]byte(m.Body), &parsedS3Event)
-		s3Key := parsedS3Event.Records[0].S3.Object.Key
-		s3KeySQSMessageMap[s3Key] = m
-		s3KeyToOnConflict[s3Key] = extractOnConflictAttr(m)
-	}
-
 	// 1. Parse UploadEntries
 	uploadEntries, orphanEntries, err := s.GetUploadEntries(sqsEvent.Records)
 	if orphanEntries != nil {
@@ -504,6 +904,11 @@ func (s *UploadHandlerStore) Handler(ctx context.Context, sqsEvent events.SQSEve
 		return response, err
 	}
 
+	// Checksums S3 reported for each object, recorded with the file rows. A
+	// SHA256 computed by finalize stands in for the one S3 doesn't have.
+	checksums := map[string]FileChecksum{}
+	addEntryChecksums(uploadEntries, s3KeyToServerSHA256, checksums)
+
 	// 2. Match against Manifest and create uploadFiles
 	uploadFiles, orphanEntries, err := s.dy.GetUploadFiles(uploadEntries)
 	if orphanEntries != nil {
@@ -519,6 +924,15 @@ func (s *UploadHandlerStore) Handler(ctx context.Context, sqsEvent events.SQSEve
 		return response, err
 	}
 
+	// Members of merge groups that have not fully arrived are staged rather than imported; the batch that completes
+	// a group brings its staged members along.
+	uploadFiles, gateFailures := s.gateMergeGroups(ctx, uploadFiles, s3KeySQSMessageMap, s3KeyToOnConflict, checksums)
+	batchItemFailures = addToFailedFiles(gateFailures, s3KeySQSMessageMap, batchItemFailures)
+
+	// Files with an unrecognised type are checked against known signatures once for the batch, however often a
+	// failing import is retried on parts of it.
+	detections := s.detectFileTypes(ctx, uploadFiles)
+
 	// 3. Map by uploadSessionID
 	var fileByManifest = map[string][]uploadFile.UploadFile{}
 	for _, f := range uploadFiles {
@@ -578,62 +992,202 @@ func (s *UploadHandlerStore) Handler(ctx context.Context, sqsEvent events.SQSEve
 			targetStatus = manifestFile.Finalized
 		}
 
-		// Resolve the manifest-wide onConflict strategy from the SQS message
-		// attributes. All messages for a single manifest in one batch should
-		// share the same value (set at finalize time); we take the first and
-		// log if anything in the group differs.
-		onConflict := resolveOnConflictForManifest(uploadFilesForManifest, s3KeyToOnConflict, contextLogger)
+		// Split the manifest group by the per-file onConflict strategy carried
+		// in the SQS message attributes. A single finalize session can mix
+		// strategies (e.g. replace for edited files, keepBoth for new ones),
+		// and ImportFiles applies one strategy per call. A group that fails
+		// does not hold back the others, which are imported all the same.
+		for _, group := range groupByOnConflict(uploadFilesForManifest, s3KeyToOnConflict) {
+			var ok bool
+			batchItemFailures, ok = s.importFileGroup(ctx, manifest, user, group.files, direct, group.onConflict,
+				checksums, detections, targetStatus, s3KeySQSMessageMap, batchItemFailures, contextLogger)
+			if !ok {
+				contextLogger.WithFields(log.Fields{
+					"on_conflict": group.onConflict,
+					"files":       len(group.files),
+				}).Warn("Not every file of the onConflict group was imported")
+			}
+		}
+		s.notifyManifestProgress(ctx, manifest, contextLogger)
 
-		err = s.ImportFiles(ctx, int(manifest.DatasetId), int(manifest.OrganizationId), *user, uploadFilesForManifest, manifest, direct, onConflict)
+		// Update Dataset updated_at value.
+		err = s.pg.SetUpdatedAt(ctx, manifest.DatasetId, time.Now())
 		if err != nil {
-			contextLogger.Error("Error in batch create packages: ", err)
-
-			// Try to import each file individually and add item to batchItemFailures if it fails.
-			// This will ensure that only the files that cause the failure will be returned to the sqs queue
-			for _, f := range uploadFilesForManifest {
-				singleFileArr := []uploadFile.UploadFile{f}
-				err = s.ImportFiles(ctx, int(manifest.DatasetId), int(manifest.OrganizationId), *user, singleFileArr, manifest, direct, onConflict)
-				if err != nil {
-					batchItemFailures = addToFailedFiles(singleFileArr, s3KeySQSMessageMap, batchItemFailures)
-					contextLogger.WithFields(
-						log.Fields{
-							"upload_id": f.UploadId,
-						}).Error("Error when creating package: ", err)
-
-					continue
-				}
+			contextLogger.Error(err)
+			continue
+		}
+	}
 
-				// Update entries in manifest to target status for single file
-				err = s.dy.updateManifestFileStatusTo(singleFileArr, manifestId, targetStatus)
-				if err != nil {
-					// Status is not correctly updated in Manifest but files are completely imported.
-					// This should not return the failed files.
-					contextLogger.Error("Unable to update manifest file", err)
-				}
+	response.BatchItemFailures = batchItemFailures
+	return response, nil
+}
 
-			}
-			continue
+// importFileGroup imports files that share a manifest and an onConflict strategy and updates their manifest-file
+// status. If the batch import fails, bisectImport isolates the files that cause the failure so only those are
+// returned to the SQS queue, with the reason recorded on their manifest-file row. Returns the updated
+// batchItemFailures and whether every file was imported and its status updated.
+func (s *UploadHandlerStore) importFileGroup(ctx context.Context, manifest *dydb.ManifestTable, user *pgdb.User,
+	files []uploadFile.UploadFile, direct bool, onConflict string, checksums map[string]FileChecksum,
+	detections map[string]fileTypeDetection, targetStatus manifestFile.Status,
+	s3KeySQSMessageMap map[string]events.SQSMessage, batchItemFailures []events.SQSBatchItemFailure,
+	contextLogger *log.Entry) ([]events.SQSBatchItemFailure, bool) {
+
+	statusesUpdated := true
+	attempts := 0
+	failures := bisectImport(files, func(batch []uploadFile.UploadFile) error {
+		attempts++
+		importResult, err := s.ImportFiles(ctx, int(manifest.DatasetId), int(manifest.OrganizationId), *user, batch,
+			manifest, direct, onConflict, checksums, detections)
+		if err != nil {
+			contextLogger.WithFields(log.Fields{
+				"on_conflict": onConflict,
+				"batch_size":  len(batch),
+			}).Error("Error in batch create packages: ", err)
+			return err
 		}
 
-		// Update entries in manifest to target status for all files
-		err = s.dy.updateManifestFileStatusTo(uploadFilesForManifest, manifestId, targetStatus)
+		// Update entries in manifest to target status for the batch
+		err = s.updateManifestFileStatuses(ctx, manifest.ManifestId, batch, importResult, targetStatus)
 		if err != nil {
 			// Status is not correctly updated in Manifest but files are completely imported.
 			// This should not return the failed files.
-			contextLogger.Error(err)
-			continue
+			contextLogger.Error("Unable to update manifest file", err)
+			statusesUpdated = false
 		}
+		return nil
+	})
+	if len(failures) == 0 {
+		return batchItemFailures, statusesUpdated
+	}
 
-		// Update Dataset updated_at value.
-		err = s.pg.SetUpdatedAt(ctx, manifest.DatasetId, time.Now())
-		if err != nil {
-			contextLogger.Error(err)
-			continue
+	var failed []uploadFile.UploadFile
+	reasons := map[string]string{}
+	for _, f := range files {
+		if err, ok := failures[f.UploadId]; ok {
+			failed = append(failed, f)
+			reasons[f.UploadId] = err.Error()
+			contextLogger.WithFields(log.Fields{
+				"upload_id": f.UploadId,
+			}).Error("Error when creating package: ", err)
 		}
 	}
+	contextLogger.WithFields(log.Fields{
+		"files":    len(files),
+		"failed":   len(failed),
+		"attempts": attempts,
+	}).Warn("isolated failing files in import batch")
+
+	if err := s.dy.updateManifestFileImportError(ctx, manifest.ManifestId, failed, reasons); err != nil {
+		contextLogger.Error("Unable to record import errors: ", err)
+	}
+	return addToFailedFiles(failed, s3KeySQSMessageMap, batchItemFailures), false
+}
 
-	response.BatchItemFailures = batchItemFailures
-	return response, nil
+// maxBisectImports bounds the imports bisectImport runs for one batch. Isolating a few failing files among the 250
+// of a full batch takes well under this; a batch in which most files fail is returned to the queue once it is spent.
+const maxBisectImports = 64
+
+// bisectImport imports files through importBatch. A batch that fails is split in halves and each half is imported
+// on its own, until every failing file is isolated; with k failing files among n that takes O(k log n) imports
+// rather than one per file. Returns the error of every file that failed, keyed by uploadId.
+//   - An error that does not depend on the files, such as a lost connection or an expired context, fails the batch
+//     and every batch not yet imported with it, without splitting: retrying halves would only fail the same way.
+//   - After maxBisectImports imports, failing batches are no longer split and batches not yet imported are not
+//     tried; their files fail with the error of the batch they were part of.
+func bisectImport(files []uploadFile.UploadFile, importBatch func([]uploadFile.UploadFile) error) map[string]error {
+	failures := map[string]error{}
+	fail := func(batch []uploadFile.UploadFile, err error) {
+		for _, f := range batch {
+			failures[f.UploadId] = err
+		}
+	}
+
+	imports := 0
+	var abort error
+	var bisect func(batch []uploadFile.UploadFile, parentErr error)
+	bisect = func(batch []uploadFile.UploadFile, parentErr error) {
+		if abort != nil {
+			fail(batch, abort)
+			return
+		}
+		if imports == maxBisectImports {
+			fail(batch, fmt.Errorf("not imported after %d attempts to isolate failing files: %w", imports, parentErr))
+			return
+		}
+		imports++
+		err := importBatch(batch)
+		if err == nil {
+			return
+		}
+		if fileIndependentError(err) {
+			abort = err
+			fail(batch, err)
+			return
+		}
+		if len(batch) == 1 || imports == maxBisectImports {
+			fail(batch, err)
+			return
+		}
+		// Copy the halves: ImportFiles sorts and trims the files it is given.
+		mid := len(batch) / 2
+		bisect(append([]uploadFile.UploadFile(nil), batch[:mid]...), err)
+		bisect(append([]uploadFile.UploadFile(nil), batch[mid:]...), err)
+	}
+	if len(files) > 0 {
+		bisect(files, nil)
+	}
+	return failures
+}
+
+// fileIndependentError returns true for errors an import hits whatever files it is given: a cancelled or expired
+// context, and a database connection that is closed or was lost.
+func fileIndependentError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) ||
+		errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// updateManifestFileStatuses writes the post-import manifest-file status for a batch passed to ImportFiles:
+// targetStatus for imported files, Finalized for redelivered files that were already moved, Skipped or Failed (with the conflict reason) for files the skip and fail
+// strategies left out.
+func (s *UploadHandlerStore) updateManifestFileStatuses(ctx context.Context, manifestId string,
+	files []uploadFile.UploadFile, result *ImportResult, targetStatus manifestFile.Status) error {
+
+	moved := map[string]bool{}
+	for _, f := range result.Moved {
+		moved[f.UploadId] = true
+	}
+
+	var imported []uploadFile.UploadFile
+	for _, f := range files {
+		if !result.notImported(f.UploadId) && !moved[f.UploadId] {
+			imported = append(imported, f)
+		}
+	}
+
+	if len(imported) > 0 {
+		if err := s.dy.updateManifestFileStatusTo(imported, manifestId, targetStatus); err != nil {
+			return err
+		}
+	}
+
+	if len(result.Moved) > 0 {
+		if err := s.dy.updateManifestFileStatusTo(result.Moved, manifestId, manifestFile.Finalized); err != nil {
+			return err
+		}
+	}
+
+	if err := s.dy.updateManifestFileConflictStatus(ctx, manifestId, result.Skipped, manifestFileStatusSkipped,
+		result.Reasons); err != nil {
+		return err
+	}
+
+	return s.dy.updateManifestFileConflictStatus(ctx, manifestId, result.Failed, manifestFile.Failed.String(),
+		result.Reasons)
 }
 
 // deleteOrphanFiles deletes files from upload bucket if no representation exists in manifest.
@@ -650,7 +1204,7 @@ func (s *UploadHandlerStore) deleteOrphanFiles(files []OrphanS3File) error {
 	// Assert all buckets are the same
 	s3Bucket := files[0].S3Bucket
 
-	var keys []s3Types.ObjectIdentifier
+	var keys []string
 	for _, f := range files {
 		if strings.HasPrefix(f.S3Key, "/") {
 			log.WithFields(log.Fields{
@@ -667,55 +1221,42 @@ func (s *UploadHandlerStore) deleteOrphanFiles(files []OrphanS3File) error {
 		if f.S3Bucket != s3Bucket {
 			return errors.New("not all orphan files have the same bucket")
 		}
-		keys = append(keys, s3Types.ObjectIdentifier{
-			Key:       aws.String(f.S3Key),
-			VersionId: nil,
-		})
+		keys = append(keys, f.S3Key)
 	}
 
 	if len(keys) == 0 {
 		return nil
 	}
 
-	f := s3Types.Delete{
-		Objects: keys,
-		Quiet:   aws.Bool(false),
-	}
-
-	params := s3.DeleteObjectsInput{
-		Bucket: aws.String(s3Bucket),
-		Delete: &f,
-	}
-
-	result, err := s.S3Client.DeleteObjects(ctx, &params)
-	if err != nil {
-		return err
-	}
-	if len(result.Deleted) != len(files) {
-		return errors.New("unable to delete all orphan files")
-	}
-
-	return nil
-
+	return s.Storage.Delete(ctx, s3Bucket, keys...)
 }
 
 // createStorageUpdateMap returns object with information on how to update storage for packages, dataset, and org.
-func (s *UploadHandlerStore) createStorageUpdateMap(ctx context.Context, pf PackagesAndFiles) (*storageUpdateParams, error) {
+// The ancestors of all packages are looked up in one query on the provided transaction.
+func createStorageUpdateMap(ctx context.Context, qtx *UploadPgQueries, pf PackagesAndFiles) (*storageUpdateParams, error) {
 
 	storageMap := storageUpdateParams{
 		total:    0,
 		packages: map[int64]int64{},
 	}
 
+	var packageIds []int64
+	seen := map[int64]bool{}
 	for _, curFile := range pf.files {
-
-		parentIds, err := s.pg.GetPackageAncestorIds(ctx, int64(curFile.PackageId))
-		if err != nil {
-			return nil, err
+		if !seen[int64(curFile.PackageId)] {
+			seen[int64(curFile.PackageId)] = true
+			packageIds = append(packageIds, int64(curFile.PackageId))
 		}
+	}
+	ancestors, err := qtx.GetPackagesAncestorIds(ctx, packageIds)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, curFile := range pf.files {
 
 		// Add to individual packages in map
-		for _, p := range parentIds {
+		for _, p := range ancestors[int64(curFile.PackageId)] {
 			storageMap.packages[p] += curFile.Size
 		}
 
@@ -727,113 +1268,41 @@ func (s *UploadHandlerStore) createStorageUpdateMap(ctx context.Context, pf Pack
 
 }
 
-func trimSlashes(path string) string {
-	// Remove leading and trailing "/"
-	leadingSlashes := regexp.MustCompile(`^/+`)
-	trimmed := leadingSlashes.ReplaceAllString(path, "")
-
-	trailingSlashes := regexp.MustCompile(`/+$`)
-	trimmed = trailingSlashes.ReplaceAllString(trimmed, "")
-	return trimmed
-}
-
 // getUploadFolderMap returns an object that maps path name to Folder object.
 func getUploadFolderMap(sortedFiles []uploadFile.UploadFile, targetFolder string) uploadFolder.UploadFolderMap {
 
 	// Mapping path from targetFolder to UploadFolder Object
 	var folderNameMap = map[string]*uploadFolder.UploadFolder{}
 
-	// Iterate over the files and create the UploadFolder objects.
-	for _, f := range sortedFiles {
-		p := f.Path
-
-		if p == "" {
-			continue
+	// The plan lists parents before their children, so a folder's parent is always in the map already.
+	for _, f := range importplan.New(planFiles(sortedFiles), targetFolder).Folders {
+		folder := &uploadFolder.UploadFolder{
+			NodeId:   fmt.Sprintf("N:collection:%s", uuid.New().String()),
+			Name:     f.Name,
+			ParentId: -1,
+			Depth:    f.Depth,
 		}
-
-		// Prepend the target-Folder if it exists
-		if targetFolder != "" {
-			p = strings.Join(
-				[]string{
-					targetFolder, p,
-				}, "/")
-		}
-
-		// Iterate over path segments in a single file and identify folders.
-		pathSegments := strings.Split(p, "/")
-		absoluteSegment := "" // Current location in the path walker for current file.
-		currentNodeId := ""
-		currentFolderPath := ""
-		for depth, segment := range pathSegments {
-
-			parentNodeId := currentNodeId
-			parentFolderPath := currentFolderPath
-
-			// If depth > 0 ==> prepend the previous absoluteSegment to the current path name.
-			if depth > 0 {
-				absoluteSegment = strings.Join(
-					[]string{
-
-						absoluteSegment,
-						segment,
-					}, "/")
-			} else {
-				absoluteSegment = segment
-			}
-
-			// If folder already exists in map, add current folder as a child to the parent
-			// folder (which will exist too at this point). If not, create new folder to the map and add to parent folder.
-
-			folder, ok := folderNameMap[absoluteSegment]
-			if ok {
-				currentNodeId = folder.NodeId
-				currentFolderPath = absoluteSegment
-
-			} else {
-				currentNodeId = fmt.Sprintf("N:collection:%s", uuid.New().String())
-				currentFolderPath = absoluteSegment
-
-				folder = &uploadFolder.UploadFolder{
-					NodeId:       currentNodeId,
-					Name:         segment,
-					ParentNodeId: parentNodeId,
-					ParentId:     -1,
-					Depth:        depth,
-				}
-				folderNameMap[absoluteSegment] = folder
-			}
-
-			// Add current segment to parent if exist
-			if parentFolderPath != "" {
-				folderNameMap[parentFolderPath].Children = append(folderNameMap[parentFolderPath].Children, folder)
-			}
-
+		if parent, ok := folderNameMap[f.ParentPath]; ok {
+			folder.ParentNodeId = parent.NodeId
+			parent.Children = append(parent.Children, folder)
 		}
+		folderNameMap[f.Path] = folder
 	}
 
 	return folderNameMap
 }
 
-// getPackageParams returns an array of PackageParams to insert in the Packages Table.
-func getPackageParams(datasetId int, ownerId int, uploadFiles []uploadFile.UploadFile, pathToFolderMap pgdb.PackageMap) ([]pgdb.PackageParams, error) {
+// getPackageParams returns an array of PackageParams to insert in the Packages Table: one per package of the import
+// plan, so upload-files that map to the same package do not create duplicates.
+func getPackageParams(datasetId int, ownerId int, uploadFiles []uploadFile.UploadFile, pathToFolderMap pgdb.PackageMap) []pgdb.PackageParams {
 	var pkgParams []pgdb.PackageParams
 
-	// First create a map of params. As there can be upload-files that should be mapped to the same package,
-	// we want to ensure we are not creating duplicate packages (as this will cause an error when inserting in db).
-	// Then we turn map into array and return the array.
-	pkgParamsMap := map[string]pgdb.PackageParams{}
-	for _, file := range uploadFiles {
-
-		// Create the packageID based on the uploadID or the mergePackageID if it exists
-		packageId, packageName, err := parsePackageId(file)
-		if err != nil {
-			log.Error(err.Error())
-			return nil, err
-		}
+	for _, pkg := range importplan.New(planFiles(uploadFiles), "").Packages {
+		file := uploadFiles[pkg.Files[0]]
 
 		parentId := int64(-1)
-		if file.Path != "" {
-			parentId = pathToFolderMap[file.Path].Id
+		if pkg.ParentPath != "" {
+			parentId = pathToFolderMap[pkg.ParentPath].Id
 		}
 
 		uploadId := sql.NullString{
@@ -867,65 +1336,65 @@ func getPackageParams(datasetId int, ownerId int, uploadFiles []uploadFile.Uploa
 			setPackageState = packageState.Ready
 		}
 
-		pkgParam := pgdb.PackageParams{
-			Name:         packageName,
+		pkgParams = append(pkgParams, pgdb.PackageParams{
+			Name:         pkg.Name,
 			PackageType:  file.Type,
 			PackageState: setPackageState,
-			NodeId:       packageId,
+			NodeId:       pkg.NodeId,
 			ParentId:     parentId,
 			DatasetId:    datasetId,
 			OwnerId:      ownerId,
 			Size:         0,
 			ImportId:     uploadId,
 			Attributes:   attributes,
-		}
-
-		pkgParamsMap[packageId] = pkgParam
-		//// If entry already exists --> sum size, else assign value
-		//if val, ok := pkgParamsMap[packageId]; ok {
-		//	val.Size += pkgParam.Size
-		//} else {
-		//	pkgParamsMap[packageId] = pkgParam
-		//}
-
-	}
-
-	// Turn map into array --> ensure no duplicate packages.
-	for i := range pkgParamsMap {
-		pkgParams = append(pkgParams, pkgParamsMap[i])
+		})
 	}
 
-	return pkgParams, nil
+	return pkgParams
 
 }
 
-// parsePackageId returns a packageId and name based on upload-file
-func parsePackageId(file uploadFile.UploadFile) (string, string, error) {
-	packageId := fmt.Sprintf("N:package:%s", file.UploadId)
-	packageName := file.Name
-	if len(file.MergePackageId) > 0 {
-		packageId = fmt.Sprintf("N:package:%s", file.MergePackageId)
-
-		// Set packageName to name without extension
-		r := regexp.MustCompile(`(?P<FileName>[^.]*)?\.?(?P<Extension>.*)`)
-		pathParts := r.FindStringSubmatch(file.Name)
-		if pathParts == nil {
-			log.Error("Unable to parse filename:", file.Name)
-			return "", "", errors.New(fmt.Sprintf("Unable to parse filename: %s", file.Name))
+// planFiles returns what import planning needs of each upload-file, in the same order.
+func planFiles(files []uploadFile.UploadFile) []importplan.File {
+	planned := make([]importplan.File, len(files))
+	for i, f := range files {
+		planned[i] = importplan.File{
+			UploadId:       f.UploadId,
+			Path:           f.Path,
+			Name:           f.Name,
+			MergePackageId: f.MergePackageId,
 		}
-
-		packageName = pathParts[r.SubexpIndex("FileName")]
 	}
+	return planned
+}
 
-	return packageId, packageName, nil
+// addEntryChecksums adds the checksum S3 reported for each entry to checksums, keyed by uploadId. A SHA256 computed by
+// finalize, from s3KeyToServerSHA256, stands in for the one S3 doesn't have.
+func addEntryChecksums(entries []UploadEntry, s3KeyToServerSHA256 map[string]string, checksums map[string]FileChecksum) {
+	for i, e := range entries {
+		c := e.Checksum
+		c.ServerSHA256 = s3KeyToServerSHA256[e.S3Key]
+		if e.Sha256 == "" {
+			entries[i].Sha256 = c.ServerSHA256
+		}
+		if c.Value != "" || c.ServerSHA256 != "" || c.ClientSHA256 != "" {
+			checksums[e.UploadId] = c
+		}
+	}
 }
 
 // addToFailedFiles appends array of upload files to failed SQS messages
 func addToFailedFiles(files []uploadFile.UploadFile, s3KeySQSMessageMap map[string]events.SQSMessage,
 	failures []events.SQSBatchItemFailure) []events.SQSBatchItemFailure {
 	for _, f := range files {
+		message, ok := s3KeySQSMessageMap[f.S3Key]
+		if !ok {
+			// A staged merge group member released into this batch has no message in it; it stays staged and is
+			// released again when the rest of its group is retried.
+			continue
+		}
 		failedMessage := events.SQSBatchItemFailure{
-			ItemIdentifier: s3KeySQSMessageMap[f.S3Key].MessageId}
+			ItemIdentifier: message.MessageId}
 
 		failures = append(failures, failedMessage)
 
@@ -933,6 +1402,23 @@ func addToFailedFiles(files []uploadFile.UploadFile, s3KeySQSMessageMap map[stri
 	return failures
 }
 
+// OnConflict MessageAttribute values set by the service lambda's finalize
+// handler. keepBoth and replace map onto pennsieve-go-core conflict
+// strategies; version rides on replace and records the predecessor as a prior
+// version in the same transaction; skip and fail are resolved in ImportFiles
+// before the package insert.
+const (
+	onConflictKeepBoth = "keepBoth"
+	onConflictReplace  = "replace"
+	onConflictVersion  = "version"
+	onConflictSkip     = "skip"
+	onConflictFail     = "fail"
+)
+
+// serverSHA256AttrName is the MessageAttribute the finalize handler sets to
+// the SHA256 it computed for an object S3 stored no SHA256 checksum for.
+const serverSHA256AttrName = "ServerSHA256"
+
 // extractOnConflictAttr returns the OnConflict MessageAttribute from an SQS
 // message, or "keepBoth" when the attribute is missing or empty. Missing
 // attribute is the backward-compatible default: legacy S3-triggered uploads
@@ -940,47 +1426,63 @@ func addToFailedFiles(files []uploadFile.UploadFile, s3KeySQSMessageMap map[stri
 func extractOnConflictAttr(m events.SQSMessage) string {
 	attr, ok := m.MessageAttributes["OnConflict"]
 	if !ok {
-		return "keepBoth"
+		return onConflictKeepBoth
 	}
 	if attr.StringValue == nil || *attr.StringValue == "" {
-		return "keepBoth"
+		return onConflictKeepBoth
 	}
 	return *attr.StringValue
 }
 
-// resolveOnConflictForManifest picks the onConflict value for a manifest's
-// file group. Normally every message in the group carries the same value
-// (set at finalize time); we take the first file's value and log a warning
-// if a different value shows up within the group. That's defensive against
-// a client that somehow issues two concurrent finalize calls for the same
-// manifest with different conflict strategies — unlikely, but we don't want
-// a silent divergence if it happens.
-func resolveOnConflictForManifest(files []uploadFile.UploadFile, s3KeyToOnConflict map[string]string, logger *log.Entry) string {
-	if len(files) == 0 {
-		return "keepBoth"
-	}
-	chosen := s3KeyToOnConflict[files[0].S3Key]
-	if chosen == "" {
-		chosen = "keepBoth"
-	}
-	for _, f := range files[1:] {
-		if v, ok := s3KeyToOnConflict[f.S3Key]; ok && v != "" && v != chosen {
-			logger.WithFields(log.Fields{
-				"chosen": chosen,
-				"other":  v,
-			}).Warn("mixed onConflict values within manifest batch; using first-observed value")
-			break
+// onConflictGroup is a set of files from one manifest that share an onConflict strategy.
+type onConflictGroup struct {
+	onConflict string
+	files      []uploadFile.UploadFile
+}
+
+// groupByOnConflict splits a manifest's files by the onConflict value of the
+// SQS message each file arrived on. Files without a recorded value default to
+// keepBoth. The members of a merge group become one package, so they all take
+// the value of the first member seen and stay in one group even when their
+// messages disagree. Groups are returned in the order their strategy is first
+// seen so imports stay deterministic for a given batch.
+func groupByOnConflict(files []uploadFile.UploadFile, s3KeyToOnConflict map[string]string) []onConflictGroup {
+	var groups []onConflictGroup
+	index := map[string]int{}
+	mergeGroupOnConflict := map[string]string{}
+	for _, f := range files {
+		onConflict := s3KeyToOnConflict[f.S3Key]
+		if onConflict == "" {
+			onConflict = onConflictKeepBoth
+		}
+		if f.MergePackageId != "" {
+			if first, ok := mergeGroupOnConflict[f.MergePackageId]; ok {
+				onConflict = first
+			} else {
+				mergeGroupOnConflict[f.MergePackageId] = onConflict
+			}
+		}
+		i, ok := index[onConflict]
+		if !ok {
+			i = len(groups)
+			index[onConflict] = i
+			groups = append(groups, onConflictGroup{onConflict: onConflict})
 		}
+		groups[i].files = append(groups[i].files, f)
 	}
-	return chosen
+	return groups
 }
 
 // conflictStrategyFromAttr maps the SQS MessageAttribute string to the typed
 // conflictStrategy.Strategy consumed by pennsieve-go-core. Unknown values
 // fall back to KeepBoth (legacy behavior) to keep older clients working.
+// Skip and fail also map to KeepBoth: ImportFiles removes the conflicting
+// packages first, so the library only ever sees non-conflicting names.
+// Version maps to Replace: the library frees the name and links the new
+// package to its predecessor, ImportFiles does the rest.
 func conflictStrategyFromAttr(s string) conflictStrategy.Strategy {
 	switch s {
-	case "replace":
+	case onConflictReplace, onConflictVersion:
 		return conflictStrategy.Replace
 	default:
 		return conflictStrategy.KeepBoth
@@ -1,11 +1,21 @@
 package handler
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sns/types"
 	"github.com/google/uuid"
+	"github.com/pennsieve/pennsieve-go-core/pkg/changelog"
 	"github.com/pennsieve/pennsieve-go-core/pkg/models/dydb"
 	"github.com/pennsieve/pennsieve-go-core/pkg/models/fileInfo/fileType"
+	"github.com/pennsieve/pennsieve-go-core/pkg/models/packageInfo/conflictStrategy"
 	"github.com/pennsieve/pennsieve-go-core/pkg/models/packageInfo/packageType"
 	pgdbmodels "github.com/pennsieve/pennsieve-go-core/pkg/models/pgdb"
 	"github.com/pennsieve/pennsieve-go-core/pkg/models/uploadFile"
@@ -15,7 +25,12 @@ import (
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestStore(t *testing.T) {
@@ -26,6 +41,21 @@ func TestStore(t *testing.T) {
 		"correctly maps files to folders":      testFolderMapping,
 		"test folder mapping for nested files": testNestedStructure,
 		"test deleting orphaned files":         testDeleteOrphanedFiles,
+		"splits manifest group by onConflict":  testGroupByOnConflict,
+		"keeps merge groups in one group":      testGroupByOnConflictMergeGroup,
+		"maps onConflict to library strategy":  testConflictStrategyFromAttr,
+		"bisection isolates failing files":     testBisectImport,
+		"bisection stops on connection errors": testBisectImportFileIndependent,
+		"bisection gives up after its budget":  testBisectImportBudget,
+		"import changelog events":              testImportChangelogEvents,
+		"changelog messages are chunked":       testChangelogMessages,
+		"publishes FileFinalized versions":     testPublishFileFinalizedVersions,
+		"FileFinalized SHA256 prefers client":  testFileFinalizedSHA256,
+		"outbox payloads survive a round trip": testOutboxPayloadRoundTrip,
+		"outbox backoff doubles up to a cap":   testOutboxBackoff,
+		"sniffs file types from content":       testSniffFileType,
+		"detects file types once per batch":    testDetectFileTypes,
+		"merge groups expire after a timeout":  testMergeGroupExpired,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			client := getDynamoDBClient()
@@ -36,12 +66,12 @@ func TestStore(t *testing.T) {
 			}
 
 			mSNS := test.MockSNS{}
-			mS3 := test.MockS3{}
+			mStorage := test.MockStorage{}
 			mPusher := test.NewMockPusherClient()
 			mChangelogger := &test.MockChangelogger{}
 
-			store := NewUploadHandlerStore(pgdbClient, client, mSNS, mS3,
-				ManifestFileTableName, ManifestTableName, SNSTopic, "", mPusher, mChangelogger, nil, "")
+			store := NewUploadHandlerStore(pgdbClient, client, mSNS, mStorage,
+				ManifestFileTableName, ManifestTableName, SNSTopic, "", NewPusherNotifier(mPusher), mChangelogger, nil, "")
 
 			fn(t, store)
 		})
@@ -84,6 +114,180 @@ func testSortFiles(t *testing.T, _ *UploadHandlerStore) {
 
 }
 
+func testGroupByOnConflict(t *testing.T, _ *UploadHandlerStore) {
+
+	files := []uploadFile.UploadFile{
+		{S3Key: "m1/u1", UploadId: "u1"},
+		{S3Key: "m1/u2", UploadId: "u2"},
+		{S3Key: "m1/u3", UploadId: "u3"},
+		{S3Key: "m1/u4", UploadId: "u4"},
+	}
+	s3KeyToOnConflict := map[string]string{
+		"m1/u1": onConflictReplace,
+		"m1/u2": "",
+		"m1/u3": onConflictReplace,
+		"m1/u4": onConflictSkip,
+	}
+
+	groups := groupByOnConflict(files, s3KeyToOnConflict)
+	if assert.Len(t, groups, 3) {
+		assert.Equal(t, onConflictReplace, groups[0].onConflict)
+		assert.Equal(t, []uploadFile.UploadFile{files[0], files[2]}, groups[0].files)
+		assert.Equal(t, onConflictKeepBoth, groups[1].onConflict)
+		assert.Equal(t, []uploadFile.UploadFile{files[1]}, groups[1].files)
+		assert.Equal(t, onConflictSkip, groups[2].onConflict)
+		assert.Equal(t, []uploadFile.UploadFile{files[3]}, groups[2].files)
+	}
+}
+
+func testGroupByOnConflictMergeGroup(t *testing.T, _ *UploadHandlerStore) {
+
+	files := []uploadFile.UploadFile{
+		{S3Key: "m1/u1", UploadId: "u1", MergePackageId: "p1"},
+		{S3Key: "m1/u2", UploadId: "u2"},
+		{S3Key: "m1/u3", UploadId: "u3", MergePackageId: "p1"},
+		{S3Key: "m1/u4", UploadId: "u4", MergePackageId: "p2"},
+	}
+	s3KeyToOnConflict := map[string]string{
+		"m1/u1": onConflictReplace,
+		"m1/u2": onConflictSkip,
+		"m1/u3": onConflictSkip,
+		"m1/u4": onConflictSkip,
+	}
+
+	groups := groupByOnConflict(files, s3KeyToOnConflict)
+	if assert.Len(t, groups, 2) {
+		assert.Equal(t, onConflictReplace, groups[0].onConflict)
+		assert.Equal(t, []uploadFile.UploadFile{files[0], files[2]}, groups[0].files)
+		assert.Equal(t, onConflictSkip, groups[1].onConflict)
+		assert.Equal(t, []uploadFile.UploadFile{files[1], files[3]}, groups[1].files)
+	}
+}
+
+func testMergeGroupExpired(t *testing.T, _ *UploadHandlerStore) {
+	now := time.Now()
+	recent := mergeGroupMember{StagedAt: now.Add(-time.Hour).Unix()}
+	old := mergeGroupMember{StagedAt: now.Add(-mergeGroupTimeout - time.Minute).Unix()}
+
+	assert.False(t, mergeGroupExpired([]mergeGroupMember{recent}, now))
+	assert.True(t, mergeGroupExpired([]mergeGroupMember{recent, old}, now))
+	assert.False(t, mergeGroupExpired([]mergeGroupMember{{}}, now), "a member without a staging time never expires")
+
+	assert.True(t, needsCompleteGroup(uploadFile.UploadFile{MergePackageId: "m", FileType: fileType.EDF}))
+	assert.False(t, needsCompleteGroup(uploadFile.UploadFile{FileType: fileType.EDF}))
+	assert.False(t, needsCompleteGroup(uploadFile.UploadFile{MergePackageId: "m", FileType: fileType.Text}))
+}
+
+func testBisectImport(t *testing.T, _ *UploadHandlerStore) {
+	files := make([]uploadFile.UploadFile, 250)
+	for i := range files {
+		files[i] = uploadFile.UploadFile{UploadId: fmt.Sprintf("file-%03d", i)}
+	}
+
+	for _, poisoned := range [][]int{nil, {0}, {249}, {17, 18}, {3, 120, 240}} {
+		t.Run(fmt.Sprint(poisoned), func(t *testing.T) {
+			poison := map[string]bool{}
+			for _, i := range poisoned {
+				poison[files[i].UploadId] = true
+			}
+
+			calls := 0
+			imported := map[string]int{}
+			failures := bisectImport(files, func(batch []uploadFile.UploadFile) error {
+				calls++
+				for _, f := range batch {
+					if poison[f.UploadId] {
+						return fmt.Errorf("cannot import %s", f.UploadId)
+					}
+				}
+				for _, f := range batch {
+					imported[f.UploadId]++
+				}
+				return nil
+			})
+
+			// Every failing file is reported with its own error, every other file is imported exactly once.
+			assert.Len(t, failures, len(poisoned))
+			for id := range poison {
+				assert.EqualError(t, failures[id], fmt.Sprintf("cannot import %s", id))
+			}
+			assert.Len(t, imported, len(files)-len(poisoned))
+			for id, n := range imported {
+				assert.Equal(t, 1, n, id)
+			}
+
+			// Each failing file costs at most two imports per level of the split tree.
+			assert.LessOrEqual(t, calls, 1+2*len(poisoned)*8)
+		})
+	}
+}
+
+func testBisectImportFileIndependent(t *testing.T, _ *UploadHandlerStore) {
+	files := make([]uploadFile.UploadFile, 250)
+	for i := range files {
+		files[i] = uploadFile.UploadFile{UploadId: fmt.Sprintf("file-%03d", i)}
+	}
+
+	for name, err := range map[string]error{
+		"context":    fmt.Errorf("begin tx: %w", context.DeadlineExceeded),
+		"connection": fmt.Errorf("insert packages: %w", driver.ErrBadConn),
+	} {
+		t.Run(name, func(t *testing.T) {
+			calls := 0
+			failures := bisectImport(files, func(batch []uploadFile.UploadFile) error {
+				calls++
+				return err
+			})
+			assert.Equal(t, 1, calls, "the batch is not split")
+			assert.Len(t, failures, len(files))
+			assert.ErrorIs(t, failures[files[42].UploadId], err)
+		})
+	}
+
+	t.Run("later batches", func(t *testing.T) {
+		calls := 0
+		failures := bisectImport(files, func(batch []uploadFile.UploadFile) error {
+			calls++
+			switch {
+			case calls == 1:
+				return errors.New("cannot import file-000")
+			case calls == 2:
+				return context.Canceled
+			}
+			return nil
+		})
+		assert.Equal(t, 2, calls, "nothing is imported after the context is cancelled")
+		assert.Len(t, failures, len(files))
+		assert.ErrorIs(t, failures[files[249].UploadId], context.Canceled)
+	})
+}
+
+func testBisectImportBudget(t *testing.T, _ *UploadHandlerStore) {
+	files := make([]uploadFile.UploadFile, 250)
+	for i := range files {
+		files[i] = uploadFile.UploadFile{UploadId: fmt.Sprintf("file-%03d", i)}
+	}
+
+	calls := 0
+	failures := bisectImport(files, func(batch []uploadFile.UploadFile) error {
+		calls++
+		return fmt.Errorf("cannot import %s", batch[0].UploadId)
+	})
+	assert.Equal(t, maxBisectImports, calls)
+	assert.Len(t, failures, len(files), "every file fails, isolated or not")
+	assert.EqualError(t, failures[files[0].UploadId], "cannot import file-000")
+	assert.ErrorContains(t, failures[files[249].UploadId], "not imported after")
+}
+
+func testConflictStrategyFromAttr(t *testing.T, _ *UploadHandlerStore) {
+	assert.Equal(t, conflictStrategy.KeepBoth, conflictStrategyFromAttr(onConflictKeepBoth))
+	assert.Equal(t, conflictStrategy.Replace, conflictStrategyFromAttr(onConflictReplace))
+	// Version rides on the library's replace and records the chain itself.
+	assert.Equal(t, conflictStrategy.Replace, conflictStrategyFromAttr(onConflictVersion))
+	assert.Equal(t, conflictStrategy.KeepBoth, conflictStrategyFromAttr(onConflictSkip))
+	assert.Equal(t, conflictStrategy.KeepBoth, conflictStrategyFromAttr("unknown"))
+}
+
 func testFolderMapping(t *testing.T, _ *UploadHandlerStore) {
 
 	uploadFile1 := uploadFile.UploadFile{
@@ -229,25 +433,37 @@ func TestStoreWithPG(t *testing.T) {
 	}
 
 	mSNS := test.MockSNS{}
-	mS3 := test.MockS3{}
+	mStorage := test.MockStorage{}
 	mChangelogger := &test.MockChangelogger{}
 	mPusher := test.NewMockPusherClient()
 
 	orgID := 1
 
-	store := NewUploadHandlerStore(pgdbClient, client, mSNS, mS3,
-		ManifestFileTableName, ManifestTableName, SNSTopic, "", mPusher, mChangelogger, nil, "")
+	store := NewUploadHandlerStore(pgdbClient, client, mSNS, mStorage,
+		ManifestFileTableName, ManifestTableName, SNSTopic, "", NewPusherNotifier(mPusher), mChangelogger, nil, "")
 	require.NoError(t, store.WithOrg(orgID))
 
 	for scenario, fn := range map[string]func(
 		*testing.T, int, *UploadHandlerStore,
 	){
-		"import files":                                    testImportFiles,
-		"import single file at top level":                 testImportFilesSingleFile,
-		"import single file in folder at top level":       testImportFilesSingleFileInFolder,
-		"import single file with leading slash":           testImportFilesSingleWithLeadingSlash,
-		"import single file in folder with leading slash": testImportFilesSingleInFolderWithLeadingSlash,
-		"import files with leading slash in path values":  testImportFilesWithLeadingSlash,
+		"import files":                                     testImportFiles,
+		"import single file at top level":                  testImportFilesSingleFile,
+		"import single file in folder at top level":        testImportFilesSingleFileInFolder,
+		"import single file with leading slash":            testImportFilesSingleWithLeadingSlash,
+		"import single file in folder with leading slash":  testImportFilesSingleInFolderWithLeadingSlash,
+		"import files with leading slash in path values":   testImportFilesWithLeadingSlash,
+		"conflicting file is skipped with onConflict skip": testImportFilesConflictSkip,
+		"conflicting file fails with onConflict fail":      testImportFilesConflictFail,
+		"redelivered file is imported once":                testImportFilesRedelivered,
+		"concurrent imports create a folder once":          testImportFilesConcurrentFolders,
+		"storage is added to every ancestor":               testImportFilesStorage,
+		"prior versions are hidden and still charged":      testImportFilesVersionsHidden,
+		"late merged members join the existing package":    testImportFilesLateMergedMember,
+		"concurrent merged members create one package":     testImportFilesConcurrentMergedMembers,
+		"created folders and packages are logged":          testImportFilesChangelog,
+		"import messages are delivered through the outbox": testImportFilesOutbox,
+		"outbox relay retries failed deliveries":           testRelayOutbox,
+		"outbox relay gives up after max attempts":         testRelayOutboxDead,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			t.Cleanup(func() {
@@ -256,6 +472,8 @@ func TestStoreWithPG(t *testing.T) {
 				testHelpers.Truncate(t, store.pgdb, orgID, "package_storage")
 				testHelpers.Truncate(t, store.pgdb, orgID, "organization_storage")
 				testHelpers.Truncate(t, store.pgdb, orgID, "dataset_storage")
+				_, err := store.pgdb.Exec("DELETE FROM pennsieve.upload_outbox;")
+				require.NoError(t, err)
 				mChangelogger.Clear()
 				mPusher.Clear()
 			})
@@ -307,7 +525,8 @@ func testImportFilesSingleFile(t *testing.T, orgID int, store *UploadHandlerStor
 		},
 	}
 
-	if assert.NoError(t, store.ImportFiles(context.Background(), datasetID, orgID, user, files, manifest, false, "")) {
+	_, err := store.ImportFiles(context.Background(), datasetID, orgID, user, files, manifest, false, "", nil, nil)
+	if assert.NoError(t, err) {
 		if test.AssertRowCount(t, store.pgdb, orgID, "packages", 1) {
 			test.AssertExistsOneWhere(t, store.pgdb, orgID, "packages", map[string]any{"name": "file1.txt", "parent_id": nil})
 		}
@@ -360,7 +579,8 @@ func testImportFilesSingleFileInFolder(t *testing.T, orgID int, store *UploadHan
 		},
 	}
 
-	if assert.NoError(t, store.ImportFiles(context.Background(), datasetID, orgID, user, files, manifest, false, "")) {
+	_, err := store.ImportFiles(context.Background(), datasetID, orgID, user, files, manifest, false, "", nil, nil)
+	if assert.NoError(t, err) {
 		// One package for the folder and one for the file
 		if test.AssertRowCount(t, store.pgdb, orgID, "packages", 2) {
 			test.AssertExistsOneWhere(t, store.pgdb, orgID, "packages", map[string]any{"name": "dir1", "parent_id": nil})
@@ -416,7 +636,8 @@ func testImportFilesSingleWithLeadingSlash(t *testing.T, orgID int, store *Uploa
 		},
 	}
 
-	if assert.NoError(t, store.ImportFiles(context.Background(), datasetID, orgID, user, files, manifest, false, "")) {
+	_, err := store.ImportFiles(context.Background(), datasetID, orgID, user, files, manifest, false, "", nil, nil)
+	if assert.NoError(t, err) {
 		// There should only be one package since the path is "/", the import should not create a containing folder.
 		if test.AssertRowCount(t, store.pgdb, orgID, "packages", 1) {
 			test.AssertExistsOneWhere(t, store.pgdb, orgID, "packages", map[string]any{"name": "file1.txt", "parent_id": nil})
@@ -470,7 +691,8 @@ func testImportFilesSingleInFolderWithLeadingSlash(t *testing.T, orgID int, stor
 		},
 	}
 
-	if assert.NoError(t, store.ImportFiles(context.Background(), datasetID, orgID, user, files, manifest, false, "")) {
+	_, err := store.ImportFiles(context.Background(), datasetID, orgID, user, files, manifest, false, "", nil, nil)
+	if assert.NoError(t, err) {
 		// Two packages: dir1 and file1.txt
 		if test.AssertRowCount(t, store.pgdb, orgID, "packages", 2) {
 			test.AssertExistsOneWhere(t, store.pgdb, orgID, "packages", map[string]any{"name": "dir1", "parent_id": nil})
@@ -576,7 +798,8 @@ func testImportFiles(t *testing.T, orgID int, store *UploadHandlerStore) {
 		},
 	}
 
-	if assert.NoError(t, store.ImportFiles(context.Background(), datasetID, orgID, user, files, manifest, false, "")) {
+	_, err := store.ImportFiles(context.Background(), datasetID, orgID, user, files, manifest, false, "", nil, nil)
+	if assert.NoError(t, err) {
 		if test.AssertRowCount(t, store.pgdb, orgID, "packages", 7) {
 			test.AssertExistsOneWhere(t, store.pgdb, orgID, "packages",
 				map[string]any{"name": "root1.txt", "parent_id": nil})
@@ -699,7 +922,8 @@ func testImportFilesWithLeadingSlash(t *testing.T, orgID int, store *UploadHandl
 		},
 	}
 
-	if assert.NoError(t, store.ImportFiles(context.Background(), datasetID, orgID, user, files, manifest, false, "")) {
+	_, err := store.ImportFiles(context.Background(), datasetID, orgID, user, files, manifest, false, "", nil, nil)
+	if assert.NoError(t, err) {
 		if test.AssertRowCount(t, store.pgdb, orgID, "packages", 7) {
 			test.AssertExistsOneWhere(t, store.pgdb, orgID, "packages",
 				map[string]any{"name": "root1.txt", "parent_id": nil})
@@ -729,3 +953,923 @@ func testImportFilesWithLeadingSlash(t *testing.T, orgID int, store *UploadHandl
 	}
 
 }
+
+// importConflictingFile imports file1.txt at the top level of the dataset,
+// then imports a second upload with the same name under onConflict and
+// returns the second ImportResult.
+func importConflictingFile(t *testing.T, orgID int, store *UploadHandlerStore, onConflict string) (*ImportResult, uploadFile.UploadFile) {
+	datasetID := 1
+	user := pgdbmodels.User{
+		Id:           int64(1),
+		NodeId:       "N:user:99f02be5-009c-4ecd-9006-f016d48628bf",
+		Email:        uuid.NewString(),
+		FirstName:    uuid.NewString(),
+		LastName:     uuid.NewString(),
+		IsSuperAdmin: false,
+		PreferredOrg: int64(orgID),
+	}
+	manifestID := uuid.NewString()
+	manifest := &dydb.ManifestTable{
+		ManifestId:     manifestID,
+		DatasetId:      int64(datasetID),
+		DatasetNodeId:  uuid.NewString(),
+		OrganizationId: int64(orgID),
+		UserId:         user.Id,
+	}
+	newFile := func() uploadFile.UploadFile {
+		uploadID := uuid.NewString()
+		return uploadFile.UploadFile{
+			ManifestId: manifestID,
+			UploadId:   uploadID,
+			S3Bucket:   "bucket",
+			S3Key:      fmt.Sprintf("%s/%s", manifestID, uploadID),
+			Name:       "file1.txt",
+			Extension:  "txt",
+			FileType:   fileType.Text,
+			Type:       packageType.Text,
+		}
+	}
+
+	_, err := store.ImportFiles(context.Background(), datasetID, orgID, user, []uploadFile.UploadFile{newFile()}, manifest, false, onConflictKeepBoth, nil, nil)
+	require.NoError(t, err)
+
+	conflicting := newFile()
+	result, err := store.ImportFiles(context.Background(), datasetID, orgID, user, []uploadFile.UploadFile{conflicting}, manifest, false, onConflict, nil, nil)
+	require.NoError(t, err)
+
+	// The original package and file are untouched and nothing new was created.
+	test.AssertRowCount(t, store.pgdb, orgID, "packages", 1)
+	test.AssertRowCount(t, store.pgdb, orgID, "files", 1)
+
+	return result, conflicting
+}
+
+func testImportFilesConflictSkip(t *testing.T, orgID int, store *UploadHandlerStore) {
+	result, conflicting := importConflictingFile(t, orgID, store, onConflictSkip)
+
+	if assert.Len(t, result.Skipped, 1) {
+		assert.Equal(t, conflicting.UploadId, result.Skipped[0].UploadId)
+	}
+	assert.Empty(t, result.Failed)
+	assert.Contains(t, result.Reasons[conflicting.UploadId], "file1.txt")
+}
+
+func testImportFilesConflictFail(t *testing.T, orgID int, store *UploadHandlerStore) {
+	result, conflicting := importConflictingFile(t, orgID, store, onConflictFail)
+
+	if assert.Len(t, result.Failed, 1) {
+		assert.Equal(t, conflicting.UploadId, result.Failed[0].UploadId)
+	}
+	assert.Empty(t, result.Skipped)
+	assert.Contains(t, result.Reasons[conflicting.UploadId], "name conflict")
+}
+
+func testImportFilesRedelivered(t *testing.T, orgID int, store *UploadHandlerStore) {
+	datasetID := 1
+	user := pgdbmodels.User{
+		IsSuperAdmin: false,
+		PreferredOrg: int64(orgID),
+	}
+	manifestID := uuid.NewString()
+	manifest := &dydb.ManifestTable{
+		ManifestId:     manifestID,
+		DatasetId:      int64(datasetID),
+		DatasetNodeId:  uuid.NewString(),
+		OrganizationId: int64(orgID),
+		UserId:         user.Id,
+	}
+	uploadID := uuid.NewString()
+	file := uploadFile.UploadFile{
+		ManifestId: manifestID,
+		UploadId:   uploadID,
+		S3Bucket:   "bucket",
+		S3Key:      fmt.Sprintf("%s/%s", manifestID, uploadID),
+		Name:       "file1.txt",
+		Extension:  "txt",
+		FileType:   fileType.Text,
+		Type:       packageType.Text,
+	}
+
+	// The same event twice in one batch, then again in a later batch.
+	_, err := store.ImportFiles(context.Background(), datasetID, orgID, user, []uploadFile.UploadFile{file, file}, manifest, false, onConflictKeepBoth, nil, nil)
+	require.NoError(t, err)
+
+	other := file
+	other.UploadId = uuid.NewString()
+	other.S3Key = fmt.Sprintf("%s/%s", manifestID, other.UploadId)
+	other.Name = "file2.txt"
+	result, err := store.ImportFiles(context.Background(), datasetID, orgID, user, []uploadFile.UploadFile{file, other}, manifest, false, onConflictKeepBoth, nil, nil)
+	require.NoError(t, err)
+
+	// The redelivered file counts as imported, so its status transition completes.
+	assert.False(t, result.notImported(file.UploadId))
+	test.AssertRowCount(t, store.pgdb, orgID, "packages", 2)
+	test.AssertRowCount(t, store.pgdb, orgID, "files", 2)
+	test.AssertExistsOneWhere(t, store.pgdb, orgID, "files", map[string]any{"uuid": uploadID})
+}
+
+func testImportFilesConcurrentFolders(t *testing.T, orgID int, store *UploadHandlerStore) {
+	datasetID := 1
+	user := pgdbmodels.User{
+		IsSuperAdmin: false,
+		PreferredOrg: int64(orgID),
+	}
+	manifestID := uuid.NewString()
+	manifest := &dydb.ManifestTable{
+		ManifestId:     manifestID,
+		DatasetId:      int64(datasetID),
+		DatasetNodeId:  uuid.NewString(),
+		OrganizationId: int64(orgID),
+		UserId:         user.Id,
+	}
+
+	// Each import runs on its own connection, like two upload lambdas.
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+	for i := range errs {
+		db, err := pgdb.ConnectENVWithOrg(orgID)
+		require.NoError(t, err)
+		defer db.Close()
+		lambdaStore := NewUploadHandlerStore(db, store.dynamodb, store.SNSClient, store.Storage,
+			ManifestFileTableName, ManifestTableName, SNSTopic, "", store.notifier, store.changelogClient, nil, "")
+
+		uploadID := uuid.NewString()
+		file := uploadFile.UploadFile{
+			ManifestId: manifestID,
+			UploadId:   uploadID,
+			S3Bucket:   "bucket",
+			S3Key:      fmt.Sprintf("%s/%s", manifestID, uploadID),
+			Path:       "data/sub",
+			Name:       fmt.Sprintf("file%d.txt", i),
+			Extension:  "txt",
+			FileType:   fileType.Text,
+			Type:       packageType.Text,
+		}
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = lambdaStore.ImportFiles(context.Background(), datasetID, orgID, user, []uploadFile.UploadFile{file}, manifest, false, onConflictKeepBoth, nil, nil)
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		assert.NoError(t, err)
+	}
+	test.AssertExistsOneWhere(t, store.pgdb, orgID, "packages", map[string]any{"name": "data"})
+	test.AssertExistsOneWhere(t, store.pgdb, orgID, "packages", map[string]any{"name": "sub"})
+	test.AssertRowCount(t, store.pgdb, orgID, "files", 4)
+}
+
+func testImportFilesStorage(t *testing.T, orgID int, store *UploadHandlerStore) {
+	datasetID := 1
+	user := pgdbmodels.User{
+		IsSuperAdmin: false,
+		PreferredOrg: int64(orgID),
+	}
+	manifestID := uuid.NewString()
+	manifest := &dydb.ManifestTable{
+		ManifestId:     manifestID,
+		DatasetId:      int64(datasetID),
+		DatasetNodeId:  uuid.NewString(),
+		OrganizationId: int64(orgID),
+		UserId:         user.Id,
+	}
+	var files []uploadFile.UploadFile
+	for i, path := range []string{"a/b", "a/b", "a"} {
+		uploadID := uuid.NewString()
+		files = append(files, uploadFile.UploadFile{
+			ManifestId: manifestID,
+			UploadId:   uploadID,
+			S3Bucket:   "bucket",
+			S3Key:      fmt.Sprintf("%s/%s", manifestID, uploadID),
+			Path:       path,
+			Name:       fmt.Sprintf("file%d.txt", i),
+			Extension:  "txt",
+			FileType:   fileType.Text,
+			Type:       packageType.Text,
+			Size:       int64(10 * (i + 1)),
+		})
+	}
+
+	_, err := store.ImportFiles(context.Background(), datasetID, orgID, user, files, manifest, false, onConflictKeepBoth, nil, nil)
+	require.NoError(t, err)
+
+	packageSize := func(name string) int64 {
+		var size int64
+		err := store.pgdb.QueryRow(fmt.Sprintf(
+			`SELECT ps.size FROM "%d".package_storage ps JOIN "%d".packages p ON p.id = ps.package_id WHERE p.name = $1`,
+			orgID, orgID), name).Scan(&size)
+		require.NoError(t, err)
+		return size
+	}
+	assert.Equal(t, int64(60), packageSize("a"))
+	assert.Equal(t, int64(30), packageSize("b"))
+	assert.Equal(t, int64(10), packageSize("file0.txt"))
+	assert.Equal(t, int64(30), packageSize("file2.txt"))
+
+	var datasetSize int64
+	err = store.pgdb.QueryRow(fmt.Sprintf(`SELECT size FROM "%d".dataset_storage WHERE dataset_id = $1`, orgID),
+		datasetID).Scan(&datasetSize)
+	require.NoError(t, err)
+	assert.Equal(t, int64(60), datasetSize)
+}
+
+func testImportFilesVersionsHidden(t *testing.T, orgID int, store *UploadHandlerStore) {
+	datasetID := 1
+	user := pgdbmodels.User{
+		IsSuperAdmin: false,
+		PreferredOrg: int64(orgID),
+	}
+	manifestID := uuid.NewString()
+	manifest := &dydb.ManifestTable{
+		ManifestId:     manifestID,
+		DatasetId:      int64(datasetID),
+		DatasetNodeId:  uuid.NewString(),
+		OrganizationId: int64(orgID),
+		UserId:         user.Id,
+	}
+
+	for i, onConflict := range []string{onConflictKeepBoth, onConflictVersion, onConflictVersion} {
+		uploadID := uuid.NewString()
+		file := uploadFile.UploadFile{
+			ManifestId: manifestID,
+			UploadId:   uploadID,
+			S3Bucket:   "bucket",
+			S3Key:      fmt.Sprintf("%s/%s", manifestID, uploadID),
+			Path:       "a",
+			Name:       "file.txt",
+			Extension:  "txt",
+			FileType:   fileType.Text,
+			Type:       packageType.Text,
+			Size:       int64(10 * (i + 1)),
+		}
+		_, err := store.ImportFiles(context.Background(), datasetID, orgID, user, []uploadFile.UploadFile{file}, manifest, false, onConflict, nil, nil)
+		require.NoError(t, err)
+	}
+	test.AssertRowCount(t, store.pgdb, orgID, "packages", 4)
+
+	var folder pgdbmodels.Package
+	err := store.pgdb.QueryRow(fmt.Sprintf(`SELECT id FROM "%d".packages WHERE name = 'a'`, orgID)).Scan(&folder.Id)
+	require.NoError(t, err)
+	children, err := store.pg.GetPackageChildren(context.Background(), &folder, datasetID, false)
+	require.NoError(t, err)
+	require.Len(t, children, 1, "only the newest version is listed")
+	conflicts, err := store.pg.GetConflictingPackages(context.Background(), datasetID, []pgdbmodels.PackageParams{
+		{Name: "file.txt", NodeId: "N:package:new", ParentId: folder.Id},
+	})
+	require.NoError(t, err)
+	if assert.Len(t, conflicts, 1) {
+		assert.Equal(t, children[0].Id, conflicts["N:package:new"].Id)
+	}
+
+	var folderSize, datasetSize int64
+	err = store.pgdb.QueryRow(fmt.Sprintf(`SELECT size FROM "%d".package_storage WHERE package_id = $1`, orgID),
+		folder.Id).Scan(&folderSize)
+	require.NoError(t, err)
+	assert.Equal(t, int64(60), folderSize, "prior versions keep their bytes")
+	err = store.pgdb.QueryRow(fmt.Sprintf(`SELECT size FROM "%d".dataset_storage WHERE dataset_id = $1`, orgID),
+		datasetID).Scan(&datasetSize)
+	require.NoError(t, err)
+	assert.Equal(t, int64(60), datasetSize)
+}
+
+func testImportFilesLateMergedMember(t *testing.T, orgID int, store *UploadHandlerStore) {
+	datasetID := 1
+	user := pgdbmodels.User{
+		IsSuperAdmin: false,
+		PreferredOrg: int64(orgID),
+	}
+	manifestID := uuid.NewString()
+	manifest := &dydb.ManifestTable{
+		ManifestId:     manifestID,
+		DatasetId:      int64(datasetID),
+		DatasetNodeId:  uuid.NewString(),
+		OrganizationId: int64(orgID),
+		UserId:         user.Id,
+	}
+	mergeID := uuid.NewString()
+	member := func(name string, size int64) uploadFile.UploadFile {
+		uploadID := uuid.NewString()
+		return uploadFile.UploadFile{
+			ManifestId:     manifestID,
+			UploadId:       uploadID,
+			S3Bucket:       "bucket",
+			S3Key:          fmt.Sprintf("%s/%s", manifestID, uploadID),
+			Path:           "a",
+			Name:           name,
+			Extension:      "txt",
+			FileType:       fileType.Text,
+			Type:           packageType.Text,
+			Size:           size,
+			MergePackageId: mergeID,
+		}
+	}
+
+	// Two members arrive in one batch and the rest one at a time in later ones.
+	_, err := store.ImportFiles(context.Background(), datasetID, orgID, user,
+		[]uploadFile.UploadFile{member("rec.txt", 10), member("rec.meta.txt", 20)}, manifest, false, onConflictKeepBoth, nil, nil)
+	require.NoError(t, err)
+	for _, onConflict := range []string{onConflictKeepBoth, onConflictFail} {
+		res, err := store.ImportFiles(context.Background(), datasetID, orgID, user,
+			[]uploadFile.UploadFile{member("rec.data.txt", 100)}, manifest, false, onConflict, nil, nil)
+		require.NoError(t, err)
+		assert.Empty(t, res.Failed, onConflict)
+	}
+
+	var packageIDs []int64
+	rows, err := store.pgdb.Query(fmt.Sprintf(`SELECT id FROM "%d".packages WHERE node_id = $1`, orgID),
+		fmt.Sprintf("N:package:%s", mergeID))
+	require.NoError(t, err)
+	for rows.Next() {
+		var id int64
+		require.NoError(t, rows.Scan(&id))
+		packageIDs = append(packageIDs, id)
+	}
+	require.NoError(t, rows.Err())
+	require.Len(t, packageIDs, 1)
+
+	var fileCount int
+	err = store.pgdb.QueryRow(fmt.Sprintf(`SELECT COUNT(*) FROM "%d".files WHERE package_id = $1`, orgID),
+		packageIDs[0]).Scan(&fileCount)
+	require.NoError(t, err)
+	assert.Equal(t, 4, fileCount)
+
+	var packageSize, folderSize int64
+	err = store.pgdb.QueryRow(fmt.Sprintf(`SELECT size FROM "%d".package_storage WHERE package_id = $1`, orgID),
+		packageIDs[0]).Scan(&packageSize)
+	require.NoError(t, err)
+	assert.Equal(t, int64(230), packageSize)
+	err = store.pgdb.QueryRow(fmt.Sprintf(
+		`SELECT ps.size FROM "%d".package_storage ps JOIN "%d".packages p ON p.id = ps.package_id WHERE p.name = 'a'`,
+		orgID, orgID)).Scan(&folderSize)
+	require.NoError(t, err)
+	assert.Equal(t, int64(230), folderSize)
+}
+
+func testImportFilesConcurrentMergedMembers(t *testing.T, orgID int, store *UploadHandlerStore) {
+	datasetID := 1
+	user := pgdbmodels.User{
+		IsSuperAdmin: false,
+		PreferredOrg: int64(orgID),
+	}
+	manifestID := uuid.NewString()
+	manifest := &dydb.ManifestTable{
+		ManifestId:     manifestID,
+		DatasetId:      int64(datasetID),
+		DatasetNodeId:  uuid.NewString(),
+		OrganizationId: int64(orgID),
+		UserId:         user.Id,
+	}
+	mergeID := uuid.NewString()
+
+	// Every member arrives in its own batch on its own connection before any of them created the package.
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+	for i := range errs {
+		db, err := pgdb.ConnectENVWithOrg(orgID)
+		require.NoError(t, err)
+		defer db.Close()
+		lambdaStore := NewUploadHandlerStore(db, store.dynamodb, store.SNSClient, store.Storage,
+			ManifestFileTableName, ManifestTableName, SNSTopic, "", store.notifier, store.changelogClient, nil, "")
+
+		uploadID := uuid.NewString()
+		file := uploadFile.UploadFile{
+			ManifestId:     manifestID,
+			UploadId:       uploadID,
+			S3Bucket:       "bucket",
+			S3Key:          fmt.Sprintf("%s/%s", manifestID, uploadID),
+			Path:           "a",
+			Name:           fmt.Sprintf("rec.%d.txt", i),
+			Extension:      "txt",
+			FileType:       fileType.Text,
+			Type:           packageType.Text,
+			MergePackageId: mergeID,
+		}
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = lambdaStore.ImportFiles(context.Background(), datasetID, orgID, user, []uploadFile.UploadFile{file}, manifest, false, onConflictKeepBoth, nil, nil)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		assert.NoError(t, err)
+	}
+
+	var packageID int64
+	err := store.pgdb.QueryRow(fmt.Sprintf(`SELECT id FROM "%d".packages WHERE node_id = $1`, orgID),
+		fmt.Sprintf("N:package:%s", mergeID)).Scan(&packageID)
+	require.NoError(t, err)
+	test.AssertRowCount(t, store.pgdb, orgID, "files", 4)
+	test.AssertExistsOneWhere(t, store.pgdb, orgID, "packages", map[string]any{"name": "a"})
+
+	var fileCount int
+	err = store.pgdb.QueryRow(fmt.Sprintf(`SELECT COUNT(*) FROM "%d".files WHERE package_id = $1`, orgID),
+		packageID).Scan(&fileCount)
+	require.NoError(t, err)
+	assert.Equal(t, 4, fileCount)
+}
+
+func testImportChangelogEvents(t *testing.T, _ *UploadHandlerStore) {
+	folder := pgdbmodels.Package{Id: 1, Name: "data", NodeId: "N:collection:1"}
+	created := pgdbmodels.Package{Id: 2, Name: "sub", NodeId: "N:collection:2", ParentId: sql.NullInt64{Int64: 1, Valid: true}}
+	replacement := pgdbmodels.Package{
+		Id:                4,
+		Name:              "file.txt",
+		NodeId:            "N:package:4",
+		ParentId:          sql.NullInt64{Int64: 2, Valid: true},
+		ReplacesPackageId: sql.NullInt64{Int64: 3, Valid: true},
+	}
+	predecessors := map[int64]pgdbmodels.Package{3: {Id: 3, Name: "file.txt", NodeId: "N:package:3"}}
+	folders := pgdbmodels.PackageMap{"data": folder, "data/sub": created}
+
+	events := importChangelogEvents([]pgdbmodels.Package{created}, []pgdbmodels.Package{replacement}, predecessors,
+		folders, time.Now())
+	require.Len(t, events, 3)
+
+	assert.Equal(t, changelog.CreatePackage, events[0].EventType)
+	assert.Equal(t, changelog.PackageCreateEvent{Id: 2, Name: "sub", NodeId: "N:collection:2",
+		Parent: &changelog.ParentPackage{Id: 1, Name: "data", NodeId: "N:collection:1"}}, events[0].EventDetail)
+
+	assert.Equal(t, changelog.CreatePackage, events[1].EventType)
+	assert.Equal(t, int64(4), events[1].EventDetail.(changelog.PackageCreateEvent).Id)
+
+	assert.Equal(t, changelog.DeletePackage, events[2].EventType)
+	deleted := events[2].EventDetail.(packageDeleteEvent)
+	assert.Equal(t, int64(3), deleted.Id)
+	assert.Equal(t, "N:package:3", deleted.NodeId)
+	assert.Equal(t, "N:collection:2", deleted.Parent.NodeId)
+	assert.Equal(t, "N:package:4", deleted.ReplacedBy.NodeId)
+}
+
+func testChangelogMessages(t *testing.T, store *UploadHandlerStore) {
+	mChangelogger := store.changelogClient.(*test.MockChangelogger)
+	params := changelog.MessageParams{OrganizationId: 1, DatasetId: 2, UserId: "N:user:1", TraceId: "manifest"}
+
+	// 2000 events of about 300 bytes need more than one 240 KiB message.
+	var events []changelog.Event
+	for i := 0; i < 2000; i++ {
+		events = append(events, changelog.Event{
+			EventType: changelog.CreatePackage,
+			EventDetail: changelog.PackageCreateEvent{
+				Id:     int64(i),
+				Name:   strings.Repeat("x", 200),
+				NodeId: fmt.Sprintf("N:package:%d", i),
+			},
+			Timestamp: time.Now(),
+		})
+	}
+
+	messages, err := changelogOutboxMessages(params, events)
+	require.NoError(t, err)
+	for _, m := range messages {
+		require.NoError(t, store.deliverOutboxMessage(context.Background(), m))
+	}
+	require.Greater(t, len(mChangelogger.Messages), 1)
+
+	ids := map[string]bool{}
+	next := 0
+	for _, m := range mChangelogger.Messages {
+		body, err := json.Marshal(m)
+		require.NoError(t, err)
+		assert.LessOrEqual(t, len(body), maxChangelogMessageBytes)
+
+		job := m.DatasetChangelogEventJob
+		assert.Equal(t, params.TraceId, job.TraceId)
+		assert.Equal(t, params.DatasetId, job.DatasetId)
+		assert.False(t, ids[job.Id], "every message has its own id")
+		ids[job.Id] = true
+		for _, e := range job.Events {
+			assert.Equal(t, int64(next), e.EventDetail.(changelog.PackageCreateEvent).Id, "events stay in order")
+			next++
+		}
+	}
+	assert.Equal(t, len(events), next)
+
+	// Nothing to log sends nothing.
+	messages, err = changelogOutboxMessages(params, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, messages)
+}
+
+func testImportFilesChangelog(t *testing.T, orgID int, store *UploadHandlerStore) {
+	mChangelogger := store.changelogClient.(*test.MockChangelogger)
+	datasetID := 1
+	user := pgdbmodels.User{
+		NodeId:       "N:user:99f02be5-009c-4ecd-9006-f016d48628bf",
+		PreferredOrg: int64(orgID),
+	}
+	manifestID := uuid.NewString()
+	manifest := &dydb.ManifestTable{
+		ManifestId:     manifestID,
+		DatasetId:      int64(datasetID),
+		DatasetNodeId:  uuid.NewString(),
+		OrganizationId: int64(orgID),
+		UserId:         user.Id,
+	}
+	newFile := func(path string, name string) uploadFile.UploadFile {
+		uploadID := uuid.NewString()
+		return uploadFile.UploadFile{
+			ManifestId: manifestID,
+			UploadId:   uploadID,
+			S3Bucket:   "bucket",
+			S3Key:      fmt.Sprintf("%s/%s", manifestID, uploadID),
+			Path:       path,
+			Name:       name,
+			Extension:  "txt",
+			FileType:   fileType.Text,
+			Type:       packageType.Text,
+		}
+	}
+
+	_, err := store.ImportFiles(context.Background(), datasetID, orgID, user,
+		[]uploadFile.UploadFile{newFile("data/sub", "file1.txt")}, manifest, false, onConflictKeepBoth, nil, nil)
+	require.NoError(t, err)
+
+	// A second import into the existing folder logs only its package.
+	_, err = store.ImportFiles(context.Background(), datasetID, orgID, user,
+		[]uploadFile.UploadFile{newFile("data/sub", "file2.txt")}, manifest, false, onConflictKeepBoth, nil, nil)
+	require.NoError(t, err)
+
+	var names [][]string
+	for _, m := range mChangelogger.Messages {
+		assert.Equal(t, manifestID, m.DatasetChangelogEventJob.TraceId)
+		assert.Equal(t, user.NodeId, m.DatasetChangelogEventJob.UserId)
+		var batch []string
+		for _, e := range m.DatasetChangelogEventJob.Events {
+			assert.Equal(t, changelog.CreatePackage, e.EventType)
+			batch = append(batch, e.EventDetail.(changelog.PackageCreateEvent).Name)
+		}
+		names = append(names, batch)
+	}
+	assert.Equal(t, [][]string{{"data", "sub", "file1.txt"}, {"file2.txt"}}, names)
+}
+
+func testPublishFileFinalizedVersions(t *testing.T, store *UploadHandlerStore) {
+	defer func(v FileFinalizedVersions) { FileFinalizedEventVersions = v }(FileFinalizedEventVersions)
+
+	fileUUID := uuid.New()
+	file := pgdbmodels.File{
+		Id:        "7",
+		PackageId: 3,
+		Name:      "scan.nii",
+		FileType:  fileType.NIFTI,
+		S3Bucket:  "bucket",
+		S3Key:     "O1/D1/manifest/" + fileUUID.String(),
+		Size:      42,
+		CheckSum:  "etag-1",
+		UUID:      fileUUID,
+	}
+	manifest := &dydb.ManifestTable{ManifestId: "manifest", DatasetId: 1, DatasetNodeId: "N:dataset:1", OrganizationId: 1}
+	details := finalizedFileDetails{
+		uploader: pgdbmodels.User{Id: 5, NodeId: "N:user:5"},
+		uploads: map[string]uploadFile.UploadFile{
+			fileUUID.String(): {UploadId: fileUUID.String(), Path: "data/sub"},
+		},
+		checksums: map[string]FileChecksum{
+			fileUUID.String(): {Algorithm: "CRC64NVME", Type: "FULL_OBJECT", Value: "crc", ClientSHA256: "declared"},
+		},
+		packages: map[int64]pgdbmodels.Package{
+			3: {Id: 3, NodeId: "N:package:3", ReplacesPackageId: sql.NullInt64{Int64: 2, Valid: true}},
+		},
+	}
+
+	for versions, expected := range map[FileFinalizedVersions][]string{
+		FileFinalizedV1:   {"1"},
+		FileFinalizedV2:   {"2"},
+		FileFinalizedDual: {"1", "2"},
+	} {
+		FileFinalizedEventVersions = versions
+		recorder := &test.MockSNSRecorder{}
+		publisher := NewUploadHandlerStore(store.pgdb, store.dynamodb, recorder, store.Storage,
+			ManifestFileTableName, ManifestTableName, SNSTopic, "file-finalized", store.notifier, store.changelogClient, nil, "")
+
+		require.NoError(t, publisher.PublishFileFinalized(context.Background(), []pgdbmodels.File{file}, manifest, details))
+		require.Len(t, recorder.Batches, 1)
+
+		var published []string
+		for _, e := range recorder.Batches[0].PublishBatchRequestEntries {
+			version := *e.MessageAttributes["eventVersion"].StringValue
+			assert.Equal(t, "Number", *e.MessageAttributes["eventVersion"].DataType)
+			published = append(published, version)
+
+			if version == "1" {
+				var evt FileFinalizedEvent
+				require.NoError(t, json.Unmarshal([]byte(*e.Message), &evt))
+				assert.Equal(t, "etag-1", evt.Checksum, "version 1 keeps the ETag as checksum")
+				continue
+			}
+			var evt FileFinalizedEventV2
+			require.NoError(t, json.Unmarshal([]byte(*e.Message), &evt))
+			assert.Equal(t, 2, evt.EventVersion)
+			assert.Equal(t, "etag-1", evt.ETag)
+			assert.Equal(t, &FileFinalizedChecksum{Algorithm: "CRC64NVME", Type: "FULL_OBJECT", Value: "crc"}, evt.Checksum)
+			assert.Equal(t, "declared", evt.SHA256)
+			assert.Equal(t, "N:package:3", evt.PackageNodeID)
+			if assert.NotNil(t, evt.ReplacedPackageID) {
+				assert.Equal(t, int64(2), *evt.ReplacedPackageID)
+			}
+			assert.Equal(t, "data/sub", evt.DatasetPath)
+			assert.Equal(t, "N:dataset:1", evt.DatasetNodeID)
+			assert.Equal(t, int64(5), evt.UploaderID)
+			assert.Equal(t, "N:user:5", evt.UploaderNodeID)
+		}
+		assert.Equal(t, expected, published, versions)
+	}
+
+	_, err := ParseFileFinalizedVersions("3")
+	assert.Error(t, err)
+}
+
+func testFileFinalizedSHA256(t *testing.T, _ *UploadHandlerStore) {
+	fileUUID := uuid.New()
+	file := pgdbmodels.File{Id: "7", PackageId: 3, Name: "scan.nii", UUID: fileUUID}
+	manifest := &dydb.ManifestTable{ManifestId: "manifest", DatasetId: 1, OrganizationId: 1}
+
+	for expected, c := range map[string]FileChecksum{
+		"declared": {Algorithm: "SHA256", Type: "FULL_OBJECT", Value: "declared", ClientSHA256: "declared"},
+		"stored":   {Algorithm: "SHA256", Type: "FULL_OBJECT", Value: "stored"},
+		"server":   {Algorithm: "SHA256", Type: "COMPOSITE", Value: "composite-3", ServerSHA256: "server"},
+		"":         {Algorithm: "CRC32C", Type: "FULL_OBJECT", Value: "crc"},
+	} {
+		details := finalizedFileDetails{checksums: map[string]FileChecksum{fileUUID.String(): c}}
+		evt := newFileFinalizedEventV2(file, 7, manifest, details, nil, "standard", "now", "trace")
+		assert.Equal(t, expected, evt.SHA256, c)
+	}
+}
+
+func testOutboxPayloadRoundTrip(t *testing.T, _ *UploadHandlerStore) {
+	var entries []types.PublishBatchRequestEntry
+	for i := 0; i < 12; i++ {
+		entries = append(entries, types.PublishBatchRequestEntry{
+			Id:      aws.String(fmt.Sprintf("e%d", i)),
+			Message: aws.String(fmt.Sprintf(`{"index":%d}`, i)),
+			MessageAttributes: map[string]types.MessageAttributeValue{
+				"eventVersion": {DataType: aws.String("Number"), StringValue: aws.String("2")},
+			},
+		})
+	}
+
+	messages := outboxSNSMessages("arn:aws:sns:us-east-1:123456789012:topic", entries)
+	require.Len(t, messages, 2, "one message per PublishBatch request of at most 10 entries")
+
+	var roundTripped []types.PublishBatchRequestEntry
+	for _, m := range messages {
+		b, err := json.Marshal(m.payload)
+		require.NoError(t, err)
+		payload, err := outboxPayload[outboxSNSPayload](outboxMessage{kind: m.kind, payload: json.RawMessage(b)})
+		require.NoError(t, err)
+		assert.Equal(t, "arn:aws:sns:us-east-1:123456789012:topic", payload.TopicArn)
+		roundTripped = append(roundTripped, payload.batchEntries()...)
+	}
+	assert.Equal(t, entries, roundTripped)
+
+	jobs := make([]DeletePackageJobParams, 11)
+	for i := range jobs {
+		jobs[i] = DeletePackageJobParams{PackageId: int64(i), OrganizationId: 1, UserNodeId: "N:user:1", TraceId: "manifest"}
+	}
+	jobMessages := deletePackageJobOutboxMessages(jobs)
+	require.Len(t, jobMessages, 2)
+	b, err := json.Marshal(jobMessages[1].payload)
+	require.NoError(t, err)
+	decoded, err := outboxPayload[[]DeletePackageJobParams](outboxMessage{kind: outboxDeletePackageJobs, payload: json.RawMessage(b)})
+	require.NoError(t, err)
+	assert.Equal(t, jobs[10:], decoded)
+
+	_, ok, err := notificationOutboxMessage("dataset-1", uploadEventName, nil)
+	require.NoError(t, err)
+	assert.False(t, ok, "no items, no notification")
+}
+
+func testOutboxBackoff(t *testing.T, _ *UploadHandlerStore) {
+	assert.Equal(t, 30*time.Second, outboxBackoff(1))
+	assert.Equal(t, time.Minute, outboxBackoff(2))
+	assert.Equal(t, 4*time.Minute, outboxBackoff(4))
+	assert.Equal(t, time.Hour, outboxBackoff(8))
+	assert.Equal(t, time.Hour, outboxBackoff(1000))
+}
+
+func testSniffFileType(t *testing.T, _ *UploadHandlerStore) {
+	at := func(offset int, magic string) []byte {
+		header := make([]byte, offset+len(magic)+16)
+		copy(header[offset:], magic)
+		return header
+	}
+	gzipped := func(data []byte) []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		_, err := zw.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, zw.Close())
+		return buf.Bytes()
+	}
+
+	for name, tc := range map[string]struct {
+		header  []byte
+		want    fileType.Type
+		matched bool
+	}{
+		"dicom":            {at(128, "DICM"), fileType.DICOM, true},
+		"nifti-1":          {at(344, "n+1\x00"), fileType.NIFTI, true},
+		"nifti-1 pair":     {at(344, "ni1\x00"), fileType.NIFTI, true},
+		"nifti-2":          {at(4, "n+2\x00\r\n\x1a\n"), fileType.NIFTI, true},
+		"gzipped nifti":    {gzipped(at(344, "n+1\x00")), fileType.NIFTI, true},
+		"hdf5":             {at(0, "\x89HDF\r\n\x1a\n"), fileType.HDF5, true},
+		"hdf5 user block":  {at(512, "\x89HDF\r\n\x1a\n"), fileType.HDF5, true},
+		"truncated header": {[]byte("DIC"), fileType.GenericData, false},
+		"plain text":       {[]byte("just some text that matches nothing"), fileType.GenericData, false},
+		"gzipped text":     {gzipped([]byte("just some text")), fileType.GenericData, false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			got, matched := sniffFileType(tc.header)
+			assert.Equal(t, tc.matched, matched)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+
+	assert.True(t, needsSniffing(uploadFile.UploadFile{FileType: fileType.GenericData}))
+	assert.False(t, needsSniffing(uploadFile.UploadFile{FileType: fileType.DICOM}))
+}
+
+// headerStorage serves the objects in headers and counts the reads; other objects are empty.
+type headerStorage struct {
+	test.MockStorage
+	headers map[string][]byte
+	reads   *atomic.Int32
+}
+
+func (s headerStorage) OpenRange(ctx context.Context, bucket string, key string, offset int64, length int64) (io.ReadCloser, error) {
+	s.reads.Add(1)
+	return io.NopCloser(bytes.NewReader(s.headers[key])), nil
+}
+
+func testDetectFileTypes(t *testing.T, _ *UploadHandlerStore) {
+	dicom := make([]byte, 256)
+	copy(dicom[128:], "DICM")
+	objects := headerStorage{
+		headers: map[string][]byte{"scan": dicom, "notes": []byte("just some text")},
+		reads:   &atomic.Int32{},
+	}
+	sniffer := &UploadHandlerStore{Storage: objects}
+
+	files := []uploadFile.UploadFile{
+		{UploadId: "scan", S3Key: "scan", FileType: fileType.GenericData},
+		{UploadId: "notes", S3Key: "notes", FileType: fileType.GenericData},
+		{UploadId: "empty", S3Key: "empty", FileType: fileType.GenericData},
+		{UploadId: "text", S3Key: "text", FileType: fileType.Text},
+	}
+	detections := sniffer.detectFileTypes(context.Background(), files)
+	assert.Equal(t, int32(3), objects.reads.Load(), "files with a recognised type are not read")
+	assert.Equal(t, map[string]fileTypeDetection{
+		"scan":  {Declared: fileType.GenericData, Detected: fileType.DICOM, Matched: true},
+		"notes": {Declared: fileType.GenericData, Detected: fileType.GenericData},
+	}, detections)
+	assert.Equal(t, fileType.GenericData, files[0].FileType, "detection leaves the files alone")
+
+	applyFileTypeDetections(files, detections, log.NewEntry(log.StandardLogger()))
+	assert.Equal(t, fileType.DICOM, files[0].FileType)
+	assert.Equal(t, packageType.FileTypeToInfoDict[fileType.DICOM].PackageType, files[0].Type)
+	assert.Equal(t, fileType.GenericData, files[1].FileType)
+	assert.Equal(t, fileType.Text, files[3].FileType)
+}
+
+// countOutbox returns the number of entries in the outbox.
+func countOutbox(t *testing.T, store *UploadHandlerStore) int {
+	var n int
+	require.NoError(t, store.pgdb.QueryRow("SELECT COUNT(*) FROM pennsieve.upload_outbox;").Scan(&n))
+	return n
+}
+
+func testImportFilesOutbox(t *testing.T, orgID int, store *UploadHandlerStore) {
+	mChangelogger := store.changelogClient.(*test.MockChangelogger)
+	datasetID := 1
+	user := pgdbmodels.User{
+		NodeId:       "N:user:99f02be5-009c-4ecd-9006-f016d48628bf",
+		PreferredOrg: int64(orgID),
+	}
+	manifestID := uuid.NewString()
+	manifest := &dydb.ManifestTable{
+		ManifestId:     manifestID,
+		DatasetId:      int64(datasetID),
+		DatasetNodeId:  uuid.NewString(),
+		OrganizationId: int64(orgID),
+		UserId:         user.Id,
+	}
+	newFile := func(name string) uploadFile.UploadFile {
+		uploadID := uuid.NewString()
+		return uploadFile.UploadFile{
+			ManifestId: manifestID,
+			UploadId:   uploadID,
+			S3Bucket:   "bucket",
+			S3Key:      fmt.Sprintf("%s/%s", manifestID, uploadID),
+			Path:       "data",
+			Name:       name,
+			Extension:  "txt",
+			FileType:   fileType.Text,
+			Type:       packageType.Text,
+		}
+	}
+
+	_, err := store.ImportFiles(context.Background(), datasetID, orgID, user,
+		[]uploadFile.UploadFile{newFile("file1.txt")}, manifest, false, onConflictKeepBoth, nil, nil)
+	require.NoError(t, err)
+	assert.Len(t, mChangelogger.Messages, 1)
+	assert.Zero(t, countOutbox(t, store), "delivered messages leave the outbox")
+
+	// Without a jobs queue, replacing a package records no DeletePackageJob that could never be delivered.
+	_, err = store.ImportFiles(context.Background(), datasetID, orgID, user,
+		[]uploadFile.UploadFile{newFile("file1.txt")}, manifest, false, onConflictReplace, nil, nil)
+	require.NoError(t, err)
+	assert.Zero(t, countOutbox(t, store))
+}
+
+func testRelayOutbox(t *testing.T, orgID int, store *UploadHandlerStore) {
+	mChangelogger := store.changelogClient.(*test.MockChangelogger)
+	ctx := context.Background()
+	params := changelog.MessageParams{OrganizationId: int64(orgID), DatasetId: 1, UserId: "N:user:1", TraceId: "manifest"}
+	messages, err := changelogOutboxMessages(params, []changelog.Event{{
+		EventType:   changelog.CreatePackage,
+		EventDetail: changelog.PackageCreateEvent{Id: 1, Name: "file1.txt", NodeId: "N:package:1"},
+		Timestamp:   time.Now(),
+	}})
+	require.NoError(t, err)
+	// The store has no jobs queue, so the DeletePackageJob fails.
+	messages = append(messages, deletePackageJobOutboxMessages([]DeletePackageJobParams{
+		{PackageId: 2, OrganizationId: orgID, UserNodeId: "N:user:1", TraceId: "manifest"},
+	})...)
+
+	// Entries still leased to the import that recorded them are left alone.
+	_, err = store.pg.AddOutboxMessages(ctx, orgID, 1, messages, outboxLease)
+	require.NoError(t, err)
+	store.RelayOutbox(ctx)
+	assert.Empty(t, mChangelogger.Messages)
+	assert.Equal(t, 2, countOutbox(t, store))
+	_, err = store.pgdb.Exec("DELETE FROM pennsieve.upload_outbox;")
+	require.NoError(t, err)
+
+	_, err = store.pg.AddOutboxMessages(ctx, orgID, 1, messages, 0)
+	require.NoError(t, err)
+	store.RelayOutbox(ctx)
+
+	if assert.Len(t, mChangelogger.Messages, 1) {
+		sent := mChangelogger.Messages[0].DatasetChangelogEventJob
+		expected := messages[0].payload.(changelog.Message).DatasetChangelogEventJob
+		assert.Equal(t, expected.Id, sent.Id, "a retried message keeps its id")
+		require.Len(t, sent.Events, 1)
+		assert.Equal(t, changelog.CreatePackage, sent.Events[0].EventType)
+	}
+
+	var kind, lastError string
+	var attempts int
+	var waiting bool
+	require.NoError(t, store.pgdb.QueryRow(
+		"SELECT kind, attempts, last_error, next_attempt_at > CURRENT_TIMESTAMP FROM pennsieve.upload_outbox;").
+		Scan(&kind, &attempts, &lastError, &waiting))
+	assert.Equal(t, string(outboxDeletePackageJobs), kind)
+	assert.Equal(t, 1, attempts)
+	assert.Contains(t, lastError, "jobs queue URL is not configured")
+	assert.True(t, waiting, "the failed entry waits for its backoff")
+
+	// Not due yet, so another run leaves it alone.
+	store.RelayOutbox(ctx)
+	require.NoError(t, store.pgdb.QueryRow("SELECT attempts FROM pennsieve.upload_outbox;").Scan(&attempts))
+	assert.Equal(t, 1, attempts)
+}
+
+func testRelayOutboxDead(t *testing.T, orgID int, store *UploadHandlerStore) {
+	ctx := context.Background()
+	// The store has no jobs queue, so the DeletePackageJob fails.
+	messages := deletePackageJobOutboxMessages([]DeletePackageJobParams{
+		{PackageId: 2, OrganizationId: orgID, UserNodeId: "N:user:1", TraceId: "manifest"},
+	})
+	_, err := store.pg.AddOutboxMessages(ctx, orgID, 1, messages, 0)
+	require.NoError(t, err)
+	_, err = store.pgdb.Exec("UPDATE pennsieve.upload_outbox SET attempts = $1;", outboxMaxAttempts-1)
+	require.NoError(t, err)
+
+	store.RelayOutbox(ctx)
+
+	var attempts int
+	var dead bool
+	require.NoError(t, store.pgdb.QueryRow("SELECT attempts, dead_at IS NOT NULL FROM pennsieve.upload_outbox;").
+		Scan(&attempts, &dead))
+	assert.Equal(t, outboxMaxAttempts, attempts)
+	assert.True(t, dead, "the last failed attempt kills the entry")
+
+	backlog, err := store.pg.GetOutboxBacklog(ctx, outboxStuckAttempts)
+	require.NoError(t, err)
+	assert.Equal(t, 0, backlog.pending)
+	assert.Equal(t, 0, backlog.stuck)
+	assert.Equal(t, 1, backlog.dead)
+	assert.Zero(t, backlog.oldest, "dead entries do not age the backlog")
+
+	// Even when due, a dead entry is not claimed again.
+	_, err = store.pgdb.Exec("UPDATE pennsieve.upload_outbox SET next_attempt_at = CURRENT_TIMESTAMP;")
+	require.NoError(t, err)
+	store.RelayOutbox(ctx)
+	require.NoError(t, store.pgdb.QueryRow("SELECT attempts FROM pennsieve.upload_outbox;").Scan(&attempts))
+	assert.Equal(t, outboxMaxAttempts, attempts)
+}
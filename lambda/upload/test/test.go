@@ -2,13 +2,15 @@ package test
 
 import (
 	"context"
-	"github.com/aws/aws-sdk-go-v2/aws"
+	"io"
+	"strings"
+	"time"
+
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/aws/aws-sdk-go-v2/service/sns"
 	"github.com/aws/smithy-go/middleware"
 	"github.com/pennsieve/pennsieve-go-core/pkg/changelog"
+	"github.com/pennsieve/pennsieve-upload-service-v2/storage"
 	"github.com/pusher/pusher-http-go/v5"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -25,30 +27,57 @@ func (s MockSNS) PublishBatch(ctx context.Context, params *sns.PublishBatchInput
 	return &result, nil
 }
 
-type MockS3 struct{}
+// MockSNSRecorder records the PublishBatch requests it receives.
+type MockSNSRecorder struct {
+	Batches []*sns.PublishBatchInput
+}
 
-func (s MockS3) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
-	result := s3.HeadObjectOutput{
-		ChecksumSHA256: aws.String("fakeSHA"),
-	}
+func (s *MockSNSRecorder) PublishBatch(ctx context.Context, params *sns.PublishBatchInput, optFns ...func(*sns.Options)) (*sns.PublishBatchOutput, error) {
+	s.Batches = append(s.Batches, params)
+	return &sns.PublishBatchOutput{}, nil
+}
 
-	return &result, nil
+// MockStorage serves every object as a small file with a full-object SHA256 checksum.
+type MockStorage struct{}
+
+func (s MockStorage) Type() storage.BackendType {
+	return storage.BackendS3
 }
 
-func (s MockS3) DeleteObjects(ctx context.Context, params *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error) {
+func (s MockStorage) Stat(ctx context.Context, bucket string, key string) (storage.ObjectInfo, error) {
+	return storage.ObjectInfo{
+		Bucket:   bucket,
+		Key:      key,
+		Checksum: storage.ObjectChecksum{Algorithm: "SHA256", Type: "FULL_OBJECT", Value: "fakeSHA"},
+	}, nil
+}
 
-	var deleted []types.DeletedObject
-	toBeDeleted := params.Delete.Objects
-	for _, f := range toBeDeleted {
-		deleted = append(deleted, types.DeletedObject{
-			Key: f.Key,
-		})
-	}
+func (s MockStorage) Open(ctx context.Context, bucket string, key string) (io.ReadCloser, error) {
+	return io.NopCloser(strings.NewReader("")), nil
+}
 
-	result := s3.DeleteObjectsOutput{
-		Deleted: deleted,
-	}
-	return &result, nil
+func (s MockStorage) OpenRange(ctx context.Context, bucket string, key string, offset int64, length int64) (io.ReadCloser, error) {
+	return io.NopCloser(strings.NewReader("")), nil
+}
+
+func (s MockStorage) Copy(ctx context.Context, srcBucket string, srcKey string, dstBucket string, dstKey string) error {
+	return nil
+}
+
+func (s MockStorage) Delete(ctx context.Context, bucket string, keys ...string) error {
+	return nil
+}
+
+func (s MockStorage) List(ctx context.Context, bucket string, prefix string, fn func(storage.ObjectInfo) error) error {
+	return nil
+}
+
+func (s MockStorage) PresignGet(ctx context.Context, bucket string, key string, expires time.Duration) (string, error) {
+	return "", storage.ErrNotSupported
+}
+
+func (s MockStorage) Credentials(ctx context.Context, req storage.CredentialsRequest) (*storage.Credentials, error) {
+	return nil, storage.ErrNotSupported
 }
 
 type MockChangelogger struct {
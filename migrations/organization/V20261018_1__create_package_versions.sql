@@ -0,0 +1,16 @@
+-- Version history for packages imported with onConflict=version.
+--
+-- One row per package that superseded a predecessor. The predecessor keeps its
+-- files and S3 objects and stays charged to storage. It is moved to state
+-- VERSIONED, which the upload service hides from listings and name conflicts
+-- the same way as DELETING, and no DeletePackageJob is issued for it.
+-- Walk previous_package_id to reconstruct the full chain; purging a prior
+-- version ends the chain at the newer version instead of deleting its row.
+CREATE TABLE IF NOT EXISTS package_versions
+(
+    package_id          INTEGER   NOT NULL PRIMARY KEY REFERENCES packages (id) ON DELETE CASCADE,
+    previous_package_id INTEGER   UNIQUE REFERENCES packages (id) ON DELETE SET NULL,
+    version             INTEGER   NOT NULL,
+    user_id             INTEGER   NOT NULL,
+    created_at          TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
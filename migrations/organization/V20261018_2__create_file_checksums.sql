@@ -0,0 +1,12 @@
+-- The checksum S3 stored for each imported source file, in any algorithm S3
+-- supports. files.sha256 only holds SHA256 values; this table also records
+-- CRC32, CRC32C, CRC64NVME and SHA1 checksums and whether the value covers the
+-- full object or is a multipart composite ("<base64>-<parts>").
+CREATE TABLE IF NOT EXISTS file_checksums
+(
+    file_id       INTEGER      NOT NULL PRIMARY KEY REFERENCES files (id) ON DELETE CASCADE,
+    algorithm     VARCHAR(16)  NOT NULL,
+    checksum_type VARCHAR(16)  NOT NULL,
+    checksum      VARCHAR(128) NOT NULL,
+    created_at    TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
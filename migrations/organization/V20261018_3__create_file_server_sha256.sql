@@ -0,0 +1,18 @@
+-- SHA256 values the upload service computed itself because S3 stored no SHA256
+-- checksum for the object (the client uploaded without one, or the file came
+-- through the legacy upload bucket).
+--
+-- computed_by is where the object was hashed: 'finalize' (inline, small
+-- objects), 'reconcile' (asynchronously after import, large objects) or
+-- 'upload-move' (legacy upload-bucket path, after the copy to storage).
+-- declared_sha256 is the value the object was compared against, and verified
+-- the outcome; both are NULL when there was nothing to compare against.
+CREATE TABLE IF NOT EXISTS file_server_sha256
+(
+    file_id         INTEGER     NOT NULL PRIMARY KEY REFERENCES files (id) ON DELETE CASCADE,
+    sha256          VARCHAR(44) NOT NULL,
+    declared_sha256 VARCHAR(44),
+    verified        BOOLEAN,
+    computed_by     VARCHAR(16) NOT NULL,
+    created_at      TIMESTAMP   NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,13 @@
+-- Per-dataset storage bucket overrides. The storage resolver checks this table
+-- first, then organizations.storage_bucket, then the deployment's default
+-- bucket. A dataset without a row uses its organization's bucket.
+--
+-- The bucket must already be covered by the account-service storage policies
+-- the upload service's roles attach; adding a row does not grant access.
+CREATE TABLE IF NOT EXISTS dataset_storage_buckets
+(
+    dataset_id     INTEGER      NOT NULL PRIMARY KEY REFERENCES datasets (id) ON DELETE CASCADE,
+    storage_bucket VARCHAR(255) NOT NULL,
+    created_at     TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at     TIMESTAMP    NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,14 @@
+-- File types the upload service detected from an object's content because the
+-- manifest declared a type it could not map to a package (typically a file
+-- with a missing or unrecognised extension).
+--
+-- declared_type is the type the manifest resolved to; detected_type is the
+-- type the leading bytes matched, or NULL when no known signature matched and
+-- the file was imported as declared.
+CREATE TABLE IF NOT EXISTS file_type_detections
+(
+    file_id       INTEGER     NOT NULL PRIMARY KEY REFERENCES files (id) ON DELETE CASCADE,
+    declared_type VARCHAR(64) NOT NULL,
+    detected_type VARCHAR(64),
+    created_at    TIMESTAMP   NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,27 @@
+-- Side effects of imports that have yet to be delivered: SNS publishes,
+-- changelog messages, DeletePackageJobs and client notifications. An import
+-- records its rows in the transaction that commits it and deletes each row
+-- once the message is delivered; the upload lambda's relay retries the rest
+-- from next_attempt_at. A single table across organizations lets one relay
+-- query serve them all.
+--
+-- An entry that failed too many times is dead (dead_at is set): the relay no
+-- longer claims it, and it stays until the reconcile lambda's inspectOutbox
+-- mode requeues it. The relay only reads live entries, so the due index
+-- leaves the dead ones out.
+CREATE TABLE IF NOT EXISTS pennsieve.upload_outbox
+(
+    id              BIGSERIAL   NOT NULL PRIMARY KEY,
+    organization_id INTEGER     NOT NULL,
+    dataset_id      INTEGER     NOT NULL,
+    kind            VARCHAR(32) NOT NULL,
+    payload         JSONB       NOT NULL,
+    attempts        INTEGER     NOT NULL DEFAULT 0,
+    last_error      TEXT,
+    created_at      TIMESTAMP   NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    next_attempt_at TIMESTAMP   NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    dead_at         TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS upload_outbox_next_attempt_at_idx ON pennsieve.upload_outbox (next_attempt_at)
+    WHERE dead_at IS NULL;
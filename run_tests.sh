@@ -23,6 +23,13 @@ echo ""
 cd ../../lambda/upload; \
   go test -v ./... ;
 echo ""
+echo "*******************************"
+echo "*   Testing Reconcile Lambda  *"
+echo "*******************************"
+echo ""
+cd ../../lambda/reconcile; \
+  go test -v ./... ;
+echo ""
 echo "******************************"
 echo "*   Testing Archiver Lambda  *"
 echo "******************************"
@@ -35,4 +42,11 @@ echo "*   Testing Move Fargate Task	*"
 echo "**********************************"
 echo ""
 cd ../../fargate/upload-move; \
-  go test -v ./... ;
\ No newline at end of file
+  go test -v ./... ;
+echo ""
+echo "**********************************"
+echo "*   Testing Storage Module       *"
+echo "**********************************"
+echo ""
+cd ../../storage; \
+  go test -v ./... ;
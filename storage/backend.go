@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// BackendType identifies the kind of object store a deployment writes to.
+type BackendType string
+
+const (
+	// BackendS3 stores objects in S3 buckets.
+	BackendS3 BackendType = "s3"
+	// BackendLocal stores objects on a local filesystem, one directory per
+	// bucket. Used by on-prem installs and local end-to-end tests.
+	BackendLocal BackendType = "local"
+)
+
+// ParseBackendType returns the BackendType for s. Empty is BackendS3.
+func ParseBackendType(s string) (BackendType, error) {
+	switch t := BackendType(s); t {
+	case "":
+		return BackendS3, nil
+	case BackendS3, BackendLocal:
+		return t, nil
+	default:
+		return "", fmt.Errorf("unsupported storage backend %q", s)
+	}
+}
+
+var (
+	// ErrObjectNotFound is returned by Stat and Open when the object does not exist.
+	ErrObjectNotFound = errors.New("object not found")
+	// ErrNotSupported is returned for operations a backend cannot perform,
+	// such as issuing credentials for a local filesystem.
+	ErrNotSupported = errors.New("operation not supported by storage backend")
+)
+
+// ObjectChecksum is the checksum a backend stored with an object. S3 stores
+// at most one per object. Algorithm is upper case ("SHA256", "CRC32C", ...)
+// and Type is "FULL_OBJECT" or "COMPOSITE"; a composite Value carries a
+// "-<parts>" suffix. The zero value means no checksum was stored.
+type ObjectChecksum struct {
+	Algorithm string
+	Type      string
+	Value     string
+}
+
+// ObjectInfo describes a stored object.
+type ObjectInfo struct {
+	Bucket       string
+	Key          string
+	Size         int64
+	ETag         string
+	LastModified time.Time
+	Checksum     ObjectChecksum
+}
+
+// CredentialsRequest asks for temporary credentials that allow writing under
+// Prefix in Bucket.
+type CredentialsRequest struct {
+	Bucket   string
+	Prefix   string
+	Session  string
+	Duration time.Duration
+}
+
+// Credentials are temporary credentials for direct uploads to a backend.
+type Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Expiration      time.Time
+	Region          string
+}
+
+// StorageBackend is the set of object-store operations the upload service
+// performs on upload and storage buckets. Implementations must be safe for
+// concurrent use.
+type StorageBackend interface {
+	// Type returns the kind of backend.
+	Type() BackendType
+	// Stat returns the object's metadata, or ErrObjectNotFound.
+	Stat(ctx context.Context, bucket string, key string) (ObjectInfo, error)
+	// Open returns the object's content, or ErrObjectNotFound. The caller
+	// closes the reader.
+	Open(ctx context.Context, bucket string, key string) (io.ReadCloser, error)
+	// OpenRange returns up to length bytes of the object's content from
+	// offset, or ErrObjectNotFound. A range past the end of the object
+	// reads nothing. The caller closes the reader.
+	OpenRange(ctx context.Context, bucket string, key string, offset int64, length int64) (io.ReadCloser, error)
+	// Copy copies an object, possibly between buckets, replacing any
+	// existing object at the destination.
+	Copy(ctx context.Context, srcBucket string, srcKey string, dstBucket string, dstKey string) error
+	// Delete removes objects from a bucket. Keys that do not exist are not
+	// an error.
+	Delete(ctx context.Context, bucket string, keys ...string) error
+	// List calls fn for every object whose key starts with prefix, in key
+	// order, and stops at the first error fn returns.
+	List(ctx context.Context, bucket string, prefix string, fn func(ObjectInfo) error) error
+	// PresignGet returns a URL that reads the object without further
+	// credentials until it expires.
+	PresignGet(ctx context.Context, bucket string, key string, expires time.Duration) (string, error)
+	// Credentials returns temporary credentials scoped to a bucket prefix,
+	// or ErrNotSupported.
+	Credentials(ctx context.Context, req CredentialsRequest) (*Credentials, error)
+}
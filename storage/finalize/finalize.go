@@ -0,0 +1,91 @@
+// Package finalize defines the message the finalize endpoint and the reconcile
+// lambda send to the upload trigger queue for a verified object. The upload
+// lambda reads it; keeping the one definition here keeps senders and reader
+// from drifting apart.
+package finalize
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// MessageType is the type discriminator of a Message body.
+const MessageType = "pennsieve.upload.finalize"
+
+// MessageVersion is the newest Message version. The upload lambda returns
+// messages of a higher version to the queue, so it must be deployed before a
+// sender of a new version.
+const MessageVersion = 1
+
+// Sources of a Message.
+const (
+	SourceFinalize  = "finalize"
+	SourceReconcile = "reconcile"
+)
+
+// Message is the upload trigger queue body for a verified object. Unlike the
+// S3 notifications the queue also receives, it carries what the sender
+// already knows about the file, so the import does not read the object again.
+type Message struct {
+	Type    string `json:"type"`
+	Version int    `json:"version"`
+
+	Bucket     string `json:"bucket"`
+	Key        string `json:"key"`
+	ManifestID string `json:"manifestId"`
+	UploadID   string `json:"uploadId"`
+	Size       int64  `json:"size"`
+	ETag       string `json:"etag,omitempty"`
+	// Checksum is the checksum storage holds for the object, as the sender
+	// read it. Nil when the sender did not read one; the import then reads it.
+	Checksum *Checksum `json:"checksum,omitempty"`
+	// ClientSHA256 is the full-object SHA256 the client declared, base64 like
+	// S3 checksums. The import checks it against the object's SHA256.
+	ClientSHA256 string `json:"clientSha256,omitempty"`
+	// ServerSHA256 is the SHA256 the sender computed for an object storage
+	// holds no SHA256 checksum for.
+	ServerSHA256 string `json:"serverSha256,omitempty"`
+	// OnConflict is the conflict strategy of the file; empty means keepBoth.
+	OnConflict string `json:"onConflict,omitempty"`
+
+	// Source is SourceFinalize or SourceReconcile. The finalize request and
+	// job ids are only set by the finalize endpoint.
+	Source            string `json:"source"`
+	FinalizeRequestID string `json:"finalizeRequestId,omitempty"`
+	FinalizeJobID     string `json:"finalizeJobId,omitempty"`
+}
+
+// Checksum is a storage checksum carried by a Message.
+type Checksum struct {
+	Algorithm string `json:"algorithm"`
+	Type      string `json:"type,omitempty"`
+	Value     string `json:"value"`
+}
+
+// IsMessage returns true when body is typed as a Message, whatever its
+// version.
+func IsMessage(body []byte) bool {
+	var envelope struct {
+		Type string `json:"type"`
+	}
+	return json.Unmarshal(body, &envelope) == nil && envelope.Type == MessageType
+}
+
+// Decode reads a Message body. It returns an error for a version newer than
+// MessageVersion and for a message that names no object.
+func Decode(body []byte) (*Message, error) {
+	var m Message
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil, fmt.Errorf("malformed finalize message: %w", err)
+	}
+	if m.Type != MessageType {
+		return nil, fmt.Errorf("not a finalize message: type %q", m.Type)
+	}
+	if m.Version < 1 || m.Version > MessageVersion {
+		return nil, fmt.Errorf("unsupported finalize message version %d", m.Version)
+	}
+	if m.Bucket == "" || m.Key == "" {
+		return nil, fmt.Errorf("finalize message for upload %s has no bucket or key", m.UploadID)
+	}
+	return &m, nil
+}
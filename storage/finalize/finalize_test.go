@@ -0,0 +1,76 @@
+package finalize
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessage(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T){
+		"decodes what a sender encodes":        testRoundTrip,
+		"rejects versions it does not know":    testVersion,
+		"rejects messages that name no object": testNoObject,
+		"recognizes messages by type":          testIsMessage,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			fn(t)
+		})
+	}
+}
+
+func testMessage() Message {
+	return Message{
+		Type:         MessageType,
+		Version:      MessageVersion,
+		Bucket:       "storage",
+		Key:          "O1/D1/m/u",
+		ManifestID:   "m",
+		UploadID:     "u",
+		Size:         42,
+		Checksum:     &Checksum{Algorithm: "SHA256", Type: "FULL_OBJECT", Value: "c2hh"},
+		ClientSHA256: "c2hh",
+		Source:       SourceFinalize,
+	}
+}
+
+func testRoundTrip(t *testing.T) {
+	sent := testMessage()
+	body, err := json.Marshal(sent)
+	require.NoError(t, err)
+
+	got, err := Decode(body)
+	require.NoError(t, err)
+	assert.Equal(t, sent, *got)
+}
+
+func testVersion(t *testing.T) {
+	for _, version := range []int{0, MessageVersion + 1} {
+		m := testMessage()
+		m.Version = version
+		body, _ := json.Marshal(m)
+
+		_, err := Decode(body)
+		assert.Error(t, err, "version %d", version)
+		assert.True(t, IsMessage(body), "version %d", version)
+	}
+}
+
+func testNoObject(t *testing.T) {
+	m := testMessage()
+	m.Key = ""
+	body, _ := json.Marshal(m)
+
+	_, err := Decode(body)
+	assert.ErrorContains(t, err, "upload u has no bucket or key")
+}
+
+func testIsMessage(t *testing.T) {
+	assert.False(t, IsMessage([]byte(`{"heartbeat":true}`)))
+	assert.False(t, IsMessage([]byte(`not json`)))
+
+	_, err := Decode([]byte(`{"heartbeat":true}`))
+	assert.Error(t, err)
+}
@@ -0,0 +1,142 @@
+// Package importplan derives, from the files of a manifest, the folders and
+// packages an import creates. The upload lambda imports from a Plan and the
+// service lambda previews one, so the two agree on folder paths, package node
+// ids and names, and on which files share a package.
+//
+// It works on plain strings so that neither consumer's model types leak into
+// the other.
+package importplan
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// File is what planning needs to know about a file of a manifest.
+type File struct {
+	UploadId       string
+	Path           string
+	Name           string
+	MergePackageId string
+}
+
+// Folder is a collection referenced by the path of at least one file.
+type Folder struct {
+	Path       string
+	Name       string
+	ParentPath string // "" for a folder at the root of the target
+	Depth      int
+}
+
+// Package is a package the import creates. Files share a package when they
+// share a MergePackageId.
+//   - Files indexes the planned files, in path order; the first one names the
+//     package and places it.
+type Package struct {
+	NodeId     string
+	Name       string
+	ParentPath string
+	Files      []int
+}
+
+// Plan is the folders and packages for a set of files.
+//   - Folders lists parents before their children, in the order the sorted
+//     files reference them.
+//   - Packages is in the order of their first file.
+type Plan struct {
+	Folders  []Folder
+	Packages []Package
+}
+
+var fileNameRegex = regexp.MustCompile(`(?P<FileName>[^.]*)?\.?(?P<Extension>.*)`)
+
+// TrimPath removes leading and trailing slashes, which manifests may or may
+// not include.
+func TrimPath(path string) string {
+	return strings.Trim(path, "/")
+}
+
+// PackageNodeId returns the node id of the package a file is imported into:
+// its merge package if it has one, its own otherwise.
+func PackageNodeId(f File) string {
+	if len(f.MergePackageId) > 0 {
+		return fmt.Sprintf("N:package:%s", f.MergePackageId)
+	}
+	return fmt.Sprintf("N:package:%s", f.UploadId)
+}
+
+// PackageName returns the name of the package a file is imported into: the
+// file name, or for a merged package the file name without its extension.
+func PackageName(f File) string {
+	if len(f.MergePackageId) == 0 {
+		return f.Name
+	}
+	// Both groups are optional, so every name matches.
+	pathParts := fileNameRegex.FindStringSubmatch(f.Name)
+	return pathParts[fileNameRegex.SubexpIndex("FileName")]
+}
+
+// New plans the import of files below targetFolder ("" for the dataset root).
+// Paths are trimmed and files are visited in path order, keeping the given
+// order among files in the same folder.
+func New(files []File, targetFolder string) *Plan {
+	targetFolder = TrimPath(targetFolder)
+
+	paths := make([]string, len(files))
+	order := make([]int, len(files))
+	for i, f := range files {
+		paths[i] = TrimPath(f.Path)
+		if targetFolder != "" {
+			paths[i] = TrimPath(targetFolder + "/" + paths[i])
+		}
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return paths[order[i]] < paths[order[j]]
+	})
+
+	plan := &Plan{}
+	folders := map[string]bool{}
+	packages := map[string]int{}
+	for _, i := range order {
+		p := paths[i]
+		if p != "" {
+			absolute := ""
+			for depth, segment := range strings.Split(p, "/") {
+				parent := absolute
+				if depth > 0 {
+					absolute = absolute + "/" + segment
+				} else {
+					absolute = segment
+				}
+				if folders[absolute] {
+					continue
+				}
+				folders[absolute] = true
+				plan.Folders = append(plan.Folders, Folder{
+					Path:       absolute,
+					Name:       segment,
+					ParentPath: parent,
+					Depth:      depth,
+				})
+			}
+		}
+
+		nodeId := PackageNodeId(files[i])
+		if k, ok := packages[nodeId]; ok {
+			plan.Packages[k].Files = append(plan.Packages[k].Files, i)
+			continue
+		}
+		packages[nodeId] = len(plan.Packages)
+		plan.Packages = append(plan.Packages, Package{
+			NodeId:     nodeId,
+			Name:       PackageName(files[i]),
+			ParentPath: p,
+			Files:      []int{i},
+		})
+	}
+
+	return plan
+}
@@ -0,0 +1,102 @@
+package importplan
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlan(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T){
+		"lists folders parents first":            testFolders,
+		"places folders below a target folder":   testTargetFolder,
+		"merged files share one package":         testMergedPackages,
+		"keeps the given order within a folder":  testStableOrder,
+		"names packages after the file or group": testPackageNames,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			fn(t)
+		})
+	}
+}
+
+func testFolders(t *testing.T) {
+	plan := New([]File{
+		{UploadId: "u1", Path: "/a/b/c/", Name: "x.txt"},
+		{UploadId: "u2", Path: "a/d", Name: "y.txt"},
+		{UploadId: "u3", Path: "", Name: "z.txt"},
+	}, "")
+
+	var paths []string
+	for _, f := range plan.Folders {
+		paths = append(paths, f.Path)
+	}
+	assert.Equal(t, []string{"a", "a/b", "a/b/c", "a/d"}, paths)
+	assert.Equal(t, Folder{Path: "a/b/c", Name: "c", ParentPath: "a/b", Depth: 2}, plan.Folders[2])
+	assert.Equal(t, "", plan.Folders[0].ParentPath)
+
+	parents := map[string]string{}
+	for _, p := range plan.Packages {
+		parents[p.NodeId] = p.ParentPath
+	}
+	assert.Equal(t, map[string]string{
+		"N:package:u1": "a/b/c",
+		"N:package:u2": "a/d",
+		"N:package:u3": "",
+	}, parents)
+}
+
+func testTargetFolder(t *testing.T) {
+	plan := New([]File{
+		{UploadId: "u1", Path: "a", Name: "x.txt"},
+		{UploadId: "u2", Name: "y.txt"},
+	}, "hello/you")
+
+	require.Len(t, plan.Folders, 3)
+	assert.Equal(t, Folder{Path: "hello/you/a", Name: "a", ParentPath: "hello/you", Depth: 2}, plan.Folders[2])
+	assert.Equal(t, "hello/you", plan.Packages[0].ParentPath)
+	assert.Equal(t, "hello/you/a", plan.Packages[1].ParentPath)
+}
+
+func testMergedPackages(t *testing.T) {
+	files := []File{
+		{UploadId: "u1", Name: "scan.img", MergePackageId: "m1"},
+		{UploadId: "u2", Name: "notes.txt"},
+		{UploadId: "u3", Name: "scan.hdr", MergePackageId: "m1"},
+	}
+	plan := New(files, "")
+
+	require.Len(t, plan.Packages, 2)
+	assert.Equal(t, Package{NodeId: "N:package:m1", Name: "scan", Files: []int{0, 2}}, plan.Packages[0])
+	assert.Equal(t, Package{NodeId: "N:package:u2", Name: "notes.txt", Files: []int{1}}, plan.Packages[1])
+}
+
+func testStableOrder(t *testing.T) {
+	plan := New([]File{
+		{UploadId: "u1", Path: "b", Name: "x.txt"},
+		{UploadId: "u2", Path: "a", Name: "y.txt"},
+		{UploadId: "u3", Path: "b", Name: "x.txt"},
+	}, "")
+
+	var order []int
+	for _, p := range plan.Packages {
+		order = append(order, p.Files...)
+	}
+	assert.Equal(t, []int{1, 0, 2}, order)
+}
+
+func testPackageNames(t *testing.T) {
+	for _, tc := range []struct {
+		file File
+		name string
+	}{
+		{File{UploadId: "u1", Name: "x.txt"}, "x.txt"},
+		{File{UploadId: "u1", Name: "scan.nii.gz", MergePackageId: "m1"}, "scan"},
+		{File{UploadId: "u1", Name: "README", MergePackageId: "m1"}, "README"},
+	} {
+		assert.Equal(t, tc.name, PackageName(tc.file))
+	}
+	assert.Equal(t, "N:package:m1", PackageNodeId(File{UploadId: "u1", MergePackageId: "m1"}))
+	assert.Equal(t, "N:package:u1", PackageNodeId(File{UploadId: "u1"}))
+}
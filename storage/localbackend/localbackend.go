@@ -0,0 +1,226 @@
+// Package localbackend implements storage.StorageBackend on a local
+// filesystem. Each bucket is a directory below the root and each key a file
+// path inside it, so "O1/D2/m/u" in bucket "storage" is
+// <root>/storage/O1/D2/m/u. The backend stores no checksums; consumers fall
+// back to hashing the content.
+package localbackend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pennsieve/pennsieve-upload-service-v2/storage"
+)
+
+// tempPrefix marks partially written copies, which List skips.
+const tempPrefix = ".localbackend-"
+
+// Backend is a storage.StorageBackend rooted at a directory.
+type Backend struct {
+	root string
+}
+
+var _ storage.StorageBackend = (*Backend)(nil)
+
+// New returns a Backend that keeps buckets as directories of root.
+func New(root string) (*Backend, error) {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	return &Backend{root: abs}, nil
+}
+
+func (b *Backend) Type() storage.BackendType {
+	return storage.BackendLocal
+}
+
+// path returns the filesystem path of an object, rejecting buckets and keys
+// that would escape the bucket directory.
+func (b *Backend) path(bucket string, key string) (string, error) {
+	if err := checkBucket(bucket); err != nil {
+		return "", err
+	}
+	clean := path.Clean("/" + key)
+	if key == "" || clean == "/" {
+		return "", fmt.Errorf("invalid object key %q", key)
+	}
+	return filepath.Join(b.root, bucket, filepath.FromSlash(clean)), nil
+}
+
+func checkBucket(bucket string) error {
+	if bucket == "" || bucket == "." || bucket == ".." || strings.ContainsAny(bucket, `/\`) {
+		return fmt.Errorf("invalid bucket name %q", bucket)
+	}
+	return nil
+}
+
+func (b *Backend) Stat(_ context.Context, bucket string, key string) (storage.ObjectInfo, error) {
+	p, err := b.path(bucket, key)
+	if err != nil {
+		return storage.ObjectInfo{}, err
+	}
+	fi, err := os.Stat(p)
+	if errors.Is(err, fs.ErrNotExist) || (err == nil && fi.IsDir()) {
+		return storage.ObjectInfo{}, fmt.Errorf("%s/%s: %w", bucket, key, storage.ErrObjectNotFound)
+	}
+	if err != nil {
+		return storage.ObjectInfo{}, err
+	}
+	return objectInfo(bucket, key, fi), nil
+}
+
+func (b *Backend) Open(_ context.Context, bucket string, key string) (io.ReadCloser, error) {
+	p, err := b.path(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%s/%s: %w", bucket, key, storage.ErrObjectNotFound)
+	}
+	return f, err
+}
+
+func (b *Backend) OpenRange(ctx context.Context, bucket string, key string, offset int64, length int64) (io.ReadCloser, error) {
+	r, err := b.Open(ctx, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	f := r.(*os.File)
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.NewSectionReader(f, offset, max(length, 0)), f}, nil
+}
+
+// Copy writes the destination through a temporary file in the same directory
+// and renames it into place, so readers never see a partial object.
+func (b *Backend) Copy(ctx context.Context, srcBucket string, srcKey string, dstBucket string, dstKey string) error {
+	src, err := b.Open(ctx, srcBucket, srcKey)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := b.path(dstBucket, dstKey)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dst), tempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, src); err != nil {
+		tmp.Close()
+		return fmt.Errorf("copy %s/%s to %s/%s: %w", srcBucket, srcKey, dstBucket, dstKey, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+func (b *Backend) Delete(_ context.Context, bucket string, keys ...string) error {
+	for _, key := range keys {
+		p, err := b.path(bucket, key)
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Backend) List(ctx context.Context, bucket string, prefix string, fn func(storage.ObjectInfo) error) error {
+	if err := checkBucket(bucket); err != nil {
+		return err
+	}
+	dir := filepath.Join(b.root, bucket)
+
+	// WalkDir's per-directory order is not key order ("a/b" sorts after
+	// "a-b"), so collect and sort before calling fn.
+	var objects []storage.ObjectInfo
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), tempPrefix) {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, objectInfo(bucket, key, fi))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+
+	for _, o := range objects {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(o); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PresignGet returns a file:// URL. It grants nothing by itself and is only
+// useful to processes that share the filesystem.
+func (b *Backend) PresignGet(ctx context.Context, bucket string, key string, _ time.Duration) (string, error) {
+	if _, err := b.Stat(ctx, bucket, key); err != nil {
+		return "", err
+	}
+	p, _ := b.path(bucket, key)
+	u := url.URL{Scheme: "file", Path: filepath.ToSlash(p)}
+	return u.String(), nil
+}
+
+// Credentials is not supported: a local filesystem has no temporary
+// credentials to hand out.
+func (b *Backend) Credentials(context.Context, storage.CredentialsRequest) (*storage.Credentials, error) {
+	return nil, storage.ErrNotSupported
+}
+
+func objectInfo(bucket string, key string, fi fs.FileInfo) storage.ObjectInfo {
+	return storage.ObjectInfo{
+		Bucket:       bucket,
+		Key:          key,
+		Size:         fi.Size(),
+		LastModified: fi.ModTime(),
+	}
+}
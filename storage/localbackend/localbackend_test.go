@@ -0,0 +1,162 @@
+package localbackend
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pennsieve/pennsieve-upload-service-v2/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackend(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, b *Backend){
+		"stats and opens objects":                   testStatOpen,
+		"opens a byte range":                        testOpenRange,
+		"reports missing objects as not found":      testNotFound,
+		"copies between buckets":                    testCopy,
+		"deletes objects and ignores missing keys":  testDelete,
+		"lists objects under a prefix in key order": testList,
+		"rejects keys that escape the bucket":       testEscape,
+		"does not issue credentials":                testCredentials,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			b, err := New(t.TempDir())
+			require.NoError(t, err)
+			fn(t, b)
+		})
+	}
+}
+
+func put(t *testing.T, b *Backend, bucket string, key string, content string) {
+	t.Helper()
+	p, err := b.path(bucket, key)
+	require.NoError(t, err)
+	require.NoError(t, os.MkdirAll(filepath.Dir(p), 0o755))
+	require.NoError(t, os.WriteFile(p, []byte(content), 0o644))
+}
+
+func testStatOpen(t *testing.T, b *Backend) {
+	ctx := context.Background()
+	put(t, b, "upload", "m1/u1", "hello")
+
+	info, err := b.Stat(ctx, "upload", "m1/u1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), info.Size)
+	assert.Equal(t, "m1/u1", info.Key)
+	assert.Equal(t, storage.ObjectChecksum{}, info.Checksum)
+
+	r, err := b.Open(ctx, "upload", "m1/u1")
+	require.NoError(t, err)
+	defer r.Close()
+	content, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(content))
+}
+
+func testOpenRange(t *testing.T, b *Backend) {
+	ctx := context.Background()
+	put(t, b, "upload", "m1/u1", "hello world")
+
+	read := func(offset int64, length int64) string {
+		r, err := b.OpenRange(ctx, "upload", "m1/u1", offset, length)
+		require.NoError(t, err)
+		defer r.Close()
+		content, err := io.ReadAll(r)
+		require.NoError(t, err)
+		return string(content)
+	}
+	assert.Equal(t, "hello", read(0, 5))
+	assert.Equal(t, "world", read(6, 100), "a range is cut at the end of the object")
+	assert.Equal(t, "", read(20, 5))
+
+	_, err := b.OpenRange(ctx, "upload", "m1/missing", 0, 5)
+	assert.True(t, errors.Is(err, storage.ErrObjectNotFound))
+}
+
+func testNotFound(t *testing.T, b *Backend) {
+	ctx := context.Background()
+	put(t, b, "upload", "m1/u1", "hello")
+
+	_, err := b.Stat(ctx, "upload", "m1/missing")
+	assert.True(t, errors.Is(err, storage.ErrObjectNotFound))
+	_, err = b.Stat(ctx, "upload", "m1")
+	assert.True(t, errors.Is(err, storage.ErrObjectNotFound), "a directory is not an object")
+	_, err = b.Open(ctx, "other", "m1/u1")
+	assert.True(t, errors.Is(err, storage.ErrObjectNotFound))
+}
+
+func testCopy(t *testing.T, b *Backend) {
+	ctx := context.Background()
+	put(t, b, "upload", "m1/u1", "hello")
+
+	require.NoError(t, b.Copy(ctx, "upload", "m1/u1", "storage", "O1/D2/m1/u1"))
+	info, err := b.Stat(ctx, "storage", "O1/D2/m1/u1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), info.Size)
+
+	var keys []string
+	require.NoError(t, b.List(ctx, "storage", "", func(o storage.ObjectInfo) error {
+		keys = append(keys, o.Key)
+		return nil
+	}))
+	assert.Equal(t, []string{"O1/D2/m1/u1"}, keys, "no temporary files are left behind")
+}
+
+func testDelete(t *testing.T, b *Backend) {
+	ctx := context.Background()
+	put(t, b, "upload", "m1/u1", "a")
+	put(t, b, "upload", "m1/u2", "b")
+
+	require.NoError(t, b.Delete(ctx, "upload", "m1/u1", "m1/u2", "m1/never-existed"))
+	_, err := b.Stat(ctx, "upload", "m1/u1")
+	assert.True(t, errors.Is(err, storage.ErrObjectNotFound))
+}
+
+func testList(t *testing.T, b *Backend) {
+	ctx := context.Background()
+	put(t, b, "storage", "a/b", "1")
+	put(t, b, "storage", "a-b", "2")
+	put(t, b, "storage", "z/c", "3")
+
+	var keys []string
+	require.NoError(t, b.List(ctx, "storage", "a", func(o storage.ObjectInfo) error {
+		keys = append(keys, o.Key)
+		return nil
+	}))
+	assert.Equal(t, []string{"a-b", "a/b"}, keys)
+
+	stop := errors.New("stop")
+	calls := 0
+	err := b.List(ctx, "storage", "", func(storage.ObjectInfo) error {
+		calls++
+		return stop
+	})
+	assert.Equal(t, stop, err)
+	assert.Equal(t, 1, calls)
+
+	require.NoError(t, b.List(ctx, "empty", "", func(storage.ObjectInfo) error {
+		t.Fatal("missing bucket has no objects")
+		return nil
+	}))
+}
+
+func testEscape(t *testing.T, b *Backend) {
+	p, err := b.path("upload", "../../etc/passwd")
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(b.root, "upload", "etc", "passwd"), p)
+
+	_, err = b.path("../upload", "key")
+	assert.Error(t, err)
+	_, err = b.path("upload", "")
+	assert.Error(t, err)
+}
+
+func testCredentials(t *testing.T, b *Backend) {
+	_, err := b.Credentials(context.Background(), storage.CredentialsRequest{Bucket: "storage"})
+	assert.True(t, errors.Is(err, storage.ErrNotSupported))
+}
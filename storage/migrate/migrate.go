@@ -0,0 +1,263 @@
+// Package migrate applies the upload service's Postgres migrations, the
+// scripts in the repository's migrations directory, on top of the core
+// Pennsieve schema. The reconcile lambda applies them on every deploy and the
+// database-backed tests apply them before they run, so both see the tables
+// the lambdas write to.
+//
+// Scripts follow the Flyway naming convention, V<version>__<description>.sql,
+// and run in version order. Those in DirPennsieve run once against the shared
+// pennsieve schema; those in DirOrganization run once per organization schema,
+// with the search path set to it. Each script is applied in its own
+// transaction together with its row in the history table, so a failed script
+// is retried as a whole on the next run.
+package migrate
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Directories of the migrations, relative to the migrations root.
+const (
+	DirPennsieve    = "pennsieve"
+	DirOrganization = "organization"
+)
+
+// historyTable records the scripts applied to each schema.
+const historyTable = "pennsieve.upload_service_migrations"
+
+// lockKey serializes concurrent runs, such as a deploy and a test run against
+// the same database.
+const lockKey = "upload-service-migrations"
+
+var scriptName = regexp.MustCompile(`^V(\d+(?:[._]\d+)*)__(\w+)\.sql$`)
+
+// Script is one migration script.
+type Script struct {
+	Dir      string
+	Name     string
+	Version  string
+	SQL      string
+	Checksum string
+
+	order []int
+}
+
+// Applied is a script applied to a schema, or one a dry run would apply.
+type Applied struct {
+	Schema string `json:"schema"`
+	Script string `json:"script"`
+}
+
+// Result is the outcome of Apply.
+type Result struct {
+	Schemas int       `json:"schemas"`
+	Applied []Applied `json:"applied,omitempty"`
+}
+
+// Load returns the scripts of both directories below root, each directory in
+// version order. Versions are unique across both directories, as in a single
+// Flyway series.
+func Load(root fs.FS) (pennsieve []Script, organization []Script, err error) {
+	seen := map[string]string{}
+	load := func(dir string) ([]Script, error) {
+		entries, err := fs.ReadDir(root, dir)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var scripts []Script
+		for _, e := range entries {
+			if e.IsDir() || !strings.HasSuffix(e.Name(), ".sql") {
+				continue
+			}
+			m := scriptName.FindStringSubmatch(e.Name())
+			if m == nil {
+				return nil, fmt.Errorf("%s/%s is not named V<version>__<description>.sql", dir, e.Name())
+			}
+			s := Script{Dir: dir, Name: e.Name(), Version: strings.ReplaceAll(m[1], "_", ".")}
+			if other, ok := seen[s.Version]; ok {
+				return nil, fmt.Errorf("%s/%s has the version of %s", dir, e.Name(), other)
+			}
+			seen[s.Version] = path.Join(dir, e.Name())
+			for _, part := range strings.Split(s.Version, ".") {
+				n, err := strconv.Atoi(part)
+				if err != nil {
+					return nil, fmt.Errorf("%s/%s: %w", dir, e.Name(), err)
+				}
+				s.order = append(s.order, n)
+			}
+
+			body, err := fs.ReadFile(root, path.Join(dir, e.Name()))
+			if err != nil {
+				return nil, err
+			}
+			sum := sha256.Sum256(body)
+			s.SQL = string(body)
+			s.Checksum = hex.EncodeToString(sum[:])
+			scripts = append(scripts, s)
+		}
+		sort.Slice(scripts, func(i, j int) bool { return before(scripts[i].order, scripts[j].order) })
+		return scripts, nil
+	}
+
+	if pennsieve, err = load(DirPennsieve); err != nil {
+		return nil, nil, err
+	}
+	if organization, err = load(DirOrganization); err != nil {
+		return nil, nil, err
+	}
+	return pennsieve, organization, nil
+}
+
+// before compares two versions part by part, so 20261018.10 follows
+// 20261018.9.
+func before(a []int, b []int) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return len(a) < len(b)
+}
+
+// Apply applies the scripts below root that have not been applied yet: the
+// pennsieve scripts first, then the organization scripts to the schema of
+// every organization. A script whose content changed after it was applied is
+// an error. With dryRun, Apply only reports the scripts it would apply.
+func Apply(ctx context.Context, db *sql.DB, root fs.FS, dryRun bool) (*Result, error) {
+	pennsieve, organization, err := Load(root)
+	if err != nil {
+		return nil, err
+	}
+
+	if !dryRun {
+		err = inTx(ctx, db, func(tx *sql.Tx) error {
+			if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext($1));", lockKey); err != nil {
+				return err
+			}
+			_, err := tx.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+historyTable+" ("+
+				"schema_name TEXT NOT NULL, version TEXT NOT NULL, script TEXT NOT NULL, checksum TEXT NOT NULL, "+
+				"applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP, PRIMARY KEY (schema_name, version));")
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("create %s: %w", historyTable, err)
+		}
+	}
+
+	schemas, err := organizationSchemas(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &Result{Schemas: len(schemas) + 1}
+	for _, s := range pennsieve {
+		if err := apply(ctx, db, "pennsieve", s, dryRun, res); err != nil {
+			return res, err
+		}
+	}
+	for _, schema := range schemas {
+		for _, s := range organization {
+			if err := apply(ctx, db, schema, s, dryRun, res); err != nil {
+				return res, err
+			}
+		}
+	}
+	return res, nil
+}
+
+// organizationSchemas returns the schema of every organization.
+func organizationSchemas(ctx context.Context, db *sql.DB) ([]string, error) {
+	rows, err := db.QueryContext(ctx, "SELECT id FROM pennsieve.organizations ORDER BY id;")
+	if err != nil {
+		return nil, fmt.Errorf("list organizations: %w", err)
+	}
+	defer rows.Close()
+
+	var schemas []string
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		schemas = append(schemas, strconv.FormatInt(id, 10))
+	}
+	return schemas, rows.Err()
+}
+
+// apply applies s to schema unless the history has it.
+func apply(ctx context.Context, db *sql.DB, schema string, s Script, dryRun bool, res *Result) error {
+	err := inTx(ctx, db, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext($1));", lockKey); err != nil {
+			return err
+		}
+
+		var checksum string
+		err := tx.QueryRowContext(ctx, "SELECT checksum FROM "+historyTable+" WHERE schema_name = $1 AND version = $2;",
+			schema, s.Version).Scan(&checksum)
+		switch {
+		case err == nil:
+			if checksum != s.Checksum {
+				return errors.New("script changed after it was applied")
+			}
+			return nil
+		case dryRun && isUndefinedTable(err):
+		case !errors.Is(err, sql.ErrNoRows):
+			return err
+		}
+
+		res.Applied = append(res.Applied, Applied{Schema: schema, Script: path.Join(s.Dir, s.Name)})
+		if dryRun {
+			return nil
+		}
+
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf(`SET LOCAL search_path TO "%s", pennsieve;`, schema)); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, s.SQL); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "INSERT INTO "+historyTable+" (schema_name, version, script, checksum) "+
+			"VALUES ($1, $2, $3, $4);", schema, s.Version, s.Name, s.Checksum)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("apply %s/%s to schema %s: %w", s.Dir, s.Name, schema, err)
+	}
+	return nil
+}
+
+// isUndefinedTable returns true for the error of a query against a table that
+// does not exist yet, which a dry run on a fresh database reads the history
+// from.
+func isUndefinedTable(err error) bool {
+	var pgErr interface{ SQLState() string }
+	return errors.As(err, &pgErr) && pgErr.SQLState() == "42P01"
+}
+
+// inTx runs fn in a transaction and commits it unless fn fails.
+func inTx(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,76 @@
+package migrate
+
+import (
+	"os"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoad(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T){
+		"orders scripts by version":             testLoadOrder,
+		"rejects scripts it cannot order":       testLoadNames,
+		"rejects versions used twice":           testLoadDuplicateVersion,
+		"loads the repository's migrations":     testLoadRepository,
+		"checksums change with the script body": testLoadChecksum,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			fn(t)
+		})
+	}
+}
+
+func testLoadOrder(t *testing.T) {
+	root := fstest.MapFS{
+		"organization/V20261018_10__c.sql": {Data: []byte("SELECT 10;")},
+		"organization/V20261018_9__b.sql":  {Data: []byte("SELECT 9;")},
+		"organization/V20261017__a.sql":    {Data: []byte("SELECT 1;")},
+		"organization/README.md":           {Data: []byte("not a script")},
+		"pennsieve/V20261018_5__d.sql":     {Data: []byte("SELECT 5;")},
+	}
+
+	pennsieve, organization, err := Load(root)
+	require.NoError(t, err)
+	require.Len(t, pennsieve, 1)
+	assert.Equal(t, "20261018.5", pennsieve[0].Version)
+
+	var names []string
+	for _, s := range organization {
+		names = append(names, s.Name)
+	}
+	assert.Equal(t, []string{"V20261017__a.sql", "V20261018_9__b.sql", "V20261018_10__c.sql"}, names)
+	assert.Equal(t, "SELECT 10;", organization[2].SQL)
+}
+
+func testLoadNames(t *testing.T) {
+	for _, name := range []string{"create_table.sql", "V1_create_table.sql", "Vx__create_table.sql"} {
+		_, _, err := Load(fstest.MapFS{"organization/" + name: {Data: []byte("SELECT 1;")}})
+		assert.Error(t, err, name)
+	}
+}
+
+func testLoadDuplicateVersion(t *testing.T) {
+	_, _, err := Load(fstest.MapFS{
+		"pennsieve/V1_2__a.sql":    {Data: []byte("SELECT 1;")},
+		"organization/V1.2__b.sql": {Data: []byte("SELECT 2;")},
+	})
+	assert.ErrorContains(t, err, "has the version of pennsieve/V1_2__a.sql")
+}
+
+func testLoadRepository(t *testing.T) {
+	pennsieve, organization, err := Load(os.DirFS("../../migrations"))
+	require.NoError(t, err)
+	assert.NotEmpty(t, pennsieve)
+	assert.NotEmpty(t, organization)
+}
+
+func testLoadChecksum(t *testing.T) {
+	_, a, err := Load(fstest.MapFS{"organization/V1__a.sql": {Data: []byte("SELECT 1;")}})
+	require.NoError(t, err)
+	_, b, err := Load(fstest.MapFS{"organization/V1__a.sql": {Data: []byte("SELECT 2;")}})
+	require.NoError(t, err)
+	assert.NotEqual(t, a[0].Checksum, b[0].Checksum)
+}
@@ -0,0 +1,246 @@
+// Package storage resolves the destination storage bucket and prefix for a
+// manifest, and defines the StorageBackend interface the upload service uses
+// for object operations. It is shared by the service, upload and reconcile
+// lambdas and the upload-move Fargate task, which each pin a different
+// pennsieve-go-core version; the package therefore does not import go-core,
+// and each consumer supplies a Source backed by its own clients. Backend
+// implementations live in the s3backend and localbackend subpackages.
+//
+// The bucket is resolved most-specific first: a per-dataset override in the
+// organization's dataset_storage_buckets table, then the workspace bucket
+// (organizations.storage_bucket), then the deployment default.
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrManifestNotFound is returned when the manifest does not exist in the
+// manifest table. Unlike other resolution errors it is cached (see
+// Config.NegativeTTL) and callers may treat it as terminal.
+var ErrManifestNotFound = errors.New("manifest not found")
+
+// Manifest is the part of a manifest-table row the resolver needs.
+type Manifest struct {
+	ManifestId     string
+	OrganizationId int64
+	DatasetId      int64
+	DateCreated    int64
+}
+
+// Resolution describes where files for a given manifest must be written.
+type Resolution struct {
+	Manifest       Manifest
+	OrganizationId int64
+	DatasetId      int64
+	StorageBucket  string
+	// Backend is the kind of store StorageBucket lives in.
+	Backend BackendType
+}
+
+// KeyPrefix returns the full object-key prefix used for files in this manifest.
+// Format: O{orgId}/D{datasetId}/{manifestId}.
+func (r Resolution) KeyPrefix(manifestId string) string {
+	return fmt.Sprintf("O%d/D%d/%s", r.OrganizationId, r.DatasetId, manifestId)
+}
+
+// Source loads the inputs of a resolution. Consumers implement it on top of
+// their pennsieve-go-core queries.
+type Source interface {
+	// Manifest returns the manifest, or an error wrapping ErrManifestNotFound
+	// when there is no such manifest.
+	Manifest(ctx context.Context, manifestId string) (Manifest, error)
+	// DatasetBucket returns the dataset's bucket override, if any. See
+	// QueryDatasetBucket.
+	DatasetBucket(ctx context.Context, organizationId int64, datasetId int64) (string, bool, error)
+	// OrganizationBucket returns the organization's bucket, if it has one.
+	OrganizationBucket(ctx context.Context, organizationId int64) (string, bool, error)
+}
+
+// Querier is the subset of *sql.DB and *sql.Tx QueryDatasetBucket uses.
+type Querier interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// QueryDatasetBucket reads a dataset's bucket override from the organization's
+// dataset_storage_buckets table. The table is schema-qualified because
+// resolution runs before (or without) setting the search path.
+func QueryDatasetBucket(ctx context.Context, db Querier, organizationId int64, datasetId int64) (string, bool, error) {
+	var bucket string
+	err := db.QueryRowContext(ctx,
+		fmt.Sprintf(`SELECT storage_bucket FROM "%d".dataset_storage_buckets WHERE dataset_id = $1`, organizationId),
+		datasetId).Scan(&bucket)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return bucket, true, nil
+}
+
+// Config configures a Resolver.
+type Config struct {
+	// DefaultBucket is used when neither the dataset nor the organization
+	// has a bucket.
+	DefaultBucket string
+	// Backend is the backend every bucket of this deployment lives in.
+	// Empty means BackendS3.
+	Backend BackendType
+	// TTL is how long a resolution is cached. Bucket overrides take up to
+	// TTL to reach a running process. Zero means DefaultTTL.
+	TTL time.Duration
+	// NegativeTTL is how long ErrManifestNotFound is cached, so a sweep over
+	// many files of a deleted manifest asks DynamoDB once. Zero means
+	// DefaultNegativeTTL.
+	NegativeTTL time.Duration
+	// LoadTimeout bounds a load from the Source. A load is shared by every
+	// concurrent caller, so it runs without any one caller's deadline or
+	// cancellation. Zero means DefaultLoadTimeout.
+	LoadTimeout time.Duration
+}
+
+const (
+	DefaultTTL         = 5 * time.Minute
+	DefaultNegativeTTL = time.Minute
+	DefaultLoadTimeout = 30 * time.Second
+)
+
+// Resolver resolves manifests to storage locations. Results are cached per
+// manifest for Config.TTL, and concurrent lookups of the same manifest share
+// one call to the Source; a caller whose context ends stops waiting for it,
+// without failing the others. Safe for concurrent use.
+type Resolver struct {
+	cfg Config
+	now func() time.Time
+
+	mu       sync.Mutex
+	entries  map[string]entry
+	inFlight map[string]*call
+}
+
+type entry struct {
+	resolution *Resolution
+	err        error
+	expires    time.Time
+}
+
+type call struct {
+	done       chan struct{}
+	resolution *Resolution
+	err        error
+}
+
+// NewResolver returns a Resolver with an empty cache.
+func NewResolver(cfg Config) *Resolver {
+	if cfg.TTL == 0 {
+		cfg.TTL = DefaultTTL
+	}
+	if cfg.NegativeTTL == 0 {
+		cfg.NegativeTTL = DefaultNegativeTTL
+	}
+	if cfg.LoadTimeout == 0 {
+		cfg.LoadTimeout = DefaultLoadTimeout
+	}
+	if cfg.Backend == "" {
+		cfg.Backend = BackendS3
+	}
+	return &Resolver{
+		cfg:      cfg,
+		now:      time.Now,
+		entries:  map[string]entry{},
+		inFlight: map[string]*call{},
+	}
+}
+
+// Resolve returns the storage location for a manifest, loading it from src
+// unless a cached result is still fresh. The returned Resolution is shared
+// and must not be modified.
+func (r *Resolver) Resolve(ctx context.Context, src Source, manifestId string) (*Resolution, error) {
+	r.mu.Lock()
+	if e, ok := r.entries[manifestId]; ok && r.now().Before(e.expires) {
+		r.mu.Unlock()
+		return e.resolution, e.err
+	}
+	c, ok := r.inFlight[manifestId]
+	if !ok {
+		c = &call{done: make(chan struct{})}
+		r.inFlight[manifestId] = c
+		go r.run(context.WithoutCancel(ctx), src, manifestId, c)
+	}
+	r.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.resolution, c.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// run performs the shared load of c under Config.LoadTimeout, caches its
+// result and releases the callers waiting for it.
+func (r *Resolver) run(ctx context.Context, src Source, manifestId string, c *call) {
+	ctx, cancel := context.WithTimeout(ctx, r.cfg.LoadTimeout)
+	defer cancel()
+
+	c.resolution, c.err = r.load(ctx, src, manifestId)
+
+	r.mu.Lock()
+	delete(r.inFlight, manifestId)
+	switch {
+	case c.err == nil:
+		r.entries[manifestId] = entry{resolution: c.resolution, expires: r.now().Add(r.cfg.TTL)}
+	case errors.Is(c.err, ErrManifestNotFound):
+		r.entries[manifestId] = entry{err: c.err, expires: r.now().Add(r.cfg.NegativeTTL)}
+	}
+	r.mu.Unlock()
+	close(c.done)
+}
+
+// Invalidate drops the cached result for a manifest.
+func (r *Resolver) Invalidate(manifestId string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.entries, manifestId)
+}
+
+func (r *Resolver) load(ctx context.Context, src Source, manifestId string) (*Resolution, error) {
+	manifest, err := src.Manifest(ctx, manifestId)
+	if err != nil {
+		if errors.Is(err, ErrManifestNotFound) {
+			return nil, fmt.Errorf("manifest %s: %w", manifestId, ErrManifestNotFound)
+		}
+		return nil, fmt.Errorf("error getting manifest %s: %w", manifestId, err)
+	}
+
+	resolution := &Resolution{
+		Manifest:       manifest,
+		OrganizationId: manifest.OrganizationId,
+		DatasetId:      manifest.DatasetId,
+		Backend:        r.cfg.Backend,
+	}
+
+	bucket, found, err := src.DatasetBucket(ctx, manifest.OrganizationId, manifest.DatasetId)
+	if err != nil {
+		return nil, fmt.Errorf("error getting storage bucket for dataset %d referenced in manifest %s: %w",
+			manifest.DatasetId, manifestId, err)
+	}
+	if !found {
+		bucket, found, err = src.OrganizationBucket(ctx, manifest.OrganizationId)
+		if err != nil {
+			return nil, fmt.Errorf("error getting organization %d referenced in manifest %s: %w",
+				manifest.OrganizationId, manifestId, err)
+		}
+	}
+	if !found {
+		bucket = r.cfg.DefaultBucket
+	}
+	resolution.StorageBucket = bucket
+	return resolution, nil
+}
@@ -0,0 +1,226 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeSource struct {
+	manifests      map[string]Manifest
+	datasetBuckets map[int64]string
+	orgBuckets     map[int64]string
+	manifestErr    error
+	delay          time.Duration
+	manifestHits   atomic.Int32
+}
+
+func (f *fakeSource) Manifest(ctx context.Context, manifestId string) (Manifest, error) {
+	f.manifestHits.Add(1)
+	select {
+	case <-time.After(f.delay):
+	case <-ctx.Done():
+		return Manifest{}, ctx.Err()
+	}
+	if f.manifestErr != nil {
+		return Manifest{}, f.manifestErr
+	}
+	m, ok := f.manifests[manifestId]
+	if !ok {
+		return Manifest{}, fmt.Errorf("get manifest %s: %w", manifestId, ErrManifestNotFound)
+	}
+	return m, nil
+}
+
+func (f *fakeSource) DatasetBucket(_ context.Context, _ int64, datasetId int64) (string, bool, error) {
+	b, ok := f.datasetBuckets[datasetId]
+	return b, ok, nil
+}
+
+func (f *fakeSource) OrganizationBucket(_ context.Context, organizationId int64) (string, bool, error) {
+	b, ok := f.orgBuckets[organizationId]
+	return b, ok, nil
+}
+
+func newFakeSource() *fakeSource {
+	return &fakeSource{
+		manifests: map[string]Manifest{
+			"m-dataset": {ManifestId: "m-dataset", OrganizationId: 1, DatasetId: 10},
+			"m-org":     {ManifestId: "m-org", OrganizationId: 1, DatasetId: 11},
+			"m-default": {ManifestId: "m-default", OrganizationId: 2, DatasetId: 20},
+		},
+		datasetBuckets: map[int64]string{10: "dataset-10-bucket"},
+		orgBuckets:     map[int64]string{1: "org-1-bucket"},
+	}
+}
+
+func TestResolver(t *testing.T) {
+	for scenario, fn := range map[string]func(tt *testing.T){
+		"resolves dataset, then org, then default bucket": testResolvePrecedence,
+		"caches resolutions until the TTL expires":        testResolveTTL,
+		"caches missing manifests as ErrManifestNotFound": testResolveNegative,
+		"does not cache other errors":                     testResolveErrorNotCached,
+		"shares one load between concurrent callers":      testResolveSingleflight,
+		"outlives the caller that started the load":       testResolveCallerCanceled,
+		"bounds the load by its own timeout":              testResolveLoadTimeout,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			fn(t)
+		})
+	}
+}
+
+func testResolvePrecedence(t *testing.T) {
+	r := NewResolver(Config{DefaultBucket: "default-bucket"})
+	src := newFakeSource()
+
+	for manifestId, bucket := range map[string]string{
+		"m-dataset": "dataset-10-bucket",
+		"m-org":     "org-1-bucket",
+		"m-default": "default-bucket",
+	} {
+		res, err := r.Resolve(context.Background(), src, manifestId)
+		require.NoError(t, err)
+		assert.Equal(t, bucket, res.StorageBucket, manifestId)
+	}
+
+	res, _ := r.Resolve(context.Background(), src, "m-dataset")
+	assert.Equal(t, "O1/D10/m-dataset", res.KeyPrefix("m-dataset"))
+	assert.Equal(t, BackendS3, res.Backend)
+
+	r = NewResolver(Config{Backend: BackendLocal})
+	res, err := r.Resolve(context.Background(), src, "m-org")
+	require.NoError(t, err)
+	assert.Equal(t, BackendLocal, res.Backend)
+}
+
+func testResolveTTL(t *testing.T) {
+	r := NewResolver(Config{TTL: time.Minute})
+	now := time.Now()
+	r.now = func() time.Time { return now }
+	src := newFakeSource()
+
+	_, err := r.Resolve(context.Background(), src, "m-org")
+	require.NoError(t, err)
+	src.orgBuckets[1] = "org-1-new-bucket"
+
+	res, _ := r.Resolve(context.Background(), src, "m-org")
+	assert.Equal(t, "org-1-bucket", res.StorageBucket)
+	assert.Equal(t, int32(1), src.manifestHits.Load())
+
+	now = now.Add(2 * time.Minute)
+	res, _ = r.Resolve(context.Background(), src, "m-org")
+	assert.Equal(t, "org-1-new-bucket", res.StorageBucket)
+	assert.Equal(t, int32(2), src.manifestHits.Load())
+
+	r.Invalidate("m-org")
+	_, _ = r.Resolve(context.Background(), src, "m-org")
+	assert.Equal(t, int32(3), src.manifestHits.Load())
+}
+
+func testResolveNegative(t *testing.T) {
+	r := NewResolver(Config{NegativeTTL: time.Minute})
+	now := time.Now()
+	r.now = func() time.Time { return now }
+	src := newFakeSource()
+
+	for i := 0; i < 3; i++ {
+		_, err := r.Resolve(context.Background(), src, "m-missing")
+		assert.True(t, errors.Is(err, ErrManifestNotFound))
+	}
+	assert.Equal(t, int32(1), src.manifestHits.Load())
+
+	now = now.Add(2 * time.Minute)
+	_, _ = r.Resolve(context.Background(), src, "m-missing")
+	assert.Equal(t, int32(2), src.manifestHits.Load())
+}
+
+func testResolveErrorNotCached(t *testing.T) {
+	r := NewResolver(Config{})
+	src := newFakeSource()
+	src.manifestErr = errors.New("GetItem: ProvisionedThroughputExceededException")
+
+	_, err := r.Resolve(context.Background(), src, "m-org")
+	assert.Error(t, err)
+	assert.False(t, errors.Is(err, ErrManifestNotFound))
+
+	src.manifestErr = nil
+	res, err := r.Resolve(context.Background(), src, "m-org")
+	require.NoError(t, err)
+	assert.Equal(t, "org-1-bucket", res.StorageBucket)
+	assert.Equal(t, int32(2), src.manifestHits.Load())
+}
+
+func testResolveSingleflight(t *testing.T) {
+	r := NewResolver(Config{})
+	src := newFakeSource()
+	src.delay = 50 * time.Millisecond
+
+	var wg sync.WaitGroup
+	for _, manifestId := range []string{"m-dataset", "m-org"} {
+		for i := 0; i < 100; i++ {
+			wg.Add(1)
+			go func(manifestId string) {
+				defer wg.Done()
+				res, err := r.Resolve(context.Background(), src, manifestId)
+				require.NoError(t, err)
+				assert.Equal(t, manifestId, res.Manifest.ManifestId)
+			}(manifestId)
+		}
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(2), src.manifestHits.Load())
+}
+
+func testResolveCallerCanceled(t *testing.T) {
+	r := NewResolver(Config{})
+	src := newFakeSource()
+	src.delay = 50 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := r.Resolve(ctx, src, "m-org")
+		first <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	second := make(chan *Resolution, 1)
+	go func() {
+		res, err := r.Resolve(context.Background(), src, "m-org")
+		assert.NoError(t, err)
+		second <- res
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	// The caller that started the load gives up; the load itself does not.
+	assert.True(t, errors.Is(<-first, context.Canceled))
+	res := <-second
+	if assert.NotNil(t, res) {
+		assert.Equal(t, "org-1-bucket", res.StorageBucket)
+	}
+	assert.Equal(t, int32(1), src.manifestHits.Load())
+
+	_, err := r.Resolve(context.Background(), src, "m-org")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), src.manifestHits.Load(), "the shared load's result is cached")
+}
+
+func testResolveLoadTimeout(t *testing.T) {
+	r := NewResolver(Config{LoadTimeout: 10 * time.Millisecond})
+	src := newFakeSource()
+	src.delay = time.Minute
+
+	_, err := r.Resolve(context.Background(), src, "m-org")
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.False(t, errors.Is(err, ErrManifestNotFound))
+}
@@ -0,0 +1,144 @@
+package s3backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// maxPartSize is the size of each copied part. S3 allows 10,000 parts, so
+// this caps a copied object at about 1TB.
+const maxPartSize = 105 * 1024 * 1024
+
+// copyWorkers is the number of parts copied concurrently.
+const copyWorkers = 10
+
+// multipartCopy copies an object of size bytes with UploadPartCopy, aborting
+// the upload if any part fails.
+func (b *Backend) multipartCopy(ctx context.Context, size int64, srcBucket string, srcKey string,
+	dstBucket string, dstKey string, opts []func(*s3.Options)) error {
+
+	created, err := b.s3.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket: aws.String(dstBucket),
+		Key:    aws.String(dstKey),
+	}, opts...)
+	if err != nil {
+		return err
+	}
+	uploadId := aws.ToString(created.UploadId)
+	if uploadId == "" {
+		return errors.New("no upload id found in start upload request")
+	}
+
+	parts, err := b.copyParts(ctx, size, copySource(srcBucket, srcKey), dstBucket, dstKey, uploadId, opts)
+	if err != nil {
+		// The abort is best effort; the bucket's lifecycle rule removes
+		// incomplete uploads it leaves behind.
+		_, _ = b.s3.AbortMultipartUpload(context.WithoutCancel(ctx), &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(dstBucket),
+			Key:      aws.String(dstKey),
+			UploadId: aws.String(uploadId),
+		}, opts...)
+		return err
+	}
+
+	_, err = b.s3.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(dstBucket),
+		Key:             aws.String(dstKey),
+		UploadId:        aws.String(uploadId),
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	}, opts...)
+	if err != nil {
+		return fmt.Errorf("error completing upload: %w", err)
+	}
+	return nil
+}
+
+// copyParts copies every part with copyWorkers workers and returns the parts
+// in order. The first failure cancels the remaining parts.
+func (b *Backend) copyParts(ctx context.Context, size int64, source string, dstBucket string, dstKey string,
+	uploadId string, opts []func(*s3.Options)) ([]types.CompletedPart, error) {
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	inputs := make(chan s3.UploadPartCopyInput)
+	go func() {
+		defer close(inputs)
+		var partNumber int32 = 1
+		for start := int64(0); start < size; start += maxPartSize {
+			input := s3.UploadPartCopyInput{
+				Bucket:          aws.String(dstBucket),
+				Key:             aws.String(dstKey),
+				CopySource:      aws.String(source),
+				CopySourceRange: aws.String(copySourceRange(start, size)),
+				PartNumber:      aws.Int32(partNumber),
+				UploadId:        aws.String(uploadId),
+			}
+			select {
+			case inputs <- input:
+			case <-ctx.Done():
+				return
+			}
+			partNumber++
+		}
+	}()
+
+	var (
+		mu       sync.Mutex
+		parts    []types.CompletedPart
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	for w := 0; w < copyWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for input := range inputs {
+				out, err := b.s3.UploadPartCopy(ctx, &input, opts...)
+				mu.Lock()
+				if err != nil {
+					if firstErr == nil {
+						firstErr = fmt.Errorf("copy part %d: %w", aws.ToInt32(input.PartNumber), err)
+					}
+					cancel()
+				} else {
+					parts = append(parts, types.CompletedPart{
+						ETag:       aws.String(strings.Trim(aws.ToString(out.CopyPartResult.ETag), `"`)),
+						PartNumber: input.PartNumber,
+					})
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		return aws.ToInt32(parts[i].PartNumber) < aws.ToInt32(parts[j].PartNumber)
+	})
+	return parts, nil
+}
+
+// copySourceRange returns the byte range of the part starting at start.
+func copySourceRange(start int64, size int64) string {
+	end := start + maxPartSize - 1
+	if end >= size {
+		end = size - 1
+	}
+	return "bytes=" + strconv.FormatInt(start, 10) + "-" + strconv.FormatInt(end, 10)
+}
@@ -0,0 +1,114 @@
+package s3backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// LocationAPI is the subset of *s3.Client RegionCache uses.
+type LocationAPI interface {
+	GetBucketLocation(ctx context.Context, params *s3.GetBucketLocationInput, optFns ...func(*s3.Options)) (*s3.GetBucketLocationOutput, error)
+	HeadBucket(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error)
+}
+
+// guessedRegionTTL is how long a region taken from the bucket name is
+// cached. Discovery failed for that bucket, so it is retried once in a while
+// rather than on every request.
+const guessedRegionTTL = 10 * time.Minute
+
+// RegionCache discovers the region of buckets and caches it. Region has the
+// signature of Options.Region. Safe for concurrent use.
+type RegionCache struct {
+	client LocationAPI
+	now    func() time.Time
+
+	mu      sync.Mutex
+	regions map[string]cachedRegion
+}
+
+type cachedRegion struct {
+	region string
+	// expires is zero for discovered regions, which do not change while the
+	// bucket exists.
+	expires time.Time
+}
+
+// NewRegionCache returns a RegionCache that asks S3 through client.
+func NewRegionCache(client LocationAPI) *RegionCache {
+	return &RegionCache{
+		client:  client,
+		now:     time.Now,
+		regions: map[string]cachedRegion{},
+	}
+}
+
+// Region returns the region of bucket. It asks GetBucketLocation, then
+// HeadBucket (which reports the region even when the caller may not read the
+// bucket's location), and finally falls back to the bucket naming convention
+// (see GetRegion).
+func (c *RegionCache) Region(ctx context.Context, bucket string) (string, error) {
+	c.mu.Lock()
+	cached, ok := c.regions[bucket]
+	c.mu.Unlock()
+	if ok && (cached.expires.IsZero() || c.now().Before(cached.expires)) {
+		return cached.region, nil
+	}
+
+	region, discoverErr := c.discover(ctx, bucket)
+	if discoverErr == nil {
+		c.store(bucket, cachedRegion{region: region})
+		return region, nil
+	}
+	if guessed, exists := GetRegion(bucket); exists {
+		c.store(bucket, cachedRegion{region: guessed.RegionCode, expires: c.now().Add(guessedRegionTTL)})
+		return guessed.RegionCode, nil
+	}
+	return "", fmt.Errorf("could not determine region of bucket %s: %w", bucket, discoverErr)
+}
+
+func (c *RegionCache) store(bucket string, r cachedRegion) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.regions[bucket] = r
+}
+
+func (c *RegionCache) discover(ctx context.Context, bucket string) (string, error) {
+	location, err := c.client.GetBucketLocation(ctx, &s3.GetBucketLocationInput{Bucket: aws.String(bucket)})
+	if err == nil {
+		return regionFromLocation(string(location.LocationConstraint)), nil
+	}
+
+	head, headErr := c.client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(bucket)})
+	if headErr == nil && aws.ToString(head.BucketRegion) != "" {
+		return aws.ToString(head.BucketRegion), nil
+	}
+	// S3 sets the region header on the redirect and access-denied responses
+	// too, which the SDK surfaces as errors.
+	var responseErr *smithyhttp.ResponseError
+	if errors.As(headErr, &responseErr) && responseErr.Response != nil {
+		if region := responseErr.Response.Header.Get("x-amz-bucket-region"); region != "" {
+			return region, nil
+		}
+	}
+	return "", errors.Join(err, headErr)
+}
+
+// regionFromLocation maps a GetBucketLocation constraint to a region: buckets
+// in us-east-1 have no constraint, and the oldest eu-west-1 buckets report
+// the legacy "EU".
+func regionFromLocation(constraint string) string {
+	switch constraint {
+	case "":
+		return "us-east-1"
+	case "EU":
+		return "eu-west-1"
+	}
+	return constraint
+}
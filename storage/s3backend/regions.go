@@ -1,4 +1,6 @@
-package pkg
+package s3backend
+
+import "strings"
 
 type AWSRegion struct {
 	FullName   string
@@ -42,3 +44,13 @@ var AWSRegions = map[string]AWSRegion{
 	"usge1": {"AWS GovCloud (US-East)", "us-gov-east-1"},
 	"usgw1": {"AWS GovCloud (US-West)", "us-gov-west-1"},
 }
+
+// GetRegion from bucket naming scheme format gets the region name from the shortname
+func GetRegion(storageBucket string) (AWSRegion, bool) {
+	bucketNameTokens := strings.Split(storageBucket, "-")
+	shortname := strings.ToLower(bucketNameTokens[len(bucketNameTokens)-1])
+
+	region, exists := AWSRegions[shortname]
+
+	return region, exists
+}
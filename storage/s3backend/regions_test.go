@@ -0,0 +1,105 @@
+package s3backend
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetRegion(t *testing.T) {
+
+	USE1Region, exists := GetRegion("pennsieve-storage-use1")
+	assert.True(t, exists)
+	AFS1Region, exists := GetRegion("pennsieve-storage-afs1")
+	assert.True(t, exists)
+	EUW1Region, exists := GetRegion("pennsieve-storage-euw1")
+	assert.True(t, exists)
+	APS2Region, exists := GetRegion("pennsieve-storage-aps2")
+	assert.True(t, exists)
+	USE1Region2, exists := GetRegion("PENNSIEVE-STORAGE-USE1")
+	assert.True(t, exists)
+	_, exists = GetRegion("PENNSIEVE-STORAGE-DEV")
+	assert.False(t, exists)
+
+	assert.Equal(t, AWSRegions["use1"], USE1Region)
+	assert.Equal(t, AWSRegions["afs1"], AFS1Region)
+	assert.Equal(t, AWSRegions["euw1"], EUW1Region)
+	assert.Equal(t, AWSRegions["aps2"], APS2Region)
+	assert.Equal(t, AWSRegions["use1"], USE1Region2)
+
+}
+
+// fakeLocation serves bucket locations, failing GetBucketLocation for buckets
+// it does not list.
+type fakeLocation struct {
+	locations map[string]string
+	headers   map[string]string
+	calls     int
+}
+
+func (f *fakeLocation) GetBucketLocation(_ context.Context, in *s3.GetBucketLocationInput, _ ...func(*s3.Options)) (*s3.GetBucketLocationOutput, error) {
+	f.calls++
+	location, ok := f.locations[aws.ToString(in.Bucket)]
+	if !ok {
+		return nil, errors.New("access denied")
+	}
+	return &s3.GetBucketLocationOutput{LocationConstraint: types.BucketLocationConstraint(location)}, nil
+}
+
+func (f *fakeLocation) HeadBucket(_ context.Context, in *s3.HeadBucketInput, _ ...func(*s3.Options)) (*s3.HeadBucketOutput, error) {
+	region, ok := f.headers[aws.ToString(in.Bucket)]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	return nil, &smithyhttp.ResponseError{Response: &smithyhttp.Response{Response: &http.Response{
+		StatusCode: http.StatusMovedPermanently,
+		Header:     http.Header{"X-Amz-Bucket-Region": []string{region}},
+	}}}
+}
+
+func TestRegionCache(t *testing.T) {
+	ctx := context.Background()
+	f := &fakeLocation{
+		locations: map[string]string{"uploads": "", "legacy": "EU", "storage": "af-south-1"},
+		headers:   map[string]string{"other-account": "eu-central-1"},
+	}
+	c := NewRegionCache(f)
+
+	for bucket, want := range map[string]string{
+		"uploads":              "us-east-1",
+		"legacy":               "eu-west-1",
+		"storage":              "af-south-1",
+		"other-account":        "eu-central-1",
+		"pennsieve-prd-x-use2": "us-east-2",
+	} {
+		region, err := c.Region(ctx, bucket)
+		require.NoError(t, err, bucket)
+		assert.Equal(t, want, region, bucket)
+	}
+
+	_, err := c.Region(ctx, "unknown-bucket")
+	assert.ErrorContains(t, err, "could not determine region of bucket unknown-bucket")
+
+	calls := f.calls
+	_, err = c.Region(ctx, "storage")
+	require.NoError(t, err)
+	assert.Equal(t, calls, f.calls, "discovered regions are cached")
+
+	_, err = c.Region(ctx, "pennsieve-prd-x-use2")
+	require.NoError(t, err)
+	assert.Equal(t, calls, f.calls, "guessed regions are cached")
+
+	c.now = func() time.Time { return time.Now().Add(guessedRegionTTL + time.Second) }
+	_, err = c.Region(ctx, "pennsieve-prd-x-use2")
+	require.NoError(t, err)
+	assert.Equal(t, calls+1, f.calls, "guessed regions expire")
+}
@@ -0,0 +1,388 @@
+// Package s3backend implements storage.StorageBackend on Amazon S3.
+package s3backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsMiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/pennsieve/pennsieve-upload-service-v2/storage"
+)
+
+// API is the subset of *s3.Client the backend uses.
+type API interface {
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error)
+	DeleteObjects(ctx context.Context, params *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error)
+	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+	CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error)
+	UploadPartCopy(ctx context.Context, params *s3.UploadPartCopyInput, optFns ...func(*s3.Options)) (*s3.UploadPartCopyOutput, error)
+	CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error)
+	AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error)
+}
+
+// STSAPI is the subset of *sts.Client the backend uses to issue credentials.
+type STSAPI interface {
+	AssumeRole(ctx context.Context, params *sts.AssumeRoleInput, optFns ...func(*sts.Options)) (*sts.AssumeRoleOutput, error)
+}
+
+// Options configures a Backend.
+type Options struct {
+	// Region returns the region of a bucket. Requests are sent to that
+	// region, and Credentials reports it. Nil sends every request to the
+	// client's region and reports DefaultRegion.
+	Region func(ctx context.Context, bucket string) (string, error)
+	// DefaultRegion is reported by Credentials when Region is nil.
+	DefaultRegion string
+	// STS and CredentialsRoleARN are required by Credentials: the role is
+	// assumed with a session policy that narrows it to the requested prefix.
+	STS                STSAPI
+	CredentialsRoleARN string
+}
+
+// Backend is a storage.StorageBackend backed by S3.
+type Backend struct {
+	s3      API
+	presign *s3.PresignClient
+	opts    Options
+}
+
+var _ storage.StorageBackend = (*Backend)(nil)
+
+// New returns a Backend that uses client for all S3 requests.
+func New(client *s3.Client, opts Options) *Backend {
+	return &Backend{
+		s3:      client,
+		presign: s3.NewPresignClient(client),
+		opts:    opts,
+	}
+}
+
+func (b *Backend) Type() storage.BackendType {
+	return storage.BackendS3
+}
+
+// region returns the request option that routes a request to the bucket's
+// region, or none when Options.Region is not set.
+func (b *Backend) region(ctx context.Context, bucket string) ([]func(*s3.Options), error) {
+	if b.opts.Region == nil {
+		return nil, nil
+	}
+	region, err := b.opts.Region(ctx, bucket)
+	if err != nil {
+		return nil, err
+	}
+	return []func(*s3.Options){func(o *s3.Options) { o.Region = region }}, nil
+}
+
+// Stat HEADs the object with checksum mode enabled; without it S3 omits the
+// x-amz-checksum-* headers even when it has stored a checksum.
+func (b *Backend) Stat(ctx context.Context, bucket string, key string) (storage.ObjectInfo, error) {
+	opts, err := b.region(ctx, bucket)
+	if err != nil {
+		return storage.ObjectInfo{}, err
+	}
+	head, err := b.s3.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:       aws.String(bucket),
+		Key:          aws.String(key),
+		ChecksumMode: types.ChecksumModeEnabled,
+	}, opts...)
+	if err != nil {
+		return storage.ObjectInfo{}, notFound(bucket, key, err)
+	}
+	return storage.ObjectInfo{
+		Bucket:       bucket,
+		Key:          key,
+		Size:         aws.ToInt64(head.ContentLength),
+		ETag:         strings.Trim(aws.ToString(head.ETag), `"`),
+		LastModified: aws.ToTime(head.LastModified),
+		Checksum:     checksumFromHead(head),
+	}, nil
+}
+
+func (b *Backend) Open(ctx context.Context, bucket string, key string) (io.ReadCloser, error) {
+	opts, err := b.region(ctx, bucket)
+	if err != nil {
+		return nil, err
+	}
+	out, err := b.s3.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}, opts...)
+	if err != nil {
+		return nil, notFound(bucket, key, err)
+	}
+	return out.Body, nil
+}
+
+// OpenRange issues a ranged GET. S3 rejects a range that starts at or past
+// the end of the object as InvalidRange, which reads as empty here.
+func (b *Backend) OpenRange(ctx context.Context, bucket string, key string, offset int64, length int64) (io.ReadCloser, error) {
+	if length <= 0 {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+	opts, err := b.region(ctx, bucket)
+	if err != nil {
+		return nil, err
+	}
+	out, err := b.s3.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
+	}, opts...)
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "InvalidRange" {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+	if err != nil {
+		return nil, notFound(bucket, key, err)
+	}
+	return out.Body, nil
+}
+
+// maxCopyObjectSize is the largest object CopyObject accepts (5GB, kept a
+// little under); larger objects are copied in parts.
+const maxCopyObjectSize = 5 * 1000 * 1000 * 1000
+
+// Copy uses CopyObject for objects under 5GB and a multipart copy above.
+// Requests go to the destination bucket's region.
+func (b *Backend) Copy(ctx context.Context, srcBucket string, srcKey string, dstBucket string, dstKey string) error {
+	src, err := b.Stat(ctx, srcBucket, srcKey)
+	if err != nil {
+		return err
+	}
+	opts, err := b.region(ctx, dstBucket)
+	if err != nil {
+		return err
+	}
+	if src.Size >= maxCopyObjectSize {
+		return b.multipartCopy(ctx, src.Size, srcBucket, srcKey, dstBucket, dstKey, opts)
+	}
+	_, err = b.s3.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:     aws.String(dstBucket),
+		CopySource: aws.String(copySource(srcBucket, srcKey)),
+		Key:        aws.String(dstKey),
+	}, opts...)
+	return err
+}
+
+// maxDeleteKeys is the most keys one DeleteObjects request accepts.
+const maxDeleteKeys = 1000
+
+func (b *Backend) Delete(ctx context.Context, bucket string, keys ...string) error {
+	opts, err := b.region(ctx, bucket)
+	if err != nil {
+		return err
+	}
+	for start := 0; start < len(keys); start += maxDeleteKeys {
+		end := start + maxDeleteKeys
+		if end > len(keys) {
+			end = len(keys)
+		}
+		objects := make([]types.ObjectIdentifier, 0, end-start)
+		for _, key := range keys[start:end] {
+			objects = append(objects, types.ObjectIdentifier{Key: aws.String(key)})
+		}
+		out, err := b.s3.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(bucket),
+			Delete: &types.Delete{Objects: objects, Quiet: aws.Bool(false)},
+		}, opts...)
+		if err != nil {
+			return err
+		}
+		if len(out.Errors) > 0 {
+			e := out.Errors[0]
+			return fmt.Errorf("unable to delete %d of %d objects from %s, first %s: %s",
+				len(out.Errors), len(objects), bucket, aws.ToString(e.Key), aws.ToString(e.Message))
+		}
+	}
+	return nil
+}
+
+func (b *Backend) List(ctx context.Context, bucket string, prefix string, fn func(storage.ObjectInfo) error) error {
+	opts, err := b.region(ctx, bucket)
+	if err != nil {
+		return err
+	}
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	}
+	for {
+		out, err := b.s3.ListObjectsV2(ctx, input, opts...)
+		if err != nil {
+			return err
+		}
+		for _, o := range out.Contents {
+			err := fn(storage.ObjectInfo{
+				Bucket:       bucket,
+				Key:          aws.ToString(o.Key),
+				Size:         aws.ToInt64(o.Size),
+				ETag:         strings.Trim(aws.ToString(o.ETag), `"`),
+				LastModified: aws.ToTime(o.LastModified),
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if !aws.ToBool(out.IsTruncated) {
+			return nil
+		}
+		input.ContinuationToken = out.NextContinuationToken
+	}
+}
+
+func (b *Backend) PresignGet(ctx context.Context, bucket string, key string, expires time.Duration) (string, error) {
+	opts, err := b.region(ctx, bucket)
+	if err != nil {
+		return "", err
+	}
+	req, err := b.presign.PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}, append([]func(*s3.PresignOptions){s3.WithPresignExpires(expires)}, presignOptions(opts)...)...)
+	if err != nil {
+		return "", err
+	}
+	return req.URL, nil
+}
+
+// credentialsPolicy limits the assumed role to uploading under one prefix,
+// including the multipart operations the agent's uploader uses.
+const credentialsPolicy = `{
+	"Version": "2012-10-17",
+	"Statement": [{
+		"Effect": "Allow",
+		"Action": [
+			"s3:PutObject",
+			"s3:ListBucketMultipartUploads",
+			"s3:AbortMultipartUpload",
+			"s3:ListMultipartUploadParts",
+			"s3:PutObjectTagging"
+		],
+		"Resource": [
+			"arn:aws:s3:::%s",
+			"arn:aws:s3:::%s/%s/*"
+		]
+	}]
+}`
+
+func (b *Backend) Credentials(ctx context.Context, req storage.CredentialsRequest) (*storage.Credentials, error) {
+	if b.opts.STS == nil || b.opts.CredentialsRoleARN == "" {
+		return nil, fmt.Errorf("no credentials role configured: %w", storage.ErrNotSupported)
+	}
+	region := b.opts.DefaultRegion
+	if b.opts.Region != nil {
+		var err error
+		if region, err = b.opts.Region(ctx, req.Bucket); err != nil {
+			return nil, err
+		}
+	}
+
+	input := &sts.AssumeRoleInput{
+		RoleArn:         aws.String(b.opts.CredentialsRoleARN),
+		RoleSessionName: aws.String(req.Session),
+		Policy:          aws.String(fmt.Sprintf(credentialsPolicy, req.Bucket, req.Bucket, req.Prefix)),
+	}
+	if req.Duration > 0 {
+		input.DurationSeconds = aws.Int32(int32(req.Duration / time.Second))
+	}
+	out, err := b.opts.STS.AssumeRole(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	return &storage.Credentials{
+		AccessKeyID:     aws.ToString(out.Credentials.AccessKeyId),
+		SecretAccessKey: aws.ToString(out.Credentials.SecretAccessKey),
+		SessionToken:    aws.ToString(out.Credentials.SessionToken),
+		Expiration:      aws.ToTime(out.Credentials.Expiration),
+		Region:          region,
+	}, nil
+}
+
+// notFound wraps storage.ErrObjectNotFound around S3's not-found errors:
+// NotFound from HeadObject, which has no body to carry a code, and NoSuchKey
+// from the other operations.
+func notFound(bucket string, key string, err error) error {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "NotFound", "NoSuchKey":
+			return fmt.Errorf("%s/%s: %w", bucket, key, storage.ErrObjectNotFound)
+		}
+	}
+	return err
+}
+
+// copySource returns the URL-encoded CopySource for an object.
+func copySource(bucket string, key string) string {
+	segments := strings.Split(key, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return bucket + "/" + strings.Join(segments, "/")
+}
+
+// presignOptions applies client options to a presigned request.
+func presignOptions(opts []func(*s3.Options)) []func(*s3.PresignOptions) {
+	if len(opts) == 0 {
+		return nil
+	}
+	return []func(*s3.PresignOptions){func(p *s3.PresignOptions) {
+		p.ClientOptions = append(p.ClientOptions, opts...)
+	}}
+}
+
+// checksumAlgorithms are the algorithms S3 can store a checksum in. An object has at most one.
+var checksumAlgorithms = []string{"SHA256", "CRC64NVME", "CRC32C", "CRC32", "SHA1"}
+
+var compositeChecksumRegex = regexp.MustCompile(`-[0-9]+$`)
+
+// checksumFromHead returns the checksum S3 stored for the object, read from
+// the raw response headers: the SDK does not model every algorithm or the
+// checksum type. Older endpoints omit the type header; a "-<parts>" suffix
+// then marks a composite checksum.
+func checksumFromHead(head *s3.HeadObjectOutput) storage.ObjectChecksum {
+	raw, ok := awsMiddleware.GetRawResponse(head.ResultMetadata).(*smithyhttp.Response)
+	if !ok {
+		if head.ChecksumSHA256 != nil {
+			return storage.ObjectChecksum{Algorithm: "SHA256", Type: checksumType("", *head.ChecksumSHA256), Value: *head.ChecksumSHA256}
+		}
+		return storage.ObjectChecksum{}
+	}
+	for _, algorithm := range checksumAlgorithms {
+		value := raw.Header.Get("x-amz-checksum-" + strings.ToLower(algorithm))
+		if value == "" {
+			continue
+		}
+		return storage.ObjectChecksum{
+			Algorithm: algorithm,
+			Type:      checksumType(raw.Header.Get("x-amz-checksum-type"), value),
+			Value:     value,
+		}
+	}
+	return storage.ObjectChecksum{}
+}
+
+func checksumType(header string, value string) string {
+	if t := strings.ToUpper(header); t != "" {
+		return t
+	}
+	if compositeChecksumRegex.MatchString(value) {
+		return "COMPOSITE"
+	}
+	return "FULL_OBJECT"
+}
@@ -0,0 +1,278 @@
+package s3backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	stsTypes "github.com/aws/aws-sdk-go-v2/service/sts/types"
+	"github.com/aws/smithy-go"
+	"github.com/pennsieve/pennsieve-upload-service-v2/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeS3 records calls and serves objects from a map of key to size.
+type fakeS3 struct {
+	API
+
+	mu          sync.Mutex
+	sizes       map[string]int64
+	failPart    int32
+	copies      []string
+	ranges      []string
+	deleteCalls [][]string
+	parts       []int32
+	aborted     bool
+	completed   []types.CompletedPart
+	regions     []string
+}
+
+func (f *fakeS3) region(optFns []func(*s3.Options)) {
+	o := s3.Options{}
+	for _, fn := range optFns {
+		fn(&o)
+	}
+	f.regions = append(f.regions, o.Region)
+}
+
+func (f *fakeS3) HeadObject(_ context.Context, in *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.region(optFns)
+	size, ok := f.sizes[aws.ToString(in.Key)]
+	if !ok {
+		return nil, &types.NotFound{}
+	}
+	return &s3.HeadObjectOutput{ContentLength: aws.Int64(size), ChecksumSHA256: aws.String("c2hhMjU2-3")}, nil
+}
+
+func (f *fakeS3) GetObject(_ context.Context, in *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.region(optFns)
+	f.ranges = append(f.ranges, aws.ToString(in.Range))
+	size, ok := f.sizes[aws.ToString(in.Key)]
+	if !ok {
+		return nil, &types.NoSuchKey{}
+	}
+	if size == 0 {
+		return nil, &smithy.GenericAPIError{Code: "InvalidRange"}
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader("DICM"))}, nil
+}
+
+func (f *fakeS3) CopyObject(_ context.Context, in *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.region(optFns)
+	f.copies = append(f.copies, aws.ToString(in.CopySource))
+	return &s3.CopyObjectOutput{}, nil
+}
+
+func (f *fakeS3) DeleteObjects(_ context.Context, in *s3.DeleteObjectsInput, _ ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error) {
+	var keys []string
+	for _, o := range in.Delete.Objects {
+		keys = append(keys, aws.ToString(o.Key))
+	}
+	f.deleteCalls = append(f.deleteCalls, keys)
+	return &s3.DeleteObjectsOutput{}, nil
+}
+
+func (f *fakeS3) ListObjectsV2(_ context.Context, in *s3.ListObjectsV2Input, _ ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	if in.ContinuationToken == nil {
+		return &s3.ListObjectsV2Output{
+			Contents:              []types.Object{{Key: aws.String("p/a"), Size: aws.Int64(1)}},
+			IsTruncated:           aws.Bool(true),
+			NextContinuationToken: aws.String("next"),
+		}, nil
+	}
+	return &s3.ListObjectsV2Output{
+		Contents:    []types.Object{{Key: aws.String("p/b"), Size: aws.Int64(2)}},
+		IsTruncated: aws.Bool(false),
+	}, nil
+}
+
+func (f *fakeS3) CreateMultipartUpload(context.Context, *s3.CreateMultipartUploadInput, ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String("upload-1")}, nil
+}
+
+func (f *fakeS3) UploadPartCopy(_ context.Context, in *s3.UploadPartCopyInput, _ ...func(*s3.Options)) (*s3.UploadPartCopyOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := aws.ToInt32(in.PartNumber)
+	if n == f.failPart {
+		return nil, errors.New("part failed")
+	}
+	f.parts = append(f.parts, n)
+	return &s3.UploadPartCopyOutput{CopyPartResult: &types.CopyPartResult{ETag: aws.String(fmt.Sprintf(`"etag-%d"`, n))}}, nil
+}
+
+func (f *fakeS3) CompleteMultipartUpload(_ context.Context, in *s3.CompleteMultipartUploadInput, _ ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	f.completed = in.MultipartUpload.Parts
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+
+func (f *fakeS3) AbortMultipartUpload(context.Context, *s3.AbortMultipartUploadInput, ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	f.aborted = true
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+type fakeSTS struct {
+	input *sts.AssumeRoleInput
+}
+
+func (f *fakeSTS) AssumeRole(_ context.Context, in *sts.AssumeRoleInput, _ ...func(*sts.Options)) (*sts.AssumeRoleOutput, error) {
+	f.input = in
+	return &sts.AssumeRoleOutput{Credentials: &stsTypes.Credentials{
+		AccessKeyId:     aws.String("AKIA"),
+		SecretAccessKey: aws.String("secret"),
+		SessionToken:    aws.String("token"),
+	}}, nil
+}
+
+func TestBackend(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T){
+		"stats objects and maps not found":          testStat,
+		"reads a byte range":                        testOpenRange,
+		"copies small objects with CopyObject":      testCopySmall,
+		"copies large objects in ordered parts":     testCopyMultipart,
+		"aborts a multipart copy when a part fails": testCopyMultipartFailure,
+		"deletes in batches of 1000":                testDeleteBatches,
+		"lists every page":                          testList,
+		"scopes credentials to the prefix":          testCredentials,
+		"routes requests to the bucket's region":    testRegion,
+	} {
+		t.Run(scenario, fn)
+	}
+}
+
+func testStat(t *testing.T) {
+	f := &fakeS3{sizes: map[string]int64{"m/u": 5}}
+	b := &Backend{s3: f}
+
+	info, err := b.Stat(context.Background(), "bucket", "m/u")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), info.Size)
+	assert.Equal(t, storage.ObjectChecksum{Algorithm: "SHA256", Type: "COMPOSITE", Value: "c2hhMjU2-3"}, info.Checksum)
+
+	_, err = b.Stat(context.Background(), "bucket", "m/missing")
+	assert.True(t, errors.Is(err, storage.ErrObjectNotFound))
+}
+
+func testOpenRange(t *testing.T) {
+	f := &fakeS3{sizes: map[string]int64{"m/u": 5000, "m/empty": 0}}
+	b := &Backend{s3: f}
+
+	r, err := b.OpenRange(context.Background(), "bucket", "m/u", 128, 4096)
+	require.NoError(t, err)
+	content, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "DICM", string(content))
+	assert.Equal(t, []string{"bytes=128-4223"}, f.ranges)
+
+	r, err = b.OpenRange(context.Background(), "bucket", "m/empty", 0, 4096)
+	require.NoError(t, err, "a range past the end reads nothing")
+	content, err = io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Empty(t, content)
+
+	_, err = b.OpenRange(context.Background(), "bucket", "m/missing", 0, 4096)
+	assert.True(t, errors.Is(err, storage.ErrObjectNotFound))
+}
+
+func testCopySmall(t *testing.T) {
+	f := &fakeS3{sizes: map[string]int64{"m/u 1": 5}}
+	b := &Backend{s3: f}
+
+	require.NoError(t, b.Copy(context.Background(), "upload", "m/u 1", "storage", "O1/D1/m/u"))
+	assert.Equal(t, []string{"upload/m/u%201"}, f.copies)
+}
+
+func testCopyMultipart(t *testing.T) {
+	size := int64(maxCopyObjectSize + 1)
+	f := &fakeS3{sizes: map[string]int64{"m/u": size}}
+	b := &Backend{s3: f}
+
+	require.NoError(t, b.Copy(context.Background(), "upload", "m/u", "storage", "O1/D1/m/u"))
+	assert.Empty(t, f.copies)
+
+	nParts := int((size + maxPartSize - 1) / maxPartSize)
+	require.Len(t, f.completed, nParts)
+	for i, p := range f.completed {
+		assert.Equal(t, int32(i+1), aws.ToInt32(p.PartNumber))
+		assert.Equal(t, fmt.Sprintf("etag-%d", i+1), aws.ToString(p.ETag))
+	}
+	assert.Equal(t, "bytes=0-110100479", copySourceRange(0, size))
+	assert.Equal(t, fmt.Sprintf("bytes=%d-%d", int64(nParts-1)*maxPartSize, size-1),
+		copySourceRange(int64(nParts-1)*maxPartSize, size))
+}
+
+func testCopyMultipartFailure(t *testing.T) {
+	f := &fakeS3{sizes: map[string]int64{"m/u": maxCopyObjectSize + 1}, failPart: 3}
+	b := &Backend{s3: f}
+
+	err := b.Copy(context.Background(), "upload", "m/u", "storage", "O1/D1/m/u")
+	assert.ErrorContains(t, err, "copy part 3")
+	assert.True(t, f.aborted)
+	assert.Nil(t, f.completed)
+}
+
+func testDeleteBatches(t *testing.T) {
+	f := &fakeS3{}
+	b := &Backend{s3: f}
+
+	keys := make([]string, 2500)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("k%d", i)
+	}
+	require.NoError(t, b.Delete(context.Background(), "bucket", keys...))
+	require.Len(t, f.deleteCalls, 3)
+	assert.Len(t, f.deleteCalls[0], 1000)
+	assert.Len(t, f.deleteCalls[2], 500)
+}
+
+func testList(t *testing.T) {
+	b := &Backend{s3: &fakeS3{}}
+
+	var keys []string
+	require.NoError(t, b.List(context.Background(), "bucket", "p/", func(o storage.ObjectInfo) error {
+		keys = append(keys, o.Key)
+		return nil
+	}))
+	assert.Equal(t, []string{"p/a", "p/b"}, keys)
+}
+
+func testCredentials(t *testing.T) {
+	_, err := (&Backend{s3: &fakeS3{}}).Credentials(context.Background(), storage.CredentialsRequest{})
+	assert.True(t, errors.Is(err, storage.ErrNotSupported))
+
+	s := &fakeSTS{}
+	b := &Backend{s3: &fakeS3{}, opts: Options{STS: s, CredentialsRoleARN: "arn:role", DefaultRegion: "us-east-1"}}
+	creds, err := b.Credentials(context.Background(), storage.CredentialsRequest{
+		Bucket: "storage", Prefix: "O1/D2/m", Session: "storage-1-2",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "AKIA", creds.AccessKeyID)
+	assert.Equal(t, "us-east-1", creds.Region)
+	assert.Contains(t, aws.ToString(s.input.Policy), `"arn:aws:s3:::storage/O1/D2/m/*"`)
+	assert.Equal(t, "storage-1-2", aws.ToString(s.input.RoleSessionName))
+}
+
+func testRegion(t *testing.T) {
+	f := &fakeS3{sizes: map[string]int64{"m/u": 5}}
+	b := &Backend{s3: f, opts: Options{Region: func(_ context.Context, bucket string) (string, error) {
+		return map[string]string{"upload": "us-east-1", "storage": "af-south-1"}[bucket], nil
+	}}}
+
+	require.NoError(t, b.Copy(context.Background(), "upload", "m/u", "storage", "O1/D1/m/u"))
+	assert.Equal(t, []string{"us-east-1", "af-south-1"}, f.regions)
+}
@@ -178,6 +178,27 @@ resource "aws_cloudwatch_metric_alarm" "reconciliation_errors" {
   alarm_actions       = [aws_sns_topic.reconcile_alerts.arn]
 }
 
+# A SHA256 verification job (or another asynchronous reconcile invocation)
+# failed all its retries. The object's checksum is unverified until the job is
+# re-run: invoke the reconcile lambda with the message body as payload.
+resource "aws_cloudwatch_metric_alarm" "reconcile_deadletter" {
+  alarm_name          = "${var.environment_name}-${var.service_name}-reconcile-deadletter-${data.terraform_remote_state.region.outputs.aws_region_shortname}"
+  alarm_description   = "An asynchronous reconcile invocation, typically a SHA256 verification job, failed all retries. Re-run it from the reconcile dead-letter queue."
+  comparison_operator = "GreaterThanOrEqualToThreshold"
+  evaluation_periods  = 1
+  metric_name         = "ApproximateNumberOfMessagesVisible"
+  namespace           = "AWS/SQS"
+  period              = 300
+  statistic           = "Maximum"
+  threshold           = 1
+  treat_missing_data  = "notBreaching"
+  alarm_actions       = [aws_sns_topic.reconcile_alerts.arn]
+
+  dimensions = {
+    QueueName = aws_sqs_queue.reconcile_deadletter_queue.name
+  }
+}
+
 ######################################
 # UPLOAD LAMBDA HEARTBEAT            #
 ######################################
@@ -189,8 +210,12 @@ resource "aws_cloudwatch_metric_alarm" "reconciliation_errors" {
 # from 10-22s to 6-8s once a steady trickle kept pollers warm.
 #
 # Fires every minute. The upload handler (store.go Handler) detects
-# heartbeat messages by their missing S3 Records and returns without
-# processing. Cost: ~43k invocations/month on a 512MB lambda — pennies.
+# heartbeat messages by their {"heartbeat":true} body and imports nothing; it
+# returns bodies it does not recognize to the queue. On a heartbeat it runs
+# the outbox relay, retrying import side effects (SNS, changelog,
+# DeletePackageJobs, Pusher) that failed to deliver, and fails the staged
+# members of merge groups that did not complete in time. Cost: ~43k
+# invocations/month on a 512MB lambda — pennies.
 
 resource "aws_cloudwatch_event_rule" "upload_lambda_heartbeat" {
   name                = "${var.environment_name}-${var.service_name}-upload-heartbeat-${data.terraform_remote_state.region.outputs.aws_region_shortname}"
@@ -205,6 +230,40 @@ resource "aws_cloudwatch_event_target" "upload_lambda_heartbeat_target" {
   input     = jsonencode({ heartbeat = true })
 }
 
+# An import message still in the outbox after an hour has failed several
+# retries (backoff doubles from 30s). Inspect the entries with the reconcile
+# lambda: {"inspectOutbox": {}}.
+resource "aws_cloudwatch_metric_alarm" "upload_outbox_stuck" {
+  alarm_name          = "${var.environment_name}-${var.service_name}-upload-outbox-stuck-${data.terraform_remote_state.region.outputs.aws_region_shortname}"
+  alarm_description   = "An upload import message has been undelivered for over an hour. Inspect pennsieve.upload_outbox with the reconcile lambda's inspectOutbox mode."
+  comparison_operator = "GreaterThanThreshold"
+  evaluation_periods  = 3
+  metric_name         = "OutboxOldestAgeSeconds"
+  namespace           = "UploadService/Outbox"
+  period              = 300
+  statistic           = "Maximum"
+  threshold           = 3600
+  treat_missing_data  = "notBreaching"
+  alarm_actions       = [aws_sns_topic.reconcile_alerts.arn]
+}
+
+# An import message the relay gave up on after 20 failed deliveries (about
+# 14 hours) is dead and is no longer retried. Inspect and requeue it with the
+# reconcile lambda: {"inspectOutbox": {"requeue": true}}.
+resource "aws_cloudwatch_metric_alarm" "upload_outbox_dead" {
+  alarm_name          = "${var.environment_name}-${var.service_name}-upload-outbox-dead-${data.terraform_remote_state.region.outputs.aws_region_shortname}"
+  alarm_description   = "The upload outbox relay gave up on an import message. Inspect and requeue pennsieve.upload_outbox entries with the reconcile lambda's inspectOutbox mode."
+  comparison_operator = "GreaterThanThreshold"
+  evaluation_periods  = 1
+  metric_name         = "OutboxDead"
+  namespace           = "UploadService/Outbox"
+  period              = 300
+  statistic           = "Maximum"
+  threshold           = 0
+  treat_missing_data  = "notBreaching"
+  alarm_actions       = [aws_sns_topic.reconcile_alerts.arn]
+}
+
 ######################################
 # ARCHIVE-SWEEPER SCHEDULE + ALARMS  #
 ######################################
@@ -123,6 +123,19 @@ resource "aws_iam_policy" "upload_service_v2_lambda_iam_policy" {
 
 data "aws_iam_policy_document" "upload_service_v2_iam_policy_document" {
 
+  statement {
+    sid    = "BucketRegionDiscovery"
+    effect = "Allow"
+
+    // Regions of storage buckets are looked up rather than parsed from their names. ListBucket is deliberately not
+    // granted: where GetBucketLocation is denied, the region is read from the 403 a HeadBucket returns.
+    actions = [
+      "s3:GetBucketLocation"
+    ]
+
+    resources = ["arn:aws:s3:::*"]
+  }
+
   statement {
     sid    = "UploadsBucketAccess"
     effect = "Allow"
@@ -162,6 +175,22 @@ data "aws_iam_policy_document" "upload_service_v2_iam_policy_document" {
     ]
   }
 
+  // Asynchronous finalize: the service lambda stores each job's request and
+  // status, and the GET endpoint reads the status back.
+  statement {
+    sid    = "ServiceLambdaFinalizeJobs"
+    effect = "Allow"
+
+    actions = [
+      "s3:GetObject",
+      "s3:PutObject",
+    ]
+
+    resources = [
+      "${aws_s3_bucket.finalize_jobs_bucket.arn}/*",
+    ]
+  }
+
   // Allow upload handler to decrypt the SHA256 checksum on s3 objects
   statement {
     sid    = "AwsKmsKeyAccess"
@@ -313,7 +342,7 @@ data "aws_iam_policy_document" "upload_service_v2_iam_policy_document" {
     ]
   }
 
-  // The service lambda enqueues synthesized S3 "Object Created" events to
+  // The service lambda enqueues FinalizeMessages to
   // upload_trigger_queue from the finalize endpoint. The upload lambda's
   // existing SQS event source drains them and runs the same ImportFiles
   // flow as for real S3 notifications. Replaces the previous synchronous
@@ -344,6 +373,10 @@ data "aws_iam_policy_document" "upload_service_v2_iam_policy_document" {
     resources = [
       aws_lambda_function.archive_lambda.arn,
       aws_lambda_function.upload_lambda.arn,
+      // The service lambda invokes itself to run asynchronous finalize jobs.
+      aws_lambda_function.service_lambda.arn,
+      // Finalize hands large objects without a stored SHA256 to reconcile.
+      aws_lambda_function.reconcile_lambda.arn,
     ]
 
   }
@@ -715,6 +748,19 @@ resource "aws_iam_policy" "iam_policy" {
 
 data "aws_iam_policy_document" "upload_fargate_iam_policy_document" {
 
+  statement {
+    sid    = "BucketRegionDiscovery"
+    effect = "Allow"
+
+    // Regions of storage buckets are looked up rather than parsed from their names. ListBucket is deliberately not
+    // granted: where GetBucketLocation is denied, the region is read from the 403 a HeadBucket returns.
+    actions = [
+      "s3:GetBucketLocation"
+    ]
+
+    resources = ["arn:aws:s3:::*"]
+  }
+
   statement {
     sid    = "SecretsManagerPermissions"
     effect = "Allow"
@@ -964,7 +1010,7 @@ resource "aws_iam_role_policy_attachment" "fargate_storage_bucket_write" {
 }
 
 # Service lambda needs read on dynamic workspace storage buckets for the
-# finalize endpoint's HEAD verification. Managed policy is refreshed by
+# finalize endpoint's HEAD verification and server-side SHA256. Managed policy is refreshed by
 # account-service whenever storage nodes are added/removed.
 resource "aws_iam_role_policy_attachment" "service_lambda_storage_bucket_read" {
   role       = aws_iam_role.upload_service_v2_lambda_role.name
@@ -1001,6 +1047,18 @@ resource "aws_iam_policy" "reconcile_lambda_policy" {
 }
 
 data "aws_iam_policy_document" "reconcile_lambda_policy_document" {
+
+  # Region lookup for the storage buckets reconcile HEADs. No ListBucket: a
+  # denied HeadBucket still reports the bucket's region.
+  statement {
+    sid    = "BucketRegionDiscovery"
+    effect = "Allow"
+    actions = [
+      "s3:GetBucketLocation",
+    ]
+    resources = ["arn:aws:s3:::*"]
+  }
+
   statement {
     sid    = "LambdaBaseExec"
     effect = "Allow"
@@ -1059,7 +1117,7 @@ data "aws_iam_policy_document" "reconcile_lambda_policy_document" {
     resources = ["*"]
   }
 
-  # Enqueue synthesized S3 events to upload_trigger_queue.
+  # Enqueue FinalizeMessages to upload_trigger_queue.
   statement {
     sid    = "ReconcileEnqueue"
     effect = "Allow"
@@ -1071,9 +1129,22 @@ data "aws_iam_policy_document" "reconcile_lambda_policy_document" {
       aws_sqs_queue.upload_trigger_queue.arn,
     ]
   }
+
+  # Dead-letter queue for asynchronous invocations that exhaust their retries.
+  statement {
+    sid    = "ReconcileDeadLetter"
+    effect = "Allow"
+    actions = [
+      "sqs:SendMessage",
+    ]
+    resources = [
+      aws_sqs_queue.reconcile_deadletter_queue.arn,
+    ]
+  }
 }
 
-# Static storage bucket read is needed to HEAD objects during verification.
+# Static storage bucket read is needed to HEAD objects during verification and
+# to hash them for SHA256 verification jobs.
 # Dynamic workspace buckets are covered by the account-service managed
 # policy attached below.
 resource "aws_iam_role_policy_attachment" "reconcile_storage_bucket_read" {
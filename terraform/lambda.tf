@@ -17,6 +17,8 @@ resource "aws_lambda_function" "upload_lambda" {
   s3_key                         = "${var.service_name}/upload/upload-v2-handler-${var.image_tag}.zip"
   reserved_concurrent_executions = 100 // Set a maximum concurrency to prevent overloading RDS interaction
 
+  depends_on = [aws_lambda_invocation.upload_migrations]
+
   vpc_config {
     subnet_ids         = tolist(data.terraform_remote_state.vpc.outputs.private_subnet_ids)
     security_group_ids = [data.terraform_remote_state.platform_infrastructure.outputs.upload_v2_security_group_id]
@@ -30,6 +32,7 @@ resource "aws_lambda_function" "upload_lambda" {
       MANIFEST_FILE_TABLE = aws_dynamodb_table.manifest_files_dynamo_table.name,
       IMPORTED_SNS_TOPIC    = aws_sns_topic.imported_file_sns_topic.arn,
       FILE_FINALIZED_TOPIC  = aws_sns_topic.file_finalized_topic.arn,
+      FILE_FINALIZED_EVENT_VERSIONS = var.file_finalized_event_versions,
       JOBS_QUEUE_ID         = data.terraform_remote_state.platform_infrastructure.outputs.jobs_queue_id,
       REGION              = var.aws_region,
       RDS_PROXY_ENDPOINT  = data.terraform_remote_state.pennsieve_postgres.outputs.rds_proxy_endpoint,
@@ -53,6 +56,8 @@ resource "aws_lambda_function" "service_lambda" {
   s3_bucket     = var.lambda_bucket
   s3_key        = "${var.service_name}/service/upload-v2-service-${var.image_tag}.zip"
 
+  depends_on = [aws_lambda_invocation.upload_migrations]
+
   vpc_config {
     subnet_ids         = tolist(data.terraform_remote_state.vpc.outputs.private_subnet_ids)
     security_group_ids = [data.terraform_remote_state.platform_infrastructure.outputs.upload_v2_security_group_id]
@@ -74,6 +79,8 @@ resource "aws_lambda_function" "service_lambda" {
       DEFAULT_STORAGE_BUCKET       = data.terraform_remote_state.platform_infrastructure.outputs.storage_bucket_id,
       UPLOAD_LAMBDA_ARN            = aws_lambda_function.upload_lambda.arn,
       UPLOAD_TRIGGER_QUEUE_URL     = aws_sqs_queue.upload_trigger_queue.url,
+      FINALIZE_JOBS_BUCKET         = aws_s3_bucket.finalize_jobs_bucket.id,
+      RECONCILE_FUNCTION_NAME      = aws_lambda_function.reconcile_lambda.function_name,
       LOG_LEVEL                    = "info",
     }
   }
@@ -186,6 +193,12 @@ resource "aws_lambda_function" "reconcile_lambda" {
       LOG_LEVEL                = "info"
     }
   }
+
+  # SHA256 verification jobs arrive asynchronously; a job that fails its two
+  # retries is kept here instead of being dropped.
+  dead_letter_config {
+    target_arn = aws_sqs_queue.reconcile_deadletter_queue.arn
+  }
 }
 
 resource "aws_lambda_permission" "reconcile_allow_events" {
@@ -196,6 +209,19 @@ resource "aws_lambda_permission" "reconcile_allow_events" {
   source_arn    = aws_cloudwatch_event_rule.reconcile_schedule.arn
 }
 
+# Applies the upload service's Postgres migrations on every deploy. The
+# reconcile package carries the migrations directory (see the Makefile), and
+# the lambdas that use the tables wait for the invocation; a failed migration
+# fails the apply. See mode 7 in lambda/reconcile/handler/handler.go.
+resource "aws_lambda_invocation" "upload_migrations" {
+  function_name = aws_lambda_function.reconcile_lambda.function_name
+  input         = jsonencode({ migrate = {} })
+
+  triggers = {
+    image_tag = var.image_tag
+  }
+}
+
 ### ARCHIVE-SWEEPER LAMBDA
 #
 # Daily EventBridge sweep (see cloudwatch.tf) of manifest_table for rows
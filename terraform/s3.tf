@@ -99,4 +99,46 @@ resource "aws_s3_bucket_server_side_encryption_configuration" "manifest_archive_
       sse_algorithm = "AES256"
     }
   }
-}
\ No newline at end of file
+}
+
+# S3 Bucket for asynchronous finalize jobs (request + status per job)
+resource "aws_s3_bucket" "finalize_jobs_bucket" {
+  bucket = "pennsieve-${var.environment_name}-upload-finalize-jobs-${data.terraform_remote_state.region.outputs.aws_region_shortname}"
+
+  tags = merge(
+    local.common_tags,
+    {
+      "Name"         = "${var.environment_name}-uploads-v2-finalize-jobs-${data.terraform_remote_state.region.outputs.aws_region_shortname}"
+      "name"         = "${var.environment_name}-uploads-v2-finalize-jobs-${data.terraform_remote_state.region.outputs.aws_region_shortname}"
+      "service_name" = "upload-service-v2"
+      "tier"         = "s3"
+    },
+  )
+}
+
+resource "aws_s3_bucket_lifecycle_configuration" "finalize_jobs_bucket_lifecycle" {
+  bucket = aws_s3_bucket.finalize_jobs_bucket.bucket
+
+  // Clients poll a job for minutes, not days.
+  rule {
+    id = "expire-finalize-jobs"
+
+    filter {}
+
+    expiration {
+      days = 7
+    }
+
+    status = "Enabled"
+  }
+}
+
+resource "aws_s3_bucket_server_side_encryption_configuration" "finalize_jobs_bucket_encryption" {
+  bucket = aws_s3_bucket.finalize_jobs_bucket.bucket
+
+  rule {
+    apply_server_side_encryption_by_default {
+      sse_algorithm = "AES256"
+    }
+  }
+}
@@ -43,7 +43,9 @@ resource "aws_sns_topic" "reconcile_alerts" {
 # a file row lands in Postgres (see lambda/upload/handler/store.go
 # ImportFiles). Consumers subscribe via their own SQS queues — scan-
 # service is the first (filter: complianceTier=hipaa); metadata /
-# AI-readiness services will follow.
+# AI-readiness services will follow. Every message carries an
+# eventVersion attribute; var.file_finalized_event_versions picks the
+# payload versions published.
 #
 # Publish is authorized via the upload lambda role's identity policy in
 # iam.tf; no resource-based topic policy is needed for same-account use.
@@ -151,3 +151,12 @@ resource "aws_sqs_queue_policy" "imported_file_sqs_policy" {
 }
 POLICY
 }
+
+# Asynchronous invocations of the reconcile lambda that failed all their
+# retries, mostly SHA256 verification jobs finalize started for objects it
+# could not hash inline.
+resource "aws_sqs_queue" "reconcile_deadletter_queue" {
+  name                      = "${var.environment_name}-reconcile-deadletter-queue-${data.terraform_remote_state.region.outputs.aws_region_shortname}"
+  max_message_size          = 262144
+  message_retention_seconds = 1209600 // 2 weeks: jobs are re-run by hand
+}
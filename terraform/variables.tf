@@ -67,6 +67,13 @@ variable "file_move_timeout" {
 variable "api_domain_name" {
 }
 
+// FileFinalized payload versions the upload lambda publishes: "1", "2" or
+// "dual". Publish "dual" while consumers move their subscription filters
+// from eventVersion 1 to 2.
+variable "file_finalized_event_versions" {
+  default = "1"
+}
+
 locals {
   domain_name = data.terraform_remote_state.account.outputs.domain_name
   hosted_zone = data.terraform_remote_state.account.outputs.public_hosted_zone_id